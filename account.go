@@ -0,0 +1,211 @@
+package syncbox
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// constants for accounts
+const (
+	// PasswordHashScheme is the prefix of password hashes stored in UserTable
+	PasswordHashScheme        = "pbkdf2-sha256"
+	DefaultPasswordIterations = 100000
+	PasswordSaltSize          = 16
+	PasswordKeySize           = 32
+	MinPasswordLength         = 8
+	MaxUsernameLength         = 64
+
+	// AuthenticationRate is the number of identity and register requests allowed per second for each remote host,
+	// with bursts of at most AuthenticationBurst, since each of them verifies or hashes a password
+	AuthenticationRate  = 1
+	AuthenticationBurst = 10
+)
+
+// variables for accounts
+var (
+	// PasswordIterations is the number of PBKDF2 iterations of new password hashes,
+	// hashes keep the iterations they are made with, so it could be raised without breaking existing accounts
+	PasswordIterations = DefaultPasswordIterations
+
+	// dummyHash is verified against when the user doesn't exist, so that failures take the same time either way
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// HashPassword returns the salted PBKDF2-SHA256 hash of password, encoded with its parameters as
+// pbkdf2-sha256$<iterations>$<salt>$<key>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, PasswordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, PasswordIterations, PasswordKeySize)
+	return strings.Join([]string{
+		PasswordHashScheme,
+		strconv.Itoa(PasswordIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// VerifyPassword examines whether password matches hash made by HashPassword,
+// hashes in other formats never match
+func VerifyPassword(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != PasswordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived := pbkdf2SHA256([]byte(password), salt, iterations, len(key))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// pbkdf2SHA256 derives a key of keyLen bytes from password and salt by PBKDF2 with HMAC-SHA256, as RFC 8018
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	key := make([]byte, 0, blocks*hashLen)
+	var index [4]byte
+	u := make([]byte, hashLen)
+	t := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(index[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// ValidateUsername examines whether username could be the name of an account
+func ValidateUsername(username string) error {
+	if username == "" || len(username) > MaxUsernameLength || strings.ContainsAny(username, "'\"\\/") {
+		return ErrorInvalidUsername
+	}
+	return nil
+}
+
+// ValidateCredentials examines whether username and password could be registered
+func ValidateCredentials(username string, password string) error {
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	if len(password) < MinPasswordLength {
+		return ErrorPasswordTooShort
+	}
+	return nil
+}
+
+// FindUser returns the user of username, or ErrorUserNotFound if there's none
+func FindUser(db *DB, username string) (*UserTable, error) {
+	user := &UserTable{}
+	err := db.QueryRow("SELECT id, username, password FROM user WHERE username=?", username).Scan(&user.ID, &user.Username, &user.Password)
+	if err == sql.ErrNoRows {
+		return nil, ErrorUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// RegisterUser creates the user of username with the hash of password, it returns ErrorUserExists if the user exists
+func RegisterUser(db *DB, username string, password string) (*UserTable, error) {
+	if err := ValidateCredentials(username, password); err != nil {
+		return nil, err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := FindUser(db, username); err == nil {
+		return nil, ErrorUserExists
+	} else if err != ErrorUserNotFound {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT INTO user (username, password) VALUES (?, ?)", username, hash); err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return nil, ErrorUserExists
+		}
+		return nil, err
+	}
+	return FindUser(db, username)
+}
+
+// AuthenticateUser returns the user of username if password matches, otherwise it returns ErrorAuthFailed,
+// which doesn't tell whether the user exists
+func AuthenticateUser(db *DB, username string, password string) (*UserTable, error) {
+	user, err := FindUser(db, username)
+	if err == ErrorUserNotFound {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = HashPassword(UUID())
+		})
+		VerifyPassword(dummyHash, password)
+		return nil, ErrorAuthFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isLegacyPassword(user.Password) {
+		return migrateLegacyPassword(db, user, password)
+	}
+	if !VerifyPassword(user.Password, password) {
+		return nil, ErrorAuthFailed
+	}
+	return user, nil
+}
+
+// isLegacyPassword examines whether password stored in UserTable is the plain password of the versions before they were hashed
+func isLegacyPassword(stored string) bool {
+	return !strings.HasPrefix(stored, PasswordHashScheme+"$") && stored != ExternalAccountPassword
+}
+
+// migrateLegacyPassword authenticates user by the plain password stored by earlier versions,
+// and replaces it with the hash of password once it matches
+func migrateLegacyPassword(db *DB, user *UserTable, password string) (*UserTable, error) {
+	if password == "" || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil, ErrorAuthFailed
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	// only replace the password that is verified, in case it's changed meanwhile
+	if _, err := db.Exec("UPDATE user SET password=? WHERE id=? AND password=?", hash, user.ID, user.Password); err != nil {
+		return nil, err
+	}
+	db.LogInfo("migrated legacy password of %v\n", user.Username)
+	user.Password = hash
+	return user, nil
+}
@@ -0,0 +1,46 @@
+package syncbox
+
+import (
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	PasswordIterations = 1000
+	defer func() {
+		PasswordIterations = DefaultPasswordIterations
+	}()
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyPassword(hash, "correct horse") {
+		t.Fatal("password doesn't match its hash")
+	}
+	if VerifyPassword(hash, "wrong horse") {
+		t.Fatal("wrong password matches")
+	}
+	other, _ := HashPassword("correct horse")
+	if other == hash {
+		t.Fatal("hashes are not salted")
+	}
+	for _, stored := range []string{"correct horse", "", ExternalAccountPassword, PasswordHashScheme + "$0$$"} {
+		if VerifyPassword(stored, "correct horse") {
+			t.Fatalf("password matches %q, which is not a hash", stored)
+		}
+	}
+}
+
+func TestIsLegacyPassword(t *testing.T) {
+	hash, _ := HashPassword("password")
+	cases := map[string]bool{
+		"plain password":        true,
+		"":                      true,
+		hash:                    false,
+		ExternalAccountPassword: false,
+	}
+	for stored, legacy := range cases {
+		if isLegacyPassword(stored) != legacy {
+			t.Errorf("isLegacyPassword(%q) should be %v", stored, legacy)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package syncbox
+
+import (
+	"context"
+)
+
+// DBAuthenticator is the Authenticator that verifies passwords against the hashes in UserTable,
+// users should be registered before they log in
+type DBAuthenticator struct {
+	db *DB
+}
+
+// NewDBAuthenticator instantiates a DBAuthenticator
+func NewDBAuthenticator(db *DB) *DBAuthenticator {
+	return &DBAuthenticator{
+		db: db,
+	}
+}
+
+// Authenticate implements the Authenticator interface
+func (auth *DBAuthenticator) Authenticate(ctx context.Context, username string, password string) (string, error) {
+	user, err := AuthenticateUser(auth.db, username, password)
+	if err != nil {
+		return "", err
+	}
+	return user.Username, nil
+}
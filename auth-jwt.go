@@ -0,0 +1,417 @@
+package syncbox
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// constants for the bearer token authenticator
+const (
+	DefaultJWTUsernameClaim    = "sub"
+	DefaultJWKSRefreshInterval = time.Hour
+	DefaultJWKSFetchTimeout    = 10 * time.Second
+
+	// JWTLeeway is the clock skew tolerated when checking the expiry and not-before time of tokens
+	JWTLeeway = time.Minute
+	// JWKSMinRefetchInterval limits how often keys are fetched for tokens signed by unknown keys
+	JWKSMinRefetchInterval = time.Minute
+	jwksMaxSize            = 1 << 20
+)
+
+// JWTAuthenticator is the Authenticator of bearer tokens, which are JWTs signed by the keys in the JWKS,
+// the token is taken as the password and the username of the request is ignored,
+// the user is the UsernameClaim of the token instead.
+// Tokens signed by RS256, RS384, RS512, ES256, ES384, ES512 and EdDSA are accepted, and they should have an expiry.
+type JWTAuthenticator struct {
+	*Logger
+	JWKS            string
+	RefreshInterval time.Duration
+	Issuer          string
+	Audience        string
+	UsernameClaim   string
+	Client          *http.Client
+
+	keyMutex  sync.Mutex
+	keys      []*jwk
+	fetched   time.Time
+	attempted time.Time
+}
+
+// jwk is a key of JWKS, see RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	publicKey crypto.PublicKey
+}
+
+// jwtHeader is the header of JWT, see RFC 7515
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// NewJWTAuthenticator instantiates a JWTAuthenticator with the keys of jwks, which is a file path or an http(s) URL,
+// the keys are loaded at once so that misconfigurations are found on start
+func NewJWTAuthenticator(jwks string, refresh time.Duration, issuer string, audience string, usernameClaim string) (*JWTAuthenticator, error) {
+	if jwks == "" {
+		return nil, fmt.Errorf("%w: JWKS is required", ErrorInvalidAuthConfig)
+	}
+	if usernameClaim == "" {
+		usernameClaim = DefaultJWTUsernameClaim
+	}
+	auth := &JWTAuthenticator{
+		Logger:          NewDefaultLogger(),
+		JWKS:            jwks,
+		RefreshInterval: refresh,
+		Issuer:          issuer,
+		Audience:        audience,
+		UsernameClaim:   usernameClaim,
+		Client:          &http.Client{Timeout: DefaultJWKSFetchTimeout},
+	}
+	if err := auth.loadKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// Authenticate implements the Authenticator interface, token is the bearer token
+func (auth *JWTAuthenticator) Authenticate(ctx context.Context, username string, token string) (string, error) {
+	subject, _, err := auth.AuthenticateUntil(ctx, username, token)
+	return subject, err
+}
+
+// AuthenticateUntil implements the ExpiringAuthenticator interface, the credentials expire with the token
+func (auth *JWTAuthenticator) AuthenticateUntil(ctx context.Context, username string, token string) (string, time.Time, error) {
+	claims, err := auth.verify(ctx, token)
+	if err != nil {
+		auth.LogDebug("refuse bearer token: %v\n", err)
+		return "", time.Time{}, ErrorAuthFailed
+	}
+	subject, _ := claims[auth.UsernameClaim].(string)
+	if err := ValidateUsername(subject); err != nil {
+		auth.LogDebug("refuse bearer token, claim %v: %q: %v\n", auth.UsernameClaim, subject, err)
+		return "", time.Time{}, ErrorAuthFailed
+	}
+	// verify refuses tokens without expiry
+	expires, _ := numericDate(claims["exp"])
+	return subject, expires, nil
+}
+
+// verify verifies the signature and the claims of token, and returns the claims
+func (auth *JWTAuthenticator) verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token has %v parts", len(parts))
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	header := &jwtHeader{}
+	if err := json.Unmarshal(headerBytes, header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range auth.candidateKeys(ctx, header.Kid) {
+		if key.Alg != "" && key.Alg != header.Alg {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, key.publicKey, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("signature of alg %q, kid %q not verified", header.Alg, header.Kid)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expires, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.After(expires.Add(JWTLeeway)) {
+		return nil, fmt.Errorf("token expired at %v", expires)
+	}
+	if notBefore, ok := numericDate(claims["nbf"]); ok && now.Add(JWTLeeway).Before(notBefore) {
+		return nil, fmt.Errorf("token not valid before %v", notBefore)
+	}
+	if auth.Issuer != "" && claims["iss"] != auth.Issuer {
+		return nil, fmt.Errorf("token issued by %v", claims["iss"])
+	}
+	if auth.Audience != "" && !hasAudience(claims["aud"], auth.Audience) {
+		return nil, fmt.Errorf("token is for audience %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+// candidateKeys returns the keys that might verify tokens signed by the key of kid, all keys if kid is empty.
+// Keys are fetched again if they are older than RefreshInterval, or if no key is of kid,
+// but not more often than JWKSMinRefetchInterval, so that forged tokens can't flood the JWKS server.
+func (auth *JWTAuthenticator) candidateKeys(ctx context.Context, kid string) []*jwk {
+	auth.keyMutex.Lock()
+	keys := auth.keys
+	refetch := false
+	if auth.isRemote() && time.Since(auth.attempted) > JWKSMinRefetchInterval {
+		stale := time.Since(auth.fetched) > auth.RefreshInterval
+		unknown := kid != "" && findJWK(keys, kid) == nil
+		if stale || unknown {
+			refetch = true
+			auth.attempted = time.Now()
+		}
+	}
+	auth.keyMutex.Unlock()
+
+	if refetch {
+		if err := auth.loadKeys(ctx); err != nil {
+			auth.LogDebug("error on refreshing JWKS %v: %v\n", auth.JWKS, err)
+		}
+		auth.keyMutex.Lock()
+		keys = auth.keys
+		auth.keyMutex.Unlock()
+	}
+	if kid == "" {
+		return keys
+	}
+	if key := findJWK(keys, kid); key != nil {
+		return []*jwk{key}
+	}
+	return nil
+}
+
+func (auth *JWTAuthenticator) isRemote() bool {
+	return strings.HasPrefix(auth.JWKS, "http://") || strings.HasPrefix(auth.JWKS, "https://")
+}
+
+// loadKeys reads the keys of JWKS, keys of unsupported types or not for signatures are skipped
+func (auth *JWTAuthenticator) loadKeys(ctx context.Context) error {
+	var content []byte
+	var err error
+	if auth.isRemote() {
+		content, err = auth.fetchJWKS(ctx)
+	} else {
+		content, err = ioutil.ReadFile(auth.JWKS)
+	}
+	if err != nil {
+		return err
+	}
+	set := &struct {
+		Keys []*jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(content, set); err != nil {
+		return err
+	}
+	var keys []*jwk
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.publicKey, err = key.parse(); err != nil {
+			auth.LogDebug("skip key %q of JWKS %v: %v\n", key.Kid, auth.JWKS, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	auth.keyMutex.Lock()
+	auth.keys = keys
+	auth.fetched = time.Now()
+	auth.keyMutex.Unlock()
+	auth.LogDebug("loaded %v keys of JWKS %v\n", len(keys), auth.JWKS)
+	return nil
+}
+
+func (auth *JWTAuthenticator) fetchJWKS(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, auth.JWKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := auth.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS %v: %v", auth.JWKS, res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, jwksMaxSize))
+}
+
+// parse returns the public key of the JWK
+func (key *jwk) parse() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %v", key.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if key.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size %v", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+}
+
+// verifyJWTSignature examines whether signature is the signature of alg over signed by publicKey,
+// the algorithm should match the type of the key, so that a key is never used by another algorithm
+func verifyJWTSignature(alg string, publicKey crypto.PublicKey, signed []byte, signature []byte) bool {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "RS384", "ES384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "RS512", "ES512":
+		h, hashID = sha512.New(), crypto.SHA512
+	case "EdDSA":
+		key, ok := publicKey.(ed25519.PublicKey)
+		return ok && ed25519.Verify(key, signed, signature)
+	default:
+		return false
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hashID, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func findJWK(keys []*jwk, kid string) *jwk {
+	for _, key := range keys {
+		if key.Kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("empty integer")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+// numericDate returns the time of the NumericDate claim value, see RFC 7519
+func numericDate(value interface{}) (time.Time, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// hasAudience examines whether the aud claim, a string or an array of strings, contains audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package syncbox
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signJWT returns the JWT of claims signed by key with alg, its header tells kid
+func signJWT(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := encodeSegment(header) + "." + encodeSegment(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + encodeSegment(signature)
+}
+
+// rsaJWK returns the JWK of the public key of key
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "n": encodeSegment(key.N.Bytes()), "e": encodeSegment(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func marshalJWKS(keys ...map[string]string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return data
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := marshalJWKS(
+		rsaJWK("rsa", rsaKey),
+		map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": encodeSegment(ecKey.X.FillBytes(make([]byte, 32))), "y": encodeSegment(ecKey.Y.FillBytes(make([]byte, 32)))},
+		map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encodeSegment(edKey.Public().(ed25519.PublicKey))},
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": encodeSegment(rsaKey.N.Bytes()), "e": "AQAB"},
+	)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(file, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewJWTAuthenticator(file, time.Hour, "issuer", "audience", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": []string{"other", "audience"}, "exp": exp}
+		for name, value := range extra {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	for _, c := range []struct {
+		alg string
+		kid string
+		key crypto.Signer
+	}{{"RS256", "rsa", rsaKey}, {"ES256", "ec", ecKey}, {"EdDSA", "ed", edKey}, {"RS256", "", rsaKey}} {
+		username, expires, err := auth.AuthenticateUntil(ctx, "ignored", signJWT(t, c.alg, c.kid, c.key, claims(nil)))
+		if err != nil || username != "bob" {
+			t.Fatalf("%v, kid %q: %v, %v", c.alg, c.kid, username, err)
+		}
+		if expires.Unix() != exp {
+			t.Fatalf("%v: expires at %v, want %v", c.alg, expires, time.Unix(exp, 0))
+		}
+	}
+
+	none, _ := json.Marshal(map[string]string{"alg": "none"})
+	payload, _ := json.Marshal(claims(nil))
+	refused := map[string]string{
+		"expired":          signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-2 * JWTLeeway).Unix()})),
+		"no expiry":        signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})),
+		"other issuer":     signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "other"})),
+		"other audience":   signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+		"invalid subject":  signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"sub": "b/ob"})),
+		"not yet valid":    signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"alg of other key": signJWT(t, "ES256", "rsa", ecKey, claims(nil)),
+		"encryption key":   signJWT(t, "RS256", "enc", rsaKey, claims(nil)),
+		"unknown key":      signJWT(t, "RS256", "rsa", otherKey, claims(nil)),
+		"unsigned":         encodeSegment(none) + "." + encodeSegment(payload) + ".",
+		"malformed":        "a.b",
+	}
+	for name, token := range refused {
+		if _, err := auth.Authenticate(ctx, "bob", token); err != ErrorAuthFailed {
+			t.Errorf("%v: got %v", name, err)
+		}
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var rotated, fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&rotated) == 1 {
+			w.Write(marshalJWKS(rsaJWK("new", newKey)))
+			return
+		}
+		w.Write(marshalJWKS(rsaJWK("old", oldKey)))
+	}))
+	defer server.Close()
+	auth, err := NewJWTAuthenticator(server.URL, time.Hour, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour).Unix()
+	oldToken := signJWT(t, "RS256", "old", oldKey, map[string]interface{}{"sub": "carol", "exp": exp})
+	newToken := signJWT(t, "RS256", "new", newKey, map[string]interface{}{"sub": "carol", "exp": exp})
+	if _, err := auth.Authenticate(ctx, "", oldToken); err != nil {
+		t.Fatal(err)
+	}
+	// the unknown key is looked up once, which fails before rotation
+	if _, err := auth.Authenticate(ctx, "", newToken); err != ErrorAuthFailed {
+		t.Fatalf("token of unknown key: got %v", err)
+	}
+
+	atomic.StoreInt32(&rotated, 1)
+	if _, err := auth.Authenticate(ctx, "", newToken); err != ErrorAuthFailed {
+		t.Fatalf("keys should not be fetched again within %v, got %v", JWKSMinRefetchInterval, err)
+	}
+	auth.keyMutex.Lock()
+	auth.attempted = time.Time{}
+	auth.keyMutex.Unlock()
+	if username, err := auth.Authenticate(ctx, "", newToken); err != nil || username != "carol" {
+		t.Fatalf("token of rotated key: %v, %v", username, err)
+	}
+	if _, err := auth.Authenticate(ctx, "", oldToken); err != ErrorAuthFailed {
+		t.Fatalf("token of removed key: got %v", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 3 {
+		t.Fatalf("JWKS fetched %v times, want 3", n)
+	}
+
+	// keys older than the refresh interval are fetched again even if the key is known
+	auth.RefreshInterval = 0
+	auth.keyMutex.Lock()
+	auth.attempted = time.Time{}
+	auth.keyMutex.Unlock()
+	auth.Authenticate(ctx, "", newToken)
+	if n := atomic.LoadInt32(&fetches); n != 4 {
+		t.Fatalf("stale JWKS fetched %v times, want 4", n)
+	}
+}
+
+func TestAuthenticateUntil(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	ioutil.WriteFile(file, marshalJWKS(rsaJWK("k", key)), 0600)
+	config := &AuthConfig{Authenticator: AuthenticatorJWT, JWKS: file}
+	auth, err := NewAuthenticator(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if AllowsRegistration(auth) {
+		t.Fatal("bearer token users should not register")
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	_, expires, err := AuthenticateUntil(context.Background(), auth, "", signJWT(t, "RS256", "k", key, map[string]interface{}{"sub": "dave", "exp": exp}))
+	if err != nil || expires.Unix() != exp {
+		t.Fatalf("expires at %v, %v", expires, err)
+	}
+}
@@ -0,0 +1,285 @@
+package syncbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// constants for the LDAP authenticator
+const (
+	DefaultLDAPPort              = "389"
+	DefaultLDAPSPort             = "636"
+	DefaultLDAPTimeout           = 10 * time.Second
+	LDAPResultSuccess            = 0
+	LDAPResultInvalidCredentials = 49
+	ldapVersion                  = 3
+	ldapMaxMessageSize           = 1 << 20
+
+	// BER tags of the LDAP messages used by simple bind, see RFC 4511
+	berTagInteger      = 0x02
+	berTagOctetString  = 0x04
+	berTagEnumerated   = 0x0a
+	berTagSequence     = 0x30
+	ldapTagBindRequest = 0x60
+	ldapTagBindResult  = 0x61
+	ldapTagUnbind      = 0x42
+	ldapTagSimpleAuth  = 0x80
+)
+
+// LDAPAuthenticator is the Authenticator that binds to the LDAP server as the user with the password,
+// the user is authenticated if the bind succeeds. BindDN is the DN to bind as, with %s replaced by the escaped username.
+type LDAPAuthenticator struct {
+	*Logger
+	Addr    string
+	BindDN  string
+	TLS     *tls.Config
+	Timeout time.Duration
+}
+
+// NewLDAPAuthenticator instantiates a LDAPAuthenticator of the server of rawURL, ldap:// or ldaps://
+func NewLDAPAuthenticator(rawURL string, bindDN string) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidAuthConfig, err)
+	}
+	if !strings.Contains(bindDN, "%s") {
+		return nil, fmt.Errorf("%w: bind DN %q has no %%s for the username", ErrorInvalidAuthConfig, bindDN)
+	}
+	auth := &LDAPAuthenticator{
+		Logger:  NewDefaultLogger(),
+		BindDN:  bindDN,
+		Timeout: DefaultLDAPTimeout,
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = DefaultLDAPPort
+		}
+	case "ldaps":
+		if port == "" {
+			port = DefaultLDAPSPort
+		}
+		auth.TLS = &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown LDAP scheme %q", ErrorInvalidAuthConfig, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: LDAP URL %q has no host", ErrorInvalidAuthConfig, rawURL)
+	}
+	auth.Addr = net.JoinHostPort(u.Hostname(), port)
+	return auth, nil
+}
+
+// Authenticate implements the Authenticator interface.
+// Empty passwords are refused without binding, since LDAP servers take them as unauthenticated binds, which succeed.
+func (auth *LDAPAuthenticator) Authenticate(ctx context.Context, username string, password string) (string, error) {
+	if password == "" || ValidateUsername(username) != nil {
+		return "", ErrorAuthFailed
+	}
+	dn := strings.Replace(auth.BindDN, "%s", escapeDN(username), -1)
+
+	ctx, cancel := context.WithTimeout(ctx, auth.Timeout)
+	defer cancel()
+	conn, err := auth.dial(ctx)
+	if err != nil {
+		auth.LogDebug("error on dialing LDAP server %v: %v\n", auth.Addr, err)
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(newLDAPBindRequest(1, dn, password)); err != nil {
+		auth.LogDebug("error on sending bind request: %v\n", err)
+		return "", err
+	}
+	code, message, err := readLDAPBindResult(bufio.NewReader(conn))
+	if err != nil {
+		auth.LogDebug("error on reading bind result: %v\n", err)
+		return "", err
+	}
+	conn.Write(berEncode(berTagSequence, berEncodeInt(berTagInteger, 2), berEncode(ldapTagUnbind)))
+	switch code {
+	case LDAPResultSuccess:
+		return username, nil
+	case LDAPResultInvalidCredentials:
+		auth.LogDebug("LDAP bind of %v refused: %v\n", dn, message)
+		return "", ErrorAuthFailed
+	default:
+		return "", fmt.Errorf("LDAP bind of %v failed, result code: %v, message: %v", dn, code, message)
+	}
+}
+
+func (auth *LDAPAuthenticator) dial(ctx context.Context) (net.Conn, error) {
+	if auth.TLS != nil {
+		dialer := &tls.Dialer{Config: auth.TLS}
+		return dialer.DialContext(ctx, "tcp", auth.Addr)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", auth.Addr)
+}
+
+// escapeDN escapes value to be an attribute value of a DN, as RFC 4514
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;=", c),
+			c == ' ' && (i == 0 || i == len(value)-1),
+			c == '#' && i == 0:
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// newLDAPBindRequest returns the LDAP message of the simple bind request of dn with password
+func newLDAPBindRequest(messageID int, dn string, password string) []byte {
+	return berEncode(berTagSequence,
+		berEncodeInt(berTagInteger, messageID),
+		berEncode(ldapTagBindRequest,
+			berEncodeInt(berTagInteger, ldapVersion),
+			berEncode(berTagOctetString, []byte(dn)),
+			berEncode(ldapTagSimpleAuth, []byte(password)),
+		),
+	)
+}
+
+// readLDAPBindResult reads the bind response from r, it returns the result code and the diagnostic message
+func readLDAPBindResult(r *bufio.Reader) (int, string, error) {
+	tag, content, err := berRead(r)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != berTagSequence {
+		return 0, "", ErrorMalformedLDAPMessage
+	}
+	elements, err := berSplit(content)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(elements) < 2 || elements[1].tag != ldapTagBindResult {
+		return 0, "", ErrorMalformedLDAPMessage
+	}
+	result, err := berSplit(elements[1].content)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(result) < 3 || result[0].tag != berTagEnumerated {
+		return 0, "", ErrorMalformedLDAPMessage
+	}
+	code := 0
+	for _, b := range result[0].content {
+		code = code<<8 | int(b)
+	}
+	return code, string(result[2].content), nil
+}
+
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// berEncode returns the BER encoding of the element of tag, with contents concatenated as its content
+func berEncode(tag byte, contents ...[]byte) []byte {
+	length := 0
+	for _, content := range contents {
+		length += len(content)
+	}
+	encoded := []byte{tag}
+	if length < 0x80 {
+		encoded = append(encoded, byte(length))
+	} else {
+		var lengthBytes []byte
+		for l := length; l > 0; l >>= 8 {
+			lengthBytes = append([]byte{byte(l)}, lengthBytes...)
+		}
+		encoded = append(encoded, 0x80|byte(len(lengthBytes)))
+		encoded = append(encoded, lengthBytes...)
+	}
+	for _, content := range contents {
+		encoded = append(encoded, content...)
+	}
+	return encoded
+}
+
+// berEncodeInt returns the BER encoding of the non-negative integer value
+func berEncodeInt(tag byte, value int) []byte {
+	content := []byte{byte(value)}
+	for value >>= 8; value > 0; value >>= 8 {
+		content = append([]byte{byte(value)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berEncode(tag, content)
+}
+
+// berRead reads an element from r
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		size := int(first &^ 0x80)
+		if size == 0 || size > 4 {
+			return 0, nil, ErrorMalformedLDAPMessage
+		}
+		length = 0
+		for i := 0; i < size; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > ldapMaxMessageSize {
+		return 0, nil, ErrorMalformedLDAPMessage
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return tag, content, nil
+}
+
+// berSplit splits data into the elements it consists of
+func berSplit(data []byte) ([]berElement, error) {
+	var elements []berElement
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		tag, content, err := berRead(r)
+		if err == io.EOF {
+			return elements, nil
+		}
+		if err != nil {
+			return nil, ErrorMalformedLDAPMessage
+		}
+		elements = append(elements, berElement{tag: tag, content: content})
+	}
+}
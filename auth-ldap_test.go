@@ -0,0 +1,166 @@
+package syncbox
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeLDAP starts an LDAP server that answers simple bind requests, a bind succeeds if the password is the one of its DN in users.
+// It returns the URL of the server, and the channel of the DNs bound to.
+func fakeLDAP(t *testing.T, users map[string]string) (string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	dns := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveLDAPBind(t, conn, users, dns)
+		}
+	}()
+	return "ldap://" + ln.Addr().String(), dns
+}
+
+// serveLDAPBind answers a bind request on conn, and waits for the unbind request
+func serveLDAPBind(t *testing.T, conn net.Conn, users map[string]string, dns chan string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	tag, content, err := berRead(r)
+	if err != nil || tag != berTagSequence {
+		t.Errorf("bind request: tag %x, %v", tag, err)
+		return
+	}
+	message, err := berSplit(content)
+	if err != nil || len(message) != 2 || message[0].tag != berTagInteger || message[1].tag != ldapTagBindRequest {
+		t.Errorf("bind request message: %v, %v", message, err)
+		return
+	}
+	bind, err := berSplit(message[1].content)
+	if err != nil || len(bind) != 3 || bind[1].tag != berTagOctetString || bind[2].tag != ldapTagSimpleAuth {
+		t.Errorf("bind request: %v, %v", bind, err)
+		return
+	}
+	if len(bind[0].content) != 1 || bind[0].content[0] != ldapVersion {
+		t.Errorf("LDAP version %v", bind[0].content)
+	}
+	dn, password := string(bind[1].content), string(bind[2].content)
+	dns <- dn
+	code := LDAPResultInvalidCredentials
+	if expected, exists := users[dn]; exists && expected == password {
+		code = LDAPResultSuccess
+	}
+	conn.Write(berEncode(berTagSequence,
+		berEncode(berTagInteger, message[0].content),
+		berEncode(ldapTagBindResult,
+			berEncodeInt(berTagEnumerated, code),
+			berEncode(berTagOctetString),
+			berEncode(berTagOctetString, []byte("diagnostic")),
+		),
+	))
+	berRead(r)
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	url, dns := fakeLDAP(t, map[string]string{
+		"uid=alice,ou=people,dc=example": "password",
+		`uid=a\,b,ou=people,dc=example`:  "password2",
+	})
+	auth, err := NewLDAPAuthenticator(url, "uid=%s,ou=people,dc=example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if username, err := auth.Authenticate(ctx, "alice", "password"); err != nil || username != "alice" {
+		t.Fatalf("valid password: %v, %v", username, err)
+	}
+	<-dns
+	if _, err := auth.Authenticate(ctx, "alice", "wrong"); err != ErrorAuthFailed {
+		t.Fatalf("wrong password: %v", err)
+	}
+	<-dns
+	if _, err := auth.Authenticate(ctx, "bob", "password"); err != ErrorAuthFailed {
+		t.Fatalf("unknown user: %v", err)
+	}
+	<-dns
+	if username, err := auth.Authenticate(ctx, "a,b", "password2"); err != nil || username != "a,b" {
+		t.Fatalf("username to escape: %v, %v", username, err)
+	}
+	if dn := <-dns; dn != `uid=a\,b,ou=people,dc=example` {
+		t.Fatalf("bound to %v", dn)
+	}
+	// empty passwords are unauthenticated binds, which LDAP servers accept
+	if _, err := auth.Authenticate(ctx, "alice", ""); err != ErrorAuthFailed {
+		t.Fatalf("empty password: %v", err)
+	}
+	select {
+	case dn := <-dns:
+		t.Fatalf("bound to %v with empty password", dn)
+	default:
+	}
+}
+
+func TestLDAPAuthenticateUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ldap://" + ln.Addr().String()
+	ln.Close()
+	auth, err := NewLDAPAuthenticator(url, "uid=%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(context.Background(), "alice", "password"); err == nil || err == ErrorAuthFailed {
+		t.Fatalf("unavailable server should fail without refusing credentials, got %v", err)
+	}
+}
+
+func TestNewLDAPAuthenticatorConfig(t *testing.T) {
+	for _, c := range []struct {
+		url    string
+		bindDN string
+	}{
+		{"ldap://localhost", "uid=alice"},
+		{"http://localhost", "uid=%s"},
+		{"ldap://", "uid=%s"},
+	} {
+		if _, err := NewLDAPAuthenticator(c.url, c.bindDN); err == nil {
+			t.Errorf("%v, %v: accepted", c.url, c.bindDN)
+		}
+	}
+	auth, err := NewLDAPAuthenticator("ldaps://ldap.example.com", "uid=%s")
+	if err != nil || auth.Addr != "ldap.example.com:"+DefaultLDAPSPort || auth.TLS == nil {
+		t.Fatalf("ldaps: %v, %v", auth, err)
+	}
+}
+
+func TestBERRead(t *testing.T) {
+	long := strings.Repeat("p", 300)
+	tag, content, err := berRead(bufio.NewReader(strings.NewReader(string(berEncode(berTagOctetString, []byte(long))))))
+	if err != nil || tag != berTagOctetString || string(content) != long {
+		t.Fatalf("long form length: %x, %v bytes, %v", tag, len(content), err)
+	}
+	for _, malformed := range [][]byte{
+		{berTagSequence, 0x80},
+		{berTagSequence, 0x85, 1, 2, 3, 4, 5},
+		{berTagSequence, 0x84, 0x7f, 0xff, 0xff, 0xff},
+	} {
+		if _, _, err := berRead(bufio.NewReader(strings.NewReader(string(malformed)))); err != ErrorMalformedLDAPMessage {
+			t.Errorf("%x: got %v", malformed, err)
+		}
+	}
+	if _, err := berSplit([]byte{berTagOctetString, 5, 1}); err != ErrorMalformedLDAPMessage {
+		t.Fatalf("truncated element: got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package syncbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// constants for authenticators
+const (
+	AuthenticatorDB   = "db"
+	AuthenticatorLDAP = "ldap"
+	AuthenticatorJWT  = "jwt"
+
+	// ExternalAccountPassword is the password of users created on first login by external authenticators,
+	// it never matches a password, and the account can't be claimed by registration
+	ExternalAccountPassword = "external"
+)
+
+// config variables for authenticators
+var (
+	AuthenticatorName = os.Getenv("SB_AUTH")
+	LDAPURL           = os.Getenv("SB_LDAP_URL")
+	LDAPBindDN        = os.Getenv("SB_LDAP_BIND_DN")
+	JWKSLocation      = os.Getenv("SB_JWKS")
+	JWTIssuer         = os.Getenv("SB_JWT_ISSUER")
+	JWTAudience       = os.Getenv("SB_JWT_AUDIENCE")
+	JWTUsernameClaim  = os.Getenv("SB_JWT_USERNAME_CLAIM")
+	JWKSRefresh       = os.Getenv("SB_JWKS_REFRESH_INTERVAL")
+)
+
+// Authenticator is the interface to specify how the identity handshake authenticates users,
+// Authenticate returns the username that the credentials identify, or ErrorAuthFailed if they are invalid.
+// The username returned might differ from the one of the request, like the subject of a bearer token.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, password string) (string, error)
+}
+
+// ExpiringAuthenticator is the Authenticator of credentials that expire, like bearer tokens,
+// AuthenticateUntil is Authenticate that also returns when the credentials expire
+type ExpiringAuthenticator interface {
+	Authenticator
+	AuthenticateUntil(ctx context.Context, username string, password string) (string, time.Time, error)
+}
+
+// AuthenticateUntil authenticates the credentials by auth, and returns the username with when the credentials expire,
+// which is zero time unless auth is an ExpiringAuthenticator
+func AuthenticateUntil(ctx context.Context, auth Authenticator, username string, password string) (string, time.Time, error) {
+	if expiring, ok := auth.(ExpiringAuthenticator); ok {
+		return expiring.AuthenticateUntil(ctx, username, password)
+	}
+	username, err := auth.Authenticate(ctx, username, password)
+	return username, time.Time{}, err
+}
+
+// AuthConfig is the structure for authenticator configurations,
+// LDAP* are for the LDAP authenticator, and JWKS and JWT* are for the bearer token authenticator
+type AuthConfig struct {
+	Authenticator string
+
+	// LDAPURL is ldap://host:port or ldaps://host:port, LDAPBindDN is the DN to bind as,
+	// with %s replaced by the escaped username, like uid=%s,ou=people,dc=example,dc=com
+	LDAPURL    string
+	LDAPBindDN string
+
+	// JWKS is the path or the http(s) URL of the JWKS that verifies tokens, keys fetched from URL are refreshed
+	// every JWKSRefreshInterval, and when a token is signed by an unknown key.
+	// Tokens should be issued by JWTIssuer for JWTAudience if they are given,
+	// and the username is the JWTUsernameClaim of tokens.
+	JWKS                string
+	JWKSRefreshInterval string
+	JWTIssuer           string
+	JWTAudience         string
+	JWTUsernameClaim    string
+}
+
+// NewAuthConfig instantiates an AuthConfig from environment variables,
+// it defaults to authenticate users by the database
+func NewAuthConfig() *AuthConfig {
+	config := &AuthConfig{
+		Authenticator:       AuthenticatorName,
+		LDAPURL:             LDAPURL,
+		LDAPBindDN:          LDAPBindDN,
+		JWKS:                JWKSLocation,
+		JWKSRefreshInterval: JWKSRefresh,
+		JWTIssuer:           JWTIssuer,
+		JWTAudience:         JWTAudience,
+		JWTUsernameClaim:    JWTUsernameClaim,
+	}
+	if config.Authenticator == "" {
+		config.Authenticator = AuthenticatorDB
+	}
+	if config.JWTUsernameClaim == "" {
+		config.JWTUsernameClaim = DefaultJWTUsernameClaim
+	}
+	return config
+}
+
+// NewAuthenticator instantiates the Authenticator specified by config, db is for the database authenticator
+func NewAuthenticator(config *AuthConfig, db *DB) (Authenticator, error) {
+	switch config.Authenticator {
+	case AuthenticatorDB:
+		return NewDBAuthenticator(db), nil
+	case AuthenticatorLDAP:
+		return NewLDAPAuthenticator(config.LDAPURL, config.LDAPBindDN)
+	case AuthenticatorJWT:
+		refresh, err := configDuration(config.JWKSRefreshInterval, DefaultJWKSRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+		return NewJWTAuthenticator(config.JWKS, refresh, config.JWTIssuer, config.JWTAudience, config.JWTUsernameClaim)
+	default:
+		return nil, errors.New("unknown authenticator: " + config.Authenticator)
+	}
+}
+
+// AllowsRegistration examines whether accounts could be registered, which is only the case for the database authenticator,
+// since other authenticators create users on first login
+func AllowsRegistration(auth Authenticator) bool {
+	_, ok := auth.(*DBAuthenticator)
+	return ok
+}
+
+// ProvisionUser returns the user of username, the user is created if there's none,
+// so that users authenticated by external authenticators get their accounts on first login
+func ProvisionUser(db *DB, username string) (*UserTable, error) {
+	user, err := FindUser(db, username)
+	if err != ErrorUserNotFound {
+		return user, err
+	}
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT INTO user (username, password) VALUES (?, ?)", username, ExternalAccountPassword); err != nil {
+		// created by a concurrent login
+		if !strings.Contains(err.Error(), "Duplicate entry") {
+			return nil, err
+		}
+	} else {
+		db.LogInfo("created user %v on first login\n", username)
+	}
+	return FindUser(db, username)
+}
@@ -0,0 +1,73 @@
+package syncbox
+
+import (
+	"context"
+)
+
+// operationTimeout runs call with a context that times out after OperationTimeoutPeriod,
+// it's for the methods without context, which return ErrorTimeout on time out as before
+func operationTimeout(call func(context.Context) (*Response, error)) (*Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationTimeoutPeriod)
+	defer cancel()
+	res, err := call(ctx)
+	if err == context.DeadlineExceeded {
+		return res, ErrorTimeout
+	}
+	return res, err
+}
+
+// Context returns the context of the hub, which is cancelled when the hub is closed
+func (hub *Hub) Context() context.Context {
+	return hub.ctx
+}
+
+// requestContext returns the context to process an inbound request, which is cancelled when the hub is closed
+// or peer cancels the request, finish should be called after the request is processed
+func (hub *Hub) requestContext(id string) (ctx context.Context, finish context.CancelFunc) {
+	ctx, cancel := context.WithCancel(hub.ctx)
+	hub.inboundMutex.Lock()
+	hub.inbound[id] = cancel
+	hub.inboundMutex.Unlock()
+	return ctx, func() {
+		hub.inboundMutex.Lock()
+		delete(hub.inbound, id)
+		hub.inboundMutex.Unlock()
+		cancel()
+	}
+}
+
+// sendCancel tells peer that req is abandoned, if peer supports cancellation.
+// It doesn't wait for response, failures are only logged since the request is already given up.
+func (hub *Hub) sendCancel(req *Request) {
+	if !hub.HasCapability(CapabilityCancel) || hub.Err() != nil {
+		return
+	}
+	cReqData, err := hub.Marshal(CancelRequest{RequestID: req.ID})
+	if err != nil {
+		hub.LogDebug("error on Marshal in sendCancel: %v\n", err)
+		return
+	}
+	cancelReq := NewRequest(req.Username, req.Password, req.Device, TypeCancel, cReqData)
+	hub.LogDebug("sendCancel called, request id: %v, cancelled request id: %v\n", cancelReq.ID, req.ID)
+	if err := hub.SendRequest(cancelReq); err != nil {
+		hub.LogDebug("error on SendRequest in sendCancel: %v\n", err)
+	}
+}
+
+// ProcessCancel cancels the context of the inbound request that peer abandons,
+// requests that are already processed are ignored
+func (hub *Hub) ProcessCancel(req *Request) error {
+	cReq := &CancelRequest{}
+	if err := req.Decode(cReq); err != nil {
+		hub.LogDebug("error on Unmarshal in ProcessCancel: %v\n", err)
+		return err
+	}
+	hub.inboundMutex.Lock()
+	cancel, exists := hub.inbound[cReq.RequestID]
+	hub.inboundMutex.Unlock()
+	if exists {
+		hub.LogDebug("request %v cancelled by peer\n", cReq.RequestID)
+		cancel()
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+package syncbox
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+)
+
+// constants for codecs
+const (
+	CodecJSON   = "json"
+	CodecBinary = "binary"
+
+	// BinaryCodecMagic starts every message encoded by BinaryCodec, JSON never starts with it,
+	// so the receiver could tell the codec of a message by the first byte
+	BinaryCodecMagic = byte(0xB1)
+)
+
+// variables for codecs
+var (
+	// SupportedCodecs are the codecs that this build implements, in the order of preference
+	SupportedCodecs = []string{CodecBinary, CodecJSON}
+
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// Codec is the interface to encode Request, Response and their data types to bytes and back
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the Codec of JSON, it's the codec used before negotiation and with peers that don't negotiate
+type JSONCodec struct{}
+
+// Name implements the Codec interface
+func (JSONCodec) Name() string {
+	return CodecJSON
+}
+
+// Marshal implements the Codec interface
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements the Codec interface
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// BinaryCodec is the compact Codec that carries []byte as it is rather than base64 encoded.
+// Struct fields are encoded by position, each prefixed by its encoded length, so both peers must share the definitions of types
+// except for fields appended later: fields appended to a struct by newer peers are skipped by older ones,
+// and the ones missing from older peers are left zero valued. Fields should only be appended, never removed or reordered.
+// Integers are varints, strings, slices and maps are length-prefixed,
+// and types implementing encoding.BinaryMarshaler, like time.Time, are encoded by themselves.
+type BinaryCodec struct{}
+
+// Name implements the Codec interface
+func (BinaryCodec) Name() string {
+	return CodecBinary
+}
+
+// Marshal implements the Codec interface, pointers to v are followed as json.Marshal does
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil, ErrorCodecUnsupportedType
+		}
+		value = value.Elem()
+	}
+	encoder := &binaryEncoder{data: []byte{BinaryCodecMagic}}
+	if err := encoder.encode(value); err != nil {
+		return nil, err
+	}
+	return encoder.data, nil
+}
+
+// Unmarshal implements the Codec interface, v must be a non-nil pointer
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return ErrorCodecUnsupportedType
+	}
+	if len(data) == 0 || data[0] != BinaryCodecMagic {
+		return ErrorCodecMalformed
+	}
+	target := value.Elem()
+	for target.Kind() == reflect.Ptr {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		target = target.Elem()
+	}
+	decoder := &binaryDecoder{data: data[1:]}
+	if err := decoder.decode(target); err != nil {
+		return err
+	}
+	if len(decoder.data) != 0 {
+		return ErrorCodecMalformed
+	}
+	return nil
+}
+
+// CodecByName returns the codec of name, it returns nil if the codec is not supported
+func CodecByName(name string) Codec {
+	switch name {
+	case CodecJSON:
+		return JSONCodec{}
+	case CodecBinary:
+		return BinaryCodec{}
+	}
+	return nil
+}
+
+// CodecOf tells the codec that data is encoded with
+func CodecOf(data []byte) Codec {
+	if len(data) > 0 && data[0] == BinaryCodecMagic {
+		return BinaryCodec{}
+	}
+	return JSONCodec{}
+}
+
+// Decode decodes data encoded by any supported codec to v
+func Decode(data []byte, v interface{}) error {
+	return CodecOf(data).Unmarshal(data, v)
+}
+
+// chooseCodec returns the first of SupportedCodecs that is also in offered, or CodecJSON if there's none
+func chooseCodec(offered []string) string {
+	for _, supported := range SupportedCodecs {
+		for _, name := range offered {
+			if name == supported {
+				return name
+			}
+		}
+	}
+	return CodecJSON
+}
+
+// Codec returns the codec negotiated on the connection, which is JSONCodec before negotiation
+func (hub *Hub) Codec() Codec {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	if codec := CodecByName(hub.codec); codec != nil {
+		return codec
+	}
+	return JSONCodec{}
+}
+
+// Marshal encodes v with the codec negotiated on the connection
+func (hub *Hub) Marshal(v interface{}) ([]byte, error) {
+	return hub.Codec().Marshal(v)
+}
+
+type binaryEncoder struct {
+	data []byte
+}
+
+func (encoder *binaryEncoder) uvarint(x uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buffer[:], x)
+	encoder.data = append(encoder.data, buffer[:n]...)
+}
+
+func (encoder *binaryEncoder) varint(x int64) {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buffer[:], x)
+	encoder.data = append(encoder.data, buffer[:n]...)
+}
+
+// length writes the length of a slice or map plus one, so that nil is told apart from empty by zero
+func (encoder *binaryEncoder) length(value reflect.Value) {
+	if value.IsNil() {
+		encoder.uvarint(0)
+		return
+	}
+	encoder.uvarint(uint64(value.Len()) + 1)
+}
+
+func (encoder *binaryEncoder) encode(value reflect.Value) error {
+	if !value.IsValid() {
+		return ErrorCodecUnsupportedType
+	}
+	if value.Type().Implements(binaryMarshalerType) && value.Kind() != reflect.Ptr && value.Kind() != reflect.Interface {
+		data, err := value.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		encoder.uvarint(uint64(len(data)))
+		encoder.data = append(encoder.data, data...)
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			encoder.data = append(encoder.data, 1)
+		} else {
+			encoder.data = append(encoder.data, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encoder.varint(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		encoder.uvarint(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		var buffer [8]byte
+		binary.LittleEndian.PutUint64(buffer[:], math.Float64bits(value.Float()))
+		encoder.data = append(encoder.data, buffer[:]...)
+	case reflect.String:
+		encoder.uvarint(uint64(value.Len()))
+		encoder.data = append(encoder.data, value.String()...)
+	case reflect.Slice:
+		encoder.length(value)
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			encoder.data = append(encoder.data, value.Bytes()...)
+			return nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := encoder.encode(value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			for i := 0; i < value.Len(); i++ {
+				encoder.data = append(encoder.data, byte(value.Index(i).Uint()))
+			}
+			return nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := encoder.encode(value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		encoder.length(value)
+		iter := value.MapRange()
+		for iter.Next() {
+			if err := encoder.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := encoder.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if value.IsNil() {
+			encoder.data = append(encoder.data, 0)
+			return nil
+		}
+		encoder.data = append(encoder.data, 1)
+		return encoder.encode(value.Elem())
+	case reflect.Struct:
+		fields := exportedFields(value.Type())
+		encoder.uvarint(uint64(len(fields)))
+		for _, i := range fields {
+			field := &binaryEncoder{}
+			if err := field.encode(value.Field(i)); err != nil {
+				return err
+			}
+			encoder.uvarint(uint64(len(field.data)))
+			encoder.data = append(encoder.data, field.data...)
+		}
+	default:
+		return ErrorCodecUnsupportedType
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	data []byte
+}
+
+func (decoder *binaryDecoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(decoder.data)
+	if n <= 0 {
+		return 0, ErrorCodecMalformed
+	}
+	decoder.data = decoder.data[n:]
+	return x, nil
+}
+
+func (decoder *binaryDecoder) varint() (int64, error) {
+	x, n := binary.Varint(decoder.data)
+	if n <= 0 {
+		return 0, ErrorCodecMalformed
+	}
+	decoder.data = decoder.data[n:]
+	return x, nil
+}
+
+func (decoder *binaryDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(decoder.data)) {
+		return nil, ErrorCodecMalformed
+	}
+	data := decoder.data[:n]
+	decoder.data = decoder.data[n:]
+	return data, nil
+}
+
+// length reads the length written by binaryEncoder.length, nil is returned as -1.
+// Every element takes at least a byte, so lengths longer than the remaining data are rejected before allocating.
+func (decoder *binaryDecoder) length() (int, error) {
+	n, err := decoder.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(decoder.data))+1 {
+		return 0, ErrorCodecMalformed
+	}
+	return int(n) - 1, nil
+}
+
+func (decoder *binaryDecoder) decode(value reflect.Value) error {
+	if value.Kind() != reflect.Ptr && value.Kind() != reflect.Interface && reflect.PtrTo(value.Type()).Implements(binaryUnmarshalerType) {
+		n, err := decoder.uvarint()
+		if err != nil {
+			return err
+		}
+		data, err := decoder.next(n)
+		if err != nil {
+			return err
+		}
+		return value.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		data, err := decoder.next(1)
+		if err != nil {
+			return err
+		}
+		value.SetBool(data[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := decoder.varint()
+		if err != nil {
+			return err
+		}
+		if value.OverflowInt(x) {
+			return ErrorCodecMalformed
+		}
+		value.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := decoder.uvarint()
+		if err != nil {
+			return err
+		}
+		if value.OverflowUint(x) {
+			return ErrorCodecMalformed
+		}
+		value.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		data, err := decoder.next(8)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+	case reflect.String:
+		n, err := decoder.uvarint()
+		if err != nil {
+			return err
+		}
+		data, err := decoder.next(n)
+		if err != nil {
+			return err
+		}
+		value.SetString(string(data))
+	case reflect.Slice:
+		n, err := decoder.length()
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			value.Set(reflect.Zero(value.Type()))
+			return nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := decoder.next(uint64(n))
+			if err != nil {
+				return err
+			}
+			bytes := reflect.MakeSlice(value.Type(), n, n)
+			reflect.Copy(bytes, reflect.ValueOf(data))
+			value.Set(bytes)
+			return nil
+		}
+		slice := reflect.MakeSlice(value.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := decoder.decode(slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		value.Set(slice)
+	case reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := decoder.next(uint64(value.Len()))
+			if err != nil {
+				return err
+			}
+			for i, b := range data {
+				value.Index(i).SetUint(uint64(b))
+			}
+			return nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := decoder.decode(value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := decoder.length()
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			value.Set(reflect.Zero(value.Type()))
+			return nil
+		}
+		m := reflect.MakeMapWithSize(value.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(value.Type().Key()).Elem()
+			if err := decoder.decode(key); err != nil {
+				return err
+			}
+			elem := reflect.New(value.Type().Elem()).Elem()
+			if err := decoder.decode(elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		value.Set(m)
+	case reflect.Ptr:
+		data, err := decoder.next(1)
+		if err != nil {
+			return err
+		}
+		if data[0] == 0 {
+			value.Set(reflect.Zero(value.Type()))
+			return nil
+		}
+		elem := reflect.New(value.Type().Elem())
+		if err := decoder.decode(elem.Elem()); err != nil {
+			return err
+		}
+		value.Set(elem)
+	case reflect.Struct:
+		n, err := decoder.uvarint()
+		if err != nil {
+			return err
+		}
+		fields := exportedFields(value.Type())
+		// every field takes at least the byte of its length, so n is bounded by the remaining data
+		for i := uint64(0); i < n; i++ {
+			size, err := decoder.uvarint()
+			if err != nil {
+				return err
+			}
+			data, err := decoder.next(size)
+			if err != nil {
+				return err
+			}
+			if i >= uint64(len(fields)) {
+				// appended by a newer peer
+				continue
+			}
+			field := &binaryDecoder{data: data}
+			if err := field.decode(value.Field(fields[i])); err != nil {
+				return err
+			}
+			if len(field.data) != 0 {
+				return ErrorCodecMalformed
+			}
+		}
+	default:
+		return ErrorCodecUnsupportedType
+	}
+	return nil
+}
+
+// exportedFields returns the indexes of exported fields of a struct type, including embedded ones
+func exportedFields(t reflect.Type) []int {
+	fields := make([]int, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
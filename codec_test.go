@@ -0,0 +1,151 @@
+package syncbox
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// codecTestMessages returns a value of every Request and Response data type, with every field set
+func codecTestMessages() []interface{} {
+	object := &Object{
+		ModTime:         time.Unix(1500000000, 123).UTC(),
+		Mode:            0644,
+		Name:            "a.txt",
+		Size:            3,
+		ContentChecksum: Checksum{1, 200, 3},
+		Path:            "/dir/a.txt",
+	}
+	file := &File{Object: object}
+	// checksums of the file tree are JSON keys, which are only kept as they are if valid UTF-8
+	dir := &Dir{
+		Object: &Object{IsDir: true, Name: "dir", ModTime: time.Unix(5, 0).UTC()},
+		Files:  Files{Checksum{'f'}: file},
+		Dirs:   Dirs{Checksum{'d'}: {Object: &Object{IsDir: true, Name: "sub"}, Files: Files{}, Dirs: Dirs{}}},
+	}
+	content := bytes.Repeat([]byte{0, 1, 2, 255}, 1000)
+	return []interface{}{
+		&Request{ID: UUID(), Username: "user", Password: "password", Device: "device", DataType: TypeFile, Data: content,
+			Token: "token", Timestamp: -1, Nonce: "nonce", Signature: []byte{1, 2}, IdempotencyKey: "key"},
+		&Response{RequestID: UUID(), Status: StatusOK, Message: MessageAccept, Data: []byte{}, Timestamp: 1, Nonce: "n", Signature: []byte{3}},
+		&IdentityRequest{Username: "user", ProtocolVersion: ProtocolVersionFraming, SoftwareVersion: "v", Capabilities: SupportedCapabilities,
+			MaxFrameSize: DefaultMaxFrameSize, Compressions: []string{"gzip"}, Codecs: SupportedCodecs, SessionID: "s",
+			DeviceName: "laptop", SigningKey: []byte{4}, MaxPartialMessages: 8},
+		&IdentityResponse{ProtocolVersion: ProtocolVersionFraming, SoftwareVersion: "v", Capabilities: []string{CapabilityFraming},
+			MaxFrameSize: MinFrameSize, Compression: "deflate", Codec: CodecBinary, SessionID: "s", Resumed: true, Reason: "r",
+			Token: "t", TokenLifetime: time.Hour, SigningKey: []byte{5}, ServerSigningKey: []byte{6}, TokenFinal: true, MaxPartialMessages: 16},
+		&DigestRequest{Dir: dir},
+		&SyncRequest{Action: ActionAdd, File: file, UnrootPath: "/a.txt"},
+		&FileRequest{File: file, UnrootPath: "/a.txt", Content: content},
+		&FileChunkRequest{TransferID: UUID(), File: file, UnrootPath: "/a.txt", Offset: -5, Content: content[:10],
+			Final: true, Abort: true, Checksum: Checksum{255}},
+		&CancelRequest{RequestID: UUID()},
+		&ErrorResponse{Code: CodeNotFound, Reason: "reason"},
+		&TokenResponse{Token: "t", Lifetime: time.Minute, Final: true},
+		&DeviceListResponse{Devices: []*DeviceInfo{{ID: "id", Name: "n", LastSeen: time.Unix(7, 0).UTC(), ClientVersion: "v",
+			Address: "addr", Revoked: true, Online: true}}},
+		&RevokeDeviceRequest{Device: "id"},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{BinaryCodec{}, JSONCodec{}} {
+		for _, message := range codecTestMessages() {
+			data, err := codec.Marshal(message)
+			if err != nil {
+				t.Fatalf("%v: marshal %T: %v", codec.Name(), message, err)
+			}
+			if CodecOf(data).Name() != codec.Name() {
+				t.Fatalf("%v: %T is told as %v", codec.Name(), message, CodecOf(data).Name())
+			}
+			decoded := reflect.New(reflect.TypeOf(message).Elem()).Interface()
+			if err := Decode(data, decoded); err != nil {
+				t.Fatalf("%v: decode %T: %v", codec.Name(), message, err)
+			}
+			if !reflect.DeepEqual(message, decoded) {
+				t.Fatalf("%v: %T mismatch\n%v\n%v", codec.Name(), message, message, decoded)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	for _, message := range codecTestMessages() {
+		data, _ := BinaryCodec{}.Marshal(message)
+		for i := 0; i < len(data) && i < 500; i++ {
+			decoded := reflect.New(reflect.TypeOf(message).Elem()).Interface()
+			if err := Decode(data[:i], decoded); err == nil {
+				t.Fatalf("%T truncated to %v bytes is decoded", message, i)
+			}
+		}
+	}
+	var s string
+	if err := Decode([]byte{BinaryCodecMagic, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1}, &s); err != ErrorCodecMalformed {
+		t.Fatalf("string longer than data: got %v", err)
+	}
+}
+
+// oldMessage and newMessage are the same message type of an older and a newer peer, which appends fields
+type oldMessage struct {
+	ID    string
+	Inner *oldInner
+}
+
+type oldInner struct {
+	Size int64
+}
+
+type newMessage struct {
+	ID       string
+	Inner    *newInner
+	Token    string
+	Children []newInner
+}
+
+type newInner struct {
+	Size    int64
+	Created time.Time
+	Tags    map[string][]byte
+}
+
+func TestBinaryCodecAppendedFields(t *testing.T) {
+	newer := &newMessage{
+		ID:       "id",
+		Inner:    &newInner{Size: 42, Created: time.Unix(9, 0).UTC(), Tags: map[string][]byte{"a": {1}}},
+		Token:    "token",
+		Children: []newInner{{Size: 1}},
+	}
+	data, err := BinaryCodec{}.Marshal(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := &oldMessage{}
+	if err := Decode(data, older); err != nil {
+		t.Fatalf("older peer decoding newer message: %v", err)
+	}
+	if older.ID != "id" || older.Inner == nil || older.Inner.Size != 42 {
+		t.Fatalf("older peer decodes %#v", older)
+	}
+
+	data, err = BinaryCodec{}.Marshal(&oldMessage{ID: "id", Inner: &oldInner{Size: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer = &newMessage{}
+	if err := Decode(data, newer); err != nil {
+		t.Fatalf("newer peer decoding older message: %v", err)
+	}
+	if newer.ID != "id" || newer.Inner.Size != 7 || newer.Token != "" || newer.Children != nil {
+		t.Fatalf("newer peer decodes %#v", newer)
+	}
+}
+
+func TestChooseCodec(t *testing.T) {
+	if codec := chooseCodec(SupportedCodecs); codec != CodecBinary {
+		t.Fatalf("peers of this version should agree on %v, got %v", CodecBinary, codec)
+	}
+	if codec := chooseCodec(nil); codec != CodecJSON {
+		t.Fatalf("peers offering no codec should agree on JSON, got %v", codec)
+	}
+}
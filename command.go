@@ -1,19 +1,26 @@
 package syncbox
 
 import (
-	"crypto/md5"
 	"flag"
 	"os"
 	"path"
 	"path/filepath"
 )
 
-// Cmd command line options for client program
+// Cmd command line options for client program,
+// Register tells the client to create the account of Username before logging in,
+// Token is the bearer token to login with instead of Password, for servers that authenticate users by tokens,
+// ListDevices and RevokeDevice tell the client to list the devices of the user, or revoke one of them, and exit
 type Cmd struct {
-	RootDir  string
-	TmpDir   string
-	Username string
-	Password string
+	RootDir      string
+	TmpDir       string
+	Username     string
+	Password     string
+	Token        string
+	Register     bool
+	DeviceName   string
+	ListDevices  bool
+	RevokeDevice string
 }
 
 // ParseCommand parse commands for client program
@@ -28,22 +35,45 @@ func ParseCommand() (*Cmd, error) {
 	rootDirPtr := flag.String("root_dir", dir, "the root directory to watch")
 	tmpDirPtr := flag.String("tmp_dir", tempDir, "the temporary folder to put files that deleted")
 	usernamePtr := flag.String("Username", "hello", "username to login")
-	passwordPtr := flag.String("Password", "world", "password to login")
+	passwordPtr := flag.String("Password", "", "password to login, it's hashed by server so connections should be encrypted by TLS")
+	tokenPtr := flag.String("token", "", "bearer token to login with instead of password, the user is the one of the token")
+	registerPtr := flag.Bool("register", false, "create the account before login")
+	deviceNamePtr := flag.String("device_name", "", "the name of this device, defaults to the host name on first run")
+	listDevicesPtr := flag.Bool("devices", false, "list the devices of the user and exit")
+	revokeDevicePtr := flag.String("revoke_device", "", "revoke the device of the ID and exit, its sessions are dropped")
 	flag.Parse()
-	var pwdSlice []byte
-	copy(pwdSlice, *passwordPtr)
-	hash := md5.Sum(pwdSlice)
-	pwd := string(hash[:])
+	if *passwordPtr == "" && *tokenPtr == "" {
+		return nil, ErrorPasswordRequired
+	}
 	return &Cmd{
-		RootDir:  *rootDirPtr,
-		TmpDir:   *tmpDirPtr,
-		Username: *usernamePtr,
-		Password: pwd,
+		RootDir:      *rootDirPtr,
+		TmpDir:       *tmpDirPtr,
+		Username:     *usernamePtr,
+		Password:     *passwordPtr,
+		Token:        *tokenPtr,
+		Register:     *registerPtr,
+		DeviceName:   *deviceNamePtr,
+		ListDevices:  *listDevicesPtr,
+		RevokeDevice: *revokeDevicePtr,
 	}, nil
 }
 
 func (c *Cmd) String() string {
-	return ToString(c)
+	// keep the password out of logs
+	masked := *c
+	masked.Password = "******"
+	if masked.Token != "" {
+		masked.Token = "******"
+	}
+	return ToString(&masked)
+}
+
+// Credential returns what the identity handshake authenticates with, the bearer token if it's given, otherwise the password
+func (c *Cmd) Credential() string {
+	if c.Token != "" {
+		return c.Token
+	}
+	return c.Password
 }
 
 func getSystemTempDir() string {
@@ -0,0 +1,200 @@
+package syncbox
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// constants for message compression
+const (
+	CompressionDeflate = "deflate"
+	CompressionGzip    = "gzip"
+
+	DefaultCompressionMinSize = 1024
+
+	// CompressionMaxEntropy is the entropy in bits per byte above which content is considered already compressed,
+	// it's estimated from the first CompressionSampleSize bytes of a message
+	CompressionMaxEntropy = 7.5
+	CompressionSampleSize = 4096
+)
+
+// variables for message compression
+var (
+	// SupportedCompressions are the compression algorithms that this build implements, in the order of preference
+	SupportedCompressions = []string{CompressionDeflate, CompressionGzip}
+
+	compressionFlags = map[string]byte{
+		CompressionDeflate: FrameFlagDeflate,
+		CompressionGzip:    FrameFlagGzip,
+	}
+)
+
+// CompressionStats is the statistics of outbound messages compression on a connection,
+// BytesSaved is the sum of the sizes reduced from the compressed messages
+type CompressionStats struct {
+	Compressed int64
+	Skipped    int64
+	BytesIn    int64
+	BytesOut   int64
+	BytesSaved int64
+}
+
+func (stats *CompressionStats) String() string {
+	return ToString(stats)
+}
+
+// CompressionStats returns the compression statistics of the hub
+func (hub *Hub) CompressionStats() CompressionStats {
+	hub.compressionMutex.Lock()
+	defer hub.compressionMutex.Unlock()
+	return hub.compressionStats
+}
+
+// Compression returns the compression algorithm negotiated on the connection, or empty string if there's none
+func (hub *Hub) Compression() string {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	if !hub.capabilities[CapabilityCompression] {
+		return ""
+	}
+	return hub.compression
+}
+
+// chooseCompression returns the first of SupportedCompressions that is also in offered, or empty string if there's none
+func chooseCompression(offered []string) string {
+	for _, supported := range SupportedCompressions {
+		for _, algorithm := range offered {
+			if algorithm == supported {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+// compress compresses data with the negotiated algorithm, it returns the data to send and the frame flags telling how it's compressed.
+// Messages smaller than CompressionMinSize, and content that looks already compressed, are sent as it is,
+// so are messages that don't get smaller after compression.
+func (hub *Hub) compress(data []byte) ([]byte, byte) {
+	algorithm := hub.Compression()
+	if algorithm == "" {
+		return data, 0
+	}
+	if len(data) < hub.CompressionMinSize || entropy(sample(data)) > CompressionMaxEntropy {
+		hub.recordCompression(len(data), len(data), false)
+		return data, 0
+	}
+	compressed, err := compressBytes(algorithm, data)
+	if err != nil {
+		hub.LogDebug("error on compressing message with %v: %v\n", algorithm, err)
+		hub.recordCompression(len(data), len(data), false)
+		return data, 0
+	}
+	if len(compressed) >= len(data) {
+		hub.recordCompression(len(data), len(data), false)
+		return data, 0
+	}
+	hub.recordCompression(len(data), len(compressed), true)
+	hub.LogVerbose("message compressed with %v, size: %v -> %v\n", algorithm, len(data), len(compressed))
+	return compressed, compressionFlags[algorithm]
+}
+
+// decompress restores a message compressed as flags tells, messages without compression flags are returned as it is.
+// The restored message is limited to MaxMessageSize as well, so a small message couldn't expand to exhaust memory.
+func (hub *Hub) decompress(data []byte, flags byte) ([]byte, error) {
+	var reader io.ReadCloser
+	switch flags & FrameFlagCompressionMask {
+	case 0:
+		return data, nil
+	case FrameFlagDeflate:
+		reader = flate.NewReader(bytes.NewReader(data))
+	case FrameFlagGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+	default:
+		return nil, ErrorUnknownCompression
+	}
+	defer reader.Close()
+	limit := hub.messageSizeLimit()
+	restored, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(restored)) > limit {
+		return nil, hub.limitError(ErrorMessageTooLarge, "decompressed size exceeds limit: %v", limit)
+	}
+	return restored, nil
+}
+
+func (hub *Hub) recordCompression(in int, out int, compressed bool) {
+	hub.compressionMutex.Lock()
+	defer hub.compressionMutex.Unlock()
+	stats := &hub.compressionStats
+	if compressed {
+		stats.Compressed++
+	} else {
+		stats.Skipped++
+	}
+	stats.BytesIn += int64(in)
+	stats.BytesOut += int64(out)
+	stats.BytesSaved += int64(in - out)
+}
+
+func compressBytes(algorithm string, data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch algorithm {
+	case CompressionDeflate:
+		flateWriter, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		writer = flateWriter
+	case CompressionGzip:
+		writer = gzip.NewWriter(&buffer)
+	default:
+		return nil, ErrorUnknownCompression
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func sample(data []byte) []byte {
+	if len(data) > CompressionSampleSize {
+		return data[:CompressionSampleSize]
+	}
+	return data
+}
+
+// entropy returns the Shannon entropy of data in bits per byte, which is close to 8 for compressed or encrypted content
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	total := float64(len(data))
+	var result float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		result -= p * math.Log2(p)
+	}
+	return result
+}
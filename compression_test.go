@@ -0,0 +1,108 @@
+package syncbox
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	cases := []struct {
+		name         string
+		capabilities []string
+		compressions []string
+		compression  string
+	}{
+		{"both algorithms", []string{CapabilityCompression}, []string{CompressionGzip, CompressionDeflate}, CompressionDeflate},
+		{"gzip only", []string{CapabilityCompression}, []string{CompressionGzip}, CompressionGzip},
+		{"unknown algorithm first", []string{CapabilityCompression}, []string{"zstd", CompressionGzip}, CompressionGzip},
+		{"no shared algorithm", []string{CapabilityCompression}, []string{"zstd", "brotli"}, ""},
+		{"no algorithm", []string{CapabilityCompression}, nil, ""},
+		{"without capability", nil, SupportedCompressions, ""},
+	}
+	for _, c := range cases {
+		hub := newTestHub(t)
+		iRes, err := hub.NegotiateProtocol(&IdentityRequest{ProtocolVersion: ProtocolVersion, Capabilities: c.capabilities, Compressions: c.compressions})
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if iRes.Compression != c.compression {
+			t.Fatalf("%v: agreed on %q, want %q", c.name, iRes.Compression, c.compression)
+		}
+		hub.ApplyNegotiation(iRes, 0, 0)
+		if hub.Compression() != c.compression || hub.HasCapability(CapabilityCompression) != (c.compression != "") {
+			t.Fatalf("%v: compression %q, capabilities %v", c.name, hub.Compression(), hub.Capabilities())
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("syncbox keeps files in sync. "), 1000)
+	cases := []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"below min size", text[:DefaultCompressionMinSize-1], false},
+		{"at min size", text[:DefaultCompressionMinSize], true},
+		{"text", text, true},
+		{"high entropy", random, false},
+		// the sample passes the entropy check, but the whole doesn't get smaller after compression
+		{"random after sample", append(append([]byte{}, text[:CompressionSampleSize]...), random...), false},
+	}
+	for _, algorithm := range SupportedCompressions {
+		for _, c := range cases {
+			hub := newTestHub(t)
+			hub.ApplyNegotiation(&IdentityResponse{Capabilities: []string{CapabilityCompression}, Compression: algorithm}, 0, 0)
+			data, flags := hub.compress(c.data)
+			stats := hub.CompressionStats()
+			if (flags != 0) != c.compressed || (stats.Compressed == 1) != c.compressed || stats.Compressed+stats.Skipped != 1 {
+				t.Fatalf("%v, %v: flags %x, stats %v", algorithm, c.name, flags, &stats)
+			}
+			if flags == 0 && !bytes.Equal(data, c.data) {
+				t.Fatalf("%v, %v: skipped message is changed", algorithm, c.name)
+			}
+			if stats.BytesIn != int64(len(c.data)) || stats.BytesOut != int64(len(data)) || stats.BytesSaved != stats.BytesIn-stats.BytesOut {
+				t.Fatalf("%v, %v: stats %v", algorithm, c.name, &stats)
+			}
+			restored, err := hub.decompress(data, flags)
+			if err != nil || !bytes.Equal(restored, c.data) {
+				t.Fatalf("%v, %v: round trip: %v", algorithm, c.name, err)
+			}
+		}
+	}
+
+	hub := newTestHub(t)
+	if data, flags := hub.compress(text); flags != 0 || !bytes.Equal(data, text) || hub.CompressionStats().Skipped != 0 {
+		t.Fatal("messages should be sent as they are without negotiated compression")
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	content := bytes.Repeat([]byte("syncbox "), 10000)
+	for _, algorithm := range SupportedCompressions {
+		a, b := hubPair(t)
+		negotiated := &IdentityResponse{
+			ProtocolVersion: ProtocolVersion,
+			Capabilities:    []string{CapabilityFraming, CapabilityCompression, CapabilityChecksum},
+			Compression:     algorithm,
+		}
+		a.ApplyNegotiation(negotiated, 0, 0)
+		b.ApplyNegotiation(negotiated, 0, 0)
+		if err := a.SendRequest(NewRequest("", "", "", "ECHO", content)); err != nil {
+			t.Fatalf("%v: %v", algorithm, err)
+		}
+		req, err := b.ReceiveRequest()
+		if err != nil {
+			t.Fatalf("%v: %v", algorithm, err)
+		}
+		if !bytes.Equal(req.Data, content) {
+			t.Fatalf("%v: content mismatch", algorithm)
+		}
+		if stats := a.CompressionStats(); stats.Compressed != 1 || stats.BytesSaved <= 0 {
+			t.Fatalf("%v: stats %v", algorithm, &stats)
+		}
+	}
+}
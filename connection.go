@@ -1,10 +1,14 @@
 package syncbox
 
 import (
+	"context"
+	"crypto/ecdh"
 	"fmt"
 	"net"
 	"os"
-	"strings"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -24,7 +28,24 @@ const (
 
 // variables
 var (
-	ServerHost = os.Getenv("SB_SERVER_HOST")
+	ServerHost         = os.Getenv("SB_SERVER_HOST")
+	MaxFrameSize       = os.Getenv("SB_MAX_FRAME_SIZE")
+	HeartbeatInterval  = os.Getenv("SB_HEARTBEAT_INTERVAL")
+	HeartbeatMaxMissed = os.Getenv("SB_HEARTBEAT_MAX_MISSED")
+	CompressionMinSize = os.Getenv("SB_COMPRESSION_MIN_SIZE")
+
+	MaxMessageSize        = os.Getenv("SB_MAX_MESSAGE_SIZE")
+	MaxPartialMessages    = os.Getenv("SB_MAX_PARTIAL_MESSAGES")
+	MaxBufferedBytes      = os.Getenv("SB_MAX_BUFFERED_BYTES")
+	PartialMessageTimeout = os.Getenv("SB_PARTIAL_MESSAGE_TIMEOUT")
+
+	IdempotencyCacheSize = os.Getenv("SB_IDEMPOTENCY_CACHE_SIZE")
+	SessionTokenTTL      = os.Getenv("SB_SESSION_TOKEN_TTL")
+	Signing              = os.Getenv("SB_SIGNING")
+	RequireSigning       = os.Getenv("SB_REQUIRE_SIGNING")
+	SigningWindow        = os.Getenv("SB_SIGNING_WINDOW")
+	SigningKeyFile       = os.Getenv("SB_SIGNING_KEY")
+	SigningPinFile       = os.Getenv("SB_SIGNING_PIN_FILE")
 )
 
 // RequestHandler function type for server to handle requests
@@ -42,7 +63,7 @@ type CallbackWithoutError func()
 
 // CouldCloseConn represents an interface that supports closing a connection
 type CouldCloseConn interface {
-	CloseConn(*net.TCPConn)
+	CloseConn(net.Conn)
 }
 
 // Connector is the base structure for server and client connection
@@ -51,68 +72,198 @@ type Connector struct {
 	*Logger
 	ServerHost       string
 	ServerPort       string
-	ServerDialAddr   *net.TCPAddr
-	ServerListenAddr *net.TCPAddr
+	ServerDialAddr   string
+	ServerListenAddr string
+	MaxFrameSize     int
+	TLS              *TLSConfig
+
+	// DeviceName is the name of the device that the client runs on, told to server in the identity handshake
+	DeviceName string
+	Transport  Transport
+
+	// Registry dispatches inbound requests to the processors registered for their types
+	Registry *Registry
+
+	// HeartbeatInterval is the period to ping peers, zero disables heartbeat,
+	// peers that miss HeartbeatMaxMissed consecutive pings are disconnected
+	HeartbeatInterval  time.Duration
+	HeartbeatMaxMissed int
+
+	// CompressionMinSize is the size of messages under which they are not compressed
+	CompressionMinSize int
+
+	// limits of inbound messages on each connection, see the fields of Hub with the same names
+	MaxMessageSize        int64
+	MaxPartialMessages    int
+	MaxBufferedBytes      int64
+	PartialMessageTimeout time.Duration
+
+	// IdempotencyCacheSize is the number of completed requests whose responses are kept for each session
+	IdempotencyCacheSize int
+
+	// SessionTokenTTL is how long a session token issued by server is valid, clients refresh tokens before they expire
+	SessionTokenTTL time.Duration
+
+	// Signing makes server agree to sign messages with the peers offering to, which RequireSigning implies.
+	// RequireSigning refuses peers that don't sign messages, SigningWindow is how far the timestamp of a signed message
+	// could be from now
+	Signing        bool
+	RequireSigning bool
+	SigningWindow  time.Duration
+
+	// SigningKeyFile is the long-term signing key of server, which is generated if it doesn't exist,
+	// setting it also enables signing. SigningPinFile is where clients pin the signing keys of servers on first connect
+	SigningKeyFile string
+	SigningPinFile string
 }
 
 // ServerConnector structure for server connection
 type ServerConnector struct {
 	*Connector
-	ServerLocalAddr *net.TCPAddr
-	Clients         map[*net.TCPAddr]*Peer
+	ServerLocalAddr net.Addr
+	Clients         map[string]*Peer
+	Listener        net.Listener
+	clientsMutex    sync.RWMutex
+	sessions        map[string]*Session
+	sessionMutex    sync.Mutex
+	signingIdentity *ecdh.PrivateKey
 }
 
-// ClientConnector structure for client connection
+// ClientConnector structure for client connection,
+// the client always opens the connection, and reconnects with Backoff once it's lost
 type ClientConnector struct {
 	*Connector
 	ClientPort       string
-	ServerRemoteAddr *net.TCPAddr
-	ClientLocalAddr  *net.TCPAddr
+	ServerRemoteAddr net.Addr
+	ClientLocalAddr  net.Addr
 	Peer             *Peer
+	Backoff          *Backoff
+	peerMutex        sync.RWMutex
 }
 
 // Peer is a representation of a connection
 type Peer struct {
 	*Hub
 	Username string
-	Password string
 	Device   string
-	Address  *net.TCPAddr
+	Address  net.Addr
 	RefGraph *RefGraph
 }
 
-// ConnectionHandler is the interface to specify methods that should be implemented as a connection handler
+// RequestProcessor is the function type to process a request, it's registered in Registry for a request type,
+// ctx is cancelled when peer disconnects or cancels the request
+type RequestProcessor func(context.Context, *Request, *Peer, ErrorHandler)
+
+// ConnectionHandler is the interface to specify methods that should be implemented as a connection handler,
+// requests are processed by the processors registered in Registry, see Registry.HandleRequest
 type ConnectionHandler interface {
-	Dial(handler ConnectionHandler, addr *net.TCPAddr) error
 	HandleRequest(*Peer) error
 	HandleError(error)
-	ProcessIdentity(*Request, *Peer, ErrorHandler)
-	ProcessDigest(*Request, *Peer, ErrorHandler)
-	ProcessSync(*Request, *Peer, ErrorHandler)
-	ProcessFile(*Request, *Peer, ErrorHandler)
 	LogInfo(string, ...interface{})
 	LogDebug(string, ...interface{})
 	LogError(string, ...interface{})
 	LogVerbose(string, ...interface{})
 }
 
-// NewConnector instantiates a connector
+// NewConnector instantiates a connector, it listens and dials over TCP by default,
+// set Transport to use other kinds of connections
 func NewConnector() (*Connector, error) {
-	serverListenAddr, err := net.ResolveTCPAddr("tcp", IPAnywhere+":"+DefaultServerPort)
-	if err != nil {
+	var err error
+	connector := &Connector{
+		ServerHost:       ServerHost,
+		ServerPort:       DefaultServerPort,
+		ServerDialAddr:   net.JoinHostPort(ServerHost, DefaultServerPort),
+		ServerListenAddr: net.JoinHostPort(IPAnywhere, DefaultServerPort),
+		Logger:           NewDefaultLogger(),
+	}
+	if connector.MaxFrameSize, err = configInt(MaxFrameSize, DefaultMaxFrameSize); err != nil {
 		return nil, err
 	}
-	serverDialAddr, err := net.ResolveTCPAddr("tcp", ServerHost+":"+DefaultServerPort)
-	if err != nil {
+	if connector.HeartbeatInterval, err = configDuration(HeartbeatInterval, DefaultHeartbeatInterval); err != nil {
 		return nil, err
 	}
-	return &Connector{
-		ServerHost:       ServerHost,
-		ServerPort:       DefaultServerPort,
-		ServerDialAddr:   serverDialAddr,
-		ServerListenAddr: serverListenAddr,
-		Logger:           NewDefaultLogger(),
-	}, nil
+	if connector.HeartbeatMaxMissed, err = configInt(HeartbeatMaxMissed, DefaultHeartbeatMaxMissed); err != nil {
+		return nil, err
+	}
+	if connector.CompressionMinSize, err = configInt(CompressionMinSize, DefaultCompressionMinSize); err != nil {
+		return nil, err
+	}
+	if connector.MaxMessageSize, err = configInt64(MaxMessageSize, DefaultMaxMessageSize); err != nil {
+		return nil, err
+	}
+	if connector.MaxPartialMessages, err = configInt(MaxPartialMessages, DefaultMaxPartialMessages); err != nil {
+		return nil, err
+	}
+	if connector.MaxBufferedBytes, err = configInt64(MaxBufferedBytes, DefaultMaxBufferedBytes); err != nil {
+		return nil, err
+	}
+	if connector.PartialMessageTimeout, err = configDuration(PartialMessageTimeout, DefaultPartialMessageTimeout); err != nil {
+		return nil, err
+	}
+	if connector.IdempotencyCacheSize, err = configInt(IdempotencyCacheSize, DefaultIdempotencyCacheSize); err != nil {
+		return nil, err
+	}
+	if connector.SessionTokenTTL, err = configDuration(SessionTokenTTL, DefaultSessionTokenTTL); err != nil {
+		return nil, err
+	}
+	if connector.SigningWindow, err = configDuration(SigningWindow, DefaultSigningWindow); err != nil {
+		return nil, err
+	}
+	connector.RequireSigning = isTrue(RequireSigning)
+	connector.Signing = isTrue(Signing) || connector.RequireSigning
+	connector.SigningKeyFile = SigningKeyFile
+	connector.SigningPinFile = SigningPinFile
+	if home, err := os.UserHomeDir(); err == nil {
+		if connector.SigningKeyFile == "" && connector.Signing {
+			connector.SigningKeyFile = filepath.Join(home, DefaultSigningKeyFileName)
+		}
+		if connector.SigningPinFile == "" {
+			connector.SigningPinFile = filepath.Join(home, DefaultSigningPinFileName)
+		}
+	}
+	connector.TLS = NewTLSConfig()
+	connector.Transport = NewTCPTransport(connector.TLS)
+	connector.Registry = NewRegistry()
+	return connector, nil
+}
+
+// configInt parses an integer config variable, it returns defaultValue if value is not set
+func configInt(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// configInt64 parses a 64-bit integer config variable, it returns defaultValue if value is not set
+func configInt64(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// configDuration parses a duration config variable, it returns defaultValue if value is not set
+func configDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// NewHub instantiates a Hub for the connection with the settings of connector
+func (connector *Connector) NewHub(conn net.Conn, eHandler ErrorHandler) *Hub {
+	hub := NewHub(conn, eHandler)
+	hub.MaxFrameSize = connector.MaxFrameSize
+	hub.CompressionMinSize = connector.CompressionMinSize
+	hub.MaxMessageSize = connector.MaxMessageSize
+	hub.MaxPartialMessages = connector.MaxPartialMessages
+	hub.MaxBufferedBytes = connector.MaxBufferedBytes
+	hub.PartialMessageTimeout = connector.PartialMessageTimeout
+	hub.DeviceName = connector.DeviceName
+	hub.RequireSigning = connector.RequireSigning
+	hub.SigningWindow = connector.SigningWindow
+	return hub
 }
 
 // NewServerConnector instantiate server connector
@@ -123,7 +274,8 @@ func NewServerConnector() (*ServerConnector, error) {
 	}
 	sc := &ServerConnector{
 		Connector: connector,
-		Clients:   make(map[*net.TCPAddr]*Peer),
+		Clients:   make(map[string]*Peer),
+		sessions:  make(map[string]*Session),
 	}
 	sc.CouldCloseConn = sc
 	return sc, nil
@@ -139,13 +291,14 @@ func NewClientConnector() (*ClientConnector, error) {
 	cc := &ClientConnector{
 		Connector:  connector,
 		ClientPort: DefaultClientPort,
+		Backoff:    NewBackoff(),
 	}
 	cc.CouldCloseConn = cc
 	return cc, nil
 }
 
 // NewPeer instantiates a Peer
-func NewPeer(hub *Hub, username string, device string, addr *net.TCPAddr, rg *RefGraph) *Peer {
+func NewPeer(hub *Hub, username string, device string, addr net.Addr, rg *RefGraph) *Peer {
 	return &Peer{
 		Hub:      hub,
 		Username: username,
@@ -156,16 +309,33 @@ func NewPeer(hub *Hub, username string, device string, addr *net.TCPAddr, rg *Re
 }
 
 // CloseConn implements the CouldCloseConn interface
-func (sc *ServerConnector) CloseConn(conn *net.TCPConn) {
+func (sc *ServerConnector) CloseConn(conn net.Conn) {
 	if conn != nil {
 		sc.LogDebug("close connection of %v\n", conn.RemoteAddr())
 		conn.Close()
-		delete(sc.Clients, conn.RemoteAddr().(*net.TCPAddr))
+		sc.clientsMutex.Lock()
+		peer, exists := sc.Clients[conn.RemoteAddr().String()]
+		delete(sc.Clients, conn.RemoteAddr().String())
+		sc.clientsMutex.Unlock()
+		if exists {
+			sc.detachSession(peer)
+		}
 	}
 }
 
+// ClientPeers returns the peers of connected clients, it's safe to be called while clients connect and disconnect
+func (sc *ServerConnector) ClientPeers() []*Peer {
+	sc.clientsMutex.RLock()
+	defer sc.clientsMutex.RUnlock()
+	peers := make([]*Peer, 0, len(sc.Clients))
+	for _, peer := range sc.Clients {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
 // CloseConn implements the CouldCloseConn interface
-func (cc *ClientConnector) CloseConn(conn *net.TCPConn) {
+func (cc *ClientConnector) CloseConn(conn net.Conn) {
 	if conn != nil {
 		cc.LogDebug("close connection of %v\n", conn.RemoteAddr())
 		conn.Close()
@@ -173,8 +343,13 @@ func (cc *ClientConnector) CloseConn(conn *net.TCPConn) {
 }
 
 // SetupConnection setups methods that handles a request, including receiving message,
-// waiting for outbound message, dispatch response to corresponding request and handle request
-func (connector *Connector) SetupConnection(handler ConnectionHandler, peer *Peer, conn *net.TCPConn) {
+// waiting for outbound message, dispatch response to corresponding request and handle request.
+// The connection is closed when the hub of peer is closed, and the hub is closed if handling requests fails
+// or peer misses heartbeats.
+func (connector *Connector) SetupConnection(handler ConnectionHandler, peer *Peer, conn net.Conn) {
+	go peer.Hub.Heartbeat(connector.HeartbeatInterval, connector.HeartbeatMaxMissed)
+	go peer.Hub.RefreshSessionToken()
+
 	go func() {
 		err := peer.Hub.Setup()
 		if err != nil {
@@ -190,138 +365,191 @@ func (connector *Connector) SetupConnection(handler ConnectionHandler, peer *Pee
 			connector.LogDebug("error on handle connection: %v\n", err)
 			handler.HandleError(err)
 		}
-		connector.CloseConn(conn)
+		peer.Hub.Close()
 	}()
 }
 
-// Dial dials to client, should be used when try to reconnect to peer
-func (sc *ServerConnector) Dial(handler ConnectionHandler, clientDialAddr *net.TCPAddr) error {
-	conn, err := net.DialTCP("tcp", nil, clientDialAddr)
-	if err != nil {
-		sc.LogDebug("error on dial: %v\n", err)
-		return err
-	}
-	addr := conn.RemoteAddr().(*net.TCPAddr)
-	hub := NewHub(conn, handler.HandleError)
-	peer := NewPeer(hub, "", "", addr, nil)
-	sc.Clients[addr] = peer
-	sc.SetupConnection(handler, peer, conn)
-	return nil
-}
-
-// Listen listen on port
+// Listen listen on port, connections are accepted over TLS if it's configured.
+// If signing is enabled, the signing key is loaded from SigningKeyFile before listening, or generated if it doesn't exist,
+// otherwise server never agrees to sign messages.
 func (sc *ServerConnector) Listen(handler ConnectionHandler) error {
-	ln, err := net.ListenTCP("tcp", sc.ServerListenAddr)
+	if sc.Signing || sc.RequireSigning || sc.SigningKeyFile != "" {
+		identity, err := loadSigningIdentity(sc.SigningKeyFile)
+		if err != nil {
+			sc.LogDebug("error on loading signing key: %v\n", err)
+			return err
+		}
+		sc.signingIdentity = identity
+	}
+	ln, err := sc.Transport.Listen(sc.ServerListenAddr)
 	if err != nil {
 		sc.LogDebug("error on listening: %v\n", err)
 		return err
 	}
-	fmt.Printf("server listening on %v\n", sc.ServerListenAddr)
+	sc.Listener = ln
+	sc.ServerLocalAddr = ln.Addr()
+	if sc.TLS != nil {
+		fmt.Printf("server listening on %v with TLS\n", sc.ServerLocalAddr)
+	} else {
+		fmt.Printf("server listening on %v\n", sc.ServerLocalAddr)
+	}
 	for {
-		conn, err := ln.AcceptTCP()
+		conn, err := ln.Accept()
 		if err != nil {
 			sc.LogDebug("error on accept: %v\n", err)
 			return err
 		}
-		addr := conn.RemoteAddr().(*net.TCPAddr)
-		sc.LogDebug("accepted connection: %v\n", addr)
-		hub := NewHub(conn, handler.HandleError)
+		sc.LogDebug("accepted connection: %v\n", conn.RemoteAddr())
+		addr := conn.RemoteAddr()
+		hub := sc.NewHub(conn, handler.HandleError)
+		hub.SigningIdentity = sc.signingIdentity
 		peer := NewPeer(hub, "", "", addr, nil)
-		sc.Clients[addr] = peer
+		sc.clientsMutex.Lock()
+		sc.Clients[addr.String()] = peer
+		sc.clientsMutex.Unlock()
 		sc.SetupConnection(handler, peer, conn)
 	}
 }
 
-// Dial dials to server, serverAddr should be passed as nil,
-// it's only for  compatibility of the ConnectionHandler interface
-func (cc *ClientConnector) Dial(handler ConnectionHandler, serverAddr *net.TCPAddr) error {
-	conn, err := net.DialTCP("tcp", nil, cc.ServerDialAddr)
+// Dial dials to server, all the traffic between server and client flows over the connection.
+// The TLS handshake is done before return if TLS is configured.
+// If there was a connection before, the new one asks to resume its session in the identity handshake.
+func (cc *ClientConnector) Dial(handler ConnectionHandler) error {
+	conn, err := cc.Transport.Dial(cc.ServerDialAddr)
 	if err != nil {
 		cc.LogDebug("error on dial: %v\n", err)
 		return err
 	}
-	cc.ClientLocalAddr = conn.LocalAddr().(*net.TCPAddr)
-	cc.ServerRemoteAddr = conn.RemoteAddr().(*net.TCPAddr)
-	hub := NewHub(conn, handler.HandleError)
-	cc.Peer = NewPeer(hub, "", "", cc.ServerRemoteAddr, nil)
-	cc.SetupConnection(handler, cc.Peer, conn)
+	hub := cc.NewHub(conn, handler.HandleError)
+	hub.VerifySigningKey = cc.verifySigningKey
+	peer := NewPeer(hub, "", "", conn.RemoteAddr(), nil)
+	cc.peerMutex.Lock()
+	if cc.Peer != nil {
+		hub.setSessionID(cc.Peer.SessionID())
+	}
+	cc.ClientLocalAddr = conn.LocalAddr()
+	cc.ServerRemoteAddr = conn.RemoteAddr()
+	cc.Peer = peer
+	cc.peerMutex.Unlock()
+	cc.SetupConnection(handler, peer, conn)
 	return nil
 }
 
-// Listen listens on the port, in case that connection closed and server try to reconnect to client.
-// This should be called after client Dial, to get the port that used for dialing
-func (cc *ClientConnector) Listen(handler ConnectionHandler) error {
-	ln, err := net.ListenTCP("tcp", cc.ClientLocalAddr)
+// verifySigningKey pins the signing key of server in SigningPinFile on first connect,
+// and refuses it if it's different from the pinned one later
+func (cc *ClientConnector) verifySigningKey(key []byte) error {
+	if cc.SigningPinFile == "" {
+		return ErrorMissingSigningPinFile
+	}
+	if len(key) == 0 {
+		return ErrorBadSigningKey
+	}
+	match, err := pinFingerprint(cc.SigningPinFile, cc.ServerDialAddr, Fingerprint(key))
 	if err != nil {
-		cc.LogDebug("error on listening: %v\n", err)
 		return err
 	}
-	fmt.Printf("client listening on %v\n", cc.ClientLocalAddr)
-	for {
-		conn, err := ln.AcceptTCP()
-		if err != nil {
-			cc.LogDebug("error on accept: %v\n", err)
+	if !match {
+		return ErrorSigningKeyMismatch
+	}
+	return nil
+}
+
+// CurrentPeer returns the peer of the current connection to server,
+// it's safe to be called while the client reconnects
+func (cc *ClientConnector) CurrentPeer() *Peer {
+	cc.peerMutex.RLock()
+	defer cc.peerMutex.RUnlock()
+	return cc.Peer
+}
+
+// Reconnect dials to server until it succeeds or ctx is done, waiting by Backoff between attempts.
+// onConnect is called with each new connection, to do the identity handshake for example,
+// the connection is closed and retried if it returns error, unless the error is permanent, see IsPermanent.
+func (cc *ClientConnector) Reconnect(ctx context.Context, handler ConnectionHandler, onConnect func(context.Context, *Peer) error) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := cc.Backoff.Delay(attempt - 1)
+			cc.LogDebug("reconnect attempt %v in %v\n", attempt, delay)
+			sleepContext(ctx, delay)
+		}
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		serverAddr := conn.RemoteAddr().(*net.TCPAddr)
-		cc.LogDebug("accepted connection: %v\n", serverAddr)
-		hub := NewHub(conn, handler.HandleError)
-		cc.Peer = NewPeer(hub, "", "", serverAddr, nil)
-		cc.SetupConnection(handler, cc.Peer, conn)
+		if err := cc.Dial(handler); err != nil {
+			continue
+		}
+		peer := cc.CurrentPeer()
+		if onConnect != nil {
+			if err := onConnect(ctx, peer); err != nil {
+				cc.LogDebug("error on connecting in Reconnect: %v\n", err)
+				peer.Close()
+				if IsPermanent(err) {
+					// like wrong credentials, reconnecting doesn't help
+					return err
+				}
+				continue
+			}
+		}
+		return nil
 	}
 }
 
-// HandleRequest boilerplates connection handling.
-// It should returns error only when the error should cause connnection to be closed,
-// otherwise should just continue for next loop to process incoming requests.
-func HandleRequest(peer *Peer, handler ConnectionHandler) error {
+// KeepConnected reconnects to server by Reconnect whenever the connection is lost, until ctx is done.
+// It should be called after the first connection is made, and be run as goroutine.
+func (cc *ClientConnector) KeepConnected(ctx context.Context, handler ConnectionHandler, onConnect func(context.Context, *Peer) error) error {
 	for {
-		req, err := peer.Hub.ReceiveRequest()
-		if err != nil {
-			if err == ErrorPeerSocketClosed {
-				// peer socket is closed
-				return nil
-			}
-			handler.LogError("error on receiving request: %v\n", err)
-			continue
+		peer := cc.CurrentPeer()
+		select {
+		case <-peer.Done():
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		peer.Username = req.Username
-		peer.Password = req.Password
-		peer.Device = req.Device
-		handler.LogVerbose("request data type: %v\n", req.DataType)
-		switch req.DataType {
-		case TypeIdentity:
-			go handler.ProcessIdentity(req, peer, handler.HandleError)
-		case TypeDigest:
-			go handler.ProcessDigest(req, peer, handler.HandleError)
-		case TypeSyncRequest:
-			go handler.ProcessSync(req, peer, handler.HandleError)
-		case TypeFile:
-			go handler.ProcessFile(req, peer, handler.HandleError)
-		default:
-			handler.LogDebug("data type: %v\n", req.DataType)
-			return ErrorUnknownRequestType
+		cc.LogInfo("connection to server lost: %v, reconnecting\n", peer.Err())
+		if err := cc.Reconnect(ctx, handler, onConnect); err != nil {
+			return err
 		}
+		cc.LogInfo("reconnected to server, session: %v\n", cc.CurrentPeer().SessionID())
 	}
 }
 
-// SendWithRetry sends message with retry, it also try to  dial if connection is broken
-func SendWithRetry(handler ConnectionHandler, callback Callback, addr *net.TCPAddr) error {
+// SendWithRetry sends message with retry, callback is retried after a rest period if it fails,
+// which gives the client time to reconnect if the connection is broken.
+// Failures that peer reports as permanent are returned without retrying, see IsPermanent.
+func SendWithRetry(handler ConnectionHandler, callback Callback) error {
+	return SendWithRetryContext(context.Background(), handler, callback)
+}
+
+// SendWithRetryContext is SendWithRetry that stops retrying once ctx is done,
+// it returns ctx.Err() in that case. callback should use ctx for the requests it sends,
+// and ctx should carry an idempotency key by WithIdempotencyKey, so that peer could tell the retries from new requests.
+func SendWithRetryContext(ctx context.Context, handler ConnectionHandler, callback Callback) error {
 	var err error
 	for i := 0; i < SendMessageMaxRetry; i++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err = callback(); err != nil {
 			handler.LogDebug("error in SendWithRetry: %v,\n retry count: %v\n", err, i)
-			if err == ErrorPeerSocketClosed || strings.HasSuffix(err.Error(), "use of closed network connection") {
-				if dialErr := handler.Dial(handler, addr); dialErr != nil {
-					handler.LogDebug("error on retry Dial in SendWithRetry: %v\n", dialErr)
-					time.Sleep(SendMessageRestPeriod)
-				}
-			} else {
-				time.Sleep(SendMessageRestPeriod)
+			if IsPermanent(err) {
+				return err
+			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
 			}
+			sleepContext(ctx, SendMessageRestPeriod)
 		} else {
 			break
 		}
 	}
 	return err
 }
+
+// sleepContext pauses for period, or until ctx is done
+func sleepContext(ctx context.Context, period time.Duration) {
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,296 @@
+package syncbox
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testHandler is the ConnectionHandler of tests, requests are processed by the processors registered in registry
+type testHandler struct {
+	*Logger
+	registry *Registry
+	errs     chan error
+}
+
+func newTestHandler(logger *Logger, registry *Registry) *testHandler {
+	return &testHandler{
+		Logger:   logger,
+		registry: registry,
+		errs:     make(chan error, 100),
+	}
+}
+
+// HandleRequest implements the ConnectionHandler interface
+func (handler *testHandler) HandleRequest(peer *Peer) error {
+	return handler.registry.HandleRequest(peer, handler)
+}
+
+// HandleError implements the ConnectionHandler interface
+func (handler *testHandler) HandleError(err error) {
+	select {
+	case handler.errs <- err:
+	default:
+	}
+}
+
+// processTestIdentity negotiates the protocol as server does, without authenticating the peer
+func processTestIdentity(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+	iReq := RequestPayload(ctx).(*IdentityRequest)
+	iRes, err := peer.NegotiateProtocol(iReq)
+	if err != nil {
+		peer.SendErrorResponse(req, err)
+		return
+	}
+	data, err := peer.Marshal(iRes)
+	if err != nil {
+		eHandler(err)
+		return
+	}
+	if err := peer.SendResponse(req, &Response{Status: StatusOK, Data: data}); err != nil {
+		eHandler(err)
+		return
+	}
+	peer.ApplyNegotiation(iRes, iReq.MaxFrameSize, iReq.MaxPartialMessages)
+}
+
+// processEcho responds the data of the request
+func processEcho(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+	if err := peer.SendResponse(req, &Response{Status: StatusOK, Data: req.Data}); err != nil {
+		eHandler(err)
+	}
+}
+
+// listenNotifier is the PipeTransport that tells when a connector listens
+type listenNotifier struct {
+	*PipeTransport
+	listening chan error
+}
+
+func (transport *listenNotifier) Listen(addr string) (net.Listener, error) {
+	ln, err := transport.PipeTransport.Listen(addr)
+	transport.listening <- err
+	return ln, err
+}
+
+// testServer is a server connector listening on a PipeTransport
+type testServer struct {
+	*ServerConnector
+	handler   *testHandler
+	transport *PipeTransport
+	pinFile   string
+}
+
+// startTestServer starts a server over a new PipeTransport, its registry answers identity requests and echoes "ECHO" requests,
+// setup could register other processors and middlewares before it starts. The server stops when the test ends.
+func startTestServer(t *testing.T, setup func(*ServerConnector)) *testServer {
+	t.Helper()
+	sc, err := NewServerConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	transport := &listenNotifier{PipeTransport: NewPipeTransport(), listening: make(chan error, 1)}
+	sc.Transport = transport
+	sc.TLS = nil
+	sc.SigningKeyFile = filepath.Join(dir, "signing_key")
+	sc.Registry.Register(TypeIdentity, IdentityRequest{}, processTestIdentity)
+	sc.Registry.Register("ECHO", nil, processEcho)
+	if setup != nil {
+		setup(sc)
+	}
+	server := &testServer{
+		ServerConnector: sc,
+		handler:         newTestHandler(sc.Logger, sc.Registry),
+		transport:       transport.PipeTransport,
+		pinFile:         filepath.Join(dir, "known_signing_keys"),
+	}
+	go sc.Listen(server.handler)
+	select {
+	case err := <-transport.listening:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server doesn't listen")
+	}
+	t.Cleanup(func() {
+		sc.Listener.Close()
+		for _, peer := range sc.ClientPeers() {
+			peer.Close()
+		}
+	})
+	return server
+}
+
+// dial connects a client to server and runs the identity handshake as username
+func (server *testServer) dial(t *testing.T, username string) *ClientConnector {
+	t.Helper()
+	cc := server.dialOnly(t)
+	if _, err := cc.Peer.SendIdentityRequest(username, "password", "device"); err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+// dialOnly connects a client to server without the identity handshake
+func (server *testServer) dialOnly(t *testing.T) *ClientConnector {
+	t.Helper()
+	cc, err := NewClientConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Transport = server.transport
+	cc.TLS = nil
+	cc.ServerDialAddr = server.ServerListenAddr
+	cc.SigningPinFile = server.pinFile
+	if err := cc.Dial(newTestHandler(cc.Logger, NewRegistry())); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cc.Peer.Close()
+	})
+	return cc
+}
+
+// waitFor polls condition until it's true, or fails the test after 5 seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPipeTransportServerAndClients(t *testing.T) {
+	server := startTestServer(t, nil)
+	var clients []*ClientConnector
+	for i := 0; i < 3; i++ {
+		cc := server.dial(t, "user")
+		if !cc.Peer.HasCapability(CapabilityFraming) || !cc.Peer.IsSigning() {
+			t.Fatalf("client %v negotiated %v", i, cc.Peer.Capabilities())
+		}
+		res, err := cc.Peer.SendRequestForResponse(NewRequest("", "", "", "ECHO", []byte{byte(i)}))
+		if err != nil || len(res.Data) != 1 || res.Data[0] != byte(i) {
+			t.Fatalf("echo of client %v: %v, %v", i, res, err)
+		}
+		clients = append(clients, cc)
+	}
+	waitFor(t, "server to track clients", func() bool {
+		return len(server.ClientPeers()) == 3
+	})
+
+	// the server tells the client closed from the ones still connected
+	closed := clients[0]
+	closed.CloseConn(closed.Peer.Conn)
+	select {
+	case err := <-server.handler.errs:
+		if err != ErrorPeerSocketClosed {
+			t.Fatalf("server got %v when client closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server doesn't notice the closed client")
+	}
+	waitFor(t, "server to drop the closed client", func() bool {
+		return len(server.ClientPeers()) == 2
+	})
+	if _, err := clients[1].Peer.SendRequestForResponse(NewRequest("", "", "", "ECHO", nil)); err != nil {
+		t.Fatalf("other clients should stay connected: %v", err)
+	}
+
+	server.Listener.Close()
+	if _, err := server.transport.Dial(server.ServerListenAddr); err != ErrorConnectionRefused {
+		t.Fatalf("dial after listener closed: got %v", err)
+	}
+}
+
+func TestConnectionGoroutinesExit(t *testing.T) {
+	server := startTestServer(t, func(sc *ServerConnector) {
+		// HANG is never responded, its processor returns once the connection is closed
+		sc.Registry.Register("HANG", nil, func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+			<-peer.done
+		})
+	})
+	// warm up the goroutines that live as long as the process, such as the ones of the race detector
+	server.dial(t, "user").Peer.Close()
+	waitFor(t, "server to drop the warm up client", func() bool {
+		return len(server.ClientPeers()) == 0
+	})
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		cc := server.dial(t, "user")
+		if _, err := cc.Peer.SendRequestForResponse(NewRequest("", "", "", "ECHO", []byte("data"))); err != nil {
+			t.Fatal(err)
+		}
+		// requests waiting for response are released when the connection is closed
+		pending := make(chan error, 1)
+		go func() {
+			_, err := cc.Peer.SendRequestForResponse(NewRequest("", "", "", "HANG", nil))
+			pending <- err
+		}()
+		waitFor(t, "request to be pending", func() bool {
+			return cc.Peer.PendingRequests() == 1
+		})
+		if i%2 == 0 {
+			cc.Peer.Close()
+		} else {
+			// the server closes the connection
+			for _, peer := range server.ClientPeers() {
+				peer.Close()
+			}
+		}
+		select {
+		case err := <-pending:
+			if err == nil {
+				t.Fatal("pending request should fail when the connection is closed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("pending request isn't released when the connection is closed")
+		}
+		waitFor(t, "server to drop the client", func() bool {
+			return len(server.ClientPeers()) == 0
+		})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%v goroutines left after disconnecting, %v before:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenWithoutSigningKey(t *testing.T) {
+	server := startTestServer(t, func(sc *ServerConnector) {
+		sc.Signing = false
+		sc.SigningKeyFile = ""
+	})
+	cc := server.dial(t, "user")
+	if cc.Peer.IsSigning() || cc.Peer.HasCapability(CapabilitySigning) {
+		t.Fatal("server without signing key should not agree to sign")
+	}
+	if _, err := cc.Peer.SendRequestForResponse(NewRequest("", "", "", "ECHO", nil)); err != nil {
+		t.Fatalf("unsigned request: %v", err)
+	}
+
+	// enabling signing without a key file to keep the key is a misconfiguration
+	sc, err := NewServerConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Transport = NewPipeTransport()
+	sc.Signing = true
+	sc.SigningKeyFile = ""
+	if err := sc.Listen(newTestHandler(sc.Logger, sc.Registry)); err != ErrorMissingSigningKey {
+		t.Fatalf("signing without key file: got %v", err)
+	}
+}
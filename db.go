@@ -36,7 +36,7 @@ var (
 	}
 )
 
-// UserTable stores information about users
+// UserTable stores information about users, Password is the salted hash made by HashPassword
 type UserTable struct {
 	ID       int    `mysql:"id,pk,auto_increment"`
 	Username string `mysql:"username,unique"`
@@ -59,6 +59,19 @@ type FileRefTable struct {
 	Device string `mysql:"device,pk"`
 }
 
+// DeviceTable stores devices of users, DeviceID is generated by the client on first run,
+// LastSeen is the unix time that the device identified the last time, and identities from revoked devices are refused
+type DeviceTable struct {
+	ID            int    `mysql:"id,unique,auto_increment"`
+	UserID        int    `mysql:"user_id,pk,fk=user.id"`
+	DeviceID      string `mysql:"device_id,pk"`
+	Name          string `mysql:"name"`
+	LastSeen      int64  `mysql:"last_seen"`
+	ClientVersion string `mysql:"client_version"`
+	Address       string `mysql:"address"`
+	Revoked       bool   `mysql:"revoked"`
+}
+
 // DBConfig is the structure for DB configurations
 type DBConfig struct {
 	User     string
@@ -256,6 +269,10 @@ func createSchema(table interface{}) (string, error) {
 		switch fieldType.Kind() {
 		case reflect.Int:
 			stat += "INT "
+		case reflect.Int64:
+			stat += "BIGINT "
+		case reflect.Bool:
+			stat += "BOOLEAN "
 		case reflect.String:
 			stat += "VARCHAR(255) "
 		}
@@ -0,0 +1,266 @@
+package syncbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// constants for devices
+const (
+	DefaultDeviceFileName = ".syncbox/device"
+)
+
+// config variables for devices
+var (
+	DeviceFile = os.Getenv("SB_DEVICE_FILE")
+)
+
+// DeviceIdentity is the identity of the device that the client runs on, it's generated on first run and stored locally,
+// so that the device keeps its ID across restarts and network changes. Name is for users to tell their devices apart.
+type DeviceIdentity struct {
+	ID   string
+	Name string
+}
+
+func (identity *DeviceIdentity) String() string {
+	return ToString(identity)
+}
+
+// LoadDeviceIdentity reads the device identity from file, which defaults to DeviceFile or ~/.syncbox/device,
+// a new identity with a random ID is generated and stored if there's none.
+// The name defaults to the host name, and is replaced and stored if name is given.
+func LoadDeviceIdentity(file string, name string) (*DeviceIdentity, error) {
+	if file == "" {
+		file = DeviceFile
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, DefaultDeviceFileName)
+	}
+	identity := &DeviceIdentity{}
+	content, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(content, identity); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	changed := false
+	if identity.ID == "" {
+		identity.ID = UUID()
+		changed = true
+	}
+	if name != "" && name != identity.Name {
+		identity.Name = name
+		changed = true
+	}
+	if identity.Name == "" {
+		if identity.Name, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+	if !changed {
+		return identity, nil
+	}
+	content, err = json.Marshal(identity)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// DeviceInfo is a device of a user told by server, Online tells whether the device has a connected session
+type DeviceInfo struct {
+	ID            string
+	Name          string
+	LastSeen      time.Time
+	ClientVersion string
+	Address       string
+	Revoked       bool
+	Online        bool
+}
+
+func (info *DeviceInfo) String() string {
+	return ToString(info)
+}
+
+// DeviceListResponse is the Response data of TypeListDevices requests
+type DeviceListResponse struct {
+	Devices []*DeviceInfo
+}
+
+func (res *DeviceListResponse) String() string {
+	return ToString(res)
+}
+
+// RevokeDeviceRequest is the Request data of TypeRevokeDevice requests, Device is the ID of the device to revoke
+type RevokeDeviceRequest struct {
+	Device string
+}
+
+func (req *RevokeDeviceRequest) String() string {
+	return ToString(req)
+}
+
+// NewDeviceInfo returns the DeviceInfo of a device record
+func NewDeviceInfo(device *DeviceTable) *DeviceInfo {
+	return &DeviceInfo{
+		ID:            device.DeviceID,
+		Name:          device.Name,
+		LastSeen:      time.Unix(device.LastSeen, 0),
+		ClientVersion: device.ClientVersion,
+		Address:       device.Address,
+		Revoked:       device.Revoked,
+	}
+}
+
+// FindDevice returns the device of deviceID owned by user, or ErrorDeviceNotFound if there's none
+func FindDevice(db *DB, user *UserTable, deviceID string) (*DeviceTable, error) {
+	device := &DeviceTable{}
+	err := db.QueryRow("SELECT id, user_id, device_id, name, last_seen, client_version, address, revoked FROM device WHERE user_id=? AND device_id=?", user.ID, deviceID).
+		Scan(&device.ID, &device.UserID, &device.DeviceID, &device.Name, &device.LastSeen, &device.ClientVersion, &device.Address, &device.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, ErrorDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// RecordDevice records that the device of deviceID of user is seen from address, running the client of version,
+// the device is registered if it's new, and ErrorDeviceRevoked is returned if it's revoked
+func RecordDevice(db *DB, user *UserTable, deviceID string, name string, version string, address string) error {
+	device, err := FindDevice(db, user, deviceID)
+	switch {
+	case err == ErrorDeviceNotFound:
+		_, err = db.Exec("INSERT INTO device (user_id, device_id, name, last_seen, client_version, address, revoked) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			user.ID, deviceID, name, time.Now().Unix(), version, address, false)
+		return err
+	case err != nil:
+		return err
+	case device.Revoked:
+		return ErrorDeviceRevoked
+	}
+	if name == "" {
+		name = device.Name
+	}
+	_, err = db.Exec("UPDATE device SET name=?, last_seen=?, client_version=?, address=? WHERE id=?", name, time.Now().Unix(), version, address, device.ID)
+	return err
+}
+
+// ListDevices returns the devices of user, the most recently seen first
+func ListDevices(db *DB, user *UserTable) ([]*DeviceTable, error) {
+	rows, err := db.Query("SELECT id, user_id, device_id, name, last_seen, client_version, address, revoked FROM device WHERE user_id=? ORDER BY last_seen DESC", user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var devices []*DeviceTable
+	for rows.Next() {
+		device := &DeviceTable{}
+		if err := rows.Scan(&device.ID, &device.UserID, &device.DeviceID, &device.Name, &device.LastSeen, &device.ClientVersion, &device.Address, &device.Revoked); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// RevokeDevice revokes the device of deviceID of user, identities from the device are refused from now on
+func RevokeDevice(db *DB, user *UserTable, deviceID string) error {
+	if _, err := FindDevice(db, user, deviceID); err != nil {
+		return err
+	}
+	_, err := db.Exec("UPDATE device SET revoked=? WHERE user_id=? AND device_id=?", true, user.ID, deviceID)
+	return err
+}
+
+// AddressHost returns the host of addr without the port, or addr as it is if it has no port
+func AddressHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// SendListDevicesRequest asks peer for the devices of the user
+func (hub *Hub) SendListDevicesRequest(username string, password string, device string) ([]*DeviceInfo, error) {
+	var devices []*DeviceInfo
+	_, err := operationTimeout(func(ctx context.Context) (*Response, error) {
+		var err error
+		devices, err = hub.SendListDevicesRequestContext(ctx, username, password, device)
+		return nil, err
+	})
+	return devices, err
+}
+
+// SendListDevicesRequestContext is SendListDevicesRequest with ctx to cancel or set deadline for waiting the response
+func (hub *Hub) SendListDevicesRequestContext(ctx context.Context, username string, password string, device string) ([]*DeviceInfo, error) {
+	req := NewRequest(username, password, device, TypeListDevices, nil)
+	hub.LogDebug("SendListDevicesRequest called, request id: %v\n", req.ID)
+
+	res, err := hub.SendRequestForResponseContext(ctx, req)
+	if err != nil {
+		hub.LogDebug("error on SendRequestForResponse in SendListDevicesRequest: %v\n", err)
+		return nil, err
+	}
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	dRes := &DeviceListResponse{}
+	if err := res.Decode(dRes); err != nil {
+		hub.LogDebug("error on Unmarshal in SendListDevicesRequest: %v\n", err)
+		return nil, err
+	}
+	return dRes.Devices, nil
+}
+
+// SendRevokeDeviceRequest asks peer to revoke the device of target, and drop its sessions
+func (hub *Hub) SendRevokeDeviceRequest(username string, password string, device string, target string) (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendRevokeDeviceRequestContext(ctx, username, password, device, target)
+	})
+}
+
+// SendRevokeDeviceRequestContext is SendRevokeDeviceRequest with ctx to cancel or set deadline for waiting the response
+func (hub *Hub) SendRevokeDeviceRequestContext(ctx context.Context, username string, password string, device string, target string) (*Response, error) {
+	rReqData, err := hub.Marshal(&RevokeDeviceRequest{
+		Device: target,
+	})
+	if err != nil {
+		hub.LogDebug("error on Marshal in SendRevokeDeviceRequest: %v\n", err)
+		return nil, err
+	}
+	req := NewRequest(username, password, device, TypeRevokeDevice, rReqData)
+	hub.LogDebug("SendRevokeDeviceRequest called, request id: %v, device: %v\n", req.ID, target)
+
+	res, err := hub.SendRequestForResponseContext(ctx, req)
+	if err != nil {
+		hub.LogDebug("error on SendRequestForResponse in SendRevokeDeviceRequest: %v\n", err)
+		return nil, err
+	}
+	return res, res.Err()
+}
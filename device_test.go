@@ -0,0 +1,242 @@
+package syncbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// deviceDriver is a database/sql driver keeping the device table in memory, it understands the queries of device.go only
+type deviceDriver struct {
+	mutex  sync.Mutex
+	tables map[string]*[]*DeviceTable
+}
+
+var devices = &deviceDriver{tables: make(map[string]*[]*DeviceTable)}
+
+func init() {
+	sql.Register("syncbox-devices", devices)
+}
+
+// newDeviceDB returns a DB of an empty device table
+func newDeviceDB(t *testing.T) *DB {
+	t.Helper()
+	conn, err := sql.Open("syncbox-devices", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices.mutex.Lock()
+	devices.tables[t.Name()] = &[]*DeviceTable{}
+	devices.mutex.Unlock()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return &DB{Logger: NewDefaultLogger(), DB: conn}
+}
+
+func (d *deviceDriver) Open(name string) (driver.Conn, error) {
+	return &deviceConn{name: name}, nil
+}
+
+type deviceConn struct {
+	name string
+}
+
+func (conn *deviceConn) Prepare(query string) (driver.Stmt, error) {
+	return &deviceStmt{conn: conn, query: query}, nil
+}
+
+func (conn *deviceConn) Close() error {
+	return nil
+}
+
+func (conn *deviceConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type deviceStmt struct {
+	conn  *deviceConn
+	query string
+}
+
+func (stmt *deviceStmt) Close() error {
+	return nil
+}
+
+func (stmt *deviceStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *deviceStmt) Exec(args []driver.Value) (driver.Result, error) {
+	devices.mutex.Lock()
+	defer devices.mutex.Unlock()
+	table := devices.tables[stmt.conn.name]
+	switch {
+	case strings.HasPrefix(stmt.query, "INSERT INTO device"):
+		*table = append(*table, &DeviceTable{
+			ID: len(*table) + 1, UserID: int(args[0].(int64)), DeviceID: args[1].(string), Name: args[2].(string),
+			LastSeen: args[3].(int64), ClientVersion: args[4].(string), Address: args[5].(string), Revoked: args[6].(bool),
+		})
+	case strings.HasPrefix(stmt.query, "UPDATE device SET name="):
+		for _, device := range *table {
+			if int64(device.ID) == args[4].(int64) {
+				device.Name, device.LastSeen, device.ClientVersion, device.Address = args[0].(string), args[1].(int64), args[2].(string), args[3].(string)
+			}
+		}
+	case strings.HasPrefix(stmt.query, "UPDATE device SET revoked="):
+		for _, device := range *table {
+			if int64(device.UserID) == args[1].(int64) && device.DeviceID == args[2].(string) {
+				device.Revoked = args[0].(bool)
+			}
+		}
+	default:
+		return nil, errors.New("unknown statement: " + stmt.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *deviceStmt) Query(args []driver.Value) (driver.Rows, error) {
+	devices.mutex.Lock()
+	defer devices.mutex.Unlock()
+	rows := &deviceRows{}
+	for _, device := range *devices.tables[stmt.conn.name] {
+		if int64(device.UserID) != args[0].(int64) || (len(args) > 1 && device.DeviceID != args[1].(string)) {
+			continue
+		}
+		copied := *device
+		rows.devices = append(rows.devices, &copied)
+	}
+	return rows, nil
+}
+
+type deviceRows struct {
+	devices []*DeviceTable
+}
+
+func (rows *deviceRows) Columns() []string {
+	return []string{"id", "user_id", "device_id", "name", "last_seen", "client_version", "address", "revoked"}
+}
+
+func (rows *deviceRows) Close() error {
+	return nil
+}
+
+func (rows *deviceRows) Next(dest []driver.Value) error {
+	if len(rows.devices) == 0 {
+		return io.EOF
+	}
+	device := rows.devices[0]
+	rows.devices = rows.devices[1:]
+	values := []driver.Value{int64(device.ID), int64(device.UserID), device.DeviceID, device.Name, device.LastSeen, device.ClientVersion, device.Address, device.Revoked}
+	copy(dest, values)
+	return nil
+}
+
+func TestLoadDeviceIdentity(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dir", "device")
+	identity, err := LoadDeviceIdentity(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if identity.ID == "" || identity.Name != hostname {
+		t.Fatalf("generated identity: %v", identity)
+	}
+	reloaded, err := LoadDeviceIdentity(file, "")
+	if err != nil || *reloaded != *identity {
+		t.Fatalf("identity should persist across reloads: %v, %v", reloaded, err)
+	}
+	renamed, err := LoadDeviceIdentity(file, "laptop")
+	if err != nil || renamed.ID != identity.ID || renamed.Name != "laptop" {
+		t.Fatalf("renamed identity: %v, %v", renamed, err)
+	}
+	if reloaded, err := LoadDeviceIdentity(file, ""); err != nil || *reloaded != *renamed {
+		t.Fatalf("name should persist across reloads: %v, %v", reloaded, err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("device file: %v, %v", info, err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDeviceIdentity(file, ""); err == nil {
+		t.Fatal("corrupted device file should not be replaced silently")
+	}
+}
+
+func TestRecordRevokedDevice(t *testing.T) {
+	db := newDeviceDB(t)
+	user, other := &UserTable{ID: 1}, &UserTable{ID: 2}
+	if err := RecordDevice(db, user, "laptop", "Laptop", "v1", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordDevice(db, user, "laptop", "", "v2", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	device, err := FindDevice(db, user, "laptop")
+	if err != nil || device.Name != "Laptop" || device.ClientVersion != "v2" || device.Address != "10.0.0.2" {
+		t.Fatalf("recorded device: %+v, %v", device, err)
+	}
+	if _, err := FindDevice(db, other, "laptop"); err != ErrorDeviceNotFound {
+		t.Fatalf("device of other user: got %v", err)
+	}
+
+	if err := RevokeDevice(db, other, "laptop"); err != ErrorDeviceNotFound {
+		t.Fatalf("revoking device of other user: got %v", err)
+	}
+	if err := RevokeDevice(db, user, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	// the identity of the revoked device is refused as an authentication failure
+	err = RecordDevice(db, user, "laptop", "Laptop", "v2", "10.0.0.2")
+	if err != ErrorDeviceRevoked || ErrorCode(err) != CodeAuthFailed {
+		t.Fatalf("identity of revoked device: got %v", err)
+	}
+	listed, err := ListDevices(db, user)
+	if err != nil || len(listed) != 1 || !NewDeviceInfo(listed[0]).Revoked {
+		t.Fatalf("listed devices: %v, %v", listed, err)
+	}
+	if err := RecordDevice(db, user, "phone", "Phone", "v2", "10.0.0.3"); err != nil {
+		t.Fatalf("other devices of the user should be accepted: %v", err)
+	}
+}
+
+func TestDropDeviceSessions(t *testing.T) {
+	server := startTestServer(t, func(sc *ServerConnector) {
+		sc.Registry.Register(TypeIdentity, IdentityRequest{}, processSessionIdentity(sc))
+	})
+	laptop := server.dial(t, "user")
+	phone := server.dialOnly(t)
+	if _, err := phone.Peer.SendIdentityRequest("user", "password", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if online := server.OnlineDevices("user"); !online["device"] || !online["phone"] {
+		t.Fatalf("online devices: %v", online)
+	}
+
+	if dropped := server.DropDeviceSessions("user", "device"); dropped != 1 {
+		t.Fatalf("%v sessions dropped, want 1", dropped)
+	}
+	waitFor(t, "connection of the dropped session to close", func() bool {
+		return laptop.Peer.Err() != nil
+	})
+	if online := server.OnlineDevices("user"); online["device"] || !online["phone"] {
+		t.Fatalf("online devices after drop: %v", online)
+	}
+	res, err := phone.Peer.SendRequestForResponseContext(context.Background(), NewRequest("", "", "", "ECHO", []byte("echo")))
+	if err != nil || string(res.Data) != "echo" {
+		t.Fatalf("other device should stay connected: %v, %v", res, err)
+	}
+	if dropped := server.DropDeviceSessions("user", "device"); dropped != 0 {
+		t.Fatalf("%v sessions dropped again", dropped)
+	}
+}
@@ -0,0 +1,191 @@
+package syncbox
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// constants for error codes, they are carried by error responses to tell peer why a request fails
+const (
+	CodeAuthFailed         = "AUTH-FAILED"
+	CodeNotFound           = "NOT-FOUND"
+	CodeQuotaExceeded      = "QUOTA-EXCEEDED"
+	CodeStorageUnavailable = "STORAGE-UNAVAILABLE"
+	CodeRateLimited        = "RATE-LIMITED"
+	CodeConflict           = "CONFLICT"
+	CodeBadRequest         = "BAD-REQUEST"
+	CodeInternal           = "INTERNAL"
+)
+
+// codeStatuses maps error codes to the statuses of error responses
+var codeStatuses = map[string]int{
+	CodeAuthFailed:         StatusUnauthorized,
+	CodeNotFound:           StatusNotFound,
+	CodeQuotaExceeded:      StatusQuotaExceeded,
+	CodeStorageUnavailable: StatusUnavailable,
+	CodeRateLimited:        StatusRateLimited,
+	CodeConflict:           StatusConflict,
+	CodeBadRequest:         StatusBad,
+	CodeInternal:           StatusInternal,
+}
+
+// statusCodes maps the statuses of error responses back to error codes, for peers that don't tell the code
+var statusCodes = map[int]string{
+	StatusUnauthorized:  CodeAuthFailed,
+	StatusNotFound:      CodeNotFound,
+	StatusQuotaExceeded: CodeQuotaExceeded,
+	StatusUnavailable:   CodeStorageUnavailable,
+	StatusRateLimited:   CodeRateLimited,
+	StatusConflict:      CodeConflict,
+	StatusBad:           CodeBadRequest,
+	StatusInternal:      CodeInternal,
+}
+
+// ErrorResponse is the Response data of a failed request
+type ErrorResponse struct {
+	Code   string
+	Reason string
+}
+
+func (res *ErrorResponse) String() string {
+	return ToString(res)
+}
+
+// CodedError is an error with the error code to tell peer, it's sent as an error response by SendErrorResponse,
+// and returned by Response.Err on the requesting side
+type CodedError struct {
+	Code   string
+	Reason string
+	err    error
+}
+
+// NewCodedError instantiates a CodedError of code caused by err
+func NewCodedError(code string, err error) *CodedError {
+	return &CodedError{
+		Code:   code,
+		Reason: err.Error(),
+		err:    err,
+	}
+}
+
+func (e *CodedError) Error() string {
+	return e.Code + ": " + e.Reason
+}
+
+// Unwrap returns the local error that causes the CodedError, it's nil for most errors told by peer
+func (e *CodedError) Unwrap() error {
+	return e.err
+}
+
+// Transient examines whether the failure is temporary, so the request could succeed if retried later
+func (e *CodedError) Transient() bool {
+	return e.Code == CodeStorageUnavailable || e.Code == CodeRateLimited
+}
+
+// StorageError classifies an error of StorageBackend, missing objects are CodeNotFound,
+// and other failures are CodeStorageUnavailable
+func StorageError(err error) *CodedError {
+	if IsNoSuchKey(err) || err == ErrorNoSuchBucket {
+		return NewCodedError(CodeNotFound, err)
+	}
+	return NewCodedError(CodeStorageUnavailable, err)
+}
+
+// ErrorCode returns the error code of err, errors without a code are classified by their kinds,
+// and the unknown ones are CodeInternal
+func ErrorCode(err error) string {
+	var codedErr *CodedError
+	if errors.As(err, &codedErr) {
+		return codedErr.Code
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case IsNoSuchKey(err), err == ErrorNoSuchBucket, os.IsNotExist(err), err == ErrorDeviceNotFound:
+		return CodeNotFound
+	case err == ErrorRateLimited, err == ErrorTooManyTransfers:
+		return CodeRateLimited
+	case err == ErrorAuthFailed, err == ErrorNotAuthenticated, err == ErrorTokenExpired, err == ErrorDeviceRevoked:
+		return CodeAuthFailed
+	case err == ErrorUserExists, err == ErrorTransferExists:
+		return CodeConflict
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr),
+		err == ErrorCodecMalformed, err == ErrorCodecUnsupportedType, err == ErrorUnknownRequestType, err == ErrorUnknownAction,
+		err == ErrorInvalidUsername, err == ErrorPasswordTooShort, err == ErrorRegistrationDisabled,
+		err == ErrorTransferNotFound, err == ErrorTransferAborted, err == ErrorChunkOffset, err == ErrorChecksumMismatch,
+		err == ErrorMalformedChunk, err == ErrorBadSignature, err == ErrorStaleMessage, err == ErrorReplayedNonce:
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
+
+// IsPermanent examines whether err is a failure that peer reports as permanent,
+// such requests are not worth retrying, unlike transient error codes and broken connections
+func IsPermanent(err error) bool {
+	var codedErr *CodedError
+	return errors.As(err, &codedErr) && !codedErr.Transient()
+}
+
+// NewErrorResponse instantiates the error response of err, encoded by codec
+func NewErrorResponse(codec Codec, err error) (*Response, error) {
+	code := ErrorCode(err)
+	reason := err.Error()
+	var codedErr *CodedError
+	if errors.As(err, &codedErr) {
+		reason = codedErr.Reason
+	}
+	data, marshalErr := codec.Marshal(&ErrorResponse{
+		Code:   code,
+		Reason: reason,
+	})
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	return &Response{
+		Status:  codeStatuses[code],
+		Message: MessageDeny,
+		Data:    data,
+	}, nil
+}
+
+// SendErrorResponse responds req with the error response of err
+func (hub *Hub) SendErrorResponse(req *Request, err error) error {
+	res, marshalErr := NewErrorResponse(hub.Codec(), err)
+	if marshalErr != nil {
+		hub.LogDebug("error on Marshal in SendErrorResponse: %v\n", marshalErr)
+		return marshalErr
+	}
+	hub.LogDebug("sending error response, request id: %v, error: %v\n", req.ID, err)
+	return hub.SendResponse(req, res)
+}
+
+// Err returns nil if the response is successful, otherwise it returns the CodedError that peer tells,
+// responses of peers that don't tell the code are classified by status, see statusCodes
+func (res *Response) Err() error {
+	if res.Status == StatusOK {
+		return nil
+	}
+	return res.codedError(nil)
+}
+
+// codedError returns the CodedError of a failed response, cause is the local error it's unwrapped to
+func (res *Response) codedError(cause error) *CodedError {
+	eRes := &ErrorResponse{}
+	if len(res.Data) > 0 && res.Decode(eRes) == nil && eRes.Code != "" {
+		return &CodedError{
+			Code:   eRes.Code,
+			Reason: eRes.Reason,
+			err:    cause,
+		}
+	}
+	code, exists := statusCodes[res.Status]
+	if !exists {
+		code = CodeBadRequest
+	}
+	return &CodedError{
+		Code:   code,
+		Reason: res.Message,
+		err:    cause,
+	}
+}
@@ -0,0 +1,139 @@
+package syncbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	var syntaxErr error = &json.SyntaxError{}
+	cases := []struct {
+		err  error
+		code string
+	}{
+		{NewCodedError(CodeQuotaExceeded, errors.New("quota")), CodeQuotaExceeded},
+		{fmt.Errorf("wrapped: %w", NewCodedError(CodeConflict, errors.New("conflict"))), CodeConflict},
+		{ErrorNoSuchKey, CodeNotFound},
+		{ErrorNoSuchBucket, CodeNotFound},
+		{&os.PathError{Op: "open", Path: "a", Err: os.ErrNotExist}, CodeNotFound},
+		{ErrorDeviceNotFound, CodeNotFound},
+		{ErrorRateLimited, CodeRateLimited},
+		{ErrorTooManyTransfers, CodeRateLimited},
+		{ErrorAuthFailed, CodeAuthFailed},
+		{ErrorDeviceRevoked, CodeAuthFailed},
+		{ErrorUserExists, CodeConflict},
+		{ErrorTransferExists, CodeConflict},
+		{syntaxErr, CodeBadRequest},
+		{ErrorUnknownRequestType, CodeBadRequest},
+		{ErrorChecksumMismatch, CodeBadRequest},
+		{errors.New("unknown"), CodeInternal},
+	}
+	for _, c := range cases {
+		if code := ErrorCode(c.err); code != c.code {
+			t.Errorf("%v: got %v, want %v", c.err, code, c.code)
+		}
+	}
+	if code := StorageError(ErrorNoSuchKey).Code; code != CodeNotFound {
+		t.Fatalf("missing object: got %v", code)
+	}
+	if code := StorageError(errors.New("timeout")).Code; code != CodeStorageUnavailable {
+		t.Fatalf("storage failure: got %v", code)
+	}
+}
+
+func TestResponseCodedError(t *testing.T) {
+	if err := (&Response{Status: StatusOK}).Err(); err != nil {
+		t.Fatalf("successful response: got %v", err)
+	}
+	cause := NewCodedError(CodeQuotaExceeded, errors.New("quota of user exceeded"))
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		res, err := NewErrorResponse(codec, cause)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var codedErr *CodedError
+		if !errors.As(res.Err(), &codedErr) || codedErr.Code != CodeQuotaExceeded || codedErr.Reason != "quota of user exceeded" {
+			t.Fatalf("%v: got %v", codec.Name(), res.Err())
+		}
+		if res.Status != StatusQuotaExceeded {
+			t.Fatalf("%v: status %v", codec.Name(), res.Status)
+		}
+	}
+
+	// peers that don't tell the code are classified by status
+	for code, status := range codeStatuses {
+		if statusCodes[status] != code {
+			t.Fatalf("status %v of %v maps back to %v", status, code, statusCodes[status])
+		}
+		for i := 0; i < 10; i++ {
+			if actual := ErrorCode((&Response{Status: status, Message: MessageDeny}).Err()); actual != code {
+				t.Fatalf("response of status %v: got %v, want %v", status, actual, code)
+			}
+		}
+	}
+	if code := ErrorCode((&Response{Status: 418}).Err()); code != CodeBadRequest {
+		t.Fatalf("unknown status: got %v", code)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	cases := []struct {
+		err       error
+		permanent bool
+	}{
+		{nil, false},
+		{ErrorHubClosed, false},
+		{ErrorTimeout, false},
+		{NewCodedError(CodeStorageUnavailable, errors.New("unavailable")), false},
+		{NewCodedError(CodeRateLimited, ErrorRateLimited), false},
+		{NewCodedError(CodeAuthFailed, ErrorAuthFailed), true},
+		{NewCodedError(CodeNotFound, ErrorNoSuchKey), true},
+		{NewCodedError(CodeInternal, errors.New("internal")), true},
+		{fmt.Errorf("wrapped: %w", NewCodedError(CodeBadRequest, ErrorMalformedChunk)), true},
+	}
+	for _, c := range cases {
+		if permanent := IsPermanent(c.err); permanent != c.permanent {
+			t.Errorf("%v: permanent %v, want %v", c.err, permanent, c.permanent)
+		}
+	}
+}
+
+func TestSendWithRetryContext(t *testing.T) {
+	handler := newTestHandler(NewDefaultLogger(), NewRegistry())
+	calls := 0
+	err := SendWithRetryContext(context.Background(), handler, func() error {
+		calls++
+		if calls == 1 {
+			return NewCodedError(CodeStorageUnavailable, errors.New("unavailable"))
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("transient failure should be retried: %v calls, %v", calls, err)
+	}
+
+	calls = 0
+	denied := NewCodedError(CodeAuthFailed, ErrorAuthFailed)
+	err = SendWithRetryContext(context.Background(), handler, func() error {
+		calls++
+		return denied
+	})
+	if err != denied || calls != 1 {
+		t.Fatalf("permanent failure should not be retried: %v calls, %v", calls, err)
+	}
+
+	calls = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	err = SendWithRetryContext(ctx, handler, func() error {
+		calls++
+		cancel()
+		return ErrorHubClosed
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Fatalf("retrying with done context: %v calls, %v", calls, err)
+	}
+}
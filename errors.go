@@ -4,11 +4,69 @@ import "errors"
 
 // custom errors for this application
 var (
-	ErrorEmptyContent       = errors.New("empty content")
-	ErrorUnknownRequestType = errors.New("unknown request type")
-	ErrorPeerSocketClosed   = errors.New("peer socket closed")
-	ErrorExceedsAddrLength  = errors.New("exceeds address length")
-	ErrorNoFileRecords      = errors.New("no file records found")
-	ErrorTimeout            = errors.New("operation timeout")
-	ErrorRequestNotFound    = errors.New("request not found")
+	ErrorEmptyContent           = errors.New("empty content")
+	ErrorUnknownRequestType     = errors.New("unknown request type")
+	ErrorPeerSocketClosed       = errors.New("peer socket closed")
+	ErrorExceedsAddrLength      = errors.New("exceeds address length")
+	ErrorNoFileRecords          = errors.New("no file records found")
+	ErrorTimeout                = errors.New("operation timeout")
+	ErrorRequestNotFound        = errors.New("request not found")
+	ErrorNoSuchKey              = errors.New("NoSuchKey: The specified key does not exist.")
+	ErrorNoSuchBucket           = errors.New("NoSuchBucket: The specified bucket does not exist.")
+	ErrorInvalidBucketName      = errors.New("invalid bucket name")
+	ErrorTransferAborted        = errors.New("transfer aborted")
+	ErrorTransferNotFound       = errors.New("transfer not found")
+	ErrorTransferExists         = errors.New("transfer already exists")
+	ErrorTransferRejected       = errors.New("transfer rejected by peer")
+	ErrorChunkOffset            = errors.New("chunk offset mismatch")
+	ErrorChecksumMismatch       = errors.New("checksum mismatch")
+	ErrorMalformedChunk         = errors.New("malformed file chunk")
+	ErrorTooManyTransfers       = errors.New("too many transfers")
+	ErrorMalformedFrame         = errors.New("malformed frame")
+	ErrorFrameTooLarge          = errors.New("frame exceeds maximum frame size")
+	ErrorIdentityDenied         = errors.New("identity denied")
+	ErrorProtocolTooOld         = errors.New("protocol version too old")
+	ErrorInvalidCertificate     = errors.New("invalid certificate")
+	ErrorMissingCertificate     = errors.New("certificate and key files are required")
+	ErrorMissingClientCA        = errors.New("CA file is required to verify client certificates")
+	ErrorMissingPinFile         = errors.New("pin file is required to bootstrap TLS")
+	ErrorFingerprintMismatch    = errors.New("server certificate fingerprint mismatch")
+	ErrorListenerClosed         = errors.New("listener closed")
+	ErrorAddressInUse           = errors.New("address already in use")
+	ErrorConnectionRefused      = errors.New("connection refused")
+	ErrorHubClosed              = errors.New("hub closed")
+	ErrorPeerDead               = errors.New("peer missed heartbeats")
+	ErrorUnknownCompression     = errors.New("unknown compression algorithm")
+	ErrorCodecUnsupportedType   = errors.New("type not supported by codec")
+	ErrorMalformedPacket        = errors.New("malformed packet")
+	ErrorFrameChecksum          = errors.New("frame checksum mismatch")
+	ErrorMessageDigest          = errors.New("message digest mismatch")
+	ErrorMessageTooLarge        = errors.New("message exceeds maximum message size")
+	ErrorTooManyPartialMessages = errors.New("too many partial messages")
+	ErrorBufferLimit            = errors.New("buffered bytes exceed limit")
+	ErrorCodecMalformed         = errors.New("malformed encoded data")
+	ErrorUnknownAction          = errors.New("unknown sync action")
+	ErrorProcessorPanic         = errors.New("panic in request processor")
+	ErrorRateLimited            = errors.New("request rate exceeds limit")
+	ErrorAuthFailed             = errors.New("invalid username or password")
+	ErrorNotAuthenticated       = errors.New("connection not authenticated")
+	ErrorUserNotFound           = errors.New("user not found")
+	ErrorUserExists             = errors.New("user already exists")
+	ErrorInvalidUsername        = errors.New("invalid username")
+	ErrorPasswordTooShort       = errors.New("password too short")
+	ErrorPasswordRequired       = errors.New("password or token is required")
+	ErrorTokenExpired           = errors.New("session token expired")
+	ErrorDeviceNotFound         = errors.New("device not found")
+	ErrorDeviceRevoked          = errors.New("device revoked")
+	ErrorInvalidAuthConfig      = errors.New("invalid authenticator configuration")
+	ErrorRegistrationDisabled   = errors.New("registration is disabled, accounts are created on first login")
+	ErrorMalformedLDAPMessage   = errors.New("malformed LDAP message")
+	ErrorBadSigningKey          = errors.New("bad signing key")
+	ErrorBadSignature           = errors.New("bad message signature")
+	ErrorStaleMessage           = errors.New("message timestamp out of signing window")
+	ErrorReplayedNonce          = errors.New("message nonce reused")
+	ErrorSigningRequired        = errors.New("message signing is required")
+	ErrorMissingSigningKey      = errors.New("signing key file of server is required")
+	ErrorMissingSigningPinFile  = errors.New("pin file is required to verify signing keys of servers")
+	ErrorSigningKeyMismatch     = errors.New("server signing key fingerprint mismatch")
 )
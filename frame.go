@@ -0,0 +1,185 @@
+package syncbox
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// constants for the length-prefixed framing
+const (
+	// FrameMagic starts every frame, legacy packets start with the hex characters of message ID,
+	// so the receiver could tell frames and packets apart by the first byte
+	FrameMagic = byte(0xFB)
+
+	FrameLengthSize   = 4
+	FrameHeaderSize   = 1 + 1 + FrameLengthSize + PacketIDSIze + PacketAddrSize + PacketAddrSize
+	FrameChecksumSize = 4
+
+	DefaultMaxFrameSize = 64 * 1024
+	MinFrameSize        = 512
+
+	// frame flags, all frames of a message carry the same flags,
+	// the compression flags tell the algorithm that the message is compressed with
+	FrameFlagDeflate         = byte(0x01)
+	FrameFlagGzip            = byte(0x02)
+	FrameFlagCompressionMask = FrameFlagDeflate | FrameFlagGzip
+
+	// FrameFlagChecksum tells the frame ends with the CRC32C of all its preceding bytes,
+	// FrameFlagMessageDigest tells the frame carries the CRC32C of its whole message before the checksum,
+	// it's set on the final frame of a message
+	FrameFlagChecksum      = byte(0x04)
+	FrameFlagMessageDigest = byte(0x08)
+	frameFlagsKnown        = FrameFlagCompressionMask | FrameFlagChecksum | FrameFlagMessageDigest
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum32 returns the CRC32C of data, which is used to check integrity of frames and messages
+func Checksum32(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+// Frame is a variable length message fragment of the protocol version ProtocolVersionFraming,
+// it carries the length of its payload and the total size of the message it belongs to,
+// so no padding is needed and payloads are delivered byte-exact.
+// MessageDigest is only carried if Flags has FrameFlagMessageDigest.
+type Frame struct {
+	Flags         byte
+	MessageID     [PacketIDSIze]byte
+	MessageSize   int64
+	Offset        int64
+	Payload       []byte
+	MessageDigest uint32
+}
+
+func (frame *Frame) String() string {
+	return ToString(frame)
+}
+
+// ToBytes transfer a Frame to bytes to be written to the connection, the header is followed by the payload,
+// then the message digest and the checksum if the flags tell so
+func (frame *Frame) ToBytes() []byte {
+	size := FrameHeaderSize + len(frame.Payload)
+	if frame.Flags&FrameFlagMessageDigest != 0 {
+		size += FrameChecksumSize
+	}
+	if frame.Flags&FrameFlagChecksum != 0 {
+		size += FrameChecksumSize
+	}
+	data := make([]byte, size)
+	offset := 0
+	data[offset] = FrameMagic
+	offset++
+	data[offset] = frame.Flags
+	offset++
+	binary.LittleEndian.PutUint32(data[offset:offset+FrameLengthSize], uint32(len(frame.Payload)))
+	offset += FrameLengthSize
+	copy(data[offset:offset+PacketIDSIze], frame.MessageID[:])
+	offset += PacketIDSIze
+	binary.LittleEndian.PutUint64(data[offset:offset+PacketAddrSize], uint64(frame.MessageSize))
+	offset += PacketAddrSize
+	binary.LittleEndian.PutUint64(data[offset:offset+PacketAddrSize], uint64(frame.Offset))
+	offset += PacketAddrSize
+	copy(data[offset:], frame.Payload)
+	offset += len(frame.Payload)
+	if frame.Flags&FrameFlagMessageDigest != 0 {
+		binary.LittleEndian.PutUint32(data[offset:offset+FrameChecksumSize], frame.MessageDigest)
+		offset += FrameChecksumSize
+	}
+	if frame.Flags&FrameFlagChecksum != 0 {
+		binary.LittleEndian.PutUint32(data[offset:offset+FrameChecksumSize], Checksum32(data[:offset]))
+	}
+	return data
+}
+
+// ReadFrame reads a full frame from reader, frames with payload larger than maxFrameSize are rejected with ErrorFrameTooLarge,
+// and the ones with unknown flags, or that don't fit in their message, are rejected with ErrorMalformedFrame.
+// Frames carrying a checksum are verified, ErrorFrameChecksum is returned if it mismatches.
+func ReadFrame(reader io.Reader, maxFrameSize int) (*Frame, error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != FrameMagic {
+		return nil, ErrorMalformedFrame
+	}
+	frame := &Frame{}
+	offset := 1
+	frame.Flags = header[offset]
+	offset++
+	length := binary.LittleEndian.Uint32(header[offset : offset+FrameLengthSize])
+	offset += FrameLengthSize
+	copy(frame.MessageID[:], header[offset:offset+PacketIDSIze])
+	offset += PacketIDSIze
+	frame.MessageSize = int64(binary.LittleEndian.Uint64(header[offset : offset+PacketAddrSize]))
+	offset += PacketAddrSize
+	frame.Offset = int64(binary.LittleEndian.Uint64(header[offset : offset+PacketAddrSize]))
+
+	if int64(length) > int64(maxFrameSize) {
+		return nil, ErrorFrameTooLarge
+	}
+	if frame.Flags&^frameFlagsKnown != 0 {
+		return nil, ErrorMalformedFrame
+	}
+	// compared without addition, which may overflow
+	if frame.MessageSize < 0 || frame.Offset < 0 || frame.Offset > frame.MessageSize || int64(length) > frame.MessageSize-frame.Offset {
+		return nil, ErrorMalformedFrame
+	}
+	frame.Payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, frame.Payload); err != nil {
+		return nil, err
+	}
+	var trailer [FrameChecksumSize]byte
+	if frame.Flags&FrameFlagMessageDigest != 0 {
+		if _, err := io.ReadFull(reader, trailer[:]); err != nil {
+			return nil, err
+		}
+		frame.MessageDigest = binary.LittleEndian.Uint32(trailer[:])
+	}
+	if frame.Flags&FrameFlagChecksum != 0 {
+		checksum := crc32.Update(0, castagnoliTable, header)
+		checksum = crc32.Update(checksum, castagnoliTable, frame.Payload)
+		if frame.Flags&FrameFlagMessageDigest != 0 {
+			checksum = crc32.Update(checksum, castagnoliTable, trailer[:])
+		}
+		if _, err := io.ReadFull(reader, trailer[:]); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(trailer[:]) != checksum {
+			return nil, ErrorFrameChecksum
+		}
+	}
+	return frame, nil
+}
+
+// SerializeFrames transfer some data (a request/response) to series of frames,
+// each carries at most maxFrameSize bytes of data and the flags of the message.
+// If flags has FrameFlagChecksum, the final frame also carries the digest of data.
+func SerializeFrames(data []byte, maxFrameSize int, flags byte) []*Frame {
+	var messageID [PacketIDSIze]byte
+	copy(messageID[:], []byte(UUID()))
+	size := int64(len(data))
+	var frames []*Frame
+	var offset int64
+	for offset < size || (size == 0 && len(frames) == 0) {
+		end := offset + int64(maxFrameSize)
+		if end > size {
+			end = size
+		}
+		frames = append(frames, &Frame{
+			Flags:       flags,
+			MessageID:   messageID,
+			MessageSize: size,
+			Offset:      offset,
+			Payload:     data[offset:end],
+		})
+		offset = end
+	}
+	if flags&FrameFlagChecksum != 0 {
+		final := frames[len(frames)-1]
+		final.Flags |= FrameFlagMessageDigest
+		final.MessageDigest = Checksum32(data)
+	}
+	return frames
+}
@@ -0,0 +1,180 @@
+package syncbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// frameHeader returns the header of a frame with the fields given as they are, so that invalid values could be encoded
+func frameHeader(flags byte, length uint32, messageSize uint64, offset uint64) []byte {
+	header := make([]byte, FrameHeaderSize)
+	header[0] = FrameMagic
+	header[1] = flags
+	binary.LittleEndian.PutUint32(header[2:], length)
+	binary.LittleEndian.PutUint64(header[2+FrameLengthSize+PacketIDSIze:], messageSize)
+	binary.LittleEndian.PutUint64(header[2+FrameLengthSize+PacketIDSIze+PacketAddrSize:], offset)
+	return header
+}
+
+// receiveRaw feeds raw to a hub as the bytes sent by peer, and returns the error that ends ReceivePackets
+func receiveRaw(t *testing.T, raw []byte) error {
+	local, remote := net.Pipe()
+	hub := NewHub(local, func(error) {})
+	defer hub.Close()
+	go func() {
+		remote.Write(raw)
+		remote.Close()
+	}()
+	go func() {
+		// connectors close the hub once ReceiveMessage fails, which unblocks ReceivePackets
+		if err := hub.ReceiveMessage(); err != nil {
+			hub.Close()
+		}
+	}()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- hub.ReceivePackets()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("ReceivePackets doesn't return")
+		return nil
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("syncbox"), 1000)
+	for _, flags := range []byte{0, FrameFlagChecksum} {
+		var buf bytes.Buffer
+		for _, frame := range SerializeFrames(data, 1000, flags) {
+			buf.Write(frame.ToBytes())
+		}
+		var restored []byte
+		for {
+			frame, err := ReadFrame(&buf, 1000)
+			if err != nil {
+				break
+			}
+			if frame.Flags&FrameFlagMessageDigest != 0 && frame.MessageDigest != Checksum32(data) {
+				t.Fatalf("digest mismatch with flags %x", flags)
+			}
+			restored = append(restored, frame.Payload...)
+		}
+		if !bytes.Equal(restored, data) {
+			t.Fatalf("restored %v bytes of %v with flags %x", len(restored), len(data), flags)
+		}
+	}
+}
+
+func TestReadFrameMalformed(t *testing.T) {
+	cases := []struct {
+		name   string
+		header []byte
+		err    error
+	}{
+		{"bad magic", append([]byte{0x00}, frameHeader(0, 1, 1, 0)[1:]...), ErrorMalformedFrame},
+		{"unknown flags", frameHeader(0x80, 1, 1, 0), ErrorMalformedFrame},
+		{"too large", frameHeader(0, 1001, 2000, 0), ErrorFrameTooLarge},
+		{"negative size", frameHeader(0, 1, math.MaxUint64, 0), ErrorMalformedFrame},
+		{"negative offset", frameHeader(0, 1, 1, math.MaxUint64), ErrorMalformedFrame},
+		{"offset beyond size", frameHeader(0, 0, 10, 11), ErrorMalformedFrame},
+		{"payload beyond size", frameHeader(0, 10, 10, 1), ErrorMalformedFrame},
+		{"offset overflow", frameHeader(0, 1, math.MaxInt64, math.MaxInt64), ErrorMalformedFrame},
+	}
+	for _, c := range cases {
+		raw := append(c.header, make([]byte, 1000)...)
+		if _, err := ReadFrame(bytes.NewReader(raw), 1000); err != c.err {
+			t.Errorf("%v: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestReceiveFrameMalformed(t *testing.T) {
+	overflow := append(frameHeader(0, 1, math.MaxInt64, math.MaxInt64), 0)
+	if err := receiveRaw(t, overflow); err != ErrorMalformedFrame {
+		t.Fatalf("frame overflowing its message: got %v", err)
+	}
+	huge := (&Frame{MessageSize: MaxMessageSizeCeiling + 1, Payload: []byte{1}}).ToBytes()
+	if err := receiveRaw(t, huge); !errors.Is(err, ErrorMessageTooLarge) {
+		t.Fatalf("frame of a huge message: got %v", err)
+	}
+	corrupted := (&Frame{MessageSize: 1, Payload: []byte{1}, Flags: FrameFlagChecksum}).ToBytes()
+	corrupted[FrameHeaderSize] ^= 1
+	if err := receiveRaw(t, corrupted); err != ErrorFrameChecksum {
+		t.Fatalf("corrupted frame: got %v", err)
+	}
+	// without the digest, the duplicated frame would complete the message
+	first := (&Frame{MessageSize: 2, Payload: []byte{1}}).ToBytes()
+	if err := receiveRaw(t, append(first, first...)); err != ErrorMalformedFrame {
+		t.Fatalf("duplicated frame: got %v", err)
+	}
+	overlapping := (&Frame{MessageSize: 3, Offset: 1, Payload: []byte{2, 3}}).ToBytes()
+	if err := receiveRaw(t, append((&Frame{MessageSize: 3, Payload: []byte{1, 2}}).ToBytes(), overlapping...)); err != ErrorMalformedFrame {
+		t.Fatalf("overlapping frame: got %v", err)
+	}
+	if err := receiveRaw(t, overlapping); err != ErrorMalformedFrame {
+		t.Fatalf("frame after a gap: got %v", err)
+	}
+	digest := (&Frame{MessageSize: 1, Payload: []byte{1}, Flags: FrameFlagMessageDigest, MessageDigest: 5}).ToBytes()
+	if err := receiveRaw(t, digest); err != ErrorMessageDigest {
+		t.Fatalf("frame with wrong digest: got %v", err)
+	}
+}
+
+func TestReceiveFrameUnlimitedSize(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	hub := NewHub(local, func(error) {})
+	defer hub.Close()
+	hub.MaxMessageSize = 0
+	if err := hub.checkMessageSize(MaxMessageSizeCeiling + 1); !errors.Is(err, ErrorMessageTooLarge) {
+		t.Fatalf("size beyond ceiling with limit disabled: got %v", err)
+	}
+}
+
+// TestReceiveRandomFrames feeds random and bit-flipped frames to a hub, which should reject them without panic
+func TestReceiveRandomFrames(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	valid := (&Frame{MessageSize: 100, Payload: make([]byte, 100), Flags: FrameFlagChecksum}).ToBytes()
+	for i := 0; i < 300; i++ {
+		var raw []byte
+		switch i % 3 {
+		case 0:
+			raw = make([]byte, random.Intn(2000))
+			random.Read(raw)
+		case 1:
+			raw = frameHeader(byte(random.Intn(16)), uint32(random.Intn(2000)), random.Uint64(), random.Uint64())
+			raw = append(raw, make([]byte, random.Intn(2000))...)
+		case 2:
+			raw = append([]byte{}, valid...)
+			raw[random.Intn(len(raw))] ^= byte(1 + random.Intn(255))
+		}
+		if len(raw) > 0 && random.Intn(2) == 0 {
+			raw[0] = FrameMagic
+		}
+		receiveRaw(t, raw)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add((&Frame{MessageSize: 3, Payload: []byte{1, 2, 3}, Flags: FrameFlagChecksum | FrameFlagMessageDigest}).ToBytes())
+	f.Add(append(frameHeader(0, 1, math.MaxInt64, math.MaxInt64), 0))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		frame, err := ReadFrame(bytes.NewReader(raw), DefaultMaxFrameSize)
+		if err != nil {
+			return
+		}
+		if frame.Offset < 0 || frame.MessageSize < 0 || frame.Offset > frame.MessageSize ||
+			int64(len(frame.Payload)) > frame.MessageSize-frame.Offset {
+			t.Fatalf("frame out of its message accepted: %v", frame)
+		}
+	})
+}
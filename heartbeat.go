@@ -0,0 +1,158 @@
+package syncbox
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// constants for heartbeat
+const (
+	DefaultHeartbeatInterval  = 30 * time.Second
+	DefaultHeartbeatMaxMissed = 3
+)
+
+// HeartbeatStats is the statistics of heartbeats sent on a connection, RTT is the round-trip time of pings
+type HeartbeatStats struct {
+	Sent       int64
+	Received   int64
+	Missed     int64
+	LastRTT    time.Duration
+	MinRTT     time.Duration
+	MaxRTT     time.Duration
+	AverageRTT time.Duration
+	totalRTT   time.Duration
+}
+
+func (stats *HeartbeatStats) String() string {
+	return ToString(stats)
+}
+
+func (stats *HeartbeatStats) record(rtt time.Duration) {
+	stats.Received++
+	stats.LastRTT = rtt
+	if stats.MinRTT == 0 || rtt < stats.MinRTT {
+		stats.MinRTT = rtt
+	}
+	if rtt > stats.MaxRTT {
+		stats.MaxRTT = rtt
+	}
+	stats.totalRTT += rtt
+	stats.AverageRTT = stats.totalRTT / time.Duration(stats.Received)
+}
+
+// HeartbeatStats returns the heartbeat statistics of the hub
+func (hub *Hub) HeartbeatStats() HeartbeatStats {
+	hub.heartbeatMutex.Lock()
+	defer hub.heartbeatMutex.Unlock()
+	return hub.heartbeatStats
+}
+
+// touch records that something is read from the connection
+func (hub *Hub) touch() {
+	atomic.StoreInt64(&hub.lastReceived, time.Now().UnixNano())
+}
+
+func (hub *Hub) receivedSince(t time.Time) bool {
+	return atomic.LoadInt64(&hub.lastReceived) >= t.UnixNano()
+}
+
+// Heartbeat pings peer every interval until the hub is closed, this should be run as goroutine.
+// A ping is missed if it's not responded within interval and nothing else is received from peer meanwhile,
+// so that a peer busy with a large message is not considered dead.
+// After maxMissed consecutive missed pings, peer is considered dead and the hub is closed with ErrorPeerDead.
+// Peers that don't support heartbeat are not pinged.
+func (hub *Hub) Heartbeat(interval time.Duration, maxMissed int) {
+	if interval <= 0 {
+		return
+	}
+	missed := 0
+	// pending is the result of the ping in flight, a ping blocked on writing to a half-open connection
+	// is waited for in later rounds rather than piling up new ones
+	var pending chan error
+	var sentAt time.Time
+	for {
+		if !sleepUntilDone(hub.done, interval) {
+			return
+		}
+		if !hub.HasCapability(CapabilityHeartbeat) {
+			continue
+		}
+		if pending == nil {
+			pending = make(chan error, 1)
+			sentAt = time.Now()
+			go func(result chan error) {
+				result <- hub.ping(interval)
+			}(pending)
+			hub.heartbeatMutex.Lock()
+			hub.heartbeatStats.Sent++
+			hub.heartbeatMutex.Unlock()
+		}
+
+		var err error
+		timer := time.NewTimer(interval)
+		select {
+		case err = <-pending:
+			pending = nil
+		case <-timer.C:
+			err = ErrorTimeout
+		case <-hub.done:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+		if hub.Err() != nil {
+			return
+		}
+		if err == nil {
+			hub.heartbeatMutex.Lock()
+			hub.heartbeatStats.record(time.Since(sentAt))
+			hub.heartbeatMutex.Unlock()
+			missed = 0
+			continue
+		}
+		hub.heartbeatMutex.Lock()
+		hub.heartbeatStats.Missed++
+		hub.heartbeatMutex.Unlock()
+		if hub.receivedSince(sentAt) {
+			missed = 0
+			continue
+		}
+		missed++
+		hub.LogDebug("missed heartbeat of %v, count: %v, error: %v\n", hub.Conn.RemoteAddr(), missed, err)
+		if missed >= maxMissed {
+			hub.LogInfo("peer %v missed %v heartbeats, closing connection\n", hub.Conn.RemoteAddr(), missed)
+			hub.closeWithError(ErrorPeerDead)
+			return
+		}
+	}
+}
+
+// sleepUntilDone pauses for period, it returns false if done is closed meanwhile
+func sleepUntilDone(done <-chan struct{}, period time.Duration) bool {
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (hub *Hub) ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(hub.ctx, timeout)
+	defer cancel()
+	req := NewRequest("", "", "", TypePing, nil)
+	hub.LogVerbose("ping called, request id: %v\n", req.ID)
+	_, err := hub.SendRequestForResponseContext(ctx, req)
+	return err
+}
+
+// ProcessPing responds to a ping of peer
+func (hub *Hub) ProcessPing(req *Request) error {
+	return hub.SendResponse(req, &Response{
+		Status:  StatusOK,
+		Message: MessageAccept,
+	})
+}
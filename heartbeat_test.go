@@ -0,0 +1,119 @@
+package syncbox
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// heartbeatHub returns a hub on a PipeTransport connection that negotiated heartbeat, and the connection end of peer
+func heartbeatHub(t *testing.T) (*Hub, net.Conn) {
+	t.Helper()
+	local, remote := pipePair(t)
+	hub := NewHub(local, func(error) {})
+	hub.ApplyNegotiation(&IdentityResponse{ProtocolVersion: ProtocolVersion, Capabilities: []string{CapabilityHeartbeat}}, 0, 0)
+	go hub.Setup()
+	t.Cleanup(func() {
+		hub.Close()
+	})
+	return hub, remote
+}
+
+func TestHeartbeatSilentPeer(t *testing.T) {
+	hub, remote := heartbeatHub(t)
+	// peer reads pings but never responds nor sends anything
+	go io.Copy(ioutil.Discard, remote)
+	const interval = 20 * time.Millisecond
+	start := time.Now()
+	go hub.Heartbeat(interval, 3)
+	waitFor(t, "silent peer to be closed", func() bool {
+		return hub.Err() != nil
+	})
+	if err := hub.Err(); err != ErrorPeerDead {
+		t.Fatalf("silent peer closed with %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*interval {
+		t.Fatalf("silent peer closed after %v, before 3 intervals", elapsed)
+	}
+	if stats := hub.HeartbeatStats(); stats.Missed < 3 || stats.Received != 0 {
+		t.Fatalf("heartbeat stats of silent peer: %v", &stats)
+	}
+}
+
+func TestHeartbeatBusyPeer(t *testing.T) {
+	hub, remote := heartbeatHub(t)
+	go io.Copy(ioutil.Discard, remote)
+	// peer is busy sending a large message, and doesn't respond to pings
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		frame := &Frame{MessageSize: 1 << 20, Payload: make([]byte, 100)}
+		frame.MessageID[0] = 1
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+			if _, err := remote.Write(frame.ToBytes()); err != nil {
+				return
+			}
+			frame.Offset += int64(len(frame.Payload))
+		}
+	}()
+	const interval = 20 * time.Millisecond
+	go hub.Heartbeat(interval, 3)
+	waitFor(t, "pings to be missed", func() bool {
+		return hub.HeartbeatStats().Missed >= 5
+	})
+	if err := hub.Err(); err != nil {
+		t.Fatalf("busy peer closed with %v", err)
+	}
+	close(stop)
+	<-sending
+	waitFor(t, "peer to be closed once it's silent", func() bool {
+		return hub.Err() == ErrorPeerDead
+	})
+}
+
+func TestHeartbeatStats(t *testing.T) {
+	a, b := hubPair(t)
+	capabilities := &IdentityResponse{ProtocolVersion: ProtocolVersion, Capabilities: []string{CapabilityHeartbeat}}
+	a.ApplyNegotiation(capabilities, 0, 0)
+	b.ApplyNegotiation(capabilities, 0, 0)
+	go func() {
+		for {
+			req, err := b.ReceiveRequest()
+			if err != nil {
+				return
+			}
+			if req.DataType == TypePing {
+				b.ProcessPing(req)
+			}
+		}
+	}()
+	go a.Heartbeat(10*time.Millisecond, 3)
+	waitFor(t, "pings to be responded", func() bool {
+		return a.HeartbeatStats().Received >= 3
+	})
+	stats := a.HeartbeatStats()
+	if stats.Sent < stats.Received || stats.LastRTT <= 0 ||
+		stats.MinRTT > stats.AverageRTT || stats.AverageRTT > stats.MaxRTT {
+		t.Fatalf("heartbeat stats: %v", &stats)
+	}
+	if err := a.Err(); err != nil {
+		t.Fatalf("responding peer closed with %v", err)
+	}
+
+	recorded := &HeartbeatStats{}
+	for _, rtt := range []time.Duration{10, 30, 20} {
+		recorded.record(rtt * time.Millisecond)
+	}
+	if recorded.Received != 3 || recorded.LastRTT != 20*time.Millisecond || recorded.MinRTT != 10*time.Millisecond ||
+		recorded.MaxRTT != 30*time.Millisecond || recorded.AverageRTT != 20*time.Millisecond {
+		t.Fatalf("recorded stats: %v", recorded)
+	}
+}
@@ -1,18 +1,29 @@
 package syncbox
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/ecdh"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net"
+	"sync"
 	"time"
 )
 
-// MessageQueueItem represents an item of the message queue
+// MessageQueueItem represents an item of the message queue,
+// legacy messages are assembled from Packets, framed messages are assembled to Data.
+// Size is the bytes buffered for the message, and Updated is when it receives a packet or frame last time.
 type MessageQueueItem struct {
 	Packets      []*Packet
+	Data         []byte
+	Flags        byte
+	Size         int64
+	Received     int64
+	Updated      time.Time
 	LastProgress int
 }
 
@@ -20,7 +31,38 @@ type MessageQueueItem struct {
 // it's the lowest level entry point for network connection
 type Hub struct {
 	*Logger
-	Conn                 *net.TCPConn
+	Conn               net.Conn
+	MaxFrameSize       int
+	CompressionMinSize int
+
+	// limits of inbound messages, a peer exceeding them is disconnected,
+	// MaxMessageSize is the size of a message, MaxPartialMessages is the number of messages being received at the same time,
+	// and MaxBufferedBytes is the sum of their sizes. Partial messages are evicted if they receive nothing for PartialMessageTimeout.
+	// Zero disables the limit, but messages are never larger than MaxMessageSizeCeiling.
+	MaxMessageSize        int64
+	MaxPartialMessages    int
+	MaxBufferedBytes      int64
+	PartialMessageTimeout time.Duration
+
+	// MaxTransfers is the number of inbound streaming transfers open at the same time, zero disables the limit,
+	// transfers are aborted if they receive no chunk for TransferIdleTimeout
+	MaxTransfers        int
+	TransferIdleTimeout time.Duration
+
+	// DeviceName is the name of the device told to peer in the identity handshake
+	DeviceName string
+
+	// RequireSigning refuses peers that don't sign messages, SigningWindow is how far the timestamp of a signed message
+	// could be from now, see verifyMessage
+	RequireSigning bool
+	SigningWindow  time.Duration
+
+	// SigningIdentity is the long-term key of server that signing secrets are bound to, signing is only agreed by servers with it.
+	// VerifySigningKey verifies the public SigningIdentity of server on client side, ClientConnector pins it on first connect,
+	// if it's nil the key is trusted as it is.
+	SigningIdentity  *ecdh.PrivateKey
+	VerifySigningKey func(key []byte) error
+
 	InboundMessage       chan []byte
 	InboundMessageError  chan error
 	InboundRequest       chan []byte
@@ -29,148 +71,401 @@ type Hub struct {
 	InboundResponseError chan error
 	MessageQueue         map[[PacketIDSIze]byte]*MessageQueueItem
 	RequestQueue         map[string]chan *Response
+	Transfers            map[string]*Transfer
 	ErrorHandler         ErrorHandler
+	reader               *bufio.Reader
+	protocolVersion      int
+	peerVersion          string
+	capabilities         map[string]bool
+	sendFrameSize        int
+	sendPartialMessages  int
+	sessionID            string
+	compression          string
+	codec                string
+	token                string
+	tokenExpires         time.Time
+	tokenLifetime        time.Duration
+	tokenFinal           bool
+	tokenUpdated         chan struct{}
+	signSecret           []byte
+	nonces               *nonceCache
+	responses            *ResponseCache
+	settingsMutex        sync.RWMutex
+	transferMutex        sync.Mutex
+	messageMutex         sync.Mutex
+	requestMutex         sync.Mutex
+	lanes                [priorityLanes]lane
+	laneMutex            sync.Mutex
+	sendReady            chan struct{}
+	metadataBurst        int
+	done                 chan struct{}
+	err                  error
+	closeOnce            sync.Once
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	inbound              map[string]context.CancelFunc
+	inboundMutex         sync.Mutex
+	lastReceived         int64
+	heartbeatStats       HeartbeatStats
+	heartbeatMutex       sync.Mutex
+	compressionStats     CompressionStats
+	compressionMutex     sync.Mutex
+	bufferedBytes        int64
 }
 
 // NewHub instantiates a Hub
-func NewHub(conn *net.TCPConn, eHandler ErrorHandler) *Hub {
+func NewHub(conn net.Conn, eHandler ErrorHandler) *Hub {
 	hub := &Hub{
-		Conn:                 conn,
-		InboundMessage:       make(chan []byte),
-		InboundMessageError:  make(chan error),
-		InboundRequest:       make(chan []byte),
-		InboundRequestError:  make(chan error),
-		InboundResponse:      make(chan []byte),
-		InboundResponseError: make(chan error),
-		MessageQueue:         make(map[[PacketIDSIze]byte]*MessageQueueItem),
-		RequestQueue:         make(map[string]chan *Response),
-		ErrorHandler:         eHandler,
-		Logger:               NewDefaultLogger(),
+		Conn:                  conn,
+		MaxFrameSize:          DefaultMaxFrameSize,
+		CompressionMinSize:    DefaultCompressionMinSize,
+		MaxMessageSize:        DefaultMaxMessageSize,
+		MaxPartialMessages:    DefaultMaxPartialMessages,
+		MaxBufferedBytes:      DefaultMaxBufferedBytes,
+		PartialMessageTimeout: DefaultPartialMessageTimeout,
+		MaxTransfers:          DefaultMaxTransfers,
+		TransferIdleTimeout:   DefaultTransferIdleTimeout,
+		InboundMessage:        make(chan []byte),
+		InboundMessageError:   make(chan error),
+		InboundRequest:        make(chan []byte),
+		InboundRequestError:   make(chan error),
+		InboundResponse:       make(chan []byte),
+		InboundResponseError:  make(chan error),
+		MessageQueue:          make(map[[PacketIDSIze]byte]*MessageQueueItem),
+		RequestQueue:          make(map[string]chan *Response),
+		Transfers:             make(map[string]*Transfer),
+		ErrorHandler:          eHandler,
+		Logger:                NewDefaultLogger(),
+		reader:                bufio.NewReader(conn),
+		protocolVersion:       ProtocolVersionLegacy,
+		capabilities:          make(map[string]bool),
+		done:                  make(chan struct{}),
+		sendReady:             make(chan struct{}, 1),
+		tokenUpdated:          make(chan struct{}, 1),
+		nonces:                newNonceCache(),
+		inbound:               make(map[string]context.CancelFunc),
 	}
+	hub.ctx, hub.cancel = context.WithCancel(context.Background())
 	return hub
 }
 
-// Setup runs the goroutines necessary for a hub to communicate via channels
+func (hub *Hub) frameSize() int {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	size := hub.MaxFrameSize
+	if hub.sendFrameSize > 0 && hub.sendFrameSize < size {
+		size = hub.sendFrameSize
+	}
+	if size < MinFrameSize {
+		size = MinFrameSize
+	}
+	return size
+}
+
+// Setup runs the goroutines necessary for a hub to communicate via channels,
+// it blocks until the hub is closed and all the goroutines exit.
+// It returns the error that closed the hub, or nil if the hub is closed by Close.
 func (hub *Hub) Setup() error {
-	errChan := make(chan error)
-	go func() {
-		if err := hub.ReceivePackets(); err != nil {
-			hub.LogDebug("error on ReceivePackets in Setup: %v\n", err)
-			errChan <- err
-		}
-	}()
-	go func() {
-		if err := hub.ReceiveMessage(); err != nil {
-			hub.LogDebug("error on ReceiveMessage in Setup: %v\n", err)
-			errChan <- err
+	var wg sync.WaitGroup
+	run := func(name string, routine func() error) {
+		defer wg.Done()
+		if err := routine(); err != nil {
+			hub.LogDebug("error on %v in Setup: %v\n", name, err)
+			hub.closeWithError(err)
 		}
-	}()
-	go func() {
-		if err := hub.DispatchResponse(); err != nil {
-			hub.LogDebug("error on DispatchResponse in Setup: %v\n", err)
-			errChan <- err
+	}
+	wg.Add(6)
+	go run("SendPackets", hub.SendPackets)
+	go run("ReceivePackets", hub.ReceivePackets)
+	go run("ReceiveMessage", hub.ReceiveMessage)
+	go run("DispatchResponse", hub.DispatchResponse)
+	go run("EvictMessages", hub.EvictMessages)
+	go run("EvictTransfers", hub.EvictTransfers)
+	<-hub.done
+	wg.Wait()
+	if err := hub.Err(); err != ErrorHubClosed {
+		return err
+	}
+	return nil
+}
+
+// Close closes the hub and its connection, requests waiting for response are released with ErrorHubClosed.
+// It's safe to be called multiple times.
+func (hub *Hub) Close() error {
+	hub.closeWithError(ErrorHubClosed)
+	return nil
+}
+
+// Done returns a channel that's closed when the hub is closed, either by Close or a connection error
+func (hub *Hub) Done() <-chan struct{} {
+	return hub.done
+}
+
+// Err returns nil if the hub is not closed yet, otherwise it returns the error that closed the hub,
+// which is ErrorHubClosed if it's closed by Close, or ErrorPeerSocketClosed if peer closed the connection
+func (hub *Hub) Err() error {
+	select {
+	case <-hub.done:
+		return hub.err
+	default:
+		return nil
+	}
+}
+
+// closeWithError closes the hub with err for the first time it's called,
+// it closes the connection to stop reading, releases requests waiting for response and aborts inbound transfers
+func (hub *Hub) closeWithError(err error) {
+	hub.closeOnce.Do(func() {
+		hub.LogDebug("closing hub: %v\n", err)
+		hub.err = err
+		close(hub.done)
+		hub.cancel()
+		hub.Conn.Close()
+
+		hub.requestMutex.Lock()
+		hub.RequestQueue = make(map[string]chan *Response)
+		hub.requestMutex.Unlock()
+
+		hub.transferMutex.Lock()
+		transfers := hub.Transfers
+		hub.Transfers = make(map[string]*Transfer)
+		hub.transferMutex.Unlock()
+		for _, transfer := range transfers {
+			transfer.discard()
 		}
-	}()
-	return <-errChan
+	})
 }
 
-func (hub *Hub) sendPackets(bytes []byte) error {
-	packets, err := Serialize(bytes)
-	if err != nil {
+// sendPackets queues a message to be written by SendPackets in the lane of priority, and waits until it's written.
+func (hub *Hub) sendPackets(bytes []byte, priority Priority) error {
+	message := &outboundMessage{}
+	if err := hub.pack(message, bytes); err != nil {
 		return err
 	}
-	for _, packet := range packets {
-		hub.LogVerbose("packet to send: %v\n", packet)
-		data := packet.ToBytes()
-		dataSlice := make([]byte, PacketTotalSize)
-		copy(dataSlice, data[:])
-		_, err := (*hub.Conn).Write(dataSlice)
-		if err != nil {
-			hub.LogDebug("error on writePackets: %v\n", err)
-			return err
+	return hub.sendQueued(message, priority)
+}
+
+// pack puts bytes in message as frames or legacy packets.
+// Framed messages are compressed if compression is negotiated, and carry checksums if checksum is negotiated,
+// legacy packets have no header to tell them.
+func (hub *Hub) pack(message *outboundMessage, bytes []byte) error {
+	if hub.HasCapability(CapabilityFraming) {
+		data, flags := hub.compress(bytes)
+		if hub.HasCapability(CapabilityChecksum) {
+			flags |= FrameFlagChecksum
 		}
+		message.frames = SerializeFrames(data, hub.frameSize(), flags)
+		return nil
+	}
+	packets, err := Serialize(bytes)
+	if err != nil {
+		return err
 	}
+	message.packets = packets
 	return nil
 }
 
-func (hub *Hub) sendMessage(message []byte, prefix rune) error {
-	message = append(message, ByteDelim) // appends delim
-	switch prefix {
-	case RequestPrefix:
-		message = append([]byte{byte(RequestPrefix)}, message...) // unshift request prefix
-		hub.LogVerbose("outbound request message: %v\n", string(message))
-		return hub.sendPackets(message)
-	case ResponsePrefix:
-		message = append([]byte{byte(ResponsePrefix)}, message...) // unshift request prefix
-		hub.LogVerbose("outbound response message: %v\n", string(message))
-		return hub.sendPackets(message)
-	default:
+// sendMessage queues a request or response message of prefix, which is encoded by encode once SendPackets starts writing it,
+// so that signed messages are stamped when they are written rather than when they are queued behind others
+func (hub *Hub) sendMessage(encode func() ([]byte, error), prefix rune, priority Priority) error {
+	if prefix != RequestPrefix && prefix != ResponsePrefix {
 		return errors.New("unknown message type: " + string(prefix))
 	}
+	message := &outboundMessage{}
+	message.encode = func() error {
+		bytes, err := encode()
+		if err != nil {
+			return err
+		}
+		bytes = append(append([]byte{byte(prefix)}, bytes...), ByteDelim) // unshift prefix and append delim
+		if prefix == RequestPrefix {
+			hub.LogVerbose("outbound request message: %v\n", string(bytes))
+		} else {
+			hub.LogVerbose("outbound response message: %v\n", string(bytes))
+		}
+		return hub.pack(message, bytes)
+	}
+	return hub.sendQueued(message, priority)
 }
 
-func (hub *Hub) handlePacketFullness(size int64, sequence int64, packet *Packet, item *MessageQueueItem) {
-	full := true
+// handlePacketFullness returns the assembled message if all packets of it are received,
+// the caller should hold messageMutex
+func (hub *Hub) handlePacketFullness(size int64, sequence int64, packet *Packet, item *MessageQueueItem) ([]byte, bool) {
 	var i int64
 	for i = 0; i < size; i++ {
 		if item.Packets[i] == nil {
-			full = false
+			return nil, false
 		}
 	}
-	if full {
-		data := Deserialize(item.Packets)
-		data = bytes.TrimRight(data, string([]byte{0})) // trim trailing zero char in last packet
-		hub.InboundMessage <- data
-		delete(hub.MessageQueue, packet.MessageID)
-	}
+	data := Deserialize(item.Packets)
+	data = bytes.TrimRight(data, string([]byte{0})) // trim trailing zero char in last packet
+	hub.removeMessage(packet.MessageID, item)
+	return data, true
 }
 
 // ReceivePackets waits to read from the connection of the hub,
-// this should be run as goroutine.
+// both legacy packets and frames are accepted, told apart by the first byte.
+// Packets and frames that fail validation or integrity checks are connection level errors, which close the hub.
+// This should be run as goroutine.
 func (hub *Hub) ReceivePackets() error {
 	for {
-		buffer := make([]byte, PacketTotalSize, PacketTotalSize)
-		readSize := 0
-		// one read perhaps won't read the full packet, loop until a full packet is read
-		for readSize < PacketTotalSize {
-			n, err := (*hub.Conn).Read(buffer[readSize:len(buffer)])
-			if err != nil {
-				hub.LogDebug("error on ReceivePackets: %v\n", err)
-				hub.InboundMessageError <- err
-			}
-			readSize += n
+		first, err := hub.reader.Peek(1)
+		if err == nil && first[0] == FrameMagic {
+			err = hub.receiveFrame()
+		} else if err == nil {
+			err = hub.receivePacket()
 		}
-		var bufferArr [PacketTotalSize]byte
-		copy(bufferArr[:], buffer)
-		packet := RebornPacket(bufferArr)
-		hub.LogVerbose("packet received: %v\n", packet)
-
-		size, err := packet.GetSize()
-		if err != nil {
-			hub.InboundMessageError <- err
+		if err == nil {
+			hub.touch()
 		}
-		sequence, err := packet.GetSequence()
 		if err != nil {
-			hub.InboundMessageError <- err
-		}
-		item, exists := hub.MessageQueue[packet.MessageID]
-		if exists {
-			item.Packets[sequence] = packet
-			progress := int(math.Floor(float64(sequence) / float64(size) * 100))
-			if size > 10000 && (progress%10 == 0) && progress != item.LastProgress {
-				hub.LogInfo("progress reading inbound message: %v%%\n", progress)
+			if err == io.EOF {
+				err = ErrorPeerSocketClosed
 			}
-			hub.handlePacketFullness(size, sequence, packet, item)
-		} else {
-			packets := make([]*Packet, size, size)
-			packets[sequence] = packet
-			item = &MessageQueueItem{
-				Packets:      packets,
-				LastProgress: 0,
+			hub.LogDebug("error on ReceivePackets: %v\n", err)
+			select {
+			case hub.InboundMessageError <- err:
+			case <-hub.done:
 			}
-			hub.MessageQueue[packet.MessageID] = item
-			hub.handlePacketFullness(size, sequence, packet, item)
+			return err
+		}
+	}
+}
+
+func (hub *Hub) receivePacket() error {
+	var bufferArr [PacketTotalSize]byte
+	// one read perhaps won't read the full packet, ReadFull loops until a full packet is read
+	if _, err := io.ReadFull(hub.reader, bufferArr[:]); err != nil {
+		return err
+	}
+	packet := RebornPacket(bufferArr)
+	hub.LogVerbose("packet received: %v\n", packet)
+
+	size, err := packet.GetSize()
+	if err != nil {
+		return err
+	}
+	sequence, err := packet.GetSequence()
+	if err != nil {
+		return err
+	}
+	if size <= 0 || sequence < 0 || sequence >= size {
+		hub.LogDebug("packet of invalid size %v or sequence %v received\n", size, sequence)
+		return ErrorMalformedPacket
+	}
+	// check the number of packets before multiplying, which may overflow
+	if limit := hub.messageSizeLimit(); size > limit/PacketDataSize+1 {
+		return hub.limitError(ErrorMessageTooLarge, "packets: %v, limit: %v", size, limit)
+	}
+	hub.messageMutex.Lock()
+	item, exists := hub.MessageQueue[packet.MessageID]
+	if exists && int64(len(item.Packets)) != size {
+		hub.messageMutex.Unlock()
+		return ErrorMalformedPacket
+	}
+	if exists {
+		item.Packets[sequence] = packet
+		item.Received += PacketDataSize
+		item.Updated = time.Now()
+		progress := int(math.Floor(float64(sequence) / float64(size) * 100))
+		if size > 10000 && (progress%10 == 0) && progress != item.LastProgress {
+			hub.LogInfo("progress reading inbound message: %v%%\n", progress)
+		}
+	} else {
+		if err := hub.reserveMessage(size * PacketDataSize); err != nil {
+			hub.messageMutex.Unlock()
+			return err
+		}
+		packets := make([]*Packet, size, size)
+		packets[sequence] = packet
+		item = &MessageQueueItem{
+			Packets:      packets,
+			Size:         size * PacketDataSize,
+			Received:     PacketDataSize,
+			Updated:      time.Now(),
+			LastProgress: 0,
+		}
+		hub.MessageQueue[packet.MessageID] = item
+	}
+	data, full := hub.handlePacketFullness(size, sequence, packet, item)
+	hub.messageMutex.Unlock()
+	if full {
+		return hub.deliverMessage(data)
+	}
+	return nil
+}
+
+func (hub *Hub) receiveFrame() error {
+	frame, err := ReadFrame(hub.reader, hub.MaxFrameSize)
+	if err != nil {
+		return err
+	}
+	hub.LogVerbose("frame received: %v\n", frame)
+	// the size is checked before anything is allocated for the message
+	if err := hub.checkMessageSize(frame.MessageSize); err != nil {
+		return err
+	}
+	hub.messageMutex.Lock()
+	item, exists := hub.MessageQueue[frame.MessageID]
+	if !exists {
+		if err := hub.reserveMessage(frame.MessageSize); err != nil {
+			hub.messageMutex.Unlock()
+			return err
+		}
+		item = &MessageQueueItem{
+			Data:  make([]byte, frame.MessageSize),
+			Flags: frame.Flags,
+			Size:  frame.MessageSize,
+		}
+		hub.MessageQueue[frame.MessageID] = item
+	}
+	item.Updated = time.Now()
+	if int64(len(item.Data)) != frame.MessageSize || item.Flags&FrameFlagCompressionMask != frame.Flags&FrameFlagCompressionMask {
+		hub.messageMutex.Unlock()
+		return ErrorMalformedFrame
+	}
+	// frames of a message are written in order, so a frame that doesn't start where the received ones end is duplicated, overlapping or missing some
+	if frame.Offset != item.Received {
+		hub.messageMutex.Unlock()
+		hub.LogDebug("frame of message %x at offset %v, expected %v\n", frame.MessageID, frame.Offset, item.Received)
+		return ErrorMalformedFrame
+	}
+	copy(item.Data[frame.Offset:], frame.Payload)
+	item.Received += int64(len(frame.Payload))
+	if frame.MessageSize > 10000*PacketDataSize {
+		progress := int(math.Floor(float64(item.Received) / float64(frame.MessageSize) * 100))
+		if progress%10 == 0 && progress != item.LastProgress {
+			item.LastProgress = progress
+			hub.LogInfo("progress reading inbound message: %v%%\n", progress)
+		}
+	}
+	completed := item.Received >= frame.MessageSize
+	if completed {
+		hub.removeMessage(frame.MessageID, item)
+	}
+	hub.messageMutex.Unlock()
+	if completed {
+		if frame.Flags&FrameFlagMessageDigest != 0 && Checksum32(item.Data) != frame.MessageDigest {
+			hub.LogDebug("digest of message %x mismatch in receiveFrame\n", frame.MessageID)
+			return ErrorMessageDigest
+		}
+		data, err := hub.decompress(item.Data, item.Flags)
+		if err != nil {
+			hub.LogDebug("error on decompressing message in receiveFrame: %v\n", err)
+			return err
 		}
+		return hub.deliverMessage(data)
+	}
+	return nil
+}
+
+// deliverMessage passes an assembled message to ReceiveMessage, it returns hub.Err() if the hub is closed meanwhile
+func (hub *Hub) deliverMessage(data []byte) error {
+	select {
+	case hub.InboundMessage <- data:
+		return nil
+	case <-hub.done:
+		return hub.Err()
 	}
 }
 
@@ -179,6 +474,7 @@ func (hub *Hub) ReceivePackets() error {
 // It returns error if an error is considered as connection level, such as EOF or unknonw message type,
 // and leave for the connectors to deal with error,
 // otherwise it sends the error to InboundRequestError or InboundResponseError channel accordingly.
+// It returns nil when the hub is closed.
 func (hub *Hub) ReceiveMessage() error {
 	for {
 		// message, err := hub.readPackets()
@@ -194,23 +490,31 @@ func (hub *Hub) ReceiveMessage() error {
 			}
 			prefix := message[0]
 			message = message[1:len(message)]
+			var inbound chan []byte
 			switch prefix {
 			case RequestPrefix:
 				hub.LogVerbose("inbound request message: %v\n", string(message))
-				hub.InboundRequest <- message
+				inbound = hub.InboundRequest
 			case ResponsePrefix:
 				hub.LogVerbose("inbound response message: %v\n", string(message))
-				hub.InboundResponse <- message
+				inbound = hub.InboundResponse
 			default:
 				return errors.New("unknown message type: " + string(prefix))
 			}
+			select {
+			case inbound <- message:
+			case <-hub.done:
+				return nil
+			}
 		case err := <-hub.InboundMessageError:
 			if err == io.EOF {
 				hub.LogDebug("peer socket closed\n")
 				return ErrorPeerSocketClosed
 			}
-			hub.LogVerbose("error in waitInbound: %v\n", err)
-			continue
+			hub.LogDebug("error in ReceiveMessage: %v\n", err)
+			return err
+		case <-hub.done:
+			return nil
 		}
 	}
 }
@@ -219,11 +523,12 @@ func (hub *Hub) ReceiveMessage() error {
 // This should be called as goroutine.
 // It should returns error only when the error should cause connnection to be closed,
 // otherwise should just continue for next loop to process incoming response.
+// It returns nil when the hub is closed.
 func (hub *Hub) DispatchResponse() error {
 	for {
 		res, err := hub.ReceiveResponse()
 		if err != nil {
-			if err == ErrorPeerSocketClosed {
+			if err == ErrorPeerSocketClosed || hub.Err() != nil {
 				// peer socket is closed
 				return nil
 			}
@@ -231,171 +536,370 @@ func (hub *Hub) DispatchResponse() error {
 			continue
 		}
 		id := res.RequestID
-		resChan, exists := hub.RequestQueue[id]
+		resChan, exists := hub.takeRequest(id)
 		if exists {
+			// resChan is buffered, so it never blocks even if the request stops waiting
 			resChan <- res
-			delete(hub.RequestQueue, id)
 		} else {
 			hub.LogDebug("request not found in DispatchResponse, request id: %v\n", id)
 		}
 	}
 }
 
-// ReceiveRequest blocks until there is a inbound request
+// ReceiveRequest blocks until there is a inbound request,
+// it returns hub.Err() if the hub is closed.
+// Requests failing signature verification are responded with the error and not returned.
 func (hub *Hub) ReceiveRequest() (*Request, error) {
 	select {
 	case bytes := <-hub.InboundRequest:
 		var req Request
-		err := json.Unmarshal(bytes, &req)
+		err := Decode(bytes, &req)
 		if err != nil {
-			hub.LogDebug("error on json Unmarshal in ReceiveRequest: %v\n", err)
+			hub.LogDebug("error on Unmarshal in ReceiveRequest: %v\n", err)
+			return nil, err
+		}
+		if err := hub.verifyRequest(&req); err != nil {
+			hub.LogError("reject %v request %v: %v\n", req.DataType, req.ID, err)
+			// tell peer at once, otherwise it waits for the response until timeout
+			if resErr := hub.SendErrorResponse(&req, err); resErr != nil {
+				hub.LogDebug("error on SendErrorResponse in ReceiveRequest: %v\n", resErr)
+			}
 			return nil, err
 		}
 		return &req, nil
 	case err := <-hub.InboundRequestError:
 		return nil, err
+	case <-hub.done:
+		return nil, hub.Err()
 	}
 
 }
 
 // ReceiveResponse blocks until there is a inbound response,
+// it returns hub.Err() if the hub is closed.
+// Responses failing signature verification are replaced by the error responses of the failures.
 func (hub *Hub) ReceiveResponse() (*Response, error) {
 	select {
 	case bytes := <-hub.InboundResponse:
 		var res Response
-		err := json.Unmarshal(bytes, &res)
+		err := Decode(bytes, &res)
 		if err != nil {
-			hub.LogDebug("error on json Unmarshal in ReceiveResponse: %v\n", err)
+			hub.LogDebug("error on Unmarshal in ReceiveResponse: %v\n", err)
 			return nil, err
 		}
+		if err := hub.verifyResponse(&res); err != nil {
+			hub.LogError("reject response of request %v: %v\n", res.RequestID, err)
+			// fail the waiting request at once instead of letting it time out
+			rejected, marshalErr := NewErrorResponse(hub.Codec(), err)
+			if marshalErr != nil {
+				return nil, marshalErr
+			}
+			rejected.RequestID = res.RequestID
+			return rejected, nil
+		}
 		return &res, nil
 	case err := <-hub.InboundResponseError:
 		return nil, err
+	case <-hub.done:
+		return nil, hub.Err()
 	}
 
 }
 
-// SendRequest sends a request to the hub,
+// SendRequest sends a request to the hub, it carries the session token instead of the credentials once there's one,
+// and it's signed when it's written if signing is agreed
 func (hub *Hub) SendRequest(req *Request) error {
-	bytes, err := json.Marshal(req)
-	if err != nil {
-		hub.LogDebug("error on json Marshal in SendRequest: %v\n", err)
-		return err
-	}
-	return hub.sendMessage(bytes, RequestPrefix)
+	hub.attachToken(req)
+	return hub.sendMessage(func() ([]byte, error) {
+		// sign a copy, req might be sent again
+		signed := *req
+		if err := hub.signRequest(&signed); err != nil {
+			hub.LogDebug("error on signRequest in SendRequest: %v\n", err)
+			return nil, err
+		}
+		bytes, err := hub.Marshal(&signed)
+		if err != nil {
+			hub.LogDebug("error on Marshal in SendRequest: %v\n", err)
+		}
+		return bytes, err
+	}, RequestPrefix, RequestPriority(req.DataType))
 }
 
-// SendResponse sends a response to the hub
+// SendResponse sends a response to the hub, it's signed when it's written if signing is agreed
 func (hub *Hub) SendResponse(req *Request, res *Response) error {
 	res.RequestID = req.ID
-	bytes, err := json.Marshal(res)
-	if err != nil {
-		hub.LogDebug("error on json Marshal in SendResponse: %v\n", err)
-		return err
+	if cache := hub.responseCache(); cache != nil && req.IdempotencyKey != "" {
+		cache.record(req.IdempotencyKey, res)
 	}
-	return hub.sendMessage(bytes, ResponsePrefix)
+	return hub.sendMessage(func() ([]byte, error) {
+		// sign a copy, res is kept in the response cache and might be sent again for a retried request
+		signed := *res
+		if err := hub.signResponse(&signed); err != nil {
+			hub.LogDebug("error on signResponse in SendResponse: %v\n", err)
+			return nil, err
+		}
+		bytes, err := hub.Marshal(&signed)
+		if err != nil {
+			hub.LogDebug("error on Marshal in SendResponse: %v\n", err)
+		}
+		return bytes, err
+	}, ResponsePrefix, responsePriority(req.DataType))
+}
+
+// registerRequest adds the request to RequestQueue, the returned channel receives its response
+func (hub *Hub) registerRequest(id string) chan *Response {
+	resChan := make(chan *Response, 1)
+	hub.requestMutex.Lock()
+	defer hub.requestMutex.Unlock()
+	hub.RequestQueue[id] = resChan
+	return resChan
+}
+
+// takeRequest removes the request from RequestQueue and returns its response channel if it's still waiting
+func (hub *Hub) takeRequest(id string) (chan *Response, bool) {
+	hub.requestMutex.Lock()
+	defer hub.requestMutex.Unlock()
+	resChan, exists := hub.RequestQueue[id]
+	delete(hub.RequestQueue, id)
+	return resChan, exists
+}
+
+// PendingRequests returns the number of requests waiting for response
+func (hub *Hub) PendingRequests() int {
+	hub.requestMutex.Lock()
+	defer hub.requestMutex.Unlock()
+	return len(hub.RequestQueue)
 }
 
 // SendRequestForResponse sends a request and waits for response,
-// it returns ErrorTimeout if waits too long for the response
+// it returns ErrorTimeout if waits longer than OperationTimeoutPeriod for the response
 func (hub *Hub) SendRequestForResponse(req *Request) (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendRequestForResponseContext(ctx, req)
+	})
+}
+
+// SendRequestForResponseContext sends a request and waits for response until ctx is done,
+// it returns ctx.Err() if ctx is done first, and tells peer to abandon the request,
+// or hub.Err() if the hub is closed meanwhile.
+// The request is registered before it's sent, so that a fast response is never missed,
+// and it's removed if sending fails or is given up.
+func (hub *Hub) SendRequestForResponseContext(ctx context.Context, req *Request) (*Response, error) {
+	if err := hub.Err(); err != nil {
+		return nil, err
+	}
+	resChan := hub.registerRequest(req.ID)
 	err := hub.SendRequest(req)
 	if err != nil {
 		hub.LogDebug("error on SendRequest in SendRequestForResponse: %v\n", err)
+		hub.takeRequest(req.ID)
+		if closeErr := hub.Err(); closeErr != nil {
+			return nil, closeErr
+		}
 		return nil, err
 	}
-	resChan := make(chan *Response)
-	hub.RequestQueue[req.ID] = resChan
 	select {
 	case res := <-resChan:
 		return res, nil
-	case <-time.After(OperationTimeoutPeriod):
-		return nil, ErrorTimeout
+	case <-ctx.Done():
+		if _, waiting := hub.takeRequest(req.ID); waiting {
+			hub.sendCancel(req)
+		}
+		return nil, ctx.Err()
+	case <-hub.done:
+		return nil, hub.Err()
+	}
+}
+
+// SendRegisterRequest sends a request to create the account of username with password,
+// it returns the CodedError that peer tells if the account couldn't be created, CodeConflict if it exists
+func (hub *Hub) SendRegisterRequest(username string, password string, device string) (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendRegisterRequestContext(ctx, username, password, device)
+	})
+}
+
+// SendRegisterRequestContext is SendRegisterRequest with ctx to cancel or set deadline for waiting the response
+func (hub *Hub) SendRegisterRequestContext(ctx context.Context, username string, password string, device string) (*Response, error) {
+	req := NewRequest(username, password, device, TypeRegister, nil)
+	hub.LogDebug("SendRegisterRequest called,\n request id: %v,\n username: %v, device: %v\n", req.ID, username, device)
+
+	res, err := hub.SendRequestForResponseContext(ctx, req)
+	if err != nil {
+		hub.LogDebug("error on SendRequestForResponse in SendRegisterRequest: %v\n", err)
+		return nil, err
 	}
+	return res, res.Err()
 }
 
-// SendIdentityRequest sends a request with data type of user identity
+// SendIdentityRequest sends a request with data type of user identity,
+// and applies the protocol settings negotiated by peer
 func (hub *Hub) SendIdentityRequest(username string, password string, device string) (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendIdentityRequestContext(ctx, username, password, device)
+	})
+}
+
+// SendIdentityRequestContext is SendIdentityRequest with ctx to cancel or set deadline for waiting the response
+func (hub *Hub) SendIdentityRequestContext(ctx context.Context, username string, password string, device string) (*Response, error) {
+	signingKey, err := newSigningKey()
+	if err != nil {
+		hub.LogDebug("error on newSigningKey in SendIdentityRequest: %v\n", err)
+		return nil, err
+	}
 	eReq := IdentityRequest{
-		Username: username,
+		Username:           username,
+		ProtocolVersion:    ProtocolVersion,
+		SoftwareVersion:    SoftwareVersion,
+		Capabilities:       SupportedCapabilities,
+		MaxFrameSize:       hub.MaxFrameSize,
+		Compressions:       SupportedCompressions,
+		Codecs:             SupportedCodecs,
+		SessionID:          hub.SessionID(),
+		DeviceName:         hub.DeviceName,
+		SigningKey:         signingKey.PublicKey().Bytes(),
+		MaxPartialMessages: hub.MaxPartialMessages,
 	}
-	eReqJSON, err := json.Marshal(eReq)
+	eReqData, err := hub.Marshal(eReq)
 	if err != nil {
-		hub.LogDebug("error on json Marshal in SendIdentityRequest: %v\n", err)
+		hub.LogDebug("error on Marshal in SendIdentityRequest: %v\n", err)
 		return nil, err
 	}
-	req := NewRequest(username, password, device, TypeIdentity, eReqJSON)
-	hub.LogDebug("SendIdentityRequest called,\n request id: %v,\n username: %v, password: %v, device: %v\n", req.ID, username, password, device)
+	req := NewRequest(username, password, device, TypeIdentity, eReqData)
+	hub.LogDebug("SendIdentityRequest called,\n request id: %v,\n username: %v, device: %v\n", req.ID, username, device)
 
-	res, err := hub.SendRequestForResponse(req)
+	res, err := hub.SendRequestForResponseContext(ctx, req)
 	if err != nil {
 		hub.LogDebug("error on SendRequestForResponse in SendIdentityRequest: %v\n", err)
 		return nil, err
 	}
+	// peers that don't negotiate reply without data, keep using the legacy protocol with them
+	iRes := &IdentityResponse{}
+	if len(res.Data) > 0 {
+		if err := res.Decode(iRes); err != nil {
+			hub.LogDebug("error on Unmarshal in SendIdentityRequest: %v\n", err)
+			return nil, err
+		}
+	}
+	if res.Status != StatusOK {
+		hub.LogDebug("identity denied by peer, reason: %v\n", iRes.Reason)
+		err := fmt.Errorf("%w: %v", ErrorIdentityDenied, iRes.Reason)
+		if res.Status == StatusUnauthorized {
+			return res, NewCodedError(CodeAuthFailed, err)
+		}
+		return res, err
+	}
+	if len(res.Data) > 0 {
+		hub.ApplyNegotiation(iRes, iRes.MaxFrameSize, iRes.MaxPartialMessages)
+	}
+	if hub.HasCapability(CapabilitySigning) {
+		if hub.VerifySigningKey != nil {
+			if err := hub.VerifySigningKey(iRes.ServerSigningKey); err != nil {
+				hub.LogError("refuse signing key of server: %v\n", err)
+				return res, err
+			}
+		}
+		secret, err := clientSigningSecret(signingKey, iRes.SigningKey, iRes.ServerSigningKey)
+		if err != nil {
+			hub.LogDebug("error on clientSigningSecret in SendIdentityRequest: %v\n", err)
+			return res, err
+		}
+		hub.setSigningSecret(secret)
+	} else if hub.RequireSigning {
+		hub.LogDebug("peer doesn't sign messages, while signing is required\n")
+		return res, ErrorSigningRequired
+	}
+	if iRes.Token != "" {
+		hub.setSessionToken(iRes.Token, iRes.TokenLifetime, iRes.TokenFinal)
+	}
 	return res, nil
 }
 
 // SendDigestRequest sends a request with data type file tree digest
 func (hub *Hub) SendDigestRequest(username string, password string, device string, dir *Dir) (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendDigestRequestContext(ctx, username, password, device, dir)
+	})
+}
+
+// SendDigestRequestContext is SendDigestRequest with ctx to cancel or set deadline for waiting the response
+// it returns the response with the CodedError of it if peer responds with an error
+func (hub *Hub) SendDigestRequestContext(ctx context.Context, username string, password string, device string, dir *Dir) (*Response, error) {
 	dReq := DigestRequest{
 		Dir: dir,
 	}
-	dReqJSON, err := json.Marshal(dReq)
+	dReqData, err := hub.Marshal(dReq)
 	if err != nil {
-		hub.LogDebug("error on json Marshal in SendDigestRequest:%v\n", err)
+		hub.LogDebug("error on Marshal in SendDigestRequest: %v\n", err)
 		return nil, err
 	}
-	req := NewRequest(username, password, device, TypeDigest, dReqJSON)
-	hub.LogDebug("SendDigestRequest called,\n request id: %v,\n username: %v, password: %v, device: %v,\n dir checksum: %v\n", req.ID, username, password, device, dir.ContentChecksum)
+	req := idempotentRequest(ctx, NewRequest(username, password, device, TypeDigest, dReqData))
+	hub.LogDebug("SendDigestRequest called,\n request id: %v,\n username: %v, device: %v,\n dir checksum: %v\n", req.ID, username, device, dir.ContentChecksum)
 
-	res, err := hub.SendRequestForResponse(req)
+	res, err := hub.SendRequestForResponseContext(ctx, req)
 	if err != nil {
 		hub.LogDebug("error on SendRequestForResponse in SendDigestRequest: %v\n", err)
 		return nil, err
 	}
-	return res, nil
+	return res, res.Err()
 }
 
 // SendSyncRequest sends a request of data type file operation request
 func (hub *Hub) SendSyncRequest(username string, password string, device string, unrootPath string, action string, file *File) (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendSyncRequestContext(ctx, username, password, device, unrootPath, action, file)
+	})
+}
+
+// SendSyncRequestContext is SendSyncRequest with ctx to cancel or set deadline for waiting the response
+// it returns the response with the CodedError of it if peer responds with an error
+func (hub *Hub) SendSyncRequestContext(ctx context.Context, username string, password string, device string, unrootPath string, action string, file *File) (*Response, error) {
 	sReq := SyncRequest{
 		Action:     action,
 		File:       file,
 		UnrootPath: unrootPath,
 	}
-	sReqJSON, err := json.Marshal(sReq)
+	sReqData, err := hub.Marshal(sReq)
 	if err != nil {
-		hub.LogDebug("error on json Marshal in SendSyncRequest: %v\n", err)
+		hub.LogDebug("error on Marshal in SendSyncRequest: %v\n", err)
 		return nil, err
 	}
-	req := NewRequest(username, password, device, TypeSyncRequest, sReqJSON)
-	hub.LogDebug("SendSyncRequest called,\n request id: %v,\n username: %v, password: %v, device: %v,\n unrootPath: %v,\n action: %v,\n file checksum: %v\n", req.ID, username, password, device, unrootPath, action, file.ContentChecksum)
-	res, err := hub.SendRequestForResponse(req)
+	req := idempotentRequest(ctx, NewRequest(username, password, device, TypeSyncRequest, sReqData))
+	hub.LogDebug("SendSyncRequest called,\n request id: %v,\n username: %v, device: %v,\n unrootPath: %v,\n action: %v,\n file checksum: %v\n", req.ID, username, device, unrootPath, action, file.ContentChecksum)
+	res, err := hub.SendRequestForResponseContext(ctx, req)
 	if err != nil {
 		hub.LogDebug("error on SendRequestForResponse in SendSyncRequest: %v\n", err)
 		return nil, err
 	}
-	return res, nil
+	return res, res.Err()
 }
 
 // SendFileRequest sends a request of data type of file content
 func (hub *Hub) SendFileRequest(username string, password string, device string, unrootPath string, file *File, content []byte) (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendFileRequestContext(ctx, username, password, device, unrootPath, file, content)
+	})
+}
+
+// SendFileRequestContext is SendFileRequest with ctx to cancel or set deadline for waiting the response
+// it returns the response with the CodedError of it if peer responds with an error
+func (hub *Hub) SendFileRequestContext(ctx context.Context, username string, password string, device string, unrootPath string, file *File, content []byte) (*Response, error) {
 	fReq := FileRequest{
 		File:       file,
 		UnrootPath: unrootPath,
 		Content:    content,
 	}
-	fReqJSON, err := json.Marshal(fReq)
+	fReqData, err := hub.Marshal(fReq)
 	if err != nil {
-		hub.LogDebug("error on json Marshal in SendFileRequest: %v\n", err)
+		hub.LogDebug("error on Marshal in SendFileRequest: %v\n", err)
 		return nil, err
 	}
-	req := NewRequest(username, password, device, TypeFile, fReqJSON)
-	hub.LogDebug("SendFileRequest called,\n request id: %v,\n username: %v, password: %v, device: %v,\n unrootPath: %v,\n file checksum: %v,\n content length: %v\n", req.ID, username, password, device, unrootPath, file.ContentChecksum, len(content))
-	res, err := hub.SendRequestForResponse(req)
+	req := idempotentRequest(ctx, NewRequest(username, password, device, TypeFile, fReqData))
+	hub.LogDebug("SendFileRequest called,\n request id: %v,\n username: %v, device: %v,\n unrootPath: %v,\n file checksum: %v,\n content length: %v\n", req.ID, username, device, unrootPath, file.ContentChecksum, len(content))
+	res, err := hub.SendRequestForResponseContext(ctx, req)
 	if err != nil {
 		hub.LogDebug("error on SendRequestForResponse in SendFileRequest: %v\n", err)
 		return nil, err
 	}
-	return res, nil
+	return res, res.Err()
 }
@@ -0,0 +1,92 @@
+package syncbox
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveEcho responds requests received by hub with their data in separate goroutines,
+// so that responses are sent out of the order of the requests, requests of data type ignore are never responded
+func serveEcho(hub *Hub, ignore string) {
+	for {
+		req, err := hub.ReceiveRequest()
+		if err != nil {
+			if hub.Err() != nil {
+				return
+			}
+			continue
+		}
+		if req.DataType == ignore {
+			continue
+		}
+		go func() {
+			time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+			hub.SendResponse(req, &Response{Status: StatusOK, Data: req.Data})
+		}()
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	a, b := hubPair(t)
+	go serveEcho(b, "")
+	const requests = 500
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("request %v", i))
+			res, err := a.SendRequestForResponse(NewRequest("", "", "", "ECHO", data))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(res.Data) != string(data) {
+				errs <- fmt.Errorf("request %v got the response %q", i, res.Data)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := a.PendingRequests(); n != 0 {
+		t.Fatalf("%v requests left in RequestQueue", n)
+	}
+}
+
+func TestRequestContextDone(t *testing.T) {
+	a, b := hubPair(t)
+	go serveEcho(b, "SLOW")
+	const requests = 50
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			dataType := "ECHO"
+			if i%2 == 0 {
+				dataType = "SLOW"
+			}
+			res, err := a.SendRequestForResponseContext(ctx, NewRequest("", "", "", dataType, nil))
+			if dataType == "SLOW" && err != context.DeadlineExceeded {
+				t.Errorf("unresponded request: got %v, %v", res, err)
+			}
+			if dataType == "ECHO" && err != nil {
+				t.Errorf("responded request: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := a.PendingRequests(); n != 0 {
+		t.Fatalf("%v timed out requests left in RequestQueue", n)
+	}
+}
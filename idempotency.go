@@ -0,0 +1,182 @@
+package syncbox
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// constants for idempotent requests
+const (
+	DefaultIdempotencyCacheSize = 256
+)
+
+// idempotencyKeyContextKey is the context key of the idempotency key
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey returns the context carrying key, digest, sync and file requests sent with the context carry key as their IdempotencyKey,
+// so that peer could tell the retries of an operation from new requests. Each retry is still a request of its own ID.
+// Use a new key, like UUID(), for each operation, and the same ctx for all the retries of it.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// IdempotencyKey returns the idempotency key carried by ctx, or empty string if there's none
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key
+}
+
+// idempotentRequest sets the IdempotencyKey of req to the idempotency key of ctx
+func idempotentRequest(ctx context.Context, req *Request) *Request {
+	req.IdempotencyKey = IdempotencyKey(ctx)
+	return req
+}
+
+// cachedResponse is the state of a request in ResponseCache,
+// done is closed once the request is processed, response is nil if the processing failed
+type cachedResponse struct {
+	response  *Response
+	completed bool
+	done      chan struct{}
+}
+
+// ResponseCache keeps the responses of the requests completed recently, by idempotency key,
+// at most capacity responses are kept, the least recently completed ones are evicted first
+type ResponseCache struct {
+	capacity int
+	entries  map[string]*cachedResponse
+	order    *list.List
+	mutex    sync.Mutex
+}
+
+// NewResponseCache instantiates an empty ResponseCache that keeps at most capacity responses
+func NewResponseCache(capacity int) *ResponseCache {
+	return &ResponseCache{
+		capacity: capacity,
+		entries:  make(map[string]*cachedResponse),
+		order:    list.New(),
+	}
+}
+
+// Len returns the number of requests completed or being processed in the cache
+func (cache *ResponseCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.entries)
+}
+
+// begin starts to track the request of key, it returns the existing entry and false if the request is seen already
+func (cache *ResponseCache) begin(key string) (*cachedResponse, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if entry, exists := cache.entries[key]; exists {
+		return entry, false
+	}
+	entry := &cachedResponse{
+		done: make(chan struct{}),
+	}
+	cache.entries[key] = entry
+	return entry, true
+}
+
+// record saves res as the response of the request of key, if the request is being processed
+func (cache *ResponseCache) record(key string, res *Response) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, exists := cache.entries[key]
+	if !exists || entry.completed {
+		return
+	}
+	saved := *res
+	entry.response = &saved
+}
+
+// finish ends the processing of the request of key, its response is kept if it succeeded and responded,
+// otherwise the request is forgotten, so that a retry processes it again
+func (cache *ResponseCache) finish(key string, succeeded bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, exists := cache.entries[key]
+	if !exists || entry.completed {
+		return
+	}
+	if !succeeded || entry.response == nil {
+		entry.response = nil
+		delete(cache.entries, key)
+		close(entry.done)
+		return
+	}
+	entry.completed = true
+	cache.order.PushBack(key)
+	close(entry.done)
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Front()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(string))
+	}
+}
+
+// responseCache returns the cache of the session that the hub belongs to, or nil if the session is not opened
+func (hub *Hub) responseCache() *ResponseCache {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	return hub.responses
+}
+
+func (hub *Hub) setResponseCache(cache *ResponseCache) {
+	hub.settingsMutex.Lock()
+	defer hub.settingsMutex.Unlock()
+	hub.responses = cache
+}
+
+// Idempotent returns the middleware that processes each request of types at most once per session by its IdempotencyKey,
+// retries of a completed request are responded with the original response instead of being processed again,
+// and retries of a request being processed wait for it. A request that fails is processed again when it's retried.
+// Requests without IdempotencyKey are always processed.
+func Idempotent(types ...string) Middleware {
+	deduped := make(map[string]bool)
+	for _, dataType := range types {
+		deduped[dataType] = true
+	}
+	return func(next RequestProcessor) RequestProcessor {
+		return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+			cache := peer.responseCache()
+			key := req.IdempotencyKey
+			if cache == nil || key == "" || !deduped[req.DataType] {
+				next(ctx, req, peer, eHandler)
+				return
+			}
+			for {
+				entry, first := cache.begin(key)
+				if first {
+					break
+				}
+				select {
+				case <-entry.done:
+				case <-ctx.Done():
+					return
+				}
+				if entry.response != nil {
+					peer.LogDebug("replaying response of duplicate %v request %v, idempotency key: %v\n", req.DataType, req.ID, key)
+					replay := *entry.response
+					if err := peer.SendResponse(req, &replay); err != nil {
+						eHandler(err)
+					}
+					return
+				}
+			}
+			succeeded := false
+			defer func() {
+				cache.finish(key, succeeded)
+			}()
+			var failed int32
+			next(ctx, req, peer, func(err error) {
+				atomic.StoreInt32(&failed, 1)
+				eHandler(err)
+			})
+			succeeded = atomic.LoadInt32(&failed) == 0
+		}
+	}
+}
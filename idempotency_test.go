@@ -0,0 +1,183 @@
+package syncbox
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// idempotentServer processes "OP" requests on hub with the Idempotent middleware and cache,
+// each processing responds with the number of times it's called so far, process could hold or fail it
+type idempotentServer struct {
+	calls   int32
+	process func(call int32) error
+}
+
+func (server *idempotentServer) serve(t *testing.T, hub *Hub, cache *ResponseCache) {
+	t.Helper()
+	hub.setResponseCache(cache)
+	registry := NewRegistry()
+	registry.Use(Idempotent("OP"))
+	registry.Register("OP", nil, func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+		call := atomic.AddInt32(&server.calls, 1)
+		if server.process != nil {
+			if err := server.process(call); err != nil {
+				eHandler(err)
+				peer.SendErrorResponse(req, err)
+				return
+			}
+		}
+		peer.SendResponse(req, &Response{Status: StatusOK, Data: []byte(strconv.Itoa(int(call)))})
+	})
+	go registry.HandleRequest(NewPeer(hub, "", "", hub.Conn.RemoteAddr(), nil), newTestHandler(NewDefaultLogger(), registry))
+}
+
+// sendOP sends an "OP" request of key on hub, and returns the data of the response
+func sendOP(hub *Hub, key string) (string, error) {
+	req := idempotentRequest(WithIdempotencyKey(context.Background(), key), NewRequest("", "", "", "OP", nil))
+	res, err := hub.SendRequestForResponse(req)
+	if err != nil {
+		return "", err
+	}
+	return string(res.Data), res.Err()
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	a, b := hubPair(t)
+	server := &idempotentServer{}
+	cache := NewResponseCache(8)
+	server.serve(t, b, cache)
+	for i := 0; i < 3; i++ {
+		if data, err := sendOP(a, "key"); err != nil || data != "1" {
+			t.Fatalf("attempt %v: %q, %v", i, data, err)
+		}
+	}
+	if data, err := sendOP(a, "other"); err != nil || data != "2" {
+		t.Fatalf("request of other key: %q, %v", data, err)
+	}
+	if data, err := sendOP(a, ""); err != nil || data != "3" {
+		t.Fatalf("request without key: %q, %v", data, err)
+	}
+	if data, err := sendOP(a, ""); err != nil || data != "4" {
+		t.Fatalf("requests without key should not be deduplicated: %q, %v", data, err)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("%v responses cached, want 2", cache.Len())
+	}
+
+	// the cache belongs to the session, which a reconnected client resumes on a new connection
+	c, d := hubPair(t)
+	server.serve(t, d, cache)
+	if data, err := sendOP(c, "key"); err != nil || data != "1" {
+		t.Fatalf("retry after reconnect: %q, %v", data, err)
+	}
+	if n := atomic.LoadInt32(&server.calls); n != 4 {
+		t.Fatalf("processed %v times, want 4", n)
+	}
+}
+
+func TestIdempotentConcurrentDuplicates(t *testing.T) {
+	a, b := hubPair(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &idempotentServer{process: func(call int32) error {
+		close(started)
+		<-release
+		return nil
+	}}
+	server.serve(t, b, NewResponseCache(8))
+
+	const duplicates = 5
+	var wg sync.WaitGroup
+	results := make(chan string, duplicates)
+	send := func() {
+		defer wg.Done()
+		data, err := sendOP(a, "key")
+		if err != nil {
+			t.Error(err)
+		}
+		results <- data
+	}
+	wg.Add(1)
+	go send()
+	<-started
+	for i := 1; i < duplicates; i++ {
+		wg.Add(1)
+		go send()
+	}
+	// duplicates wait for the first attempt, each with the context of its own request
+	waitFor(t, "duplicates to be received", func() bool {
+		b.inboundMutex.Lock()
+		defer b.inboundMutex.Unlock()
+		return len(b.inbound) == duplicates
+	})
+	close(release)
+	wg.Wait()
+	close(results)
+	for data := range results {
+		if data != "1" {
+			t.Fatalf("duplicate got response %q", data)
+		}
+	}
+	if n := atomic.LoadInt32(&server.calls); n != 1 {
+		t.Fatalf("processed %v times, want 1", n)
+	}
+	waitFor(t, "requests to finish", func() bool {
+		b.inboundMutex.Lock()
+		defer b.inboundMutex.Unlock()
+		return len(b.inbound) == 0
+	})
+}
+
+func TestIdempotentRetryAfterFailure(t *testing.T) {
+	a, b := hubPair(t)
+	server := &idempotentServer{process: func(call int32) error {
+		if call == 1 {
+			return NewCodedError(CodeStorageUnavailable, errors.New("storage unavailable"))
+		}
+		return nil
+	}}
+	cache := NewResponseCache(8)
+	server.serve(t, b, cache)
+	if _, err := sendOP(a, "key"); ErrorCode(err) != CodeStorageUnavailable {
+		t.Fatalf("first attempt: got %v", err)
+	}
+	waitFor(t, "failed request to be forgotten", func() bool {
+		return cache.Len() == 0
+	})
+	if data, err := sendOP(a, "key"); err != nil || data != "2" {
+		t.Fatalf("retry should be processed again: %q, %v", data, err)
+	}
+	if data, err := sendOP(a, "key"); err != nil || data != "2" {
+		t.Fatalf("retry of succeeded request should be replayed: %q, %v", data, err)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := NewResponseCache(2)
+	for i, key := range []string{"a", "b", "c"} {
+		if _, first := cache.begin(key); !first {
+			t.Fatalf("%v should be new", key)
+		}
+		cache.record(key, &Response{Status: StatusOK, Data: []byte{byte(i)}})
+		cache.finish(key, true)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("%v responses cached, want 2", cache.Len())
+	}
+	if _, first := cache.begin("a"); !first {
+		t.Fatal("the least recently completed response should be evicted")
+	}
+	entry, first := cache.begin("c")
+	if first || entry.response == nil || entry.response.Data[0] != 2 {
+		t.Fatalf("cached response of c: %v", entry.response)
+	}
+	// requests that finish without response are forgotten
+	cache.finish("a", true)
+	if _, first := cache.begin("a"); !first {
+		t.Fatal("request without response should be forgotten")
+	}
+}
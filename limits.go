@@ -0,0 +1,96 @@
+package syncbox
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// constants for resource limits of inbound messages
+const (
+	DefaultMaxMessageSize        = 256 * 1024 * 1024
+	DefaultMaxPartialMessages    = 64
+	DefaultMaxBufferedBytes      = 512 * 1024 * 1024
+	DefaultPartialMessageTimeout = 2 * time.Minute
+
+	// MaxMessageSizeCeiling bounds the size of a message even if MaxMessageSize is disabled,
+	// since the buffer of a message is allocated by the size peer claims
+	MaxMessageSizeCeiling = 1 << 32
+)
+
+// IsLimitError examines whether err is caused by peer exceeding the resource limits of the connection
+func IsLimitError(err error) bool {
+	return errors.Is(err, ErrorMessageTooLarge) || errors.Is(err, ErrorTooManyPartialMessages) || errors.Is(err, ErrorBufferLimit)
+}
+
+// limitError wraps err with peer address and details, so that the error handler could tell which peer is offending
+func (hub *Hub) limitError(err error, format string, args ...interface{}) error {
+	return fmt.Errorf("%w, peer: %v, %v", err, hub.Conn.RemoteAddr(), fmt.Sprintf(format, args...))
+}
+
+// messageSizeLimit returns the maximum size of a message, which is MaxMessageSize bounded by MaxMessageSizeCeiling
+func (hub *Hub) messageSizeLimit() int64 {
+	if hub.MaxMessageSize <= 0 || hub.MaxMessageSize > MaxMessageSizeCeiling {
+		return MaxMessageSizeCeiling
+	}
+	return hub.MaxMessageSize
+}
+
+// checkMessageSize examines whether a message of size is allowed
+func (hub *Hub) checkMessageSize(size int64) error {
+	if limit := hub.messageSizeLimit(); size > limit {
+		return hub.limitError(ErrorMessageTooLarge, "size: %v, limit: %v", size, limit)
+	}
+	return nil
+}
+
+// reserveMessage accounts a new partial message that buffers size bytes, if limits allow.
+// The caller should hold messageMutex.
+func (hub *Hub) reserveMessage(size int64) error {
+	if err := hub.checkMessageSize(size); err != nil {
+		return err
+	}
+	if hub.MaxPartialMessages > 0 && len(hub.MessageQueue) >= hub.MaxPartialMessages {
+		return hub.limitError(ErrorTooManyPartialMessages, "limit: %v", hub.MaxPartialMessages)
+	}
+	if hub.MaxBufferedBytes > 0 && hub.bufferedBytes+size > hub.MaxBufferedBytes {
+		return hub.limitError(ErrorBufferLimit, "buffered: %v, size: %v, limit: %v", hub.bufferedBytes, size, hub.MaxBufferedBytes)
+	}
+	hub.bufferedBytes += size
+	return nil
+}
+
+// removeMessage removes a partial message from MessageQueue and releases its buffer.
+// The caller should hold messageMutex.
+func (hub *Hub) removeMessage(id [PacketIDSIze]byte, item *MessageQueueItem) {
+	delete(hub.MessageQueue, id)
+	hub.bufferedBytes -= item.Size
+}
+
+// BufferedBytes returns the bytes buffered for partial inbound messages
+func (hub *Hub) BufferedBytes() int64 {
+	hub.messageMutex.Lock()
+	defer hub.messageMutex.Unlock()
+	return hub.bufferedBytes
+}
+
+// EvictMessages removes partial messages that receive nothing for PartialMessageTimeout, until the hub is closed,
+// so that messages abandoned by peer don't hold memory forever.
+// This should be run as goroutine.
+func (hub *Hub) EvictMessages() error {
+	if hub.PartialMessageTimeout <= 0 {
+		return nil
+	}
+	for sleepUntilDone(hub.done, hub.PartialMessageTimeout/2) {
+		deadline := time.Now().Add(-hub.PartialMessageTimeout)
+		hub.messageMutex.Lock()
+		for id, item := range hub.MessageQueue {
+			if item.Updated.Before(deadline) {
+				hub.LogInfo("evict incomplete message %x from %v, received %v of %v bytes\n", id, hub.Conn.RemoteAddr(), item.Received, item.Size)
+				hub.removeMessage(id, item)
+			}
+		}
+		hub.messageMutex.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package syncbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recover returns the middleware that recovers processors from panics,
+// the panic is reported to the error handler and the request is responded with CodeInternal,
+// so that a bug in one processor doesn't take the whole program down
+func Recover() Middleware {
+	return func(next RequestProcessor) RequestProcessor {
+		return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+			defer func() {
+				if r := recover(); r != nil {
+					err := fmt.Errorf("%w: %v", ErrorProcessorPanic, r)
+					peer.LogError("panic in processing %v request %v: %v\n%s", req.DataType, req.ID, r, debug.Stack())
+					eHandler(err)
+					if sendErr := peer.SendErrorResponse(req, NewCodedError(CodeInternal, err)); sendErr != nil {
+						eHandler(sendErr)
+					}
+				}
+			}()
+			next(ctx, req, peer, eHandler)
+		}
+	}
+}
+
+// LogRequests returns the middleware that logs each request with the time it takes to be processed
+func LogRequests(logger *Logger) Middleware {
+	return func(next RequestProcessor) RequestProcessor {
+		return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+			start := time.Now()
+			logger.LogDebug("processing %v request %v from %v\n", req.DataType, req.ID, peer.Address)
+			next(ctx, req, peer, eHandler)
+			logger.LogDebug("processed %v request %v from %v in %v\n", req.DataType, req.ID, peer.Address, time.Since(start))
+		}
+	}
+}
+
+// Authenticate returns the middleware that processes requests only if authenticate accepts them,
+// the others are responded with CodeAuthFailed, unless authenticate returns a CodedError telling another code.
+// Requests of the exempt types are processed without authentication.
+func Authenticate(authenticate func(*Request, *Peer) error, exempt ...string) Middleware {
+	exempted := make(map[string]bool)
+	for _, dataType := range exempt {
+		exempted[dataType] = true
+	}
+	return func(next RequestProcessor) RequestProcessor {
+		return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+			if !exempted[req.DataType] {
+				if err := authenticate(req, peer); err != nil {
+					peer.LogDebug("authentication of %v request %v from %v failed: %v\n", req.DataType, req.ID, peer.Address, err)
+					var codedErr *CodedError
+					if !errors.As(err, &codedErr) {
+						err = NewCodedError(CodeAuthFailed, err)
+					}
+					if sendErr := peer.SendErrorResponse(req, err); sendErr != nil {
+						eHandler(sendErr)
+					}
+					return
+				}
+			}
+			next(ctx, req, peer, eHandler)
+		}
+	}
+}
+
+// RequestStats is the statistics of processing requests of a type,
+// Errors is the number of requests that report errors, Duration is the total time taken to process the requests
+type RequestStats struct {
+	Count    int64
+	Errors   int64
+	Duration time.Duration
+}
+
+func (stats *RequestStats) String() string {
+	return ToString(stats)
+}
+
+// RequestMetrics collects RequestStats of each request type, its Middleware method is the middleware that records them
+type RequestMetrics struct {
+	stats map[string]*RequestStats
+	mutex sync.Mutex
+}
+
+// NewRequestMetrics instantiates an empty RequestMetrics
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{
+		stats: make(map[string]*RequestStats),
+	}
+}
+
+// Middleware records the statistics of the requests processed by next
+func (metrics *RequestMetrics) Middleware(next RequestProcessor) RequestProcessor {
+	return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+		start := time.Now()
+		var failed int32
+		next(ctx, req, peer, func(err error) {
+			atomic.StoreInt32(&failed, 1)
+			eHandler(err)
+		})
+		metrics.record(req.DataType, time.Since(start), atomic.LoadInt32(&failed) == 1)
+	}
+}
+
+func (metrics *RequestMetrics) record(dataType string, duration time.Duration, failed bool) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	stats, exists := metrics.stats[dataType]
+	if !exists {
+		stats = &RequestStats{}
+		metrics.stats[dataType] = stats
+	}
+	stats.Count++
+	if failed {
+		stats.Errors++
+	}
+	stats.Duration += duration
+}
+
+// Stats returns a copy of the statistics by request type
+func (metrics *RequestMetrics) Stats() map[string]RequestStats {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	stats := make(map[string]RequestStats, len(metrics.stats))
+	for dataType, s := range metrics.stats {
+		stats[dataType] = *s
+	}
+	return stats
+}
+
+// tokenBucket is the rate limiting state of a peer or a host
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		tokens:  float64(burst),
+		updated: now,
+	}
+}
+
+// take refills the bucket by rate tokens per second up to burst, and takes a token if there's any
+func (bucket *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * rate
+	if bucket.tokens > float64(burst) {
+		bucket.tokens = float64(burst)
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// RateLimit returns the middleware that allows each peer to send rate requests per second on average,
+// with bursts of at most burst requests, requests beyond that are responded with CodeRateLimited
+func RateLimit(rate float64, burst int) Middleware {
+	buckets := make(map[*Peer]*tokenBucket)
+	var mutex sync.Mutex
+	allow := func(peer *Peer) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now := time.Now()
+		bucket, exists := buckets[peer]
+		if !exists {
+			bucket = newTokenBucket(burst, now)
+			buckets[peer] = bucket
+			// forget the peer once it disconnects
+			go func() {
+				<-peer.Done()
+				mutex.Lock()
+				delete(buckets, peer)
+				mutex.Unlock()
+			}()
+		}
+		return bucket.take(rate, burst, now)
+	}
+	return func(next RequestProcessor) RequestProcessor {
+		return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+			if !allow(peer) {
+				peer.LogDebug("%v request %v from %v exceeds rate limit\n", req.DataType, req.ID, peer.Address)
+				if err := peer.SendErrorResponse(req, ErrorRateLimited); err != nil {
+					eHandler(err)
+				}
+				return
+			}
+			next(ctx, req, peer, eHandler)
+		}
+	}
+}
+
+// RateLimitHost returns the middleware that allows each remote host to send rate requests of dataTypes per second on average,
+// with bursts of at most burst requests, requests beyond that are responded with CodeRateLimited.
+// It's for requests that are expensive before the peer is authenticated, like the ones verifying passwords,
+// hosts are limited instead of peers since a peer could reconnect to get a new limit.
+func RateLimitHost(rate float64, burst int, dataTypes ...string) Middleware {
+	limited := make(map[string]bool)
+	for _, dataType := range dataTypes {
+		limited[dataType] = true
+	}
+	buckets := make(map[string]*tokenBucket)
+	var mutex sync.Mutex
+	allow := func(host string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now := time.Now()
+		bucket, exists := buckets[host]
+		if !exists {
+			// forget the hosts whose buckets are refilled, they are as new ones
+			for other, b := range buckets {
+				if b.tokens+now.Sub(b.updated).Seconds()*rate >= float64(burst) {
+					delete(buckets, other)
+				}
+			}
+			bucket = newTokenBucket(burst, now)
+			buckets[host] = bucket
+		}
+		return bucket.take(rate, burst, now)
+	}
+	return func(next RequestProcessor) RequestProcessor {
+		return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+			if limited[req.DataType] && !allow(peerHost(peer)) {
+				peer.LogDebug("%v request %v from %v exceeds rate limit\n", req.DataType, req.ID, peer.Address)
+				if err := peer.SendErrorResponse(req, ErrorRateLimited); err != nil {
+					eHandler(err)
+				}
+				return
+			}
+			next(ctx, req, peer, eHandler)
+		}
+	}
+}
+
+// peerHost returns the host of the remote address of peer
+func peerHost(peer *Peer) string {
+	if peer.Address == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(peer.Address.String())
+	if err != nil {
+		return peer.Address.String()
+	}
+	return host
+}
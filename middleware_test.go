@@ -0,0 +1,139 @@
+package syncbox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// hubPair returns two hubs connected to each other, they are closed when the test ends
+func hubPair(t *testing.T) (*Hub, *Hub) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	a := NewHub(c1, func(error) {})
+	b := NewHub(c2, func(error) {})
+	go a.Setup()
+	go b.Setup()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestRateLimitHost(t *testing.T) {
+	a, b := hubPair(t)
+	processed := 0
+	process := RateLimitHost(1, 2, TypeIdentity)(func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+		processed++
+	})
+	peerFrom := func(ip string, port int) *Peer {
+		return NewPeer(a, "", "", &net.TCPAddr{IP: net.ParseIP(ip), Port: port}, nil)
+	}
+	var responses chan *Response
+	send := func(peer *Peer, dataType string) {
+		req := NewRequest("", "", "", dataType, nil)
+		responses = b.registerRequest(req.ID)
+		process(context.Background(), req, peer, func(err error) {
+			t.Fatal(err)
+		})
+	}
+	expectRateLimited := func() {
+		if res := <-responses; ErrorCode(res.Err()) != CodeRateLimited {
+			t.Fatalf("got status %v, want rate limited", res.Status)
+		}
+	}
+
+	// a reconnecting peer comes from another port of the same host, which shares the limit
+	send(peerFrom("10.0.0.1", 1000), TypeIdentity)
+	send(peerFrom("10.0.0.1", 1001), TypeIdentity)
+	send(peerFrom("10.0.0.1", 1002), TypeIdentity)
+	expectRateLimited()
+	if processed != 2 {
+		t.Fatalf("processed %v requests within burst 2", processed)
+	}
+	send(peerFrom("10.0.0.2", 1000), TypeIdentity)
+	if processed != 3 {
+		t.Fatal("other hosts should not be limited")
+	}
+	send(peerFrom("10.0.0.1", 1003), TypeDigest)
+	if processed != 4 {
+		t.Fatal("other request types should not be limited")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	a, b := hubPair(t)
+	registry := NewRegistry()
+	registry.Use(Recover())
+	registry.Register("PANIC", nil, func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+		panic("bug")
+	})
+	registry.Register("ECHO", nil, processEcho)
+	handler := serveRegistry(t, b, registry)
+	if err := sendType(t, a, "PANIC", ""); ErrorCode(err) != CodeInternal {
+		t.Fatalf("request of panicking processor: got %v", err)
+	}
+	if err := <-handler.errs; !errors.Is(err, ErrorProcessorPanic) {
+		t.Fatalf("reported error: got %v", err)
+	}
+	if err := sendType(t, a, "ECHO", ""); err != nil {
+		t.Fatalf("requests after the panic: %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, b := hubPair(t)
+	registry := NewRegistry()
+	registry.Use(Authenticate(func(req *Request, peer *Peer) error {
+		switch req.Password {
+		case "secret":
+			return nil
+		case "busy":
+			return NewCodedError(CodeStorageUnavailable, errors.New("user store unavailable"))
+		}
+		return ErrorAuthFailed
+	}, "LOGIN"))
+	registry.Register("ECHO", nil, processEcho)
+	registry.Register("LOGIN", nil, processEcho)
+	serveRegistry(t, b, registry)
+	cases := []struct {
+		dataType string
+		password string
+		code     string
+	}{
+		{"ECHO", "secret", ""},
+		{"ECHO", "wrong", CodeAuthFailed},
+		{"ECHO", "busy", CodeStorageUnavailable},
+		{"LOGIN", "wrong", ""},
+	}
+	for _, c := range cases {
+		err := sendType(t, a, c.dataType, c.password)
+		if (c.code == "" && err != nil) || (c.code != "" && ErrorCode(err) != c.code) {
+			t.Fatalf("%v request with password %q: got %v, want %q", c.dataType, c.password, err, c.code)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	registry := NewRegistry()
+	registry.Use(RateLimit(0.001, 2))
+	registry.Register("ECHO", nil, processEcho)
+	a, b := hubPair(t)
+	c, d := hubPair(t)
+	serveRegistry(t, b, registry)
+	serveRegistry(t, d, registry)
+	for i := 0; i < 2; i++ {
+		if err := sendType(t, a, "ECHO", ""); err != nil {
+			t.Fatalf("request %v within burst: %v", i, err)
+		}
+	}
+	if err := sendType(t, a, "ECHO", ""); ErrorCode(err) != CodeRateLimited {
+		t.Fatalf("request beyond burst: got %v", err)
+	}
+	// peers are limited apart
+	if err := sendType(t, c, "ECHO", ""); err != nil {
+		t.Fatalf("request of other peer: %v", err)
+	}
+}
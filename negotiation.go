@@ -0,0 +1,162 @@
+package syncbox
+
+import (
+	"fmt"
+	"sort"
+)
+
+// constants for protocol capabilities, a capability is only used on a connection
+// when both peers list it in the identity handshake
+const (
+	CapabilityFraming         = "framing"
+	CapabilityChunkedTransfer = "chunked-transfer"
+	CapabilityCompression     = "compression"
+	CapabilityCancel          = "cancel"
+	CapabilityHeartbeat       = "heartbeat"
+	CapabilityChecksum        = "checksum"
+	CapabilitySigning         = "signing"
+)
+
+// variables for negotiation
+var (
+	// SupportedCapabilities are the capabilities that this build implements
+	SupportedCapabilities = []string{CapabilityFraming, CapabilityChunkedTransfer, CapabilityCompression, CapabilityCancel, CapabilityHeartbeat, CapabilityChecksum, CapabilitySigning}
+
+	// MinProtocolVersion is the oldest protocol version of peers to accept,
+	// peers that don't tell their version are considered as ProtocolVersionLegacy
+	MinProtocolVersion = ProtocolVersionLegacy
+)
+
+// NegotiateProtocol decides the protocol settings from the ones requested by peer,
+// the capabilities are the ones supported by both sides.
+// Compression is only agreed if both sides support an algorithm, which is the preferred one in SupportedCompressions,
+// and the codec is the preferred one of SupportedCodecs, or JSON if peer doesn't offer any.
+// Signing is agreed if peer offers its signing key and the hub has SigningIdentity, the secret is used at once for inbound messages,
+// so that nothing unsigned is accepted once the response is sent.
+// It returns ErrorProtocolTooOld with the response carrying the reason if peer is too old to be served,
+// or ErrorSigningRequired if RequireSigning is set but peer doesn't sign.
+func (hub *Hub) NegotiateProtocol(iReq *IdentityRequest) (*IdentityResponse, error) {
+	version := iReq.ProtocolVersion
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < ProtocolVersionLegacy {
+		version = ProtocolVersionLegacy
+	}
+	iRes := &IdentityResponse{
+		ProtocolVersion:    version,
+		SoftwareVersion:    SoftwareVersion,
+		Capabilities:       make([]string, 0, len(SupportedCapabilities)),
+		MaxFrameSize:       hub.MaxFrameSize,
+		MaxPartialMessages: hub.MaxPartialMessages,
+	}
+	if version < MinProtocolVersion {
+		iRes.Reason = fmt.Sprintf("protocol version %v of software version %q is not supported, the minimum protocol version is %v, please upgrade the client", version, iReq.SoftwareVersion, MinProtocolVersion)
+		return iRes, ErrorProtocolTooOld
+	}
+	requested := make(map[string]bool)
+	for _, capability := range iReq.Capabilities {
+		requested[capability] = true
+	}
+	if requested[CapabilityCompression] {
+		iRes.Compression = chooseCompression(iReq.Compressions)
+		requested[CapabilityCompression] = iRes.Compression != ""
+	}
+	iRes.Codec = chooseCodec(iReq.Codecs)
+	if requested[CapabilitySigning] {
+		requested[CapabilitySigning] = hub.agreeSigning(iReq, iRes)
+	}
+	if hub.RequireSigning && !requested[CapabilitySigning] {
+		iRes.Reason = "message signing is required, please upgrade the client"
+		return iRes, ErrorSigningRequired
+	}
+	for _, capability := range SupportedCapabilities {
+		if requested[capability] {
+			iRes.Capabilities = append(iRes.Capabilities, capability)
+		}
+	}
+	return iRes, nil
+}
+
+// agreeSigning derives the signing secret from the signing key of iReq and SigningIdentity, and puts the keys of this side in iRes,
+// it returns whether signing is agreed, which is never without SigningIdentity
+func (hub *Hub) agreeSigning(iReq *IdentityRequest, iRes *IdentityResponse) bool {
+	if len(iReq.SigningKey) == 0 || hub.SigningIdentity == nil {
+		return false
+	}
+	secret, key, err := serverSigningSecret(hub.SigningIdentity, iReq.SigningKey)
+	if err != nil {
+		hub.LogDebug("error on serverSigningSecret in agreeSigning: %v\n", err)
+		return false
+	}
+	iRes.SigningKey = key
+	iRes.ServerSigningKey = hub.SigningIdentity.PublicKey().Bytes()
+	hub.setSigningSecret(secret)
+	return true
+}
+
+// ApplyNegotiation records the negotiated settings on the hub and uses them to send messages,
+// peerMaxFrameSize is the maximum frame size that the peer accepts, and peerMaxPartialMessages is the number of messages
+// the peer receives at the same time, which are ignored if they are zero.
+// Inbound messages are always accepted in either encoding and with any codec.
+func (hub *Hub) ApplyNegotiation(iRes *IdentityResponse, peerMaxFrameSize int, peerMaxPartialMessages int) {
+	hub.settingsMutex.Lock()
+	defer hub.settingsMutex.Unlock()
+	hub.protocolVersion = iRes.ProtocolVersion
+	hub.peerVersion = iRes.SoftwareVersion
+	hub.capabilities = make(map[string]bool)
+	for _, capability := range iRes.Capabilities {
+		hub.capabilities[capability] = true
+	}
+	hub.sendFrameSize = peerMaxFrameSize
+	hub.sendPartialMessages = peerMaxPartialMessages
+	hub.compression = iRes.Compression
+	hub.codec = iRes.Codec
+	hub.sessionID = iRes.SessionID
+}
+
+// ProtocolVersion returns the negotiated protocol version
+func (hub *Hub) ProtocolVersion() int {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	return hub.protocolVersion
+}
+
+// PeerSoftwareVersion returns the software version that peer told in the identity handshake
+func (hub *Hub) PeerSoftwareVersion() string {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	return hub.peerVersion
+}
+
+// SessionID returns the ID of the session that the connection belongs to, it's assigned by server in the identity handshake
+func (hub *Hub) SessionID() string {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	return hub.sessionID
+}
+
+func (hub *Hub) setSessionID(id string) {
+	hub.settingsMutex.Lock()
+	defer hub.settingsMutex.Unlock()
+	hub.sessionID = id
+}
+
+// HasCapability examines whether the capability is negotiated on the connection
+func (hub *Hub) HasCapability(capability string) bool {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	return hub.capabilities[capability]
+}
+
+// Capabilities returns the negotiated capabilities, sorted by name
+func (hub *Hub) Capabilities() []string {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	capabilities := make([]string, 0, len(hub.capabilities))
+	for capability := range hub.capabilities {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
@@ -0,0 +1,120 @@
+package syncbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	cases := []struct {
+		requested int
+		version   int
+	}{
+		{0, ProtocolVersionLegacy},
+		{ProtocolVersionLegacy, ProtocolVersionLegacy},
+		{ProtocolVersionFraming, ProtocolVersionFraming},
+		{ProtocolVersion + 10, ProtocolVersion},
+	}
+	for _, c := range cases {
+		iRes, err := newTestHub(t).NegotiateProtocol(&IdentityRequest{ProtocolVersion: c.requested})
+		if err != nil {
+			t.Fatalf("version %v: %v", c.requested, err)
+		}
+		if iRes.ProtocolVersion != c.version {
+			t.Fatalf("version %v is clamped to %v, want %v", c.requested, iRes.ProtocolVersion, c.version)
+		}
+	}
+}
+
+func TestNegotiateProtocolTooOld(t *testing.T) {
+	defer func(version int) {
+		MinProtocolVersion = version
+	}(MinProtocolVersion)
+	MinProtocolVersion = ProtocolVersionFraming
+	for _, requested := range []int{0, ProtocolVersionLegacy} {
+		iRes, err := newTestHub(t).NegotiateProtocol(&IdentityRequest{ProtocolVersion: requested, SoftwareVersion: "old"})
+		if err != ErrorProtocolTooOld || iRes.Reason == "" {
+			t.Fatalf("version %v: got %v, reason %q", requested, err, iRes.Reason)
+		}
+	}
+	if _, err := newTestHub(t).NegotiateProtocol(&IdentityRequest{ProtocolVersion: ProtocolVersionFraming}); err != nil {
+		t.Fatalf("version at the minimum: %v", err)
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	cases := []struct {
+		name         string
+		requested    []string
+		capabilities []string
+	}{
+		{"none", nil, []string{}},
+		{"all", SupportedCapabilities, []string{CapabilityFraming, CapabilityChunkedTransfer, CapabilityCancel, CapabilityHeartbeat, CapabilityChecksum}},
+		{"unknown ones", []string{"rename", CapabilityHeartbeat, "zero-copy", CapabilityFraming}, []string{CapabilityFraming, CapabilityHeartbeat}},
+		{"duplicated", []string{CapabilityCancel, CapabilityCancel}, []string{CapabilityCancel}},
+	}
+	for _, c := range cases {
+		// without compressions, signing key and signing identity, compression and signing are never agreed
+		hub := newTestHub(t)
+		iRes, err := hub.NegotiateProtocol(&IdentityRequest{ProtocolVersion: ProtocolVersion, Capabilities: c.requested})
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(iRes.Capabilities, c.capabilities) {
+			t.Fatalf("%v: agreed on %v, want %v", c.name, iRes.Capabilities, c.capabilities)
+		}
+		hub.ApplyNegotiation(iRes, 0, 0)
+		for _, capability := range SupportedCapabilities {
+			agreed := false
+			for _, expected := range c.capabilities {
+				agreed = agreed || expected == capability
+			}
+			if hub.HasCapability(capability) != agreed {
+				t.Fatalf("%v: hub has %v: %v", c.name, capability, hub.HasCapability(capability))
+			}
+		}
+	}
+}
+
+func TestNegotiateRequireSigning(t *testing.T) {
+	identity, _ := newSigningKey()
+	client, _ := newSigningKey()
+	cases := []struct {
+		name       string
+		identity   bool
+		requested  []string
+		signingKey []byte
+		err        error
+	}{
+		{"signing peer", true, []string{CapabilitySigning}, client.PublicKey().Bytes(), nil},
+		{"peer without signing", true, []string{CapabilityFraming}, nil, ErrorSigningRequired},
+		{"peer without signing key", true, []string{CapabilitySigning}, nil, ErrorSigningRequired},
+		{"bad signing key", true, []string{CapabilitySigning}, []byte{1, 2, 3}, ErrorSigningRequired},
+		{"hub without identity", false, []string{CapabilitySigning}, client.PublicKey().Bytes(), ErrorSigningRequired},
+	}
+	for _, c := range cases {
+		hub := newTestHub(t)
+		hub.RequireSigning = true
+		if c.identity {
+			hub.SigningIdentity = identity
+		}
+		iRes, err := hub.NegotiateProtocol(&IdentityRequest{ProtocolVersion: ProtocolVersion, Capabilities: c.requested, SigningKey: c.signingKey})
+		if err != c.err {
+			t.Fatalf("%v: got %v, want %v", c.name, err, c.err)
+		}
+		if err != nil && iRes.Reason == "" {
+			t.Fatalf("%v: refused without reason", c.name)
+		}
+		if err == nil && (!reflect.DeepEqual(iRes.Capabilities, []string{CapabilitySigning}) || len(iRes.ServerSigningKey) == 0) {
+			t.Fatalf("%v: capabilities %v, server signing key %x", c.name, iRes.Capabilities, iRes.ServerSigningKey)
+		}
+	}
+
+	// signing is agreed without being required if both sides could sign
+	hub := newTestHub(t)
+	hub.SigningIdentity = identity
+	iRes, err := hub.NegotiateProtocol(&IdentityRequest{ProtocolVersion: ProtocolVersion, Capabilities: []string{CapabilitySigning}, SigningKey: client.PublicKey().Bytes()})
+	if err != nil || !reflect.DeepEqual(iRes.Capabilities, []string{CapabilitySigning}) {
+		t.Fatalf("optional signing: %v, %v", iRes.Capabilities, err)
+	}
+}
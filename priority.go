@@ -0,0 +1,240 @@
+package syncbox
+
+// Priority is the class of an outbound message, which decides how soon its frames are written
+type Priority int
+
+// constants for priorities, lower value is written first
+const (
+	// PriorityControl is for messages that keep the connection working, like heartbeats, cancellations and the identity handshake,
+	// they are always written before messages of other priorities
+	PriorityControl Priority = iota
+	// PriorityMetadata is for small, latency-sensitive messages, like digests, sync requests and responses
+	PriorityMetadata
+	// PriorityBulk is for messages carrying file content
+	PriorityBulk
+
+	priorityLanes = 3
+
+	// MetadataBurst is the number of metadata frames written before a bulk frame when both are waiting,
+	// so bulk transfers make steady progress when there are many metadata messages
+	MetadataBurst = 4
+)
+
+// variables for priorities
+var (
+	// RequestPriorities are the priorities of requests by data type, requests of other types are PriorityMetadata.
+	// Responses are PriorityControl if their requests are, otherwise PriorityMetadata.
+	// It should be set before any connection is made.
+	RequestPriorities = map[string]Priority{
+		TypeIdentity:     PriorityControl,
+		TypeRegister:     PriorityControl,
+		TypeRefreshToken: PriorityControl,
+		TypeListDevices:  PriorityMetadata,
+		TypeRevokeDevice: PriorityMetadata,
+		TypeCancel:       PriorityControl,
+		TypePing:         PriorityControl,
+		TypeFile:         PriorityBulk,
+		TypeFileChunk:    PriorityBulk,
+	}
+)
+
+// RequestPriority returns the priority of requests of dataType
+func RequestPriority(dataType string) Priority {
+	if priority, exists := RequestPriorities[dataType]; exists {
+		return priority
+	}
+	return PriorityMetadata
+}
+
+// responsePriority returns the priority of responses to requests of dataType
+func responsePriority(dataType string) Priority {
+	if RequestPriority(dataType) == PriorityControl {
+		return PriorityControl
+	}
+	return PriorityMetadata
+}
+
+// outboundMessage is a message waiting to be written, either in frames or legacy packets,
+// result receives the error of writing once the message is written.
+// Messages with encode have no frames or packets until encode puts them when the first frame is about to be written.
+type outboundMessage struct {
+	frames  []*Frame
+	packets []*Packet
+	encode  func() error
+	started bool
+	result  chan error
+}
+
+// next returns the bytes of the next frame or packet to write
+func (message *outboundMessage) next() []byte {
+	message.started = true
+	if len(message.frames) > 0 {
+		frame := message.frames[0]
+		message.frames = message.frames[1:]
+		return frame.ToBytes()
+	}
+	packet := message.packets[0]
+	message.packets = message.packets[1:]
+	data := packet.ToBytes()
+	return data[:]
+}
+
+// written tells whether all the frames or packets of message are written
+func (message *outboundMessage) written() bool {
+	return len(message.frames) == 0 && len(message.packets) == 0
+}
+
+// lane is the queue of messages of a priority, messages take turns to write a frame
+type lane struct {
+	messages []*outboundMessage
+	started  int
+}
+
+// enqueue adds message to the lane of priority, and wakes up SendPackets
+func (hub *Hub) enqueue(message *outboundMessage, priority Priority) {
+	hub.laneMutex.Lock()
+	lane := &hub.lanes[priority]
+	lane.messages = append(lane.messages, message)
+	hub.laneMutex.Unlock()
+	select {
+	case hub.sendReady <- struct{}{}:
+	default:
+	}
+}
+
+// partialLimits returns the number of messages that could be partially written at the same time,
+// for all lanes and for the metadata and bulk lanes, so that the partial messages that peer buffers stay under its MaxPartialMessages.
+// One is left for control messages, bulk messages take at most half of them, and metadata messages leave one for bulk messages,
+// so that neither lane holds back the other.
+func (hub *Hub) partialLimits() (int, int, int) {
+	hub.settingsMutex.RLock()
+	limit := hub.sendPartialMessages
+	hub.settingsMutex.RUnlock()
+	if limit <= 0 {
+		limit = DefaultMaxPartialMessages
+	}
+	metadata, bulk := limit-2, limit/2
+	if metadata < 1 {
+		metadata = 1
+	}
+	if bulk < 1 {
+		bulk = 1
+	}
+	return limit, metadata, bulk
+}
+
+// nextMessage takes the message to write a frame of. Control messages are taken first,
+// metadata messages are taken for MetadataBurst times in a row at most if bulk messages are waiting.
+// Within a lane, messages take turns, and messages not started yet wait if partialLimits are reached.
+func (hub *Hub) nextMessage() (*outboundMessage, Priority) {
+	limit, metadataLimit, bulkLimit := hub.partialLimits()
+	hub.laneMutex.Lock()
+	defer hub.laneMutex.Unlock()
+	lanes := &hub.lanes
+	started := lanes[PriorityControl].started + lanes[PriorityMetadata].started + lanes[PriorityBulk].started
+	startLimit := limit
+	if limit > 1 {
+		startLimit = limit - 1
+	}
+	control := lanes[PriorityControl].ready(started < limit)
+	metadata := lanes[PriorityMetadata].ready(started < startLimit && lanes[PriorityMetadata].started < metadataLimit)
+	bulk := lanes[PriorityBulk].ready(started < startLimit && lanes[PriorityBulk].started < bulkLimit)
+	var priority Priority
+	var i int
+	switch {
+	case control >= 0:
+		priority, i = PriorityControl, control
+	case metadata >= 0 && (bulk < 0 || hub.metadataBurst < MetadataBurst):
+		priority, i = PriorityMetadata, metadata
+		if bulk < 0 {
+			hub.metadataBurst = 0
+		} else {
+			hub.metadataBurst++
+		}
+	case bulk >= 0:
+		priority, i = PriorityBulk, bulk
+		hub.metadataBurst = 0
+	default:
+		return nil, 0
+	}
+	lane := &hub.lanes[priority]
+	message := lane.messages[i]
+	lane.messages = append(lane.messages[:i], lane.messages[i+1:]...)
+	if !message.started {
+		lane.started++
+	}
+	return message, priority
+}
+
+// ready returns the index of the first message that could write a frame, or -1 if there's none,
+// messages not started yet could write only if canStart
+func (lane *lane) ready(canStart bool) int {
+	for i, message := range lane.messages {
+		if message.started || canStart {
+			return i
+		}
+	}
+	return -1
+}
+
+// requeue puts message back to the end of its lane after a frame of it is written, or finishes it if it's fully written
+func (hub *Hub) requeue(message *outboundMessage, priority Priority) {
+	hub.laneMutex.Lock()
+	defer hub.laneMutex.Unlock()
+	lane := &hub.lanes[priority]
+	if message.written() {
+		lane.started--
+		return
+	}
+	lane.messages = append(lane.messages, message)
+}
+
+// sendQueued writes message by SendPackets, it returns once the message is written or the hub is closed
+func (hub *Hub) sendQueued(message *outboundMessage, priority Priority) error {
+	message.result = make(chan error, 1)
+	hub.enqueue(message, priority)
+	select {
+	case err := <-message.result:
+		return err
+	case <-hub.done:
+		return hub.Err()
+	}
+}
+
+// SendPackets writes the queued messages to the connection, a frame or packet at a time, until the hub is closed.
+// Frames of different messages are interleaved, which peer assembles by their message IDs,
+// so a large message doesn't hold back the messages of higher priority.
+// Writing errors close the hub, since the connection is left with a partial frame.
+// This should be run as goroutine.
+func (hub *Hub) SendPackets() error {
+	for {
+		message, priority := hub.nextMessage()
+		if message == nil {
+			select {
+			case <-hub.sendReady:
+				continue
+			case <-hub.done:
+				return nil
+			}
+		}
+		if !message.started && message.encode != nil {
+			if err := message.encode(); err != nil {
+				// nothing is written, requeue finishes the message
+				hub.requeue(message, priority)
+				message.result <- err
+				continue
+			}
+		}
+		data := message.next()
+		hub.LogVerbose("%v bytes to send in priority %v\n", len(data), priority)
+		if _, err := hub.Conn.Write(data); err != nil {
+			hub.LogDebug("error on SendPackets: %v\n", err)
+			message.result <- err
+			return err
+		}
+		hub.requeue(message, priority)
+		if message.written() {
+			message.result <- nil
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package syncbox
+
+import (
+	"testing"
+)
+
+// testMessage returns a message of frames that are told apart by id
+func testMessage(id byte, frames int) *outboundMessage {
+	message := &outboundMessage{}
+	for i := 0; i < frames; i++ {
+		frame := &Frame{MessageSize: int64(frames), Offset: int64(i), Payload: []byte{id}}
+		frame.MessageID[0] = id
+		message.frames = append(message.frames, frame)
+	}
+	return message
+}
+
+// takeFrame takes a frame from the lanes as SendPackets does, it returns the id of the message of the frame, or 0 if there's none
+func takeFrame(hub *Hub) byte {
+	message, priority := hub.nextMessage()
+	if message == nil {
+		return 0
+	}
+	id := message.frames[0].MessageID[0]
+	message.next()
+	hub.requeue(message, priority)
+	return id
+}
+
+// partialMessages returns the number of started messages that are not fully written
+func partialMessages(hub *Hub) int {
+	hub.laneMutex.Lock()
+	defer hub.laneMutex.Unlock()
+	return hub.lanes[PriorityControl].started + hub.lanes[PriorityMetadata].started + hub.lanes[PriorityBulk].started
+}
+
+func TestControlDuringBulk(t *testing.T) {
+	hub := newTestHub(t)
+	hub.enqueue(testMessage(1, 100), PriorityBulk)
+	for i := 0; i < 10; i++ {
+		if id := takeFrame(hub); id != 1 {
+			t.Fatalf("frame %v of message %v", i, id)
+		}
+	}
+	hub.enqueue(testMessage(2, 3), PriorityMetadata)
+	hub.enqueue(testMessage(3, 1), PriorityControl)
+	if id := takeFrame(hub); id != 3 {
+		t.Fatalf("control message should be written next, got a frame of %v", id)
+	}
+	// metadata frames take turns with bulk ones after MetadataBurst in a row
+	for i := 0; i < 3; i++ {
+		if id := takeFrame(hub); id != 2 {
+			t.Fatalf("metadata frame %v is behind a frame of %v", i, id)
+		}
+	}
+	if id := takeFrame(hub); id != 1 {
+		t.Fatalf("bulk message should continue, got a frame of %v", id)
+	}
+}
+
+func TestBulkMessagesInterleave(t *testing.T) {
+	hub := newTestHub(t)
+	hub.enqueue(testMessage(1, 10), PriorityBulk)
+	hub.enqueue(testMessage(2, 10), PriorityBulk)
+	frames := map[byte]int{}
+	for i := 0; i < 20; i++ {
+		frames[takeFrame(hub)]++
+		if i == 3 && (frames[1] == 0 || frames[2] == 0) {
+			t.Fatalf("both bulk messages should make progress, frames written: %v", frames)
+		}
+	}
+	if frames[1] != 10 || frames[2] != 10 || takeFrame(hub) != 0 {
+		t.Fatalf("frames written: %v", frames)
+	}
+	if n := partialMessages(hub); n != 0 {
+		t.Fatalf("%v messages left started", n)
+	}
+}
+
+func TestPartialMessagesUnderPeerLimit(t *testing.T) {
+	hub := newTestHub(t)
+	hub.ApplyNegotiation(&IdentityResponse{}, 0, 8)
+	for id := byte(1); id <= 10; id++ {
+		hub.enqueue(testMessage(id, 3), PriorityBulk)
+	}
+	most := 0
+	for takeFrame(hub) != 0 {
+		if n := partialMessages(hub); n > most {
+			most = n
+		}
+	}
+	// bulk messages take half of the limit of peer
+	if most != 4 {
+		t.Fatalf("%v bulk messages written at the same time, want 4", most)
+	}
+
+	hub.ApplyNegotiation(&IdentityResponse{}, 0, 4)
+	for id := byte(1); id <= 5; id++ {
+		hub.enqueue(testMessage(id, 3), PriorityBulk)
+	}
+	for id := byte(6); id <= 10; id++ {
+		hub.enqueue(testMessage(id, 3), PriorityMetadata)
+	}
+	lanes := map[bool]bool{}
+	for i := 0; i < 8; i++ {
+		lanes[takeFrame(hub) <= 5] = true
+		// one is left for control messages
+		if n := partialMessages(hub); n > 3 {
+			t.Fatalf("%v partial messages without control messages, want 3 at most", n)
+		}
+	}
+	if !lanes[true] || !lanes[false] {
+		t.Fatal("both bulk and metadata messages should make progress")
+	}
+	hub.enqueue(testMessage(11, 2), PriorityControl)
+	if id := takeFrame(hub); id != 11 {
+		t.Fatalf("control message should start, got a frame of %v", id)
+	}
+	for takeFrame(hub) != 0 {
+		if n := partialMessages(hub); n > 4 {
+			t.Fatalf("%v partial messages, over the limit of peer", n)
+		}
+	}
+	if n := partialMessages(hub); n != 0 {
+		t.Fatalf("%v messages left started", n)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"time"
 )
 
 // constants for protocol
@@ -19,23 +20,38 @@ const (
 	PacketDataSize  = 1024
 	PacketTotalSize = 1056
 
+	ProtocolVersionLegacy  = 1 // fixed size Packet
+	ProtocolVersionFraming = 2 // length-prefixed Frame
+	ProtocolVersion        = ProtocolVersionFraming
+	SoftwareVersion        = "0.2.0"
+
 	ByteDelim   = byte(4)
 	StringDelim = string(ByteDelim)
 
-	TypeIdentity    = "IDENTITY"
-	TypeDigest      = "DIGEST"
-	TypeSyncRequest = "SYNC-REQUEST"
-	TypeFile        = "FILE"
-
-	StatusOK  = 200
-	StatusBad = 400
+	TypeIdentity     = "IDENTITY"
+	TypeRegister     = "REGISTER"
+	TypeRefreshToken = "REFRESH-TOKEN"
+	TypeListDevices  = "LIST-DEVICES"
+	TypeRevokeDevice = "REVOKE-DEVICE"
+	TypeDigest       = "DIGEST"
+	TypeSyncRequest  = "SYNC-REQUEST"
+	TypeFile         = "FILE"
+	TypeFileChunk    = "FILE-CHUNK"
+	TypeCancel       = "CANCEL"
+	TypePing         = "PING"
+
+	StatusOK            = 200
+	StatusBad           = 400
+	StatusUnauthorized  = 401
+	StatusNotFound      = 404
+	StatusConflict      = 409
+	StatusQuotaExceeded = 413
+	StatusRateLimited   = 429
+	StatusInternal      = 500
+	StatusUnavailable   = 503
 
 	MessageAccept = "ACCEPT"
 	MessageDeny   = "DENY"
-
-	SyncboxServerUsername = "SYNCBOX-SERVER"
-	SyncboxServerPwd      = "SYNCBOX-SERVER-PWD"
-	SyncboxServerDevice   = "SYNCBOX-SERVER-DEVICE"
 )
 
 // Packet is a fixed length message as the basic element to send acrosss network
@@ -203,6 +219,15 @@ type Request struct {
 	Device   string
 	DataType string
 	Data     []byte
+	Token    string
+
+	// Timestamp, Nonce and Signature are set if signing is agreed on the connection, see signRequest
+	Timestamp int64
+	Nonce     string
+	Signature []byte
+
+	// IdempotencyKey is shared by the retries of an operation, see WithIdempotencyKey
+	IdempotencyKey string
 }
 
 func (req *Request) String() string {
@@ -227,21 +252,62 @@ type Response struct {
 	Status    int
 	Message   string
 	Data      []byte
+
+	// Timestamp, Nonce and Signature are set if signing is agreed on the connection, see signResponse
+	Timestamp int64
+	Nonce     string
+	Signature []byte
 }
 
 func (res *Response) String() string {
 	return ToString(res)
 }
 
-// IdentityRequest is the Request data type of user identity
+// IdentityRequest is the Request data type of user identity,
+// it also carries the protocol version and capabilities that the requesting peer supports,
+// and the ID of the session to resume if the client is reconnecting
 type IdentityRequest struct {
-	Username string
+	Username           string
+	ProtocolVersion    int
+	SoftwareVersion    string
+	Capabilities       []string
+	MaxFrameSize       int
+	Compressions       []string
+	Codecs             []string
+	SessionID          string
+	DeviceName         string
+	SigningKey         []byte
+	MaxPartialMessages int
 }
 
 func (req *IdentityRequest) String() string {
 	return ToString(req)
 }
 
+// IdentityResponse is the Response data of IdentityRequest, it carries the negotiated protocol version and capabilities,
+// and the session of the connection with the token that later requests carry, or the reason if the identity is denied
+type IdentityResponse struct {
+	ProtocolVersion    int
+	SoftwareVersion    string
+	Capabilities       []string
+	MaxFrameSize       int
+	Compression        string
+	Codec              string
+	SessionID          string
+	Resumed            bool
+	Reason             string
+	Token              string
+	TokenLifetime      time.Duration
+	SigningKey         []byte
+	ServerSigningKey   []byte
+	TokenFinal         bool
+	MaxPartialMessages int
+}
+
+func (res *IdentityResponse) String() string {
+	return ToString(res)
+}
+
 // DigestRequest is the Request data type of a file tree digest
 type DigestRequest struct {
 	Dir *Dir
@@ -273,6 +339,43 @@ func (req *FileRequest) String() string {
 	return ToString(req)
 }
 
+// FileChunkRequest is the Request data type of a chunk of file content in a streaming transfer,
+// chunks of a transfer are sent in order, the final chunk carries the checksum of the whole content
+type FileChunkRequest struct {
+	TransferID string
+	File       *File
+	UnrootPath string
+	Offset     int64
+	Content    []byte
+	Final      bool
+	Abort      bool
+	Checksum   Checksum
+}
+
+func (req *FileChunkRequest) String() string {
+	return fmt.Sprintf("TransferID: %v\nUnrootPath: %v\nOffset: %v\nLength: %v\nFinal: %v\nAbort: %v\n", req.TransferID, req.UnrootPath, req.Offset, len(req.Content), req.Final, req.Abort)
+}
+
+// CancelRequest is the Request data type to tell peer that the request of RequestID is abandoned,
+// so peer could stop the related work, it expects no response
+type CancelRequest struct {
+	RequestID string
+}
+
+func (req *CancelRequest) String() string {
+	return ToString(req)
+}
+
+// Decode decodes the data of request to v, with the codec that the data is encoded with
+func (req *Request) Decode(v interface{}) error {
+	return Decode(req.Data, v)
+}
+
+// Decode decodes the data of response to v, with the codec that the data is encoded with
+func (res *Response) Decode(v interface{}) error {
+	return Decode(res.Data, v)
+}
+
 // ToJSON converts request to JSON string
 func (req *Request) ToJSON() (string, error) {
 	jsonBytes, err := json.Marshal(req)
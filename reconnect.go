@@ -0,0 +1,45 @@
+package syncbox
+
+import (
+	"math/rand"
+	"time"
+)
+
+// constants for reconnection
+const (
+	DefaultReconnectMinDelay = time.Second
+	DefaultReconnectMaxDelay = time.Minute
+)
+
+// Backoff decides the delay between reconnect attempts, the delay doubles on each attempt from Min up to Max,
+// and a random jitter of up to half of the delay is taken off, so that clients disconnected together
+// don't reconnect at the same moment
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter bool
+}
+
+// NewBackoff instantiates a Backoff with default delays and jitter
+func NewBackoff() *Backoff {
+	return &Backoff{
+		Min:    DefaultReconnectMinDelay,
+		Max:    DefaultReconnectMaxDelay,
+		Jitter: true,
+	}
+}
+
+// Delay returns the delay before the reconnect attempt, attempt starts from 0
+func (backoff *Backoff) Delay(attempt int) time.Duration {
+	delay := backoff.Min
+	for i := 0; i < attempt && delay < backoff.Max; i++ {
+		delay *= 2
+	}
+	if delay > backoff.Max {
+		delay = backoff.Max
+	}
+	if backoff.Jitter && delay > 1 {
+		delay -= time.Duration(rand.Int63n(int64(delay / 2)))
+	}
+	return delay
+}
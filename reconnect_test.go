@@ -0,0 +1,160 @@
+package syncbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := &Backoff{Min: time.Second, Max: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for attempt, delay := range expected {
+		if actual := backoff.Delay(attempt); actual != delay {
+			t.Fatalf("delay of attempt %v: got %v, want %v", attempt, actual, delay)
+		}
+	}
+	if delay := backoff.Delay(1000); delay != backoff.Max {
+		t.Fatalf("delay of many attempts: got %v, want the cap %v", delay, backoff.Max)
+	}
+
+	backoff.Jitter = true
+	for attempt, delay := range expected {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			actual := backoff.Delay(attempt)
+			// up to half of the delay is taken off
+			if actual <= delay/2 || actual > delay {
+				t.Fatalf("jittered delay of attempt %v: got %v, want in (%v, %v]", attempt, actual, delay/2, delay)
+			}
+			seen[actual] = true
+		}
+		if len(seen) < 2 {
+			t.Fatalf("delays of attempt %v are not jittered", attempt)
+		}
+	}
+}
+
+// processSessionIdentity negotiates the protocol as processTestIdentity does, and opens the session that the client asks to resume
+func processSessionIdentity(sc *ServerConnector) RequestProcessor {
+	return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+		iReq := RequestPayload(ctx).(*IdentityRequest)
+		iRes, err := peer.NegotiateProtocol(iReq)
+		if err != nil {
+			peer.SendErrorResponse(req, err)
+			return
+		}
+		session, resumed := sc.OpenSession(peer, req.Username, req.Device, iReq.SessionID, time.Time{})
+		iRes.SessionID = session.ID
+		iRes.Resumed = resumed
+		data, err := peer.Marshal(iRes)
+		if err != nil {
+			eHandler(err)
+			return
+		}
+		if err := peer.SendResponse(req, &Response{Status: StatusOK, Data: data}); err != nil {
+			eHandler(err)
+			return
+		}
+		peer.ApplyNegotiation(iRes, iReq.MaxFrameSize, iReq.MaxPartialMessages)
+	}
+}
+
+func TestReconnectResumesSession(t *testing.T) {
+	server := startTestServer(t, func(sc *ServerConnector) {
+		sc.Registry.Register(TypeIdentity, IdentityRequest{}, processSessionIdentity(sc))
+	})
+	cc := server.dial(t, "user")
+	sessionID := cc.Peer.SessionID()
+	if sessionID == "" {
+		t.Fatal("no session is opened")
+	}
+	cc.Backoff = &Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond}
+
+	var mutex sync.Mutex
+	var resumed []bool
+	onConnect := func(ctx context.Context, peer *Peer) error {
+		res, err := peer.SendIdentityRequestContext(ctx, "user", "password", "device")
+		if err != nil {
+			return err
+		}
+		iRes := &IdentityResponse{}
+		if err := res.Decode(iRes); err != nil {
+			return err
+		}
+		mutex.Lock()
+		resumed = append(resumed, iRes.Resumed)
+		mutex.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cc.KeepConnected(ctx, newTestHandler(cc.Logger, NewRegistry()), onConnect)
+
+	for i := 1; i <= 2; i++ {
+		previous := cc.CurrentPeer()
+		for _, peer := range server.ClientPeers() {
+			peer.Close()
+		}
+		waitFor(t, "client to reconnect", func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return len(resumed) == i
+		})
+		peer := cc.CurrentPeer()
+		if peer == previous || peer.Err() != nil {
+			t.Fatalf("redial %v: client isn't on a new connection", i)
+		}
+		if !resumed[i-1] || peer.SessionID() != sessionID {
+			t.Fatalf("redial %v: session %v, resumed: %v, want %v resumed", i, peer.SessionID(), resumed[i-1], sessionID)
+		}
+		res, err := peer.SendRequestForResponse(NewRequest("", "", "", "ECHO", []byte("echo")))
+		if err != nil || string(res.Data) != "echo" {
+			t.Fatalf("redial %v: request on the new connection: %v, %v", i, res, err)
+		}
+	}
+}
+
+func TestReconnectRetries(t *testing.T) {
+	server := startTestServer(t, nil)
+	cc := server.dialOnly(t)
+	cc.Backoff = &Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond}
+	handler := newTestHandler(cc.Logger, NewRegistry())
+
+	attempts := 0
+	var peers []*Peer
+	err := cc.Reconnect(context.Background(), handler, func(ctx context.Context, peer *Peer) error {
+		attempts++
+		peers = append(peers, peer)
+		if attempts < 3 {
+			return NewCodedError(CodeStorageUnavailable, errors.New("storage unavailable"))
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("transient failures should be retried: %v attempts, %v", attempts, err)
+	}
+	for _, peer := range peers[:2] {
+		if peer.Err() == nil {
+			t.Fatal("connection of a failed attempt isn't closed")
+		}
+	}
+
+	attempts = 0
+	denied := NewCodedError(CodeAuthFailed, ErrorIdentityDenied)
+	err = cc.Reconnect(context.Background(), handler, func(ctx context.Context, peer *Peer) error {
+		attempts++
+		return denied
+	})
+	if err != denied || attempts != 1 {
+		t.Fatalf("permanent failures should not be retried: %v attempts, %v", attempts, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cc.Reconnect(ctx, handler, nil); err != context.Canceled {
+		t.Fatalf("reconnect with done context: got %v", err)
+	}
+}
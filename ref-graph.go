@@ -13,29 +13,14 @@ type RefGraph struct {
 	DB             *DB
 }
 
-// NewRefGraph instantiates a RefGraph
-func NewRefGraph(username string, password string, db *DB) (*RefGraph, error) {
+// NewRefGraph instantiates a RefGraph of user, which should be authenticated by AuthenticateUser
+func NewRefGraph(user *UserTable, db *DB) (*RefGraph, error) {
 	rg := &RefGraph{
-		Usernmae: username,
+		Usernmae: user.Username,
+		User:     user,
 		DB:       db,
 		Logger:   NewDefaultLogger(),
 	}
-	userQuery := NewQuery(db)
-	userTableSlice := &[]*UserTable{}
-	if err := userQuery.Select("*").From("user").Where("username='" + username + "'").Populate(userTableSlice); err != nil {
-		return nil, err
-	}
-	if len(*(userTableSlice)) == 0 {
-		_, err := db.Exec("INSERT INTO user (username, password) VALUES (?, ?)", username, password)
-		if err != nil {
-			return nil, err
-		}
-		if err := userQuery.Select("*").From("user").Where("username='" + username + "'").Populate(userTableSlice); err != nil {
-			return nil, err
-		}
-	}
-	rg.User = (*userTableSlice)[0]
-
 	if err := rg.UpdateRecords(); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,180 @@
+package syncbox
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Middleware wraps a RequestProcessor with the behaviors shared by requests of all types,
+// like authentication, logging, metrics, panic recovery and rate limiting
+type Middleware func(RequestProcessor) RequestProcessor
+
+// registration is a request type registered in Registry, chain is process wrapped by the middlewares of the registry
+type registration struct {
+	payload reflect.Type
+	process RequestProcessor
+	chain   RequestProcessor
+}
+
+// Registry dispatches inbound requests to the processors registered for their data types,
+// each processor is wrapped by the middlewares used on the registry
+type Registry struct {
+	registrations map[string]*registration
+	middlewares   []Middleware
+	mutex         sync.RWMutex
+}
+
+// payloadContextKey is the context key of the decoded payload of a request
+type payloadContextKey struct{}
+
+// NewRegistry instantiates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		registrations: make(map[string]*registration),
+	}
+}
+
+// Register registers process for requests of dataType, replacing the one registered before.
+// payload is a value of the type that the request data is decoded to before process is called,
+// process gets the decoded value, which is always a pointer, by RequestPayload.
+// Requests that fail to be decoded are responded with CodeBadRequest without calling process.
+// payload could be nil if process decodes the request data by itself.
+func (registry *Registry) Register(dataType string, payload interface{}, process RequestProcessor) {
+	var payloadType reflect.Type
+	if payload != nil {
+		payloadType = reflect.TypeOf(payload)
+		if payloadType.Kind() == reflect.Ptr {
+			payloadType = payloadType.Elem()
+		}
+	}
+	reg := &registration{
+		payload: payloadType,
+		process: process,
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	reg.chain = registry.wrap(reg)
+	registry.registrations[dataType] = reg
+}
+
+// Use appends middlewares to the chain wrapped around every processor,
+// the first middleware is the outermost one, which sees a request first
+func (registry *Registry) Use(middlewares ...Middleware) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.middlewares = append(registry.middlewares, middlewares...)
+	for _, reg := range registry.registrations {
+		reg.chain = registry.wrap(reg)
+	}
+}
+
+// wrap builds the chain of the middlewares around the processor of reg, the caller should hold mutex.
+// Chains are built when processors are registered or middlewares are used, rather than for each request.
+func (registry *Registry) wrap(reg *registration) RequestProcessor {
+	process := decodePayload(reg)
+	for i := len(registry.middlewares) - 1; i >= 0; i-- {
+		process = registry.middlewares[i](process)
+	}
+	return process
+}
+
+// Types returns the registered data types, sorted by name
+func (registry *Registry) Types() []string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	types := make([]string, 0, len(registry.registrations))
+	for dataType := range registry.registrations {
+		types = append(types, dataType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Processor returns the processor of dataType wrapped by the middlewares, or nil if dataType is not registered
+func (registry *Registry) Processor(dataType string) RequestProcessor {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	reg, exists := registry.registrations[dataType]
+	if !exists {
+		return nil
+	}
+	return reg.chain
+}
+
+// decodePayload returns the processor that decodes the request data as the registered payload type before calling the registered processor
+func decodePayload(reg *registration) RequestProcessor {
+	if reg.payload == nil {
+		return reg.process
+	}
+	return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+		payload := reflect.New(reg.payload).Interface()
+		if err := req.Decode(payload); err != nil {
+			peer.LogDebug("error on decoding %v request: %v\n", req.DataType, err)
+			eHandler(err)
+			if err := peer.SendErrorResponse(req, NewCodedError(CodeBadRequest, err)); err != nil {
+				eHandler(err)
+			}
+			return
+		}
+		reg.process(context.WithValue(ctx, payloadContextKey{}, payload), req, peer, eHandler)
+	}
+}
+
+// RequestPayload returns the decoded payload of the request that ctx is processing,
+// or nil if the request type is registered without payload type
+func RequestPayload(ctx context.Context) interface{} {
+	return ctx.Value(payloadContextKey{})
+}
+
+// HandleRequest boilerplates connection handling.
+// It should returns error only when the error should cause connnection to be closed,
+// otherwise should just continue for next loop to process incoming requests.
+// Each request is processed in its own goroutine by the processor registered for its data type,
+// with a context that's cancelled when peer disconnects or sends a CancelRequest for it.
+// Requests of unregistered types are responded with ErrorUnknownRequestType, which is CodeBadRequest.
+func (registry *Registry) HandleRequest(peer *Peer, handler ConnectionHandler) error {
+	for {
+		req, err := peer.Hub.ReceiveRequest()
+		if err != nil {
+			if err == ErrorPeerSocketClosed || peer.Hub.Err() != nil {
+				// peer socket is closed, or the hub is closed and Setup reports the error
+				return nil
+			}
+			handler.LogError("error on receiving request: %v\n", err)
+			continue
+		}
+		handler.LogVerbose("request data type: %v\n", req.DataType)
+		switch req.DataType {
+		case TypeCancel:
+			if err := peer.Hub.ProcessCancel(req); err != nil {
+				handler.HandleError(err)
+			}
+			continue
+		case TypePing:
+			// respond in another goroutine, so that pings don't wait for large outbound messages here
+			go func(req *Request) {
+				if err := peer.Hub.ProcessPing(req); err != nil {
+					handler.HandleError(err)
+				}
+			}(req)
+			continue
+		}
+		process := registry.Processor(req.DataType)
+		if process == nil {
+			handler.LogDebug("unknown data type: %v\n", req.DataType)
+			go func(req *Request) {
+				if err := peer.SendErrorResponse(req, ErrorUnknownRequestType); err != nil {
+					handler.HandleError(err)
+				}
+			}(req)
+			continue
+		}
+		ctx, finish := peer.Hub.requestContext(req.ID)
+		go func(req *Request) {
+			defer finish()
+			process(ctx, req, peer, handler.HandleError)
+		}(req)
+	}
+}
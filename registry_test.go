@@ -0,0 +1,83 @@
+package syncbox
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// serveRegistry processes the requests received by hub with registry until the test ends, it returns the handler receiving errors
+func serveRegistry(t *testing.T, hub *Hub, registry *Registry) *testHandler {
+	t.Helper()
+	handler := newTestHandler(NewDefaultLogger(), registry)
+	go registry.HandleRequest(NewPeer(hub, "", "", hub.Conn.RemoteAddr(), nil), handler)
+	return handler
+}
+
+// sendType sends a request of dataType with password on hub, and returns the error of the response
+func sendType(t *testing.T, hub *Hub, dataType string, password string) error {
+	t.Helper()
+	res, err := hub.SendRequestForResponse(NewRequest("user", password, "device", dataType, []byte("data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Err()
+}
+
+func TestRegistryChainBuiltOnce(t *testing.T) {
+	registry := NewRegistry()
+	var order []string
+	wraps := 0
+	middleware := func(name string) Middleware {
+		return func(next RequestProcessor) RequestProcessor {
+			wraps++
+			return func(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+				order = append(order, name)
+				next(ctx, req, peer, eHandler)
+			}
+		}
+	}
+	registry.Register("ECHO", nil, processEcho)
+	registry.Use(middleware("outer"), middleware("inner"))
+	registry.Register("OTHER", nil, processEcho)
+	if wraps != 4 {
+		t.Fatalf("middlewares wrap %v times on registering, want 4", wraps)
+	}
+
+	a, b := hubPair(t)
+	serveRegistry(t, b, registry)
+	for i := 0; i < 3; i++ {
+		if err := sendType(t, a, "ECHO", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wraps != 4 {
+		t.Fatalf("middlewares wrap %v times after requests, chains should be built once", wraps)
+	}
+	if !reflect.DeepEqual(order[:2], []string{"outer", "inner"}) {
+		t.Fatalf("middlewares run in order %v, the first used should be the outermost", order[:2])
+	}
+	if !reflect.DeepEqual(registry.Types(), []string{"ECHO", "OTHER"}) || registry.Processor("NOPE") != nil {
+		t.Fatalf("types: %v", registry.Types())
+	}
+}
+
+func TestRegistryUnknownRequestType(t *testing.T) {
+	a, b := hubPair(t)
+	registry := NewRegistry()
+	registry.Register("ECHO", nil, processEcho)
+	serveRegistry(t, b, registry)
+	err := sendType(t, a, "NOPE", "")
+	var codedErr *CodedError
+	if ErrorCode(err) != CodeBadRequest || !errors.As(err, &codedErr) || codedErr.Reason != ErrorUnknownRequestType.Error() {
+		t.Fatalf("request of unknown type: got %v", err)
+	}
+	// pings and registered types are still processed
+	if _, err := a.SendRequestForResponse(NewRequest("", "", "", TypePing, nil)); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if err := sendType(t, a, "ECHO", ""); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
-	"net"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/roackb2/syncbox"
@@ -28,7 +32,10 @@ func main() {
 		fmt.Printf("error on new client: %v\n", err)
 		return
 	}
-	if err = client.Start(); err != nil {
+	// stop scanning and abandon pending requests on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err = client.Start(ctx); err != nil {
 		client.LogError("error on start client: %v\n", err)
 	}
 }
@@ -42,6 +49,7 @@ type Client struct {
 	NewDir  *syncbox.Dir
 	Device  string
 	fileOps int
+	resync  int32
 }
 
 // NewClient instantiates a Client
@@ -61,27 +69,31 @@ func NewClient() (*Client, error) {
 	}
 	logger.LogInfo("command:\n%v\n", cmd)
 
-	interfaces, err := net.Interfaces()
+	device, err := syncbox.LoadDeviceIdentity("", cmd.DeviceName)
 	if err != nil {
-		logger.LogDebug("error on get net interfaces: %v\n", err)
+		logger.LogDebug("error on loading device identity: %v\n", err)
 		return nil, err
 	}
-	macAddr := ""
-	for _, inter := range interfaces {
-		if inter.Name == "en0" {
-			macAddr = inter.HardwareAddr.String()
-		}
-	}
+	logger.LogInfo("device: %v\n", device)
+	connector.DeviceName = device.Name
 
-	return &Client{
+	client := &Client{
 		Logger:          logger,
 		ClientConnector: connector,
 		Cmd:             cmd,
 		OldDir:          syncbox.NewEmptyDir(),
 		NewDir:          syncbox.NewEmptyDir(),
-		Device:          macAddr,
+		Device:          device.ID,
 		fileOps:         0,
-	}, nil
+	}
+	client.Registry.Use(syncbox.Recover(), syncbox.LogRequests(logger))
+	client.Registry.Register(syncbox.TypeIdentity, syncbox.IdentityRequest{}, client.ProcessIdentity)
+	client.Registry.Register(syncbox.TypeDigest, syncbox.DigestRequest{}, client.ProcessDigest)
+	client.Registry.Register(syncbox.TypeSyncRequest, syncbox.SyncRequest{}, client.ProcessSync)
+	// file content requests are decoded by the processors, since malformed ones have to settle the file operation as well
+	client.Registry.Register(syncbox.TypeFile, nil, client.ProcessFile)
+	client.Registry.Register(syncbox.TypeFileChunk, nil, client.ProcessFileChunk)
+	return client, nil
 }
 
 // IncreaseFileOp increase the fileOps variable
@@ -100,8 +112,8 @@ func (client *Client) CouldScan() bool {
 	return client.fileOps == 0
 }
 
-// Start runs a client main program
-func (client *Client) Start() error {
+// Start runs a client main program until ctx is done
+func (client *Client) Start(ctx context.Context) error {
 	if err := os.RemoveAll(client.TmpDir); err != nil && !strings.HasSuffix(err.Error(), "no such file or directory") {
 		return err
 	}
@@ -109,35 +121,124 @@ func (client *Client) Start() error {
 		client.LogDebug("error on creating temp dir: %v\n", err)
 		return err
 	}
-	if err := client.Dial(client, nil); err != nil {
+	if err := os.MkdirAll(client.partialDir(), 0777); err != nil {
+		client.LogDebug("error on creating partial dir: %v\n", err)
+		return err
+	}
+	if err := client.Dial(client); err != nil {
 		client.LogDebug("error on dial: %v\n", err)
 		return err
 	}
-	if _, err := client.ClientConnector.Peer.SendIdentityRequest(client.Cmd.Username, client.Cmd.Password, client.Device); err != nil {
-		client.LogDebug("error on SendIdentityRequest: %v\n", err)
+	if client.Register {
+		if err := client.register(ctx, client.CurrentPeer()); err != nil {
+			return err
+		}
+	}
+	if err := client.identify(ctx, client.CurrentPeer()); err != nil {
 		return err
 	}
+	if client.ListDevices || client.RevokeDevice != "" {
+		defer client.CurrentPeer().Close()
+		return client.manageDevices(ctx, client.CurrentPeer())
+	}
 	errChan := make(chan error)
 	go func(errChan chan error) {
-		if err := client.Listen(client); err != nil {
-			client.LogDebug("error on listen: %v\n", err)
+		if err := client.KeepConnected(ctx, client, client.reconnected); err != nil {
+			client.LogDebug("error on keeping connected: %v\n", err)
 			errChan <- err
 		}
 	}(errChan)
 
 	go func(errChan chan error) {
-		if err := client.Scan(); err != nil {
-			client.LogError("error on scan: %v\n", err)
+		if err := client.Scan(ctx); err != nil {
+			if err != ctx.Err() {
+				client.LogError("error on scan: %v\n", err)
+			}
 			errChan <- err
 		}
 	}(errChan)
 
-	return <-errChan
+	err := <-errChan
+	if ctx.Err() != nil {
+		client.LogInfo("client stopped: %v\n", ctx.Err())
+		client.CurrentPeer().Close()
+		return nil
+	}
+	return err
+}
+
+// register creates the account of client over the connection of peer, an existing account is left as it is,
+// and the identity handshake tells whether the password matches
+func (client *Client) register(ctx context.Context, peer *syncbox.Peer) error {
+	if _, err := peer.SendRegisterRequestContext(ctx, client.Cmd.Username, client.Cmd.Password, client.Device); err != nil {
+		if syncbox.ErrorCode(err) == syncbox.CodeConflict {
+			client.LogInfo("account %v exists, logging in\n", client.Cmd.Username)
+			return nil
+		}
+		client.LogDebug("error on SendRegisterRequest: %v\n", err)
+		return err
+	}
+	client.LogInfo("registered account %v\n", client.Cmd.Username)
+	return nil
+}
+
+// identify sends the identity of client over the connection of peer
+func (client *Client) identify(ctx context.Context, peer *syncbox.Peer) error {
+	if _, err := peer.SendIdentityRequestContext(ctx, client.Cmd.Username, client.Cmd.Credential(), client.Device); err != nil {
+		client.LogDebug("error on SendIdentityRequest: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// manageDevices revokes the device of RevokeDevice if it's given, and prints the devices of the user
+func (client *Client) manageDevices(ctx context.Context, peer *syncbox.Peer) error {
+	if client.RevokeDevice != "" {
+		if _, err := peer.SendRevokeDeviceRequestContext(ctx, client.Username, client.Password, client.Device, client.RevokeDevice); err != nil {
+			client.LogDebug("error on SendRevokeDeviceRequest: %v\n", err)
+			return err
+		}
+		client.LogInfo("revoked device %v\n", client.RevokeDevice)
+		if client.RevokeDevice == client.Device {
+			return nil
+		}
+	}
+	devices, err := peer.SendListDevicesRequestContext(ctx, client.Username, client.Password, client.Device)
+	if err != nil {
+		client.LogDebug("error on SendListDevicesRequest: %v\n", err)
+		return err
+	}
+	for _, device := range devices {
+		state := "offline"
+		switch {
+		case device.Revoked:
+			state = "revoked"
+		case device.Online:
+			state = "online"
+		}
+		current := ""
+		if device.ID == client.Device {
+			current = " (this device)"
+		}
+		fmt.Printf("%v\t%v%v\t%v\tlast seen %v from %v, version %v\n", device.ID, device.Name, current, state,
+			device.LastSeen.Format(time.RFC3339), device.Address, device.ClientVersion)
+	}
+	return nil
+}
+
+// reconnected identifies the client over the new connection, and lets Scan send the digest again,
+// since changes on either side might be missed while disconnected
+func (client *Client) reconnected(ctx context.Context, peer *syncbox.Peer) error {
+	if err := client.identify(ctx, peer); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&client.resync, 1)
+	return nil
 }
 
 // HandleRequest implements the ConnectionHandler interface
 func (client *Client) HandleRequest(peer *syncbox.Peer) error {
-	return syncbox.HandleRequest(peer, client)
+	return client.Registry.HandleRequest(peer, client)
 }
 
 // HandleError implements the ConnectionHandler interface
@@ -149,14 +250,8 @@ func (client *Client) HandleError(err error) {
 	}
 }
 
-// ProcessIdentity implements the ConnectionHandler interface
-func (client *Client) ProcessIdentity(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	data := req.Data
-	iReq := syncbox.IdentityRequest{}
-	if err := json.Unmarshal(data, &iReq); err != nil {
-		client.LogDebug("error on Unmarshal in ProcessIdentity: %v\n", err)
-		eHandler(err)
-	}
+// ProcessIdentity is the RequestProcessor of TypeIdentity requests
+func (client *Client) ProcessIdentity(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
 	client.LogDebug("sending response in ProcessIdentity, request id: %v\n", req.ID)
 	if err := peer.SendResponse(req, &syncbox.Response{
 		Status:  syncbox.StatusOK,
@@ -167,14 +262,9 @@ func (client *Client) ProcessIdentity(req *syncbox.Request, peer *syncbox.Peer,
 	}
 }
 
-// ProcessDigest implements the ConnectionHandler interface
-func (client *Client) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	data := req.Data
-	dReq := syncbox.DigestRequest{}
-	if err := json.Unmarshal(data, &dReq); err != nil {
-		client.LogDebug("error on Unmarshal in ProcessDigest: %v\n", err)
-		eHandler(err)
-	}
+// ProcessDigest is the RequestProcessor of TypeDigest requests
+func (client *Client) ProcessDigest(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	dReq := syncbox.RequestPayload(ctx).(*syncbox.DigestRequest)
 	client.LogVerbose("client ProcessDigest called, req: %v\n", dReq)
 
 	clientDir := *(client.NewDir)
@@ -207,23 +297,21 @@ func (client *Client) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eH
 	}
 }
 
-// ProcessSync implements the ConnectionHandler interface
-func (client *Client) ProcessSync(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	data := req.Data
-	sReq := syncbox.SyncRequest{}
-	if err := json.Unmarshal(data, &sReq); err != nil {
-		client.LogDebug("error on Unmarshal in ProcessSync: %v\n", err)
-		eHandler(err)
-	}
+// ProcessSync is the RequestProcessor of TypeSyncRequest requests
+func (client *Client) ProcessSync(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	sReq := syncbox.RequestPayload(ctx).(*syncbox.SyncRequest)
 	// client.LogDebug("client ProcessSync called, req: %v\n", sReq)
 	switch sReq.Action {
 	case syncbox.ActionGet:
 		path := sReq.File.Path
-		fileBytes, err := ioutil.ReadFile(path)
+		file, err := os.Open(path)
 		if err != nil {
-			client.LogDebug("error reading file: %v\n", err)
+			client.LogDebug("error opening file: %v\n", err)
 			eHandler(err)
+			client.denyRequest(req, peer, err, eHandler)
+			return
 		}
+		defer file.Close()
 
 		client.LogDebug("sending response in ProcessSync, request id: %v\n", req.ID)
 		if err := peer.SendResponse(req, &syncbox.Response{
@@ -233,23 +321,43 @@ func (client *Client) ProcessSync(req *syncbox.Request, peer *syncbox.Peer, eHan
 			client.LogDebug("error on SendResponse in ProcessSync: %v\n", err)
 			eHandler(err)
 		}
-		// client.LogDebug("before SendFileRequest")
-		res, err := peer.SendFileRequest(client.Username, client.Password, client.Device, sReq.UnrootPath, sReq.File, fileBytes)
+		if !peer.HasCapability(syncbox.CapabilityChunkedTransfer) {
+			// peer doesn't support streaming, send the whole file at once
+			fileBytes, err := ioutil.ReadAll(file)
+			if err != nil {
+				client.LogDebug("error reading file: %v\n", err)
+				eHandler(err)
+				return
+			}
+			res, err := peer.SendFileRequestContext(ctx, client.Username, client.Password, client.Device, sReq.UnrootPath, sReq.File, fileBytes)
+			if err != nil {
+				client.LogDebug("error on SendFileRequest in ProcessSync: %v\n", err)
+				eHandler(err)
+			}
+			client.LogDebug("response of SendFileRequest:\n%v\n", res)
+			return
+		}
+		res, err := peer.SendFileStreamContext(ctx, client.Username, client.Password, client.Device, sReq.UnrootPath, sReq.File, file)
 		if err != nil {
-			client.LogDebug("error on SendFileRequest in ProcessSync: %v\n", err)
+			client.LogDebug("error on SendFileStream in ProcessSync: %v\n", err)
 			eHandler(err)
 		}
-		client.LogDebug("response of SendFileRequest:\n%v\n", res)
+		client.LogDebug("response of SendFileStream:\n%v\n", res)
+	default:
+		client.LogDebug("unknown action in ProcessSync: %v\n", sReq.Action)
+		client.denyRequest(req, peer, syncbox.ErrorUnknownAction, eHandler)
 	}
 }
 
-// ProcessFile implements the ConnectionHandler interface
-func (client *Client) ProcessFile(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	data := req.Data
+// ProcessFile is the RequestProcessor of TypeFile requests
+func (client *Client) ProcessFile(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
 	dReq := syncbox.FileRequest{}
-	if err := json.Unmarshal(data, &dReq); err != nil {
+	if err := req.Decode(&dReq); err != nil {
 		client.LogDebug("error on Unmarshal in ProcessFile: %v\n", err)
 		eHandler(err)
+		client.DecreaseFileOp()
+		client.denyRequest(req, peer, syncbox.NewCodedError(syncbox.CodeBadRequest, err), eHandler)
+		return
 	}
 
 	// server.LogDebug("filename: %v\ncontent: %v\n", filename, content)
@@ -258,6 +366,9 @@ func (client *Client) ProcessFile(req *syncbox.Request, peer *syncbox.Peer, eHan
 	if err := ioutil.WriteFile(filePath, dReq.Content, dReq.File.Mode); err != nil {
 		client.LogDebug("error on CreateObject in ProcessFile: %v\n", err)
 		eHandler(err)
+		client.DecreaseFileOp()
+		client.denyRequest(req, peer, syncbox.NewCodedError(syncbox.CodeInternal, err), eHandler)
+		return
 	}
 	client.DecreaseFileOp()
 
@@ -271,6 +382,80 @@ func (client *Client) ProcessFile(req *syncbox.Request, peer *syncbox.Peer, eHan
 	}
 }
 
+// ProcessFileChunk is the RequestProcessor of TypeFileChunk requests
+func (client *Client) ProcessFileChunk(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	cReq, done, err := peer.ReceiveFileChunk(req, client.openPartialFile)
+	if err != nil {
+		client.LogDebug("error on ReceiveFileChunk in ProcessFileChunk: %v\n", err)
+		eHandler(err)
+		client.DecreaseFileOp()
+		client.denyRequest(req, peer, err, eHandler)
+		return
+	}
+	if done {
+		client.LogVerbose("path in ProcessFileChunk: %v\n", client.rebornPath(cReq.UnrootPath))
+		client.DecreaseFileOp()
+	}
+
+	client.LogVerbose("sending response in ProcessFileChunk, request id: %v\n", req.ID)
+	if err := peer.SendResponse(req, &syncbox.Response{
+		Status:  syncbox.StatusOK,
+		Message: syncbox.MessageAccept,
+	}); err != nil {
+		client.LogDebug("error on SendResponse in ProcessFileChunk: %v\n", err)
+		eHandler(err)
+	}
+}
+
+// denyRequest responds req with the error response of err, so that peer knows why the request fails
+func (client *Client) denyRequest(req *syncbox.Request, peer *syncbox.Peer, err error, eHandler syncbox.ErrorHandler) {
+	if sendErr := peer.SendErrorResponse(req, err); sendErr != nil {
+		client.LogDebug("error on SendErrorResponse: %v\n", sendErr)
+		eHandler(sendErr)
+	}
+}
+
+// partialFile is the writer of a streaming transfer, content is written to a file in the partial directory,
+// and moved to the target path when completed, so that Scan never sees an incomplete file
+type partialFile struct {
+	*os.File
+	target string
+}
+
+// Close moves the partial file to the target path
+func (file *partialFile) Close() error {
+	if err := file.File.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), file.target)
+}
+
+// Abort removes the partial file
+func (file *partialFile) Abort() error {
+	file.File.Close()
+	return os.Remove(file.Name())
+}
+
+// openPartialFile is the ChunkWriterOpener of streaming transfers, the transfer ID is validated by WriteFileChunk already,
+// and the target path told by peer should stay in the root directory
+func (client *Client) openPartialFile(cReq *syncbox.FileChunkRequest) (io.WriteCloser, error) {
+	target := client.rebornPath(cReq.UnrootPath)
+	if !strings.HasPrefix(path.Clean(target), path.Clean(client.RootDir)+"/") {
+		client.LogDebug("target path %v of transfer %v is out of root directory\n", target, cReq.TransferID)
+		return nil, syncbox.ErrorMalformedChunk
+	}
+	partialPath := path.Join(client.partialDir(), cReq.TransferID)
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cReq.File.Mode)
+	if err != nil {
+		return nil, err
+	}
+	return &partialFile{
+		File:   file,
+		target: target,
+	}, nil
+}
+
 // AddFile implements the Syncer interface
 func (client *Client) AddFile(rootPath string, unrootPath string, file *syncbox.File, peer *syncbox.Peer) error {
 	client.LogVerbose("AddFile, rootPath: %v, unrootPath: %v, file path: %v", rootPath, unrootPath, file.Path)
@@ -283,18 +468,34 @@ func (client *Client) AddFile(rootPath string, unrootPath string, file *syncbox.
 			hasTempFile = false
 		} else {
 			client.LogDebug("error on Rename in AddFile: %v\n", err)
+			client.DecreaseFileOp()
 			return err
 		}
 	}
 	if hasTempFile {
 		client.DecreaseFileOp()
 	} else {
-		res, err := peer.SendSyncRequest(client.Username, client.Password, client.Device, unrootPath, syncbox.ActionGet, file)
-		if err != nil {
-			client.LogDebug("error on SendSyncRequest in AddFile: %v\n", err)
+		// transient failures like unavailable storage are retried, the permanent ones are given up,
+		// retries share the idempotency key so that server doesn't process the request twice
+		ctx := syncbox.WithIdempotencyKey(peer.Context(), syncbox.UUID())
+		if err := syncbox.SendWithRetryContext(ctx, client, func() error {
+			reqCtx, cancel := context.WithTimeout(ctx, syncbox.OperationTimeoutPeriod)
+			defer cancel()
+			res, err := peer.SendSyncRequestContext(reqCtx, client.Username, client.Password, client.Device, unrootPath, syncbox.ActionGet, file)
+			if err != nil {
+				client.LogDebug("error on SendSyncRequest in AddFile: %v\n", err)
+				return err
+			}
+			client.LogDebug("response of SendSyncRequest in AddFile:\n%v\n", res)
+			return nil
+		}); err != nil {
+			// the file will never arrive, so it shouldn't block Scan
+			client.DecreaseFileOp()
+			if syncbox.IsPermanent(err) {
+				client.LogError("failed to get file %v from server: %v\n", unrootPath, err)
+			}
 			return err
 		}
-		client.LogDebug("response of SendSyncRequest in AddFile:\n%v\n", res)
 	}
 	return nil
 }
@@ -329,10 +530,15 @@ func (client *Client) DeleteDir(rootPath string, unrootPath string, dir *syncbox
 	return os.RemoveAll(client.rebornPath(unrootPath))
 }
 
-// Scan through the target, write digest file on disk and send to server
-func (client *Client) Scan() error {
+// Scan through the target, write digest file on disk and send to server,
+// it returns ctx.Err() once ctx is done
+func (client *Client) Scan(ctx context.Context) error {
 	for i := 0; i < MaxScanCount; i++ {
-		time.Sleep(ScanPeriod)
+		select {
+		case <-time.After(ScanPeriod):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		if client.CouldScan() {
 			hasOldDigest := true
 
@@ -361,7 +567,8 @@ func (client *Client) Scan() error {
 			// client.LogDebug("new dir:\n%v\n", client.NewDir)
 			client.LogInfo("scanning files\nold dir checksum: %v\nnew dir checksum: %v\n", client.OldDir.ContentChecksum, client.NewDir.ContentChecksum)
 
-			if hasOldDigest && client.OldDir.ContentChecksum == client.NewDir.ContentChecksum {
+			resync := atomic.CompareAndSwapInt32(&client.resync, 1, 0)
+			if hasOldDigest && client.OldDir.ContentChecksum == client.NewDir.ContentChecksum && !resync {
 				// nothing else need to do
 				continue
 			}
@@ -372,16 +579,28 @@ func (client *Client) Scan() error {
 			}
 
 			// client.LogInfo("sending digest request to server")
-			if err := syncbox.SendWithRetry(client, func() error {
-				res, err := client.Peer.SendDigestRequest(client.Username, client.Password, client.Device, client.NewDir)
+			digestCtx := syncbox.WithIdempotencyKey(ctx, syncbox.UUID())
+			if err := syncbox.SendWithRetryContext(digestCtx, client, func() error {
+				res, err := client.CurrentPeer().SendDigestRequestContext(digestCtx, client.Username, client.Password, client.Device, client.NewDir)
 				if err != nil {
 					client.LogDebug("error on SendDigestRequest: %v\n", err)
 					return err
 				}
 				client.LogInfo("response of SendDigestRequest:\n%v\n", res)
 				return nil
-			}, nil); err != nil {
+			}); err != nil {
 				client.LogDebug("error on SendWithRetry: %v\n", err)
+				if syncbox.ErrorCode(err) == syncbox.CodeAuthFailed {
+					client.LogError("server refuses the credentials: %v\n", err)
+					return err
+				}
+				if syncbox.IsPermanent(err) {
+					// sending the same digest again won't help, it's sent when files change next time
+					client.LogError("server refuses the digest: %v\n", err)
+					continue
+				}
+				// the digest file is written already, make sure the digest is sent in the next round
+				atomic.StoreInt32(&client.resync, 1)
 				continue
 			}
 		}
@@ -409,6 +628,12 @@ func (client *Client) rebornPath(unrootPath string) string {
 	return client.RootDir + unrootPath
 }
 
+// partialDir is the directory for files of streaming transfers in progress,
+// it's kept apart from TmpDir since TmpDir is cleaned after each digest
+func (client *Client) partialDir() string {
+	return client.TmpDir + "-partial"
+}
+
 func (client *Client) cleanTempDir() error {
 	if err := os.RemoveAll(client.TmpDir); err != nil {
 		return err
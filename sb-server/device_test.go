@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roackb2/syncbox"
+)
+
+// deviceDriver is a database/sql driver keeping the device table in memory,
+// it understands the queries of syncbox.FindDevice and syncbox.RevokeDevice only
+type deviceDriver struct {
+	mutex   sync.Mutex
+	devices []*syncbox.DeviceTable
+}
+
+var devices = &deviceDriver{}
+
+func init() {
+	sql.Register("sb-server-devices", devices)
+}
+
+func (d *deviceDriver) Open(name string) (driver.Conn, error) {
+	return d, nil
+}
+
+func (d *deviceDriver) Prepare(query string) (driver.Stmt, error) {
+	return &deviceStmt{query: query}, nil
+}
+
+func (d *deviceDriver) Close() error {
+	return nil
+}
+
+func (d *deviceDriver) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type deviceStmt struct {
+	query string
+}
+
+func (stmt *deviceStmt) Close() error {
+	return nil
+}
+
+func (stmt *deviceStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *deviceStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(stmt.query, "UPDATE device SET revoked=") {
+		return nil, errors.New("unknown statement: " + stmt.query)
+	}
+	devices.mutex.Lock()
+	defer devices.mutex.Unlock()
+	for _, device := range devices.devices {
+		if int64(device.UserID) == args[1].(int64) && device.DeviceID == args[2].(string) {
+			device.Revoked = args[0].(bool)
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *deviceStmt) Query(args []driver.Value) (driver.Rows, error) {
+	devices.mutex.Lock()
+	defer devices.mutex.Unlock()
+	rows := &deviceRows{}
+	for _, device := range devices.devices {
+		if int64(device.UserID) == args[0].(int64) && device.DeviceID == args[1].(string) {
+			copied := *device
+			rows.devices = append(rows.devices, &copied)
+		}
+	}
+	return rows, nil
+}
+
+type deviceRows struct {
+	devices []*syncbox.DeviceTable
+}
+
+func (rows *deviceRows) Columns() []string {
+	return []string{"id", "user_id", "device_id", "name", "last_seen", "client_version", "address", "revoked"}
+}
+
+func (rows *deviceRows) Close() error {
+	return nil
+}
+
+func (rows *deviceRows) Next(dest []driver.Value) error {
+	if len(rows.devices) == 0 {
+		return io.EOF
+	}
+	device := rows.devices[0]
+	rows.devices = rows.devices[1:]
+	copy(dest, []driver.Value{int64(device.ID), int64(device.UserID), device.DeviceID, device.Name, device.LastSeen, device.ClientVersion, device.Address, device.Revoked})
+	return nil
+}
+
+// startDeviceServer starts a server processing device revocations over a PipeTransport, with the devices of user in the database.
+// Peers are identified as user of the device of their requests without authentication, in sessions of the server.
+// It returns the server and the transport to dial.
+func startDeviceServer(t *testing.T, user *syncbox.UserTable, deviceIDs ...string) (*Server, *syncbox.PipeTransport) {
+	t.Helper()
+	devices.mutex.Lock()
+	devices.devices = nil
+	for i, id := range deviceIDs {
+		devices.devices = append(devices.devices, &syncbox.DeviceTable{ID: i + 1, UserID: user.ID, DeviceID: id})
+	}
+	devices.mutex.Unlock()
+	conn, err := sql.Open("sb-server-devices", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := syncbox.NewServerConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &listenNotifier{PipeTransport: syncbox.NewPipeTransport(), listening: make(chan error, 1)}
+	sc.Transport = transport
+	sc.TLS = nil
+	server := &Server{
+		Logger:          syncbox.NewDefaultLogger(),
+		DB:              &syncbox.DB{Logger: syncbox.NewDefaultLogger(), DB: conn},
+		ServerConnector: sc,
+	}
+	server.Registry.Register(syncbox.TypeIdentity, syncbox.IdentityRequest{}, func(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+		iReq := syncbox.RequestPayload(ctx).(*syncbox.IdentityRequest)
+		iRes, err := peer.NegotiateProtocol(iReq)
+		if err != nil {
+			peer.SendErrorResponse(req, err)
+			return
+		}
+		peer.Username = user.Username
+		peer.Device = req.Device
+		peer.RefGraph = &syncbox.RefGraph{User: user}
+		session, _ := server.OpenSession(peer, user.Username, req.Device, iReq.SessionID, time.Time{})
+		iRes.SessionID = session.ID
+		data, _ := peer.Marshal(iRes)
+		peer.SendResponse(req, &syncbox.Response{Status: syncbox.StatusOK, Data: data})
+		peer.ApplyNegotiation(iRes, iReq.MaxFrameSize, iReq.MaxPartialMessages)
+	})
+	server.Registry.Register(syncbox.TypeRevokeDevice, syncbox.RevokeDeviceRequest{}, server.ProcessRevokeDevice)
+	go server.Listen(server)
+	select {
+	case err := <-transport.listening:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server doesn't listen")
+	}
+	t.Cleanup(func() {
+		sc.Listener.Close()
+		for _, peer := range sc.ClientPeers() {
+			peer.Close()
+		}
+		conn.Close()
+	})
+	return server, transport.PipeTransport
+}
+
+// dialDevice connects a client to server and identifies as device of username
+func dialDevice(t *testing.T, server *Server, transport *syncbox.PipeTransport, username string, device string) *syncbox.ClientConnector {
+	t.Helper()
+	cc, err := syncbox.NewClientConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Transport = transport
+	cc.TLS = nil
+	cc.ServerDialAddr = server.ServerListenAddr
+	if err := cc.Dial(&clientHandler{Logger: cc.Logger}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cc.Peer.Close()
+	})
+	if _, err := cc.Peer.SendIdentityRequest(username, "", device); err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+func TestProcessRevokeDevice(t *testing.T) {
+	user := &syncbox.UserTable{ID: 1, Username: "alice"}
+	server, transport := startDeviceServer(t, user, "laptop", "phone")
+	laptop := dialDevice(t, server, transport, "alice", "laptop")
+	phone := dialDevice(t, server, transport, "alice", "phone")
+
+	if _, err := phone.Peer.SendRevokeDeviceRequest("alice", "", "phone", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	device, err := syncbox.FindDevice(server.DB, user, "laptop")
+	if err != nil || !device.Revoked {
+		t.Fatalf("revoked device: %+v, %v", device, err)
+	}
+	// the live session of the revoked device is ended
+	waitFor(t, "connection of the revoked device to close", func() bool {
+		return laptop.Peer.Err() != nil
+	})
+	if online := server.OnlineDevices("alice"); online["laptop"] || !online["phone"] {
+		t.Fatalf("online devices after revocation: %v", online)
+	}
+	if phone.Peer.Err() != nil {
+		t.Fatalf("revoking device is disconnected: %v", phone.Peer.Err())
+	}
+
+	if _, err := phone.Peer.SendRevokeDeviceRequest("alice", "", "phone", "tablet"); syncbox.ErrorCode(err) != syncbox.CodeNotFound {
+		t.Fatalf("revoking unknown device: got %v", err)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"regexp"
 	"runtime"
-	"strings"
 
 	"github.com/roackb2/syncbox"
 )
@@ -28,13 +30,14 @@ type Server struct {
 	*syncbox.Logger
 	*syncbox.DB
 	*syncbox.ServerConnector
-	*syncbox.Storage
+	syncbox.StorageBackend
+	Authenticator syncbox.Authenticator
 }
 
 // NewServer instantiates server
 func NewServer() (*Server, error) {
 	logger := syncbox.NewDefaultLogger()
-	db, err := syncbox.NewDB(syncbox.UserTable{}, syncbox.FileTable{}, syncbox.FileRefTable{})
+	db, err := syncbox.NewDB(syncbox.UserTable{}, syncbox.FileTable{}, syncbox.FileRefTable{}, syncbox.DeviceTable{})
 	if err != nil {
 		logger.LogDebug("error on connecting database:%v\n", err)
 		return nil, err
@@ -44,13 +47,36 @@ func NewServer() (*Server, error) {
 		logger.LogDebug("error on new server connector: %v\n", err)
 		return nil, err
 	}
-	storage := syncbox.NewStorage()
+	storage, err := syncbox.NewStorage(syncbox.NewStorageConfig())
+	if err != nil {
+		logger.LogDebug("error on new storage: %v\n", err)
+		return nil, err
+	}
+	authenticator, err := syncbox.NewAuthenticator(syncbox.NewAuthConfig(), db)
+	if err != nil {
+		logger.LogDebug("error on new authenticator: %v\n", err)
+		return nil, err
+	}
 	server := &Server{
 		Logger:          logger,
 		DB:              db,
 		ServerConnector: connector,
-		Storage:         storage,
+		StorageBackend:  storage,
+		Authenticator:   authenticator,
 	}
+	server.Registry.Use(syncbox.Recover(), syncbox.LogRequests(logger),
+		syncbox.RateLimitHost(syncbox.AuthenticationRate, syncbox.AuthenticationBurst, syncbox.TypeIdentity, syncbox.TypeRegister),
+		server.RequireAuthentication(), syncbox.Idempotent(syncbox.TypeDigest, syncbox.TypeSyncRequest, syncbox.TypeFile))
+	server.Registry.Register(syncbox.TypeIdentity, syncbox.IdentityRequest{}, server.ProcessIdentity)
+	// the credentials to register are the ones of the request itself
+	server.Registry.Register(syncbox.TypeRegister, nil, server.ProcessRegister)
+	server.Registry.Register(syncbox.TypeRefreshToken, nil, server.ProcessRefreshToken)
+	server.Registry.Register(syncbox.TypeDigest, syncbox.DigestRequest{}, server.ProcessDigest)
+	server.Registry.Register(syncbox.TypeSyncRequest, syncbox.SyncRequest{}, server.ProcessSync)
+	server.Registry.Register(syncbox.TypeFile, syncbox.FileRequest{}, server.ProcessFile)
+	server.Registry.Register(syncbox.TypeFileChunk, syncbox.FileChunkRequest{}, server.ProcessFileChunk)
+	server.Registry.Register(syncbox.TypeListDevices, nil, server.ProcessListDevices)
+	server.Registry.Register(syncbox.TypeRevokeDevice, syncbox.RevokeDeviceRequest{}, server.ProcessRevokeDevice)
 	return server, nil
 }
 
@@ -68,70 +94,220 @@ func (server *Server) Start() error {
 
 // HandleRequest implements the ConnectionHandler interface
 func (server *Server) HandleRequest(peer *syncbox.Peer) error {
-	return syncbox.HandleRequest(peer, server)
+	return server.Registry.HandleRequest(peer, server)
 }
 
 // HandleError implements the ConnectionHandler interface
 func (server *Server) HandleError(err error) {
 	if err == syncbox.ErrorPeerSocketClosed {
 		server.LogInfo("%v\n", err)
+	} else if syncbox.IsLimitError(err) {
+		server.LogInfo("connection closed for exceeding limits: %v\n", err)
 	} else {
 		server.LogDebug("error: %v\n", err)
 	}
 }
 
-// ProcessIdentity implements the ConnectionHandler interface
-func (server *Server) ProcessIdentity(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	server.LogDebug("New IdentityRequest for user: %v\n", peer.Username)
-	if peer.Username != "" && peer.RefGraph == nil {
-		rg, err := syncbox.NewRefGraph(peer.Username, peer.Password, server.DB)
+// ProcessIdentity is the RequestProcessor of TypeIdentity requests,
+// it authenticates the connection if the credentials of the request are valid, otherwise it denies and closes the connection
+func (server *Server) ProcessIdentity(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	server.LogDebug("New IdentityRequest for user: %v\n", req.Username)
+	username, expires, err := syncbox.AuthenticateUntil(ctx, server.Authenticator, req.Username, req.Password)
+	var user *syncbox.UserTable
+	if err == nil {
+		user, err = syncbox.ProvisionUser(server.DB, username)
+	}
+	if err != nil {
+		status := syncbox.StatusUnauthorized
+		if err != syncbox.ErrorAuthFailed {
+			server.LogDebug("error on authenticating in ProcessIdentity: %v\n", err)
+			eHandler(err)
+			status = syncbox.StatusInternal
+		}
+		server.LogInfo("refuse identity of %v from %v: %v\n", req.Username, peer.Address, err)
+		server.refuseIdentity(req, peer, status, err.Error(), eHandler)
+		peer.Close()
+		return
+	}
+	if peer.RefGraph == nil || peer.RefGraph.User.ID != user.ID {
+		rg, err := syncbox.NewRefGraph(user, server.DB)
 		if err != nil {
-			server.LogDebug("error on NewRefGraph in ProcessDigest: %v\n", err)
+			server.LogDebug("error on NewRefGraph in ProcessIdentity: %v\n", err)
 			eHandler(err)
+			server.refuseIdentity(req, peer, syncbox.StatusInternal, err.Error(), eHandler)
+			return
 		}
 		peer.RefGraph = rg
 	}
-	data := req.Data
-	iReq := syncbox.IdentityRequest{}
-	if err := json.Unmarshal(data, &iReq); err != nil {
-		server.LogDebug("error on Unmarshal in ProcessIdentity: %v\n", err)
+	iReq := syncbox.RequestPayload(ctx).(*syncbox.IdentityRequest)
+	if err := syncbox.RecordDevice(server.DB, user, req.Device, iReq.DeviceName, iReq.SoftwareVersion, syncbox.AddressHost(peer.Address)); err != nil {
+		status := syncbox.StatusUnauthorized
+		if err != syncbox.ErrorDeviceRevoked {
+			server.LogDebug("error on RecordDevice in ProcessIdentity: %v\n", err)
+			eHandler(err)
+			status = syncbox.StatusInternal
+		}
+		server.LogInfo("refuse identity of %v from %v, device: %v: %v\n", req.Username, peer.Address, req.Device, err)
+		server.refuseIdentity(req, peer, status, err.Error(), eHandler)
+		if status == syncbox.StatusUnauthorized {
+			peer.Close()
+		}
+		return
+	}
+	res := &syncbox.Response{
+		Status:  syncbox.StatusOK,
+		Message: syncbox.MessageAccept,
+	}
+	iRes, negotiateErr := peer.NegotiateProtocol(iReq)
+	if negotiateErr != nil {
+		server.LogInfo("refuse identity of %v: %v\n", peer.Address, iRes.Reason)
+		res.Status = syncbox.StatusBad
+		res.Message = syncbox.MessageDeny
+	} else {
+		peer.Username = user.Username
+		peer.Device = req.Device
+		session, resumed := server.OpenSession(peer, user.Username, req.Device, iReq.SessionID, expires)
+		tRes, err := server.IssueToken(session)
+		if err == syncbox.ErrorTokenExpired {
+			// the credentials expire within the leeway of the authenticator
+			server.LogInfo("refuse identity of %v from %v: %v\n", req.Username, peer.Address, err)
+			server.refuseIdentity(req, peer, syncbox.StatusUnauthorized, err.Error(), eHandler)
+			peer.Close()
+			return
+		} else if err != nil {
+			server.LogDebug("error on IssueToken in ProcessIdentity: %v\n", err)
+			eHandler(err)
+			server.refuseIdentity(req, peer, syncbox.StatusInternal, err.Error(), eHandler)
+			return
+		}
+		iRes.SessionID = session.ID
+		iRes.Resumed = resumed
+		iRes.Token = tRes.Token
+		iRes.TokenLifetime = tRes.Lifetime
+		iRes.TokenFinal = tRes.Final
+		server.LogInfo("session %v of %v, resumed: %v\n", session.ID, peer.Address, resumed)
+	}
+	iResData, err := peer.Marshal(iRes)
+	if err != nil {
+		server.LogDebug("error on Marshal in ProcessIdentity: %v\n", err)
 		eHandler(err)
 	}
+	res.Data = iResData
 	server.LogDebug("sending response in ProcessIdentity, request id: %v\n", req.ID)
+	if err := peer.SendResponse(req, res); err != nil {
+		server.LogDebug("error on SendResponse in ProcessIdentity: %v\n", err)
+		eHandler(err)
+	}
+	if negotiateErr != nil {
+		peer.Close()
+		return
+	}
+	// switch after the response, since peer only understands the negotiated encodings once it gets the response
+	peer.ApplyNegotiation(iRes, iReq.MaxFrameSize, iReq.MaxPartialMessages)
+	server.LogDebug("negotiated with %v, protocol version: %v, software version: %v, capabilities: %v, compression: %v, codec: %v\n", peer.Address, iRes.ProtocolVersion, iReq.SoftwareVersion, peer.Capabilities(), peer.Compression(), iRes.Codec)
+}
+
+// ProcessRegister is the RequestProcessor of TypeRegister requests, it creates the account of the credentials of the request,
+// the connection isn't authenticated by it, peer should send an identity request afterwards
+func (server *Server) ProcessRegister(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	if !syncbox.AllowsRegistration(server.Authenticator) {
+		server.LogInfo("refuse registration of %v from %v: %v\n", req.Username, peer.Address, syncbox.ErrorRegistrationDisabled)
+		server.denyRequest(req, peer, syncbox.ErrorRegistrationDisabled, eHandler)
+		return
+	}
+	user, err := syncbox.RegisterUser(server.DB, req.Username, req.Password)
+	if err != nil {
+		server.LogInfo("refuse registration of %v from %v: %v\n", req.Username, peer.Address, err)
+		if syncbox.ErrorCode(err) == syncbox.CodeInternal {
+			eHandler(err)
+		}
+		server.denyRequest(req, peer, err, eHandler)
+		return
+	}
+	server.LogInfo("registered user %v from %v\n", user.Username, peer.Address)
+
+	server.LogDebug("sending response in ProcessRegister, request id: %v\n", req.ID)
 	if err := peer.SendResponse(req, &syncbox.Response{
 		Status:  syncbox.StatusOK,
 		Message: syncbox.MessageAccept,
 	}); err != nil {
-		server.LogDebug("error on SendResponse in ProcessIdentity: %v\n", err)
+		server.LogDebug("error on SendResponse in ProcessRegister: %v\n", err)
 		eHandler(err)
 	}
 }
 
-// ProcessDigest implements the ConnectionHandler interface
-func (server *Server) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	hasServerDigest := true
-	serverDir := syncbox.NewEmptyDir()
-	if peer.Username != "" && peer.RefGraph == nil {
-		rg, err := syncbox.NewRefGraph(peer.Username, peer.Password, server.DB)
-		if err != nil {
-			server.LogDebug("error on NewRefGraph in ProcessDigest: %v\n", err)
+// ProcessListDevices is the RequestProcessor of TypeListDevices requests, it responds the devices of the user
+func (server *Server) ProcessListDevices(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	devices, err := syncbox.ListDevices(server.DB, peer.RefGraph.User)
+	if err != nil {
+		server.LogDebug("error on ListDevices in ProcessListDevices: %v\n", err)
+		eHandler(err)
+		server.denyRequest(req, peer, err, eHandler)
+		return
+	}
+	online := server.OnlineDevices(req.Username)
+	dRes := &syncbox.DeviceListResponse{}
+	for _, device := range devices {
+		info := syncbox.NewDeviceInfo(device)
+		info.Online = online[device.DeviceID]
+		dRes.Devices = append(dRes.Devices, info)
+	}
+	dResData, err := peer.Marshal(dRes)
+	if err != nil {
+		server.LogDebug("error on Marshal in ProcessListDevices: %v\n", err)
+		eHandler(err)
+		return
+	}
+	server.LogDebug("sending response in ProcessListDevices, request id: %v\n", req.ID)
+	if err := peer.SendResponse(req, &syncbox.Response{
+		Status:  syncbox.StatusOK,
+		Message: syncbox.MessageAccept,
+		Data:    dResData,
+	}); err != nil {
+		server.LogDebug("error on SendResponse in ProcessListDevices: %v\n", err)
+		eHandler(err)
+	}
+}
+
+// ProcessRevokeDevice is the RequestProcessor of TypeRevokeDevice requests, it revokes the device of the user,
+// and drops its sessions after responding, so that the revoking device could be the revoked one
+func (server *Server) ProcessRevokeDevice(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	rReq := syncbox.RequestPayload(ctx).(*syncbox.RevokeDeviceRequest)
+	if err := syncbox.RevokeDevice(server.DB, peer.RefGraph.User, rReq.Device); err != nil {
+		if err != syncbox.ErrorDeviceNotFound {
+			server.LogDebug("error on RevokeDevice in ProcessRevokeDevice: %v\n", err)
 			eHandler(err)
 		}
-		peer.RefGraph = rg
+		server.denyRequest(req, peer, err, eHandler)
+		return
 	}
-	data := req.Data
-	dReq := syncbox.DigestRequest{}
-	if err := json.Unmarshal(data, &dReq); err != nil {
-		server.LogDebug("error on Unmarshal in ProcessDigest: %v\n", err)
+	server.LogInfo("revoked device %v of %v\n", rReq.Device, req.Username)
+	server.LogDebug("sending response in ProcessRevokeDevice, request id: %v\n", req.ID)
+	if err := peer.SendResponse(req, &syncbox.Response{
+		Status:  syncbox.StatusOK,
+		Message: syncbox.MessageAccept,
+	}); err != nil {
+		server.LogDebug("error on SendResponse in ProcessRevokeDevice: %v\n", err)
 		eHandler(err)
 	}
+	dropped := server.DropDeviceSessions(req.Username, rReq.Device)
+	server.LogInfo("dropped %v sessions of device %v\n", dropped, rReq.Device)
+}
+
+// ProcessDigest is the RequestProcessor of TypeDigest requests
+func (server *Server) ProcessDigest(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	hasServerDigest := true
+	serverDir := syncbox.NewEmptyDir()
+	dReq := syncbox.RequestPayload(ctx).(*syncbox.DigestRequest)
 	server.LogVerbose("server ProcessDigest called, req\n%v\n", dReq)
 
 	// create a bucket for the user, if not exists
-	err := server.Storage.CreateBucket(req.Username)
+	err := server.StorageBackend.CreateBucket(req.Username)
 	if err != nil {
 		server.LogDebug("error on creating bucket in ProcessDigest: %v\n", err)
 		eHandler(err)
+		server.denyRequest(req, peer, syncbox.StorageError(err), eHandler)
+		return
 	}
 	server.LogInfo("server completes create bucket in ProcessDigest\n")
 
@@ -140,17 +316,21 @@ func (server *Server) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eH
 	if err != nil {
 		server.LogDebug("error Marshal in ProcessDigest: %v\n", err)
 		eHandler(err)
+		server.denyRequest(req, peer, syncbox.NewCodedError(syncbox.CodeInternal, err), eHandler)
+		return
 	}
 	server.LogVerbose("dirBytes after json Marshal: %v\n", dirBytes)
 
 	// get the server side digest file for the user
-	serverDigestBytes, err := server.Storage.GetObject(req.Username, syncbox.DigestFileName)
+	serverDigestBytes, err := server.StorageBackend.GetObject(req.Username, syncbox.DigestFileName)
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "NoSuchKey: The specified key does not exist.") {
+		if syncbox.IsNoSuchKey(err) {
 			hasServerDigest = false
 		} else {
 			server.LogDebug("error on GetObject in ProcessDigest: %v\n", err)
 			eHandler(err)
+			server.denyRequest(req, peer, syncbox.StorageError(err), eHandler)
+			return
 		}
 	}
 	server.LogVerbose("serverDigestBytes:\n%v\n", serverDigestBytes)
@@ -160,6 +340,8 @@ func (server *Server) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eH
 		if err := json.Unmarshal(serverDigestBytes, serverDir); err != nil {
 			server.LogDebug("error on Unmarshal in ProcessDigest: %v\n", err)
 			eHandler(err)
+			server.denyRequest(req, peer, syncbox.NewCodedError(syncbox.CodeInternal, err), eHandler)
+			return
 		}
 	}
 	server.LogVerbose("serverDir:\n%v\n", serverDir)
@@ -181,11 +363,11 @@ func (server *Server) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eH
 			server.LogDebug("error on Compare in ProcessDigest: %v\n", err)
 			eHandler(err)
 		}
-		for addr, clientPeer := range server.Clients {
-			server.LogDebug("client addr: %v, username: %v\n", addr, clientPeer.Username)
-			if clientPeer.Username == peer.Username && addr != peer.Address {
-				server.LogDebug("sending digest request to peer: %v\n", addr)
-				res, innerErr := clientPeer.SendDigestRequest(syncbox.SyncboxServerUsername, syncbox.SyncboxServerPwd, syncbox.SyncboxServerDevice, dReq.Dir)
+		for _, clientPeer := range server.ClientPeers() {
+			server.LogDebug("client addr: %v, username: %v\n", clientPeer.Address, clientPeer.Username)
+			if clientPeer.Username == peer.Username && clientPeer != peer {
+				server.LogDebug("sending digest request to peer: %v\n", clientPeer.Address)
+				res, innerErr := clientPeer.SendDigestRequest("", "", "", dReq.Dir)
 				if innerErr != nil {
 					server.LogDebug("error on SendDigestRequest in ProcessDigest: %v\v", innerErr)
 					eHandler(innerErr)
@@ -195,7 +377,7 @@ func (server *Server) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eH
 		}
 	} else {
 		// otherwise, tell the original peer to update its file tree with server status
-		res, innerErr := peer.SendDigestRequest(syncbox.SyncboxServerUsername, syncbox.SyncboxServerPwd, syncbox.SyncboxServerDevice, serverDir)
+		res, innerErr := peer.SendDigestRequestContext(ctx, "", "", "", serverDir)
 		if innerErr != nil {
 			server.LogDebug("error on SendDigestRequest in ProcessDigest: %v\v", innerErr)
 			eHandler(innerErr)
@@ -205,7 +387,7 @@ func (server *Server) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eH
 
 	server.LogVerbose("before creating digest file object, dirBytes:\n%v\n", string(dirBytes))
 	// put the digest file to S3
-	if err := server.Storage.CreateObject(req.Username, syncbox.DigestFileName, string(dirBytes)); err != nil {
+	if err := server.StorageBackend.CreateObject(req.Username, syncbox.DigestFileName, string(dirBytes)); err != nil {
 		server.LogDebug("error on CreateObject in ProcessDigest: %v\n", err)
 		eHandler(err)
 	}
@@ -229,22 +411,20 @@ func (server *Server) ProcessDigest(req *syncbox.Request, peer *syncbox.Peer, eH
 	server.LogInfo("server finish cleaning up no ref files in ProcessDigest\n")
 }
 
-// ProcessSync implements the ConnectionHandler interface
-func (server *Server) ProcessSync(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	data := req.Data
-	sReq := syncbox.SyncRequest{}
-	if err := json.Unmarshal(data, &sReq); err != nil {
-		server.LogDebug("error on Unmarshal in ProcessSync: %v\n", err)
-		eHandler(err)
-	}
+// ProcessSync is the RequestProcessor of TypeSyncRequest requests
+func (server *Server) ProcessSync(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	sReq := syncbox.RequestPayload(ctx).(*syncbox.SyncRequest)
 
 	switch sReq.Action {
 	case syncbox.ActionGet:
-		fileBytes, err := server.GetObject(req.Username, syncbox.ChecksumToNumString(sReq.File.ContentChecksum))
+		reader, err := server.StorageBackend.NewObjectReader(req.Username, syncbox.ChecksumToNumString(sReq.File.ContentChecksum))
 		if err != nil {
-			server.LogDebug("error on GetObject in ProcessSync: %v\n", err)
+			server.LogDebug("error on NewObjectReader in ProcessSync: %v\n", err)
 			eHandler(err)
+			server.denyRequest(req, peer, syncbox.StorageError(err), eHandler)
+			return
 		}
+		defer reader.Close()
 
 		server.LogDebug("sending response in ProcessSync, request id: %v\n", req.ID)
 		if err := peer.SendResponse(req, &syncbox.Response{
@@ -255,32 +435,48 @@ func (server *Server) ProcessSync(req *syncbox.Request, peer *syncbox.Peer, eHan
 			eHandler(err)
 		}
 
-		res, err := peer.SendFileRequest(syncbox.SyncboxServerUsername, syncbox.SyncboxServerPwd, syncbox.SyncboxServerDevice, sReq.UnrootPath, sReq.File, fileBytes)
+		if !peer.HasCapability(syncbox.CapabilityChunkedTransfer) {
+			// peer doesn't support streaming, send the whole file at once
+			fileBytes, err := ioutil.ReadAll(reader)
+			if err != nil {
+				server.LogDebug("error on reading object in ProcessSync: %v\n", err)
+				eHandler(err)
+				return
+			}
+			res, err := peer.SendFileRequestContext(ctx, "", "", "", sReq.UnrootPath, sReq.File, fileBytes)
+			if err != nil {
+				server.LogDebug("error on SendFileRequest in ProcessSync: %v\n", err)
+				eHandler(err)
+			}
+			server.LogInfo("response of SendFileRequest:\n%v\n", res)
+			return
+		}
+		res, err := peer.SendFileStreamContext(ctx, "", "", "", sReq.UnrootPath, sReq.File, reader)
 		if err != nil {
-			server.LogDebug("error on SendFileRequest in ProcessSync: %v\n", err)
+			server.LogDebug("error on SendFileStream in ProcessSync: %v\n", err)
 			eHandler(err)
 		}
-		server.LogInfo("response of SendFileRequest:\n%v\n", res)
+		server.LogInfo("response of SendFileStream:\n%v\n", res)
+	default:
+		server.LogDebug("unknown action in ProcessSync: %v\n", sReq.Action)
+		server.denyRequest(req, peer, syncbox.ErrorUnknownAction, eHandler)
 	}
 }
 
-// ProcessFile implements the ConnectionHandler interface
+// ProcessFile is the RequestProcessor of TypeFile requests
 // should executes the steps to save file to s3
-func (server *Server) ProcessFile(req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
-	data := req.Data
-	dReq := syncbox.FileRequest{}
-	if err := json.Unmarshal(data, &dReq); err != nil {
-		server.LogDebug("error Unmarshal data in ProcessFile: %v\n", err)
-		eHandler(err)
-	}
+func (server *Server) ProcessFile(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	dReq := syncbox.RequestPayload(ctx).(*syncbox.FileRequest)
 	// server.LogDebug("server ProcessFile called, req: %v\n", dReq)
 
 	filename := syncbox.ChecksumToNumString(dReq.File.ContentChecksum)
 	content := string(dReq.Content)
 	// server.LogDebug("filename: %v\ncontent: %v\n", filename, content)
-	if err := server.Storage.CreateObject(req.Username, filename, content); err != nil {
+	if err := server.StorageBackend.CreateObject(req.Username, filename, content); err != nil {
 		server.LogDebug("error on CreateObject in ProcessFile: %v\n", err)
 		eHandler(err)
+		server.denyRequest(req, peer, syncbox.StorageError(err), eHandler)
+		return
 	}
 
 	server.LogDebug("sending response in ProcessFile, request id: %v\n", req.ID)
@@ -293,6 +489,64 @@ func (server *Server) ProcessFile(req *syncbox.Request, peer *syncbox.Peer, eHan
 	}
 }
 
+// ProcessFileChunk is the RequestProcessor of TypeFileChunk requests
+// should stream chunks of file content to the storage
+func (server *Server) ProcessFileChunk(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+	cReq := syncbox.RequestPayload(ctx).(*syncbox.FileChunkRequest)
+	done, err := peer.WriteFileChunk(cReq, func(cReq *syncbox.FileChunkRequest) (io.WriteCloser, error) {
+		return server.StorageBackend.NewObjectWriter(req.Username, syncbox.ChecksumToNumString(cReq.File.ContentChecksum))
+	})
+	if err != nil {
+		server.LogDebug("error on WriteFileChunk in ProcessFileChunk: %v\n", err)
+		eHandler(err)
+		if syncbox.ErrorCode(err) == syncbox.CodeInternal {
+			// errors that aren't about the transfer itself come from the object writer
+			err = syncbox.StorageError(err)
+		}
+		server.denyRequest(req, peer, err, eHandler)
+		return
+	}
+	if done {
+		server.LogInfo("server completes streaming transfer %v of %v\n", cReq.TransferID, cReq.UnrootPath)
+	}
+
+	server.LogVerbose("sending response in ProcessFileChunk, request id: %v\n", req.ID)
+	if err := peer.SendResponse(req, &syncbox.Response{
+		Status:  syncbox.StatusOK,
+		Message: syncbox.MessageAccept,
+	}); err != nil {
+		server.LogDebug("error on SendResponse in ProcessFileChunk: %v\n", err)
+		eHandler(err)
+	}
+}
+
+// refuseIdentity responds the identity request req with status and the reason, in the data of an IdentityResponse like peer expects
+func (server *Server) refuseIdentity(req *syncbox.Request, peer *syncbox.Peer, status int, reason string, eHandler syncbox.ErrorHandler) {
+	iResData, err := peer.Marshal(&syncbox.IdentityResponse{
+		Reason: reason,
+	})
+	if err != nil {
+		server.LogDebug("error on Marshal in refuseIdentity: %v\n", err)
+		eHandler(err)
+	}
+	if err := peer.SendResponse(req, &syncbox.Response{
+		Status:  status,
+		Message: syncbox.MessageDeny,
+		Data:    iResData,
+	}); err != nil {
+		server.LogDebug("error on SendResponse in refuseIdentity: %v\n", err)
+		eHandler(err)
+	}
+}
+
+// denyRequest responds req with the error response of err, so that peer knows why the request fails
+func (server *Server) denyRequest(req *syncbox.Request, peer *syncbox.Peer, err error, eHandler syncbox.ErrorHandler) {
+	if sendErr := peer.SendErrorResponse(req, err); sendErr != nil {
+		server.LogDebug("error on SendErrorResponse: %v\n", sendErr)
+		eHandler(sendErr)
+	}
+}
+
 // AddFile implements the Syncer interface
 // should send a FileRequest to client to get file content, and save to S3
 func (server *Server) AddFile(rootPath string, unrootPath string, file *syncbox.File, peer *syncbox.Peer) error {
@@ -309,7 +563,7 @@ func (server *Server) AddFile(rootPath string, unrootPath string, file *syncbox.
 
 	// if no duplicate, send a sync request to client to get file and save to s3
 	if !duplicate {
-		res, err := peer.SendSyncRequest(syncbox.SyncboxServerUsername, syncbox.SyncboxServerPwd, syncbox.SyncboxServerDevice, unrootPath, syncbox.ActionGet, file)
+		res, err := peer.SendSyncRequest("", "", "", unrootPath, syncbox.ActionGet, file)
 		if err != nil {
 			server.LogDebug("error on SendSyncRequest in AddFile: %v\n", err)
 			return err
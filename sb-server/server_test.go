@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/roackb2/syncbox"
+)
+
+// listenNotifier is the PipeTransport that tells when the server listens
+type listenNotifier struct {
+	*syncbox.PipeTransport
+	listening chan error
+}
+
+func (transport *listenNotifier) Listen(addr string) (net.Listener, error) {
+	ln, err := transport.PipeTransport.Listen(addr)
+	transport.listening <- err
+	return ln, err
+}
+
+// clientHandler is the ConnectionHandler of the client, which doesn't process requests
+type clientHandler struct {
+	*syncbox.Logger
+}
+
+func (handler *clientHandler) HandleRequest(peer *syncbox.Peer) error {
+	return syncbox.NewRegistry().HandleRequest(peer, handler)
+}
+
+func (handler *clientHandler) HandleError(err error) {}
+
+// startDigestServer starts a server processing digest requests over a PipeTransport, storing in storage,
+// peers are identified as the username of their requests without authentication or database.
+// It returns the client connected to the server.
+func startDigestServer(t *testing.T, storage *syncbox.MemoryStorage) *syncbox.ClientConnector {
+	t.Helper()
+	sc, err := syncbox.NewServerConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &listenNotifier{PipeTransport: syncbox.NewPipeTransport(), listening: make(chan error, 1)}
+	sc.Transport = transport
+	sc.TLS = nil
+	server := &Server{
+		Logger:          syncbox.NewDefaultLogger(),
+		ServerConnector: sc,
+		StorageBackend:  storage,
+	}
+	server.Registry.Register(syncbox.TypeDigest, syncbox.DigestRequest{}, func(ctx context.Context, req *syncbox.Request, peer *syncbox.Peer, eHandler syncbox.ErrorHandler) {
+		peer.Username = req.Username
+		peer.RefGraph = &syncbox.RefGraph{}
+		server.ProcessDigest(ctx, req, peer, eHandler)
+	})
+	go server.Listen(server)
+	select {
+	case err := <-transport.listening:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server doesn't listen")
+	}
+	t.Cleanup(func() {
+		sc.Listener.Close()
+		for _, peer := range sc.ClientPeers() {
+			peer.Close()
+		}
+	})
+
+	cc, err := syncbox.NewClientConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Transport = transport.PipeTransport
+	cc.TLS = nil
+	cc.ServerDialAddr = sc.ServerListenAddr
+	if err := cc.Dial(&clientHandler{Logger: cc.Logger}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cc.Peer.Close()
+	})
+	return cc
+}
+
+// sendDigest sends the digest of an empty directory newer than the one on server, so that server doesn't request the client
+func sendDigest(cc *syncbox.ClientConnector) (*syncbox.Response, error) {
+	dir := syncbox.NewEmptyDir()
+	dir.ModTime = time.Now()
+	return cc.Peer.SendDigestRequest("alice", "", "device", dir)
+}
+
+// waitFor polls condition until it's true, or fails the test after 5 seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProcessDigestStorageFailures(t *testing.T) {
+	unavailable := errors.New("storage unavailable")
+	for name, fault := range map[string]func(*syncbox.MemoryStorage){
+		"bucket": func(storage *syncbox.MemoryStorage) {
+			storage.FailKey(syncbox.StorageOpCreateBucket, "alice", unavailable)
+		},
+		"server digest": func(storage *syncbox.MemoryStorage) {
+			storage.FailKey(syncbox.StorageOpGetObject, syncbox.DigestFileName, unavailable)
+		},
+	} {
+		storage := syncbox.NewMemoryStorage()
+		fault(storage)
+		cc := startDigestServer(t, storage)
+		_, err := sendDigest(cc)
+		if code := syncbox.ErrorCode(err); code != syncbox.CodeStorageUnavailable {
+			t.Errorf("%v failure: got %v, code %v", name, err, code)
+		}
+		if _, statErr := storage.StatObject("alice", syncbox.DigestFileName); statErr == nil {
+			t.Errorf("%v failure: denied digest shouldn't be stored", name)
+		}
+	}
+}
+
+func TestProcessDigestWithoutServerDigest(t *testing.T) {
+	storage := syncbox.NewMemoryStorage()
+	cc := startDigestServer(t, storage)
+	res, err := sendDigest(cc)
+	if err != nil || res.Status != syncbox.StatusOK {
+		t.Fatalf("first digest: %v, %v", res, err)
+	}
+	waitFor(t, "the digest to be stored", func() bool {
+		_, err := storage.StatObject("alice", syncbox.DigestFileName)
+		return err == nil
+	})
+}
+
+func TestProcessDigestNoSuchKey(t *testing.T) {
+	storage := syncbox.NewMemoryStorage()
+	storage.CreateBucket("alice")
+	storage.CreateObject("alice", syncbox.DigestFileName, "{}")
+	// storage tells the digest doesn't exist, the one of the client replaces it
+	storage.FailKey(syncbox.StorageOpGetObject, syncbox.DigestFileName, syncbox.ErrorNoSuchKey)
+	cc := startDigestServer(t, storage)
+	res, err := sendDigest(cc)
+	if err != nil || res.Status != syncbox.StatusOK {
+		t.Fatalf("digest without server digest: %v, %v", res, err)
+	}
+	storage.ClearFaults()
+	waitFor(t, "the digest of the client", func() bool {
+		content, err := storage.GetObject("alice", syncbox.DigestFileName)
+		return err == nil && string(content) != "{}"
+	})
+}
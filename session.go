@@ -0,0 +1,130 @@
+package syncbox
+
+import (
+	"time"
+)
+
+// constants for sessions
+const (
+	// SessionResumeWindow is how long a session could be resumed after its connection is lost
+	SessionResumeWindow = 10 * time.Minute
+)
+
+// Session is the server side state of a client across reconnections,
+// a client resumes its session by telling the session ID in the identity handshake of a new connection
+type Session struct {
+	ID             string
+	Username       string
+	Device         string
+	Peer           *Peer
+	Created        time.Time
+	DisconnectedAt time.Time
+
+	// Expires is when the credentials that authenticate the session expire, like the expiry of a bearer token,
+	// tokens of the session are never valid past it. It's zero if the credentials don't expire.
+	Expires time.Time
+
+	// Responses are the responses of the requests completed in the session, to respond retried requests, see Idempotent
+	Responses *ResponseCache
+
+	// token is the token that requests of the session carry, see IssueToken
+	token sessionToken
+}
+
+func (session *Session) String() string {
+	return ToString(session)
+}
+
+// OpenSession resumes the session of previousID for peer if it's owned by the same user and device,
+// otherwise it starts a new session. It returns the session and whether it's resumed.
+// expires is when the credentials that the connection is authenticated by expire, zero if they don't, see AuthenticateUntil.
+// The connection belongs to the session from now on, but its requests are only accepted once a token is issued by IssueToken.
+// The connection that the resumed session was on is closed, since the client has given it up,
+// so that messages to the client are never sent over a half-open connection.
+func (sc *ServerConnector) OpenSession(peer *Peer, username string, device string, previousID string, expires time.Time) (*Session, bool) {
+	sc.sessionMutex.Lock()
+	sc.purgeSessions()
+	session, exists := sc.sessions[previousID]
+	resumed := exists && session.Username == username && session.Device == device
+	var stalePeer *Peer
+	if resumed {
+		if session.Peer != peer {
+			stalePeer = session.Peer
+		}
+		session.Peer = peer
+		session.DisconnectedAt = time.Time{}
+		session.Expires = expires
+	} else {
+		session = &Session{
+			ID:        UUID(),
+			Username:  username,
+			Device:    device,
+			Peer:      peer,
+			Created:   time.Now(),
+			Expires:   expires,
+			Responses: NewResponseCache(sc.IdempotencyCacheSize),
+		}
+		sc.sessions[session.ID] = session
+	}
+	sc.sessionMutex.Unlock()
+	peer.setSessionID(session.ID)
+	peer.setResponseCache(session.Responses)
+
+	if stalePeer != nil {
+		sc.LogDebug("closing stale connection %v of session %v\n", stalePeer.Address, session.ID)
+		stalePeer.Close()
+	}
+	return session, resumed
+}
+
+// detachSession marks the session of peer as disconnected, it could be resumed within SessionResumeWindow
+func (sc *ServerConnector) detachSession(peer *Peer) {
+	sc.sessionMutex.Lock()
+	defer sc.sessionMutex.Unlock()
+	session, exists := sc.sessions[peer.SessionID()]
+	if exists && session.Peer == peer {
+		session.DisconnectedAt = time.Now()
+	}
+}
+
+// DropDeviceSessions removes the sessions of device of username and closes their connections,
+// so that the device has to identify again. It returns the number of sessions dropped.
+func (sc *ServerConnector) DropDeviceSessions(username string, device string) int {
+	sc.sessionMutex.Lock()
+	var peers []*Peer
+	for id, session := range sc.sessions {
+		if session.Username == username && session.Device == device {
+			delete(sc.sessions, id)
+			peers = append(peers, session.Peer)
+		}
+	}
+	sc.sessionMutex.Unlock()
+
+	for _, peer := range peers {
+		sc.LogDebug("closing connection %v of dropped session of device %v\n", peer.Address, device)
+		peer.Close()
+	}
+	return len(peers)
+}
+
+// OnlineDevices returns the devices of username that have connected sessions
+func (sc *ServerConnector) OnlineDevices(username string) map[string]bool {
+	sc.sessionMutex.Lock()
+	defer sc.sessionMutex.Unlock()
+	devices := make(map[string]bool)
+	for _, session := range sc.sessions {
+		if session.Username == username && session.DisconnectedAt.IsZero() {
+			devices[session.Device] = true
+		}
+	}
+	return devices
+}
+
+// purgeSessions removes sessions disconnected longer than SessionResumeWindow, the caller should hold sessionMutex
+func (sc *ServerConnector) purgeSessions() {
+	for id, session := range sc.sessions {
+		if !session.DisconnectedAt.IsZero() && time.Since(session.DisconnectedAt) > SessionResumeWindow {
+			delete(sc.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package syncbox
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// constants for message signing
+const (
+	DefaultSigningWindow      = 2 * time.Minute
+	SigningNonceSize          = 16
+	DefaultSigningKeyFileName = ".syncbox/signing_key"
+	DefaultSigningPinFileName = ".syncbox/known_signing_keys"
+
+	// signingSecretLabel separates the signing secret from other keys that might be derived from the same exchange
+	signingSecretLabel = "syncbox message signing v2"
+)
+
+// newSigningKey generates an ephemeral P-256 key to agree the signing secret by ECDH
+func newSigningKey() (*ecdh.PrivateKey, error) {
+	return ecdh.P256().GenerateKey(rand.Reader)
+}
+
+// loadSigningIdentity loads the long-term signing key of server from file, which is generated if it doesn't exist,
+// so that the key pinned by clients stays the same across restarts
+func loadSigningIdentity(file string) (*ecdh.PrivateKey, error) {
+	if file == "" {
+		return nil, ErrorMissingSigningKey
+	}
+	keyBytes, err := ioutil.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(keyBytes)
+		if block == nil {
+			return nil, ErrorBadSigningKey
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecdsaKey, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, ErrorBadSigningKey
+		}
+		return ecdsaKey.ECDH()
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := newSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	NewDefaultLogger().LogInfo("generated signing key %v, fingerprint: %v\n", file, Fingerprint(key.PublicKey().Bytes()))
+	return key, nil
+}
+
+// serverSigningSecret agrees the signing secret with the ephemeral key of client on server side,
+// it returns the secret and the ephemeral key of server
+func serverSigningSecret(identity *ecdh.PrivateKey, clientKey []byte) ([]byte, []byte, error) {
+	clientPublic, err := ecdh.P256().NewPublicKey(clientKey)
+	if err != nil {
+		return nil, nil, ErrorBadSigningKey
+	}
+	key, err := newSigningKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := key.ECDH(clientPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	static, err := identity.ECDH(clientPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverKey := key.PublicKey().Bytes()
+	return deriveSigningSecret(ephemeral, static, clientKey, serverKey, identity.PublicKey().Bytes()), serverKey, nil
+}
+
+// clientSigningSecret agrees the signing secret with the ephemeral key and the long-term key of server on client side,
+// the long-term key should be verified by the caller
+func clientSigningSecret(key *ecdh.PrivateKey, serverKey []byte, serverIdentity []byte) ([]byte, error) {
+	serverPublic, err := ecdh.P256().NewPublicKey(serverKey)
+	if err != nil {
+		return nil, ErrorBadSigningKey
+	}
+	identityPublic, err := ecdh.P256().NewPublicKey(serverIdentity)
+	if err != nil {
+		return nil, ErrorBadSigningKey
+	}
+	ephemeral, err := key.ECDH(serverPublic)
+	if err != nil {
+		return nil, err
+	}
+	static, err := key.ECDH(identityPublic)
+	if err != nil {
+		return nil, err
+	}
+	return deriveSigningSecret(ephemeral, static, key.PublicKey().Bytes(), serverKey, serverIdentity), nil
+}
+
+// deriveSigningSecret derives the signing secret by HKDF from the shared secrets of the ephemeral keys
+// and of the client key with the long-term server key, bound to all the public keys of the handshake.
+// An attacker in the middle could replace the ephemeral keys, but without the long-term server key
+// it can't compute the static shared secret, nor the signing secret.
+func deriveSigningSecret(ephemeral []byte, static []byte, clientKey []byte, serverKey []byte, serverIdentity []byte) []byte {
+	info := &canonicalWriter{}
+	info.WriteString(signingSecretLabel)
+	info.field(clientKey)
+	info.field(serverKey)
+	info.field(serverIdentity)
+	return hkdfSHA256(append(append([]byte{}, ephemeral...), static...), nil, info.Bytes(), sha256.Size)
+}
+
+// hkdfSHA256 derives a key of size bytes from the input key material ikm by HKDF-SHA256 (RFC 5869)
+func hkdfSHA256(ikm []byte, salt []byte, info []byte, size int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+	var okm, block []byte
+	for counter := byte(1); len(okm) < size; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		okm = append(okm, block...)
+	}
+	return okm[:size]
+}
+
+// nonceCache remembers the nonces of the messages received in the last retention,
+// messages are only accepted within the signing window, so older nonces can't be replayed and are forgotten
+type nonceCache struct {
+	mutex sync.Mutex
+	seen  map[string]bool
+	order []nonceEntry
+}
+
+type nonceEntry struct {
+	nonce    string
+	received time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		seen: make(map[string]bool),
+	}
+}
+
+// add records nonce, it returns false if nonce is already seen within retention
+func (cache *nonceCache) add(nonce string, retention time.Duration) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	expired := 0
+	for expired < len(cache.order) && now.Sub(cache.order[expired].received) > retention {
+		delete(cache.seen, cache.order[expired].nonce)
+		expired++
+	}
+	cache.order = cache.order[expired:]
+	if cache.seen[nonce] {
+		return false
+	}
+	cache.seen[nonce] = true
+	cache.order = append(cache.order, nonceEntry{nonce: nonce, received: now})
+	return true
+}
+
+// newNonce returns a random nonce
+func newNonce() (string, error) {
+	nonce := make([]byte, SigningNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// canonicalWriter writes fields in the canonical form that signatures are made over,
+// each field is prefixed by its length, so that different messages never have the same form
+type canonicalWriter struct {
+	bytes.Buffer
+}
+
+func (w *canonicalWriter) field(value []byte) {
+	var length [binary.MaxVarintLen64]byte
+	w.Write(length[:binary.PutUvarint(length[:], uint64(len(value)))])
+	w.Write(value)
+}
+
+func (w *canonicalWriter) int(value int64) {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], uint64(value))
+	w.Write(encoded[:])
+}
+
+// canonical returns the canonical form of req that is signed, which is every field but the signature
+func (req *Request) canonical() []byte {
+	w := &canonicalWriter{}
+	w.WriteByte(RequestPrefix)
+	w.field([]byte(req.ID))
+	w.field([]byte(req.Username))
+	w.field([]byte(req.Password))
+	w.field([]byte(req.Device))
+	w.field([]byte(req.DataType))
+	w.field(req.Data)
+	w.field([]byte(req.Token))
+	w.int(req.Timestamp)
+	w.field([]byte(req.Nonce))
+	w.field([]byte(req.IdempotencyKey))
+	return w.Bytes()
+}
+
+// canonical returns the canonical form of res that is signed, which is every field but the signature
+func (res *Response) canonical() []byte {
+	w := &canonicalWriter{}
+	w.WriteByte(ResponsePrefix)
+	w.field([]byte(res.RequestID))
+	w.int(int64(res.Status))
+	w.field([]byte(res.Message))
+	w.field(res.Data)
+	w.int(res.Timestamp)
+	w.field([]byte(res.Nonce))
+	return w.Bytes()
+}
+
+// signingSecret returns the secret that messages on the connection are signed with, or nil if signing isn't agreed
+func (hub *Hub) signingSecret() []byte {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	return hub.signSecret
+}
+
+// setSigningSecret makes the hub sign outbound messages with secret, and reject inbound ones not signed with it
+func (hub *Hub) setSigningSecret(secret []byte) {
+	hub.settingsMutex.Lock()
+	defer hub.settingsMutex.Unlock()
+	hub.signSecret = secret
+}
+
+// IsSigning examines whether messages on the connection are signed
+func (hub *Hub) IsSigning() bool {
+	return hub.signingSecret() != nil
+}
+
+// stamp returns the timestamp and a nonce for an outbound message
+func stamp() (int64, string, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return 0, "", err
+	}
+	return time.Now().UnixNano(), nonce, nil
+}
+
+// signRequest stamps and signs req if signing is agreed on the connection
+func (hub *Hub) signRequest(req *Request) error {
+	secret := hub.signingSecret()
+	if secret == nil {
+		return nil
+	}
+	var err error
+	if req.Timestamp, req.Nonce, err = stamp(); err != nil {
+		return err
+	}
+	req.Signature = signMessage(secret, req.canonical())
+	return nil
+}
+
+// signResponse stamps and signs res if signing is agreed on the connection
+func (hub *Hub) signResponse(res *Response) error {
+	secret := hub.signingSecret()
+	if secret == nil {
+		return nil
+	}
+	var err error
+	if res.Timestamp, res.Nonce, err = stamp(); err != nil {
+		return err
+	}
+	res.Signature = signMessage(secret, res.canonical())
+	return nil
+}
+
+// verifyRequest examines the signature, timestamp and nonce of req if signing is agreed on the connection
+func (hub *Hub) verifyRequest(req *Request) error {
+	secret := hub.signingSecret()
+	if secret == nil {
+		return nil
+	}
+	return hub.verifyMessage(secret, req.canonical(), req.Signature, req.Timestamp, req.Nonce)
+}
+
+// verifyResponse examines the signature, timestamp and nonce of res if signing is agreed on the connection
+func (hub *Hub) verifyResponse(res *Response) error {
+	secret := hub.signingSecret()
+	if secret == nil {
+		return nil
+	}
+	return hub.verifyMessage(secret, res.canonical(), res.Signature, res.Timestamp, res.Nonce)
+}
+
+// verifyMessage rejects messages with a bad signature, a timestamp further than SigningWindow from now,
+// or a nonce seen before. The nonce is only recorded once the signature is verified, so forged messages can't burn nonces.
+func (hub *Hub) verifyMessage(secret []byte, canonical []byte, signature []byte, timestamp int64, nonce string) error {
+	if !hmac.Equal(signature, signMessage(secret, canonical)) {
+		return ErrorBadSignature
+	}
+	window := hub.SigningWindow
+	if window <= 0 {
+		window = DefaultSigningWindow
+	}
+	skew := time.Since(time.Unix(0, timestamp))
+	if skew > window || skew < -window {
+		return ErrorStaleMessage
+	}
+	if nonce == "" || !hub.nonces.add(nonce, 2*window) {
+		return ErrorReplayedNonce
+	}
+	return nil
+}
+
+func signMessage(secret []byte, canonical []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(canonical)
+	return mac.Sum(nil)
+}
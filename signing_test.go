@@ -0,0 +1,206 @@
+package syncbox
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signingPair returns two connected hubs that run the identity handshake to agree signing, b is the server with identity,
+// a verifies the signing key of b by verify. It returns the error of the handshake.
+func signingPair(t *testing.T, identity *ecdh.PrivateKey, verify func([]byte) error) (*Hub, *Hub, error) {
+	t.Helper()
+	a, b := hubPair(t)
+	b.SigningIdentity = identity
+	a.VerifySigningKey = verify
+	go func() {
+		req, err := b.ReceiveRequest()
+		if err != nil {
+			return
+		}
+		iReq := &IdentityRequest{}
+		if err := Decode(req.Data, iReq); err != nil {
+			b.SendErrorResponse(req, err)
+			return
+		}
+		iRes, _ := b.NegotiateProtocol(iReq)
+		data, _ := b.Marshal(iRes)
+		b.SendResponse(req, &Response{Status: StatusOK, Data: data})
+		b.ApplyNegotiation(iRes, iReq.MaxFrameSize, iReq.MaxPartialMessages)
+	}()
+	_, err := a.SendIdentityRequest("user", "password", "device")
+	return a, b, err
+}
+
+func TestSigningSecretBoundToServerKey(t *testing.T) {
+	server, _ := newSigningKey()
+	attacker, _ := newSigningKey()
+	client, _ := newSigningKey()
+	secret, serverKey, err := serverSigningSecret(server, client.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSecret, err := clientSigningSecret(client, serverKey, server.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, clientSecret) {
+		t.Fatal("client and server derive different secrets")
+	}
+	// an attacker in the middle answers with its own keys, but tells the key of server to pass the pin
+	forged, forgedKey, _ := serverSigningSecret(attacker, client.PublicKey().Bytes())
+	clientSecret, err = clientSigningSecret(client, forgedKey, server.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(forged, clientSecret) {
+		t.Fatal("attacker derives the secret without the key of server")
+	}
+	if _, err := clientSigningSecret(client, []byte{4, 1, 2}, server.PublicKey().Bytes()); err != ErrorBadSigningKey {
+		t.Fatalf("invalid key: got %v", err)
+	}
+}
+
+func TestVerifySigningKeyPins(t *testing.T) {
+	cc := &ClientConnector{Connector: &Connector{
+		ServerDialAddr: "localhost:8000",
+		SigningPinFile: filepath.Join(t.TempDir(), "known_signing_keys"),
+	}}
+	server, _ := newSigningKey()
+	attacker, _ := newSigningKey()
+	for i := 0; i < 2; i++ {
+		if err := cc.verifySigningKey(server.PublicKey().Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cc.verifySigningKey(attacker.PublicKey().Bytes()); err != ErrorSigningKeyMismatch {
+		t.Fatalf("changed key: got %v", err)
+	}
+
+	_, _, err := signingPair(t, attacker, cc.verifySigningKey)
+	if err != ErrorSigningKeyMismatch {
+		t.Fatalf("handshake with changed key: got %v", err)
+	}
+}
+
+func TestLoadSigningIdentity(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dir", "signing_key")
+	generated, err := loadSigningIdentity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("key file: %v, %v", info, err)
+	}
+	loaded, err := loadSigningIdentity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(generated) {
+		t.Fatal("loaded key differs from the generated one")
+	}
+}
+
+func TestSignedMessages(t *testing.T) {
+	identity, _ := newSigningKey()
+	a, b, err := signingPair(t, identity, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsSigning() || !b.IsSigning() {
+		t.Fatal("signing isn't agreed")
+	}
+	go func() {
+		for {
+			req, err := b.ReceiveRequest()
+			if err != nil {
+				if b.Err() != nil {
+					return
+				}
+				continue
+			}
+			b.SendResponse(req, &Response{Status: StatusOK})
+		}
+	}()
+	if res, err := a.SendRequestForResponse(NewRequest("", "", "", "ECHO", nil)); err != nil || res.Status != StatusOK {
+		t.Fatalf("signed request: %v, %v", res, err)
+	}
+
+	// sendRaw sends the bytes of req as they are, without signing it again
+	sendRaw := func(from *Hub, req *Request) chan *Response {
+		responses := from.registerRequest(req.ID)
+		data, _ := from.Marshal(req)
+		from.sendMessage(func() ([]byte, error) {
+			return data, nil
+		}, RequestPrefix, PriorityMetadata)
+		return responses
+	}
+	expect := func(name string, responses chan *Response, want error) {
+		t.Helper()
+		select {
+		case res := <-responses:
+			err := res.Err()
+			if want == nil && err != nil || want != nil && (ErrorCode(err) != CodeBadRequest || !strings.Contains(err.Error(), want.Error())) {
+				t.Fatalf("%v: got %v, want %v", name, err, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: no response", name)
+		}
+	}
+
+	signed := NewRequest("", "", "", "ECHO", []byte("data"))
+	a.signRequest(signed)
+	expect("signed", sendRaw(a, signed), nil)
+	expect("replayed", sendRaw(a, signed), ErrorReplayedNonce)
+
+	tampered := NewRequest("", "", "", "ECHO", []byte("data"))
+	a.signRequest(tampered)
+	tampered.Data = []byte("tampered")
+	expect("tampered", sendRaw(a, tampered), ErrorBadSignature)
+
+	stale := NewRequest("", "", "", "ECHO", nil)
+	a.signRequest(stale)
+	stale.Timestamp = time.Now().Add(-time.Hour).UnixNano()
+	stale.Signature = signMessage(a.signingSecret(), stale.canonical())
+	expect("stale", sendRaw(a, stale), ErrorStaleMessage)
+
+	expect("unsigned", sendRaw(a, NewRequest("", "", "", "ECHO", nil)), ErrorBadSignature)
+
+	// a forged response fails the request waiting for it
+	id := UUID()
+	responses := a.registerRequest(id)
+	b.sendMessage(func() ([]byte, error) {
+		return b.Marshal(&Response{RequestID: id, Status: StatusOK})
+	}, ResponsePrefix, PriorityMetadata)
+	expect("forged response", responses, ErrorBadSignature)
+}
+
+func TestSignAtWriteTime(t *testing.T) {
+	c1, c2 := net.Pipe()
+	a := NewHub(c1, func(error) {})
+	b := NewHub(c2, func(error) {})
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	a.setSigningSecret(make([]byte, 32))
+	go b.Setup()
+	go a.SendRequest(NewRequest("", "", "", "ECHO", nil))
+	// the request waits in the queue until SendPackets runs
+	time.Sleep(100 * time.Millisecond)
+	written := time.Now()
+	go a.SendPackets()
+	req, err := b.ReceiveRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Unix(0, req.Timestamp).Before(written) {
+		t.Fatalf("request is stamped at %v when it's queued, before it's written at %v", time.Unix(0, req.Timestamp), written)
+	}
+}
@@ -0,0 +1,378 @@
+package syncbox
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// constants for local storage layout
+const (
+	localBlobDir = "blobs"
+	localRefDir  = "refs"
+	localTmpDir  = "tmp"
+)
+
+// LocalStorage is the StorageBackend that keeps objects on local disk.
+// Contents are addressed by their SHA-256 hash under blobs/ of each bucket,
+// and object names are refs under refs/ that point to the blobs,
+// so objects with identical content only take the space once.
+// Blobs are removed once no refs point to them, the refs of each bucket are counted
+// by scanning refs/ the first time the bucket is used.
+type LocalStorage struct {
+	*Logger
+	RootDir  string
+	refCount map[string]map[string]int
+	mutex    sync.Mutex
+}
+
+// NewLocalStorage instantiates LocalStorage that stores objects under rootDir
+func NewLocalStorage(rootDir string) (*LocalStorage, error) {
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{
+		RootDir:  rootDir,
+		refCount: make(map[string]map[string]int),
+		Logger:   NewDefaultLogger(),
+	}, nil
+}
+
+func (storage *LocalStorage) bucketPath(bucketName string) (string, error) {
+	if bucketName == "" || bucketName == "." || bucketName == ".." || strings.ContainsAny(bucketName, "/\\") {
+		return "", ErrorInvalidBucketName
+	}
+	bucketPath := filepath.Join(storage.RootDir, bucketName)
+	if _, err := os.Stat(bucketPath); err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrorNoSuchBucket
+		}
+		return "", err
+	}
+	return bucketPath, nil
+}
+
+// refPath encodes the object name, so that any name is a valid and safe file name
+func (storage *LocalStorage) refPath(bucketPath string, objName string) string {
+	return filepath.Join(bucketPath, localRefDir, base64.RawURLEncoding.EncodeToString([]byte(objName)))
+}
+
+func (storage *LocalStorage) blobPath(bucketPath string, hash string) string {
+	return filepath.Join(bucketPath, localBlobDir, hash)
+}
+
+func (storage *LocalStorage) readRef(bucketPath string, objName string) (string, error) {
+	hash, err := ioutil.ReadFile(storage.refPath(bucketPath, objName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrorNoSuchKey
+		}
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// writeFileAtomic writes to a temporary file and renames it to path,
+// so readers never see a partially written file
+func (storage *LocalStorage) writeFileAtomic(bucketPath string, path string, content []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Join(bucketPath, localTmpDir), "obj-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// CreateBucket creates the directories of bucket, it does nothing if the bucket exists
+func (storage *LocalStorage) CreateBucket(bucketName string) error {
+	if _, err := storage.bucketPath(bucketName); err != nil && err != ErrorNoSuchBucket {
+		return err
+	}
+	bucketPath := filepath.Join(storage.RootDir, bucketName)
+	for _, dir := range []string{localBlobDir, localRefDir, localTmpDir} {
+		if err := os.MkdirAll(filepath.Join(bucketPath, dir), 0755); err != nil {
+			storage.LogDebug("error on creating bucket directory: %v\n", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateObject stores the content as a blob and points the object name to it
+func (storage *LocalStorage) CreateObject(bucketName string, objName string, content string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucketPath, err := storage.bucketPath(bucketName)
+	if err != nil {
+		return err
+	}
+	return storage.commitObject(bucketPath, objName, []byte(content))
+}
+
+func (storage *LocalStorage) commitObject(bucketPath string, objName string, content []byte) error {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	blobPath := storage.blobPath(bucketPath, hash)
+	if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+		if err := storage.writeFileAtomic(bucketPath, blobPath, content); err != nil {
+			storage.LogDebug("error on writing blob of %v: %v\n", objName, err)
+			return err
+		}
+	}
+	return storage.linkObject(bucketPath, objName, hash)
+}
+
+// linkObject points the object name to the blob of hash
+func (storage *LocalStorage) linkObject(bucketPath string, objName string, hash string) error {
+	refCount, err := storage.blobRefCount(bucketPath)
+	if err != nil {
+		return err
+	}
+	oldHash, err := storage.readRef(bucketPath, objName)
+	if err != nil && err != ErrorNoSuchKey {
+		return err
+	}
+	if err := storage.writeFileAtomic(bucketPath, storage.refPath(bucketPath, objName), []byte(hash)); err != nil {
+		storage.LogDebug("error on writing ref of %v: %v\n", objName, err)
+		return err
+	}
+	if oldHash == hash {
+		return nil
+	}
+	refCount[hash]++
+	if oldHash != "" {
+		return storage.releaseBlob(bucketPath, refCount, oldHash)
+	}
+	return nil
+}
+
+// GetObject reads the content of the object
+func (storage *LocalStorage) GetObject(bucketName string, objName string) ([]byte, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucketPath, err := storage.bucketPath(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := storage.readRef(bucketPath, objName)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(storage.blobPath(bucketPath, hash))
+}
+
+// DeleteObject removes the object name, and the blob if no other object refers to it
+func (storage *LocalStorage) DeleteObject(bucketName string, objName string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucketPath, err := storage.bucketPath(bucketName)
+	if err != nil {
+		return err
+	}
+	refCount, err := storage.blobRefCount(bucketPath)
+	if err != nil {
+		return err
+	}
+	hash, err := storage.readRef(bucketPath, objName)
+	if err != nil {
+		if err == ErrorNoSuchKey {
+			// same as S3, deleting an absent object is not an error
+			return nil
+		}
+		return err
+	}
+	if err := os.Remove(storage.refPath(bucketPath, objName)); err != nil {
+		storage.LogDebug("error on delete object: %v\n", err)
+		return err
+	}
+	return storage.releaseBlob(bucketPath, refCount, hash)
+}
+
+// blobRefCount returns the number of refs on each blob of the bucket,
+// it's counted from refs/ on first use and kept up to date by linkObject and DeleteObject
+func (storage *LocalStorage) blobRefCount(bucketPath string) (map[string]int, error) {
+	if refCount, exists := storage.refCount[bucketPath]; exists {
+		return refCount, nil
+	}
+	refInfos, err := ioutil.ReadDir(filepath.Join(bucketPath, localRefDir))
+	if err != nil {
+		return nil, err
+	}
+	refCount := make(map[string]int)
+	for _, refInfo := range refInfos {
+		refHash, err := ioutil.ReadFile(filepath.Join(bucketPath, localRefDir, refInfo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		refCount[string(refHash)]++
+	}
+	storage.refCount[bucketPath] = refCount
+	return refCount, nil
+}
+
+// releaseBlob drops a ref on the blob of hash, and removes the blob if it was the last one
+func (storage *LocalStorage) releaseBlob(bucketPath string, refCount map[string]int, hash string) error {
+	refCount[hash]--
+	if refCount[hash] > 0 {
+		return nil
+	}
+	delete(refCount, hash)
+	if err := os.Remove(storage.blobPath(bucketPath, hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// StatObject gets the information of the object
+func (storage *LocalStorage) StatObject(bucketName string, objName string) (*ObjectInfo, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucketPath, err := storage.bucketPath(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return storage.statObject(bucketPath, objName)
+}
+
+func (storage *LocalStorage) statObject(bucketPath string, objName string) (*ObjectInfo, error) {
+	hash, err := storage.readRef(bucketPath, objName)
+	if err != nil {
+		return nil, err
+	}
+	refInfo, err := os.Stat(storage.refPath(bucketPath, objName))
+	if err != nil {
+		return nil, err
+	}
+	blobInfo, err := os.Stat(storage.blobPath(bucketPath, hash))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Name:    objName,
+		Size:    blobInfo.Size(),
+		ModTime: refInfo.ModTime(),
+	}, nil
+}
+
+// ListObjects lists all objects in the bucket
+func (storage *LocalStorage) ListObjects(bucketName string) ([]*ObjectInfo, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucketPath, err := storage.bucketPath(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	refInfos, err := ioutil.ReadDir(filepath.Join(bucketPath, localRefDir))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*ObjectInfo, 0, len(refInfos))
+	for _, refInfo := range refInfos {
+		name, err := base64.RawURLEncoding.DecodeString(refInfo.Name())
+		if err != nil {
+			storage.LogDebug("skip unknown file in refs: %v\n", refInfo.Name())
+			continue
+		}
+		info, err := storage.statObject(bucketPath, string(name))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// localObjectWriter writes content to a temporary file while hashing it,
+// the temporary file becomes the blob of the object on Close
+type localObjectWriter struct {
+	storage    *LocalStorage
+	bucketPath string
+	objName    string
+	file       *os.File
+	hash       hash.Hash
+}
+
+func (writer *localObjectWriter) Write(p []byte) (int, error) {
+	n, err := writer.file.Write(p)
+	writer.hash.Write(p[:n])
+	return n, err
+}
+
+// Close commits the content as the object
+func (writer *localObjectWriter) Close() error {
+	storage := writer.storage
+	if err := writer.file.Close(); err != nil {
+		os.Remove(writer.file.Name())
+		return err
+	}
+	hash := hex.EncodeToString(writer.hash.Sum(nil))
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	blobPath := storage.blobPath(writer.bucketPath, hash)
+	if _, err := os.Stat(blobPath); err == nil {
+		os.Remove(writer.file.Name())
+	} else if err := os.Rename(writer.file.Name(), blobPath); err != nil {
+		os.Remove(writer.file.Name())
+		storage.LogDebug("error on writing blob of %v: %v\n", writer.objName, err)
+		return err
+	}
+	return storage.linkObject(writer.bucketPath, writer.objName, hash)
+}
+
+// Abort removes the temporary file
+func (writer *localObjectWriter) Abort() error {
+	writer.file.Close()
+	return os.Remove(writer.file.Name())
+}
+
+// NewObjectWriter starts to stream content to the object
+func (storage *LocalStorage) NewObjectWriter(bucketName string, objName string) (ObjectWriter, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucketPath, err := storage.bucketPath(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Join(bucketPath, localTmpDir), "stream-")
+	if err != nil {
+		return nil, err
+	}
+	return &localObjectWriter{
+		storage:    storage,
+		bucketPath: bucketPath,
+		objName:    objName,
+		file:       file,
+		hash:       sha256.New(),
+	}, nil
+}
+
+// NewObjectReader opens the content of the object as a stream, the caller should close it
+func (storage *LocalStorage) NewObjectReader(bucketName string, objName string) (io.ReadCloser, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucketPath, err := storage.bucketPath(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := storage.readRef(bucketPath, objName)
+	if err != nil {
+		return nil, err
+	}
+	// the opened file stays readable even if the blob is collected while reading
+	return os.Open(storage.blobPath(bucketPath, hash))
+}
@@ -0,0 +1,74 @@
+package syncbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// blobCount returns the number of blobs stored in the bucket
+func blobCount(t *testing.T, storage *LocalStorage, bucketName string) int {
+	t.Helper()
+	infos, err := ioutil.ReadDir(filepath.Join(storage.RootDir, bucketName, localBlobDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(infos)
+}
+
+func TestLocalStorageBlobRefs(t *testing.T) {
+	root := t.TempDir()
+	storage, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CreateBucket("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := storage.CreateObject("alice", name, "shared"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer, err := storage.NewObjectWriter("alice", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("shared"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := blobCount(t, storage, "alice"); n != 1 {
+		t.Fatalf("%v blobs of identical content, want 1", n)
+	}
+
+	// overwriting with the same content keeps the ref
+	storage.CreateObject("alice", "a", "shared")
+	// overwriting with other content moves the ref
+	storage.CreateObject("alice", "b", "other")
+	storage.DeleteObject("alice", "c")
+	if n := blobCount(t, storage, "alice"); n != 2 {
+		t.Fatalf("%v blobs, want 2", n)
+	}
+
+	// refs are counted again from disk after restart
+	storage, err = NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.DeleteObject("alice", "a")
+	if content, err := storage.GetObject("alice", "d"); err != nil || string(content) != "shared" {
+		t.Fatalf("blob referred by d: %q, %v", content, err)
+	}
+	storage.DeleteObject("alice", "d")
+	if n := blobCount(t, storage, "alice"); n != 1 {
+		t.Fatalf("blob without refs isn't removed, %v blobs", n)
+	}
+	storage.CreateObject("alice", "b", "shared")
+	if n := blobCount(t, storage, "alice"); n != 1 {
+		t.Fatalf("replaced blob isn't removed, %v blobs", n)
+	}
+	if content, err := storage.GetObject("alice", "b"); err != nil || string(content) != "shared" {
+		t.Fatalf("b: %q, %v", content, err)
+	}
+}
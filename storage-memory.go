@@ -0,0 +1,332 @@
+package syncbox
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// constants for names of storage operations, used to target injected faults
+const (
+	StorageOpCreateBucket = "CreateBucket"
+	StorageOpCreateObject = "CreateObject"
+	StorageOpGetObject    = "GetObject"
+	StorageOpDeleteObject = "DeleteObject"
+	StorageOpStatObject   = "StatObject"
+	StorageOpListObjects  = "ListObjects"
+)
+
+// StorageFault describes a failure to inject into MemoryStorage.
+// Key is the object name of object operations, and the bucket name of bucket operations (CreateBucket and ListObjects).
+// Empty Op or Key matches any operation or key, a zero Call fails every matching call,
+// otherwise only the Nth call (counting from 1) of Op fails, or the Nth call of any operation if Op is empty.
+type StorageFault struct {
+	Op      string
+	Key     string
+	Call    int
+	Err     error
+	Latency time.Duration
+}
+
+func (fault *StorageFault) String() string {
+	return ToString(fault)
+}
+
+type memoryObject struct {
+	content []byte
+	modTime time.Time
+}
+
+// MemoryStorage is the StorageBackend that keeps objects in memory,
+// it's intended for tests and simulations, and supports fault injection
+// to exercise error paths of the server deterministically
+type MemoryStorage struct {
+	*Logger
+	Latency    time.Duration
+	buckets    map[string]map[string]*memoryObject
+	faults     []*StorageFault
+	calls      map[string]int
+	totalCalls int
+	mutex      sync.Mutex
+}
+
+// NewMemoryStorage instantiates an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		buckets: make(map[string]map[string]*memoryObject),
+		calls:   make(map[string]int),
+		Logger:  NewDefaultLogger(),
+	}
+}
+
+// AddFault injects a fault, faults are examined in the order they are added
+func (storage *MemoryStorage) AddFault(fault *StorageFault) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.faults = append(storage.faults, fault)
+}
+
+// FailNthCall makes the Nth call of op return err
+func (storage *MemoryStorage) FailNthCall(op string, n int, err error) {
+	storage.AddFault(&StorageFault{
+		Op:   op,
+		Call: n,
+		Err:  err,
+	})
+}
+
+// FailKey makes every call of op on the object key return err, key is the bucket name for bucket operations
+func (storage *MemoryStorage) FailKey(op string, key string, err error) {
+	storage.AddFault(&StorageFault{
+		Op:  op,
+		Key: key,
+		Err: err,
+	})
+}
+
+// SetLatency delays every operation by latency
+func (storage *MemoryStorage) SetLatency(latency time.Duration) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.Latency = latency
+}
+
+// ClearFaults removes all injected faults and latency, and resets call counts
+func (storage *MemoryStorage) ClearFaults() {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.faults = nil
+	storage.Latency = 0
+	storage.calls = make(map[string]int)
+	storage.totalCalls = 0
+}
+
+// CallCount returns how many times op has been called, or all operations if op is empty
+func (storage *MemoryStorage) CallCount(op string) int {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if op == "" {
+		return storage.totalCalls
+	}
+	return storage.calls[op]
+}
+
+// enter counts the call and returns the injected error for it, if there is one.
+// It sleeps for the latency without holding the lock, so concurrent calls are delayed independently.
+func (storage *MemoryStorage) enter(op string, key string) error {
+	storage.mutex.Lock()
+	storage.calls[op]++
+	storage.totalCalls++
+	latency := storage.Latency
+	var err error
+	for _, fault := range storage.faults {
+		if fault.Op != "" && fault.Op != op {
+			continue
+		}
+		if fault.Key != "" && fault.Key != key {
+			continue
+		}
+		if fault.Call != 0 {
+			count := storage.totalCalls
+			if fault.Op != "" {
+				count = storage.calls[op]
+			}
+			if count != fault.Call {
+				continue
+			}
+		}
+		latency += fault.Latency
+		err = fault.Err
+		break
+	}
+	storage.mutex.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if err != nil {
+		storage.LogDebug("injected fault on %v of %v: %v\n", op, key, err)
+	}
+	return err
+}
+
+// CreateBucket creates the bucket, it does nothing if the bucket exists
+func (storage *MemoryStorage) CreateBucket(bucketName string) error {
+	if err := storage.enter(StorageOpCreateBucket, bucketName); err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if _, exists := storage.buckets[bucketName]; !exists {
+		storage.buckets[bucketName] = make(map[string]*memoryObject)
+	}
+	return nil
+}
+
+// CreateObject creates a object and put content in it
+func (storage *MemoryStorage) CreateObject(bucketName string, objName string, content string) error {
+	if err := storage.enter(StorageOpCreateObject, objName); err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucket, exists := storage.buckets[bucketName]
+	if !exists {
+		return ErrorNoSuchBucket
+	}
+	bucket[objName] = &memoryObject{
+		content: []byte(content),
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// GetObject gets a copy of the content of the object
+func (storage *MemoryStorage) GetObject(bucketName string, objName string) ([]byte, error) {
+	if err := storage.enter(StorageOpGetObject, objName); err != nil {
+		return nil, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	obj, err := storage.getObject(bucketName, objName)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, len(obj.content))
+	copy(content, obj.content)
+	return content, nil
+}
+
+func (storage *MemoryStorage) getObject(bucketName string, objName string) (*memoryObject, error) {
+	bucket, exists := storage.buckets[bucketName]
+	if !exists {
+		return nil, ErrorNoSuchBucket
+	}
+	obj, exists := bucket[objName]
+	if !exists {
+		return nil, ErrorNoSuchKey
+	}
+	return obj, nil
+}
+
+// DeleteObject deletes the object, deleting an absent object is not an error
+func (storage *MemoryStorage) DeleteObject(bucketName string, objName string) error {
+	if err := storage.enter(StorageOpDeleteObject, objName); err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucket, exists := storage.buckets[bucketName]
+	if !exists {
+		return ErrorNoSuchBucket
+	}
+	delete(bucket, objName)
+	return nil
+}
+
+// StatObject gets the information of the object
+func (storage *MemoryStorage) StatObject(bucketName string, objName string) (*ObjectInfo, error) {
+	if err := storage.enter(StorageOpStatObject, objName); err != nil {
+		return nil, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	obj, err := storage.getObject(bucketName, objName)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Name:    objName,
+		Size:    int64(len(obj.content)),
+		ModTime: obj.modTime,
+	}, nil
+}
+
+// ListObjects lists all objects in the bucket
+func (storage *MemoryStorage) ListObjects(bucketName string) ([]*ObjectInfo, error) {
+	if err := storage.enter(StorageOpListObjects, bucketName); err != nil {
+		return nil, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucket, exists := storage.buckets[bucketName]
+	if !exists {
+		return nil, ErrorNoSuchBucket
+	}
+	infos := make([]*ObjectInfo, 0, len(bucket))
+	for objName, obj := range bucket {
+		infos = append(infos, &ObjectInfo{
+			Name:    objName,
+			Size:    int64(len(obj.content)),
+			ModTime: obj.modTime,
+		})
+	}
+	return infos, nil
+}
+
+// memoryObjectWriter buffers the content until Close
+type memoryObjectWriter struct {
+	storage    *MemoryStorage
+	bucketName string
+	objName    string
+	buffer     bytes.Buffer
+}
+
+func (writer *memoryObjectWriter) Write(p []byte) (int, error) {
+	return writer.buffer.Write(p)
+}
+
+// Close stores the buffered content as the object
+func (writer *memoryObjectWriter) Close() error {
+	storage := writer.storage
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	bucket, exists := storage.buckets[writer.bucketName]
+	if !exists {
+		return ErrorNoSuchBucket
+	}
+	bucket[writer.objName] = &memoryObject{
+		content: writer.buffer.Bytes(),
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// Abort drops the buffered content
+func (writer *memoryObjectWriter) Abort() error {
+	writer.buffer.Reset()
+	return nil
+}
+
+// NewObjectWriter starts to buffer content of the object, it counts as a CreateObject call for faults
+func (storage *MemoryStorage) NewObjectWriter(bucketName string, objName string) (ObjectWriter, error) {
+	if err := storage.enter(StorageOpCreateObject, objName); err != nil {
+		return nil, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if _, exists := storage.buckets[bucketName]; !exists {
+		return nil, ErrorNoSuchBucket
+	}
+	return &memoryObjectWriter{
+		storage:    storage,
+		bucketName: bucketName,
+		objName:    objName,
+	}, nil
+}
+
+// NewObjectReader reads the content of the object as a stream, it counts as a GetObject call for faults
+func (storage *MemoryStorage) NewObjectReader(bucketName string, objName string) (io.ReadCloser, error) {
+	if err := storage.enter(StorageOpGetObject, objName); err != nil {
+		return nil, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	obj, err := storage.getObject(bucketName, objName)
+	if err != nil {
+		return nil, err
+	}
+	// stored contents are never modified in place, so the reader could share the slice
+	return ioutil.NopCloser(bytes.NewReader(obj.content)), nil
+}
@@ -0,0 +1,47 @@
+package syncbox
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryStorageFailKey(t *testing.T) {
+	storage := NewMemoryStorage()
+	injected := errors.New("injected")
+	storage.FailKey(StorageOpCreateBucket, "alice", injected)
+	storage.FailKey(StorageOpListObjects, "alice", injected)
+	storage.FailKey(StorageOpGetObject, "digest", injected)
+
+	// faults of bucket operations target buckets by name
+	if err := storage.CreateBucket("alice"); err != injected {
+		t.Fatalf("CreateBucket of targeted bucket: got %v", err)
+	}
+	if err := storage.CreateBucket("bob"); err != nil {
+		t.Fatalf("CreateBucket of other bucket: %v", err)
+	}
+	if _, err := storage.ListObjects("alice"); err != injected {
+		t.Fatalf("ListObjects of targeted bucket: got %v", err)
+	}
+	if _, err := storage.ListObjects("bob"); err != nil {
+		t.Fatalf("ListObjects of other bucket: %v", err)
+	}
+
+	// faults of object operations target objects by name in any bucket
+	if err := storage.CreateObject("bob", "digest", "content"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.GetObject("bob", "digest"); err != injected {
+		t.Fatalf("GetObject of targeted object: got %v", err)
+	}
+	if _, err := storage.GetObject("bob", "other"); !IsNoSuchKey(err) {
+		t.Fatalf("GetObject of absent object: got %v", err)
+	}
+	if n := storage.CallCount(StorageOpCreateBucket); n != 2 {
+		t.Fatalf("CreateBucket called %v times, want 2", n)
+	}
+
+	storage.ClearFaults()
+	if err := storage.CreateBucket("alice"); err != nil {
+		t.Fatalf("CreateBucket after ClearFaults: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package syncbox
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// constants for aws services
+var (
+	AWSDefaultRegion = os.Getenv("AWS_DEFAULT_REGION")
+	S3BucketPrefix   = os.Getenv("SB_STORAGE_BUCHET")
+)
+
+// S3Storage is the StorageBackend that use AWS S3
+type S3Storage struct {
+	*Logger
+	Session *session.Session
+	Svc     *s3.S3
+}
+
+// NewS3Storage instantiate S3Storage
+func NewS3Storage() *S3Storage {
+	sess := session.New(
+		&aws.Config{
+			Region: aws.String(AWSDefaultRegion),
+		},
+	)
+
+	return &S3Storage{
+		Session: sess,
+		Svc:     s3.New(sess),
+		Logger:  NewDefaultLogger(),
+	}
+}
+
+// CreateBucket creates new bucket in S3
+func (storage *S3Storage) CreateBucket(bucketName string) error {
+	bucketName = S3BucketPrefix + bucketName
+	result, err := storage.Svc.CreateBucket(&s3.CreateBucketInput{
+		Bucket: &bucketName,
+	})
+	if err != nil {
+		storage.LogDebug("Failed to create bucket", err)
+		return err
+	}
+	storage.LogDebug("create bucket result :%v\n", result)
+	return nil
+}
+
+// CreateObject creates a object and put content in it
+func (storage *S3Storage) CreateObject(bucketName string, objName string, content string) error {
+	bucketName = S3BucketPrefix + bucketName
+	result, err := storage.Svc.PutObject(&s3.PutObjectInput{
+		Body:   strings.NewReader(content),
+		Bucket: &bucketName,
+		Key:    &objName,
+	})
+	if err != nil {
+		storage.LogDebug("Failed to upload data to %s/%s, %s\n", bucketName, objName, err)
+		return err
+	}
+	storage.LogDebug("create object result: %v\n", result)
+	return nil
+}
+
+// DeleteObject deletes object in bucketName
+func (storage *S3Storage) DeleteObject(bucketName string, objName string) error {
+	bucketName = S3BucketPrefix + bucketName
+	result, err := storage.Svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objName),
+	})
+	if err != nil {
+		storage.LogDebug("error on delete object: %v\n", err)
+		return err
+	}
+	storage.LogDebug("delete object result: %v\n", result)
+	return nil
+}
+
+// GetObject gets object from S3
+func (storage *S3Storage) GetObject(bucketName string, objName string) ([]byte, error) {
+	bucketName = S3BucketPrefix + bucketName
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objName),
+	}
+
+	resp, err := storage.Svc.GetObject(params)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return respBytes, nil
+}
+
+// StatObject gets the information of object from S3 without fetching the content
+func (storage *S3Storage) StatObject(bucketName string, objName string) (*ObjectInfo, error) {
+	bucketName = S3BucketPrefix + bucketName
+	resp, err := storage.Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{
+		Name: objName,
+	}
+	if resp.ContentLength != nil {
+		info.Size = *resp.ContentLength
+	}
+	if resp.LastModified != nil {
+		info.ModTime = *resp.LastModified
+	}
+	return info, nil
+}
+
+// ListObjects lists all objects in the bucket of S3
+func (storage *S3Storage) ListObjects(bucketName string) ([]*ObjectInfo, error) {
+	bucketName = S3BucketPrefix + bucketName
+	infos := make([]*ObjectInfo, 0, 0)
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(bucketName),
+	}
+	for {
+		resp, err := storage.Svc.ListObjects(params)
+		if err != nil {
+			storage.LogDebug("error on list objects: %v\n", err)
+			return nil, err
+		}
+		for _, obj := range resp.Contents {
+			info := &ObjectInfo{
+				Name: aws.StringValue(obj.Key),
+				Size: aws.Int64Value(obj.Size),
+			}
+			if obj.LastModified != nil {
+				info.ModTime = *obj.LastModified
+			}
+			infos = append(infos, info)
+		}
+		if !aws.BoolValue(resp.IsTruncated) || len(resp.Contents) == 0 {
+			break
+		}
+		// NextMarker is only returned when a delimiter is given, otherwise the last key is the marker
+		marker := aws.StringValue(resp.NextMarker)
+		if marker == "" {
+			marker = aws.StringValue(resp.Contents[len(resp.Contents)-1].Key)
+		}
+		params.Marker = aws.String(marker)
+	}
+	return infos, nil
+}
+
+// s3ObjectWriter pipes written content to an upload running in another goroutine
+type s3ObjectWriter struct {
+	pipeWriter *io.PipeWriter
+	result     chan error
+}
+
+func (writer *s3ObjectWriter) Write(p []byte) (int, error) {
+	return writer.pipeWriter.Write(p)
+}
+
+// Close finishes the content and waits for the upload to complete
+func (writer *s3ObjectWriter) Close() error {
+	writer.pipeWriter.Close()
+	return <-writer.result
+}
+
+// Abort fails the upload, so that the object is not created
+func (writer *s3ObjectWriter) Abort() error {
+	writer.pipeWriter.CloseWithError(ErrorTransferAborted)
+	<-writer.result
+	return nil
+}
+
+// NewObjectWriter starts a streaming upload to S3, the content is sent in parts while being written
+func (storage *S3Storage) NewObjectWriter(bucketName string, objName string) (ObjectWriter, error) {
+	bucketName = S3BucketPrefix + bucketName
+	pipeReader, pipeWriter := io.Pipe()
+	writer := &s3ObjectWriter{
+		pipeWriter: pipeWriter,
+		result:     make(chan error, 1),
+	}
+	uploader := s3manager.NewUploader(storage.Session)
+	go func() {
+		result, err := uploader.Upload(&s3manager.UploadInput{
+			Body:   pipeReader,
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(objName),
+		})
+		if err != nil {
+			storage.LogDebug("error on streaming upload to %s/%s: %v\n", bucketName, objName, err)
+		} else {
+			storage.LogDebug("streaming upload result: %v\n", result)
+		}
+		// unblock the writer if the upload stops before all content is read
+		pipeReader.CloseWithError(err)
+		writer.result <- err
+	}()
+	return writer, nil
+}
+
+// NewObjectReader gets object from S3 as a stream, the caller should close it
+func (storage *S3Storage) NewObjectReader(bucketName string, objName string) (io.ReadCloser, error) {
+	bucketName = S3BucketPrefix + bucketName
+	resp, err := storage.Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Download pull the object from S3
+func (storage *S3Storage) Download(path string, bucketName string, objName string) error {
+	bucketName = S3BucketPrefix + bucketName
+	file, err := os.Create(path)
+	if err != nil {
+		storage.LogDebug("Failed to create file: %v\n", err)
+		return err
+	}
+	defer file.Close()
+
+	downloader := s3manager.NewDownloader(storage.Session)
+	numBytes, err := downloader.Download(file,
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(objName),
+		})
+	if err != nil {
+		storage.LogDebug("Failed to download file: %v\n", err)
+		return err
+	}
+
+	storage.LogDebug("Downloaded file %v: %v bytes\n", file.Name(), numBytes)
+	return nil
+}
@@ -3,134 +3,106 @@ package syncbox
 import (
 	"bytes"
 	"encoding/binary"
-	"io/ioutil"
+	"errors"
+	"io"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 )
 
-// constants for aws services
+// constants for storage backends
+const (
+	StorageBackendS3     = "s3"
+	StorageBackendLocal  = "local"
+	StorageBackendMemory = "memory"
+
+	DefaultStorageDir = "/var/lib/syncbox/storage"
+)
+
+// config variables for storage backends
 var (
-	AWSDefaultRegion = os.Getenv("AWS_DEFAULT_REGION")
-	S3BucketPrefix   = os.Getenv("SB_STORAGE_BUCHET")
+	StorageBackendName = os.Getenv("SB_STORAGE_BACKEND")
+	StorageDir         = os.Getenv("SB_STORAGE_DIR")
 )
 
-// Storage structure that use AWS S3
-type Storage struct {
-	*Logger
-	Session *session.Session
-	Svc     *s3.S3
+// ObjectInfo describes an object kept in the storage
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
 }
 
-// NewStorage instantiate Storage
-func NewStorage() *Storage {
-	sess := session.New(
-		&aws.Config{
-			Region: aws.String(AWSDefaultRegion),
-		},
-	)
-
-	return &Storage{
-		Session: sess,
-		Svc:     s3.New(sess),
-		Logger:  NewDefaultLogger(),
-	}
+func (info *ObjectInfo) String() string {
+	return ToString(info)
 }
 
-// CreateBucket creates new bucket in S3
-func (storage *Storage) CreateBucket(bucketName string) error {
-	bucketName = S3BucketPrefix + bucketName
-	result, err := storage.Svc.CreateBucket(&s3.CreateBucketInput{
-		Bucket: &bucketName,
-	})
-	if err != nil {
-		storage.LogDebug("Failed to create bucket", err)
-		return err
-	}
-	storage.LogDebug("create bucket result :%v\n", result)
-	return nil
+// StorageBackend is the interface to specify methods that a storage of file contents should implement,
+// bucket is the namespace of objects, the server uses one bucket per user
+type StorageBackend interface {
+	CreateBucket(bucketName string) error
+	CreateObject(bucketName string, objName string, content string) error
+	GetObject(bucketName string, objName string) ([]byte, error)
+	DeleteObject(bucketName string, objName string) error
+	StatObject(bucketName string, objName string) (*ObjectInfo, error)
+	ListObjects(bucketName string) ([]*ObjectInfo, error)
+	NewObjectWriter(bucketName string, objName string) (ObjectWriter, error)
+	NewObjectReader(bucketName string, objName string) (io.ReadCloser, error)
 }
 
-// CreateObject creates a object and put content in it
-func (storage *Storage) CreateObject(bucketName string, objName string, content string) error {
-	bucketName = S3BucketPrefix + bucketName
-	result, err := storage.Svc.PutObject(&s3.PutObjectInput{
-		Body:   strings.NewReader(content),
-		Bucket: &bucketName,
-		Key:    &objName,
-	})
-	if err != nil {
-		storage.LogDebug("Failed to upload data to %s/%s, %s\n", bucketName, objName, err)
-		return err
-	}
-	storage.LogDebug("create object result: %v\n", result)
-	return nil
+// ObjectWriter streams content to an object, the object is only created or replaced
+// when Close returns without error, Abort discards everything written so far
+type ObjectWriter interface {
+	io.WriteCloser
+	Abort() error
 }
 
-// DeleteObject deletes object in bucketName
-func (storage *Storage) DeleteObject(bucketName string, objName string) error {
-	bucketName = S3BucketPrefix + bucketName
-	result, err := storage.Svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(objName),
-	})
-	if err != nil {
-		storage.LogDebug("error on delete object: %v\n", err)
-		return err
-	}
-	storage.LogDebug("delete object result: %v\n", result)
-	return nil
+// StorageConfig is the structure for storage configurations
+type StorageConfig struct {
+	Backend string
+	Dir     string
 }
 
-// GetObject gets object from S3
-func (storage *Storage) GetObject(bucketName string, objName string) ([]byte, error) {
-	bucketName = S3BucketPrefix + bucketName
-	params := &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(objName),
+// NewStorageConfig instantiates a StorageConfig from environment variables,
+// it defaults to use AWS S3 if no backend is specified
+func NewStorageConfig() *StorageConfig {
+	config := &StorageConfig{
+		Backend: StorageBackendName,
+		Dir:     StorageDir,
 	}
-
-	resp, err := storage.Svc.GetObject(params)
-	if err != nil {
-		return nil, err
+	if config.Backend == "" {
+		config.Backend = StorageBackendS3
 	}
-
-	respBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if config.Dir == "" {
+		config.Dir = DefaultStorageDir
 	}
-
-	return respBytes, nil
+	return config
 }
 
-// Download pull the object from S3
-func (storage *Storage) Download(path string, bucketName string, objName string) error {
-	bucketName = S3BucketPrefix + bucketName
-	file, err := os.Create("path")
-	defer file.Close()
-	if err != nil {
-		storage.LogDebug("Failed to create file: %v\n", err)
-		return err
+// NewStorage instantiates the StorageBackend specified by config
+func NewStorage(config *StorageConfig) (StorageBackend, error) {
+	switch config.Backend {
+	case StorageBackendS3:
+		return NewS3Storage(), nil
+	case StorageBackendLocal:
+		return NewLocalStorage(config.Dir)
+	case StorageBackendMemory:
+		return NewMemoryStorage(), nil
+	default:
+		return nil, errors.New("unknown storage backend: " + config.Backend)
 	}
+}
 
-	downloader := s3manager.NewDownloader(storage.Session)
-	numBytes, err := downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(objName),
-		})
-	if err != nil {
-		storage.LogDebug("Failed to download file: %v\n", err)
-		return err
+// IsNoSuchKey examines whether err means the object does not exist in the storage
+func IsNoSuchKey(err error) bool {
+	if err == ErrorNoSuchKey {
+		return true
 	}
-
-	storage.LogDebug("Downloaded file %v: %v bytes\n", file.Name(), numBytes)
-	return nil
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "NoSuchKey" || awsErr.Code() == "NotFound"
+	}
+	return false
 }
 
 func readInt64(data []byte) (ret int64) {
@@ -0,0 +1,281 @@
+package syncbox
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// constants for TLS
+const (
+	SelfSignedCertValidPeriod = 10 * 365 * 24 * time.Hour
+	DefaultPinFileName        = ".syncbox/known_servers"
+)
+
+// config variables for TLS
+var (
+	TLSEnabled    = os.Getenv("SB_TLS")
+	TLSCertFile   = os.Getenv("SB_TLS_CERT")
+	TLSKeyFile    = os.Getenv("SB_TLS_KEY")
+	TLSCAFile     = os.Getenv("SB_TLS_CA")
+	TLSClientAuth = os.Getenv("SB_TLS_CLIENT_AUTH")
+	TLSBootstrap  = os.Getenv("SB_TLS_BOOTSTRAP")
+	TLSPinFile    = os.Getenv("SB_TLS_PIN_FILE")
+)
+
+// TLSConfig is the structure for TLS configurations of connectors.
+// On server side, CertFile and KeyFile are the server certificate, CAFile verifies client certificates if ClientAuth is set,
+// and Bootstrap generates a self-signed certificate to the files if they don't exist.
+// On client side, CertFile and KeyFile are the client certificate for client authentication, CAFile verifies the server,
+// and Bootstrap trusts the server certificate on first connect and pins its fingerprint in PinFile.
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ClientAuth bool
+	Bootstrap  bool
+	PinFile    string
+}
+
+func (config *TLSConfig) String() string {
+	return ToString(config)
+}
+
+// NewTLSConfig instantiates a TLSConfig from environment variables,
+// it returns nil if TLS is not enabled
+func NewTLSConfig() *TLSConfig {
+	if !isTrue(TLSEnabled) {
+		return nil
+	}
+	config := &TLSConfig{
+		CertFile:   TLSCertFile,
+		KeyFile:    TLSKeyFile,
+		CAFile:     TLSCAFile,
+		ClientAuth: isTrue(TLSClientAuth),
+		Bootstrap:  isTrue(TLSBootstrap),
+		PinFile:    TLSPinFile,
+	}
+	if config.PinFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			config.PinFile = filepath.Join(home, DefaultPinFileName)
+		}
+	}
+	return config
+}
+
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, ErrorInvalidCertificate
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig builds the tls.Config for listening
+func (config *TLSConfig) ServerTLSConfig() (*tls.Config, error) {
+	if config.Bootstrap {
+		if err := bootstrapCertificate(config.CertFile, config.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientAuth {
+		if config.CAFile == "" {
+			return nil, ErrorMissingClientCA
+		}
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// ClientTLSConfig builds the tls.Config for dialing to serverName
+func (config *TLSConfig) ClientTLSConfig(serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.CertFile != "" && config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.Bootstrap {
+		// the self-signed certificate couldn't be verified by chain, verify it by pinned fingerprint instead
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrorInvalidCertificate
+			}
+			return config.verifyPin(serverName, Fingerprint(rawCerts[0]))
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of a DER encoded certificate, or of a public key
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPin compares fingerprint with the one pinned for host,
+// and pins it if host is connected for the first time
+func (config *TLSConfig) verifyPin(host string, fingerprint string) error {
+	if config.PinFile == "" {
+		return ErrorMissingPinFile
+	}
+	match, err := pinFingerprint(config.PinFile, host, fingerprint)
+	if err != nil {
+		return err
+	}
+	if !match {
+		return ErrorFingerprintMismatch
+	}
+	return nil
+}
+
+// pinMutex serializes reading and appending pin files
+var pinMutex sync.Mutex
+
+// pinFingerprint compares fingerprint with the one pinned for host in pinFile, it returns false if they differ.
+// The fingerprint is pinned if host has none yet.
+func pinFingerprint(pinFile string, host string, fingerprint string) (bool, error) {
+	pinMutex.Lock()
+	defer pinMutex.Unlock()
+	file, err := os.Open(pinFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 || fields[0] != host {
+				continue
+			}
+			file.Close()
+			return fields[1] == fingerprint, nil
+		}
+		file.Close()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(pinFile), 0700); err != nil {
+		return false, err
+	}
+	appended, err := os.OpenFile(pinFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer appended.Close()
+	if _, err := appended.WriteString(host + " " + fingerprint + "\n"); err != nil {
+		return false, err
+	}
+	NewDefaultLogger().LogInfo("pinned %v in %v for the first time, fingerprint: %v\n", host, pinFile, fingerprint)
+	return true, nil
+}
+
+// bootstrapCertificate generates a self-signed certificate to certFile and keyFile unless both exist,
+// so that the fingerprint stays the same across restarts. A certificate without its key couldn't be loaded,
+// so both are generated again if either is missing.
+func bootstrapCertificate(certFile string, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return ErrorMissingCertificate
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if certErr == nil || keyErr == nil {
+		NewDefaultLogger().LogInfo("only one of %v and %v exists, generating both again\n", certFile, keyFile)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "syncbox " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SelfSignedCertValidPeriod),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{IPLocalHost, hostname},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	NewDefaultLogger().LogInfo("generated self-signed certificate %v, fingerprint: %v\n", certFile, Fingerprint(der))
+	return nil
+}
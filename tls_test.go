@@ -0,0 +1,202 @@
+package syncbox
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPinFingerprint(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "dir", "known_servers")
+	cases := []struct {
+		name        string
+		host        string
+		fingerprint string
+		match       bool
+	}{
+		{"first use", "server", "aa", true},
+		{"same fingerprint", "server", "aa", true},
+		{"changed fingerprint", "server", "bb", false},
+		{"other host", "other", "bb", true},
+		{"other host again", "other", "bb", true},
+		{"first host after other", "server", "aa", true},
+	}
+	for _, c := range cases {
+		match, err := pinFingerprint(pinFile, c.host, c.fingerprint)
+		if err != nil || match != c.match {
+			t.Fatalf("%v: match %v, %v, want %v", c.name, match, err, c.match)
+		}
+	}
+	data, err := ioutil.ReadFile(pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Fatalf("pin file should have a line of each host:\n%s", data)
+	}
+
+	config := &TLSConfig{PinFile: pinFile}
+	if err := config.verifyPin("server", "bb"); err != ErrorFingerprintMismatch {
+		t.Fatalf("mismatched fingerprint: got %v", err)
+	}
+	if err := (&TLSConfig{}).verifyPin("server", "aa"); err != ErrorMissingPinFile {
+		t.Fatalf("without pin file: got %v", err)
+	}
+}
+
+func TestBootstrapCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls", "cert.pem"), filepath.Join(dir, "tls", "key.pem")
+	if err := bootstrapCertificate(certFile, ""); err != ErrorMissingCertificate {
+		t.Fatalf("without key file: got %v", err)
+	}
+	fingerprint := func() string {
+		t.Helper()
+		if err := bootstrapCertificate(certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Fingerprint(cert.Certificate[0])
+	}
+	first := fingerprint()
+	if fingerprint() != first {
+		t.Fatal("certificate should be kept across restarts")
+	}
+	for _, missing := range []string{keyFile, certFile} {
+		if err := os.Remove(missing); err != nil {
+			t.Fatal(err)
+		}
+		// the generated pair is loadable again
+		if fingerprint() == first {
+			t.Fatalf("certificate should be generated again without %v", filepath.Base(missing))
+		}
+		first = fingerprint()
+	}
+}
+
+// writeClientCertificate writes a self-signed certificate for client authentication to dir,
+// which is also the CA that verifies it, and returns the certificate and key files
+func writeClientCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "syncbox client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsHandshake runs the TLS handshake of server and client over a pipe, and returns the errors of both sides.
+// Server writes a byte once the handshake is done, which client reads, so that the alerts of either side are read by the other.
+func tlsHandshake(server *tls.Config, client *tls.Config) (error, error) {
+	serverConn, clientConn := net.Pipe()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn := tls.Server(serverConn, server)
+		err := conn.Handshake()
+		if err == nil {
+			_, err = conn.Write([]byte{1})
+		}
+		serverConn.Close()
+		serverErr <- err
+	}()
+	conn := tls.Client(clientConn, client)
+	clientErr := conn.Handshake()
+	if clientErr == nil {
+		_, clientErr = conn.Read(make([]byte, 1))
+	}
+	clientConn.Close()
+	return <-serverErr, clientErr
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey := writeClientCertificate(t, dir)
+	serverConfig := &TLSConfig{
+		CertFile:   filepath.Join(dir, "server.pem"),
+		KeyFile:    filepath.Join(dir, "server-key.pem"),
+		Bootstrap:  true,
+		ClientAuth: true,
+	}
+	if _, err := serverConfig.ServerTLSConfig(); err != ErrorMissingClientCA {
+		t.Fatalf("client auth without CA: got %v", err)
+	}
+	serverConfig.CAFile = clientCert
+	server, err := serverConfig.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinFile := filepath.Join(dir, "known_servers")
+	client, err := (&TLSConfig{CertFile: clientCert, KeyFile: clientKey, Bootstrap: true, PinFile: pinFile}).ClientTLSConfig(IPLocalHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Certificates) != 1 {
+		t.Fatal("client certificate isn't loaded")
+	}
+	if serverErr, clientErr := tlsHandshake(server, client); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake with client certificate: server %v, client %v", serverErr, clientErr)
+	}
+	if _, err := os.Stat(pinFile); err != nil {
+		t.Fatalf("server isn't pinned on first use: %v", err)
+	}
+
+	anonymous, err := (&TLSConfig{Bootstrap: true, PinFile: pinFile}).ClientTLSConfig(IPLocalHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverErr, _ := tlsHandshake(server, anonymous); serverErr == nil {
+		t.Fatal("client without certificate is accepted")
+	}
+
+	// the server certificate is generated again, its fingerprint no longer matches the pinned one
+	os.Remove(serverConfig.KeyFile)
+	server, err = serverConfig.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, clientErr := tlsHandshake(server, client); !errors.Is(clientErr, ErrorFingerprintMismatch) {
+		t.Fatalf("server of changed certificate: got %v", clientErr)
+	}
+}
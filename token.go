@@ -0,0 +1,304 @@
+package syncbox
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"time"
+)
+
+// constants for session tokens
+const (
+	DefaultSessionTokenTTL = time.Hour
+	SessionTokenSize       = 32
+)
+
+// TokenResponse is the Response data of a token refresh request, Lifetime is how long the new token is valid,
+// Final tells that the token couldn't be refreshed, since it expires with the credentials of the session
+type TokenResponse struct {
+	Token    string
+	Lifetime time.Duration
+	Final    bool
+}
+
+func (res *TokenResponse) String() string {
+	return ToString(res)
+}
+
+// sessionToken is a token issued to a session, previous is the token it replaces,
+// which is accepted until it expires, so that requests sent while refreshing are not rejected
+type sessionToken struct {
+	token           string
+	expires         time.Time
+	previous        string
+	previousExpires time.Time
+}
+
+// newSessionToken returns a random token
+func newSessionToken() (string, error) {
+	token := make([]byte, SessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// issue replaces the token with a new one valid until expires
+func (st *sessionToken) issue(expires time.Time) error {
+	token, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	st.previous, st.previousExpires = st.token, st.expires
+	st.token, st.expires = token, expires
+	return nil
+}
+
+// verify examines whether token is the current or the previous token, and is not expired
+func (st *sessionToken) verify(token string) error {
+	now := time.Now()
+	switch {
+	case token == "":
+		return ErrorNotAuthenticated
+	case subtle.ConstantTimeCompare([]byte(token), []byte(st.token)) == 1:
+		if now.After(st.expires) {
+			return ErrorTokenExpired
+		}
+		return nil
+	case st.previous != "" && subtle.ConstantTimeCompare([]byte(token), []byte(st.previous)) == 1:
+		if now.After(st.previousExpires) {
+			return ErrorTokenExpired
+		}
+		return nil
+	}
+	return ErrorNotAuthenticated
+}
+
+// authenticatedSession returns the session that peer is authenticated in, if the connection of the session is still peer
+func (sc *ServerConnector) authenticatedSession(peer *Peer) (*Session, bool) {
+	sc.sessionMutex.Lock()
+	defer sc.sessionMutex.Unlock()
+	session, exists := sc.sessions[peer.SessionID()]
+	if !exists || session.Peer != peer {
+		return nil, false
+	}
+	return session, true
+}
+
+// verifyToken examines whether token is valid for the session of peer, it returns the session if it is
+func (sc *ServerConnector) verifyToken(peer *Peer, token string) (*Session, error) {
+	sc.sessionMutex.Lock()
+	defer sc.sessionMutex.Unlock()
+	session, exists := sc.sessions[peer.SessionID()]
+	if !exists || session.Peer != peer {
+		return nil, ErrorNotAuthenticated
+	}
+	if err := session.token.verify(token); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// RequireAuthentication returns the middleware that rejects requests with CodeAuthFailed unless they carry a valid token
+// of the session of the connection, which is issued in the identity handshake.
+// The identity fields of accepted requests are replaced with the ones of the session, so processors never see identities
+// other than the authenticated one. Identity and registration requests are processed without authentication,
+// since they are how a connection authenticates.
+func (sc *ServerConnector) RequireAuthentication() Middleware {
+	return Authenticate(func(req *Request, peer *Peer) error {
+		session, err := sc.verifyToken(peer, req.Token)
+		if err != nil {
+			return err
+		}
+		if req.Username != "" && req.Username != session.Username || req.Device != "" && req.Device != session.Device {
+			peer.LogDebug("ignoring identity of %v request %v, username: %v, device: %v\n", req.DataType, req.ID, req.Username, req.Device)
+		}
+		req.Username = session.Username
+		req.Device = session.Device
+		req.Password = ""
+		return nil
+	}, TypeIdentity, TypeRegister)
+}
+
+// IssueToken issues a new token to session, valid for SessionTokenTTL but never past the Expires of session,
+// the token is final if it expires with the session. It returns ErrorTokenExpired if the session is expired.
+func (sc *ServerConnector) IssueToken(session *Session) (*TokenResponse, error) {
+	sc.sessionMutex.Lock()
+	defer sc.sessionMutex.Unlock()
+	now := time.Now()
+	expires := now.Add(sc.SessionTokenTTL)
+	final := false
+	if !session.Expires.IsZero() {
+		if !now.Before(session.Expires) {
+			return nil, ErrorTokenExpired
+		}
+		if !expires.Before(session.Expires) {
+			expires, final = session.Expires, true
+		}
+	}
+	if err := session.token.issue(expires); err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Token:    session.token.token,
+		Lifetime: expires.Sub(now),
+		Final:    final,
+	}, nil
+}
+
+// ProcessRefreshToken is the RequestProcessor of TypeRefreshToken requests, it replaces the token of the session of peer
+// with a new one, the old token is accepted until it expires
+func (sc *ServerConnector) ProcessRefreshToken(ctx context.Context, req *Request, peer *Peer, eHandler ErrorHandler) {
+	session, exists := sc.authenticatedSession(peer)
+	if !exists {
+		if err := peer.SendErrorResponse(req, ErrorNotAuthenticated); err != nil {
+			eHandler(err)
+		}
+		return
+	}
+	tRes, err := sc.IssueToken(session)
+	if err != nil {
+		sc.LogDebug("error on issuing token in ProcessRefreshToken: %v\n", err)
+		if err != ErrorTokenExpired {
+			eHandler(err)
+		}
+		if sendErr := peer.SendErrorResponse(req, err); sendErr != nil {
+			eHandler(sendErr)
+		}
+		return
+	}
+	tResData, err := peer.Marshal(tRes)
+	if err != nil {
+		sc.LogDebug("error on Marshal in ProcessRefreshToken: %v\n", err)
+		eHandler(err)
+		return
+	}
+	sc.LogDebug("refreshed token of session %v\n", session.ID)
+	if err := peer.SendResponse(req, &Response{
+		Status:  StatusOK,
+		Message: MessageAccept,
+		Data:    tResData,
+	}); err != nil {
+		sc.LogDebug("error on SendResponse in ProcessRefreshToken: %v\n", err)
+		eHandler(err)
+	}
+}
+
+// SessionToken returns the token that server issues to the connection and when it expires,
+// or empty string if there's none
+func (hub *Hub) SessionToken() (string, time.Time) {
+	hub.settingsMutex.RLock()
+	defer hub.settingsMutex.RUnlock()
+	return hub.token, hub.tokenExpires
+}
+
+// setSessionToken records token valid for lifetime, and wakes up RefreshSessionToken to schedule the refresh,
+// final tokens are not refreshed
+func (hub *Hub) setSessionToken(token string, lifetime time.Duration, final bool) {
+	hub.settingsMutex.Lock()
+	hub.token = token
+	hub.tokenLifetime = lifetime
+	hub.tokenExpires = time.Now().Add(lifetime)
+	hub.tokenFinal = final
+	hub.settingsMutex.Unlock()
+	select {
+	case hub.tokenUpdated <- struct{}{}:
+	default:
+	}
+}
+
+// attachToken makes req carry the session token instead of the credentials, once there's one.
+// Requests to authenticate keep the credentials, and peers that don't issue tokens keep getting the credentials.
+func (hub *Hub) attachToken(req *Request) {
+	if req.DataType == TypeIdentity || req.DataType == TypeRegister {
+		return
+	}
+	token, _ := hub.SessionToken()
+	if token == "" {
+		return
+	}
+	req.Token = token
+	req.Username = ""
+	req.Password = ""
+	req.Device = ""
+}
+
+// SendRefreshTokenRequest asks peer to replace the session token with a new one, and uses the new token for later requests
+func (hub *Hub) SendRefreshTokenRequest() (*Response, error) {
+	return operationTimeout(func(ctx context.Context) (*Response, error) {
+		return hub.SendRefreshTokenRequestContext(ctx)
+	})
+}
+
+// SendRefreshTokenRequestContext is SendRefreshTokenRequest with ctx to cancel or set deadline for waiting the response
+func (hub *Hub) SendRefreshTokenRequestContext(ctx context.Context) (*Response, error) {
+	req := NewRequest("", "", "", TypeRefreshToken, nil)
+	hub.LogDebug("SendRefreshTokenRequest called, request id: %v\n", req.ID)
+
+	res, err := hub.SendRequestForResponseContext(ctx, req)
+	if err != nil {
+		hub.LogDebug("error on SendRequestForResponse in SendRefreshTokenRequest: %v\n", err)
+		return nil, err
+	}
+	if err := res.Err(); err != nil {
+		return res, err
+	}
+	tRes := &TokenResponse{}
+	if err := res.Decode(tRes); err != nil {
+		hub.LogDebug("error on Unmarshal in SendRefreshTokenRequest: %v\n", err)
+		return nil, err
+	}
+	hub.setSessionToken(tRes.Token, tRes.Lifetime, tRes.Final)
+	return res, nil
+}
+
+// RefreshSessionToken refreshes the session token when a quarter of its lifetime is left, until the hub is closed,
+// so that the token of an idle connection doesn't expire. Transient failures are retried after SendMessageRestPeriod,
+// and the hub is closed if peer refuses to refresh, so that the client reconnects and authenticates again.
+// Final tokens, which expire with the credentials, are not refreshed, the hub is closed once they expire.
+// This should be run as goroutine.
+func (hub *Hub) RefreshSessionToken() {
+	for {
+		hub.settingsMutex.RLock()
+		token, expires, lifetime, final := hub.token, hub.tokenExpires, hub.tokenLifetime, hub.tokenFinal
+		hub.settingsMutex.RUnlock()
+		if token == "" {
+			select {
+			case <-hub.tokenUpdated:
+				continue
+			case <-hub.done:
+				return
+			}
+		}
+		refreshAt := time.Until(expires) - lifetime/4
+		if final {
+			refreshAt = time.Until(expires)
+		}
+		timer := time.NewTimer(refreshAt)
+		select {
+		case <-hub.tokenUpdated:
+			timer.Stop()
+			continue
+		case <-hub.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if final {
+			hub.LogInfo("session token expires with the credentials, authenticate again\n")
+			hub.closeWithError(ErrorTokenExpired)
+			return
+		}
+		if _, err := hub.SendRefreshTokenRequest(); err != nil {
+			hub.LogDebug("error on SendRefreshTokenRequest in RefreshSessionToken: %v\n", err)
+			if IsPermanent(err) {
+				hub.closeWithError(err)
+				return
+			}
+			if !sleepUntilDone(hub.done, SendMessageRestPeriod) {
+				return
+			}
+		}
+	}
+}
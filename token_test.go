@@ -0,0 +1,49 @@
+package syncbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIssueTokenCappedBySessionExpiry(t *testing.T) {
+	sc := &ServerConnector{Connector: &Connector{SessionTokenTTL: time.Hour}}
+	session := &Session{}
+	tRes, err := sc.IssueToken(session)
+	if err != nil || tRes.Lifetime != time.Hour || tRes.Final {
+		t.Fatalf("session without expiry: %+v, %v", tRes, err)
+	}
+
+	session.Expires = time.Now().Add(10 * time.Minute)
+	tRes, err = sc.IssueToken(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tRes.Lifetime > 10*time.Minute || !tRes.Final {
+		t.Fatalf("token outlives the credentials: %+v", tRes)
+	}
+	if session.token.expires.After(session.Expires) {
+		t.Fatalf("token expires at %v, after the session at %v", session.token.expires, session.Expires)
+	}
+
+	session.Expires = time.Now().Add(-time.Second)
+	if _, err := sc.IssueToken(session); err != ErrorTokenExpired {
+		t.Fatalf("refreshing expired session: got %v", err)
+	}
+}
+
+func TestRefreshSessionTokenFinal(t *testing.T) {
+	hub := newTestHub(t)
+	hub.setSessionToken("token", 50*time.Millisecond, true)
+	go hub.RefreshSessionToken()
+	select {
+	case <-hub.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub isn't closed once the final token expires")
+	}
+	if hub.Err() != ErrorTokenExpired {
+		t.Fatalf("closed by %v", hub.Err())
+	}
+	if hub.PendingRequests() != 0 {
+		t.Fatal("final token should not be refreshed")
+	}
+}
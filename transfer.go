@@ -0,0 +1,335 @@
+package syncbox
+
+import (
+	"context"
+	"crypto/md5"
+	"hash"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// constants for streaming transfer
+const (
+	FileChunkSize = 64 * 1024
+
+	// DefaultMaxTransfers is the number of inbound transfers open at the same time on a connection,
+	// transfers that receive no chunk for DefaultTransferIdleTimeout are aborted,
+	// which is longer than a chunk waits for its response
+	DefaultMaxTransfers        = 16
+	DefaultTransferIdleTimeout = 2 * OperationTimeoutPeriod
+)
+
+// transferIDPattern matches the transfer IDs generated by SendFileStream, which are UUIDs
+var transferIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Aborter is implemented by writers that could discard what has been written, like ObjectWriter
+type Aborter interface {
+	Abort() error
+}
+
+// ChunkWriterOpener opens the writer for the content of a new inbound transfer,
+// it's called with the first chunk of the transfer
+type ChunkWriterOpener func(*FileChunkRequest) (io.WriteCloser, error)
+
+// Transfer is an inbound streaming transfer in progress
+type Transfer struct {
+	ID      string
+	Writer  io.WriteCloser
+	Offset  int64
+	Updated time.Time
+	hash    hash.Hash
+
+	// mutex serializes chunks with the abort by hub, finished tells the writer is closed or aborted
+	mutex    sync.Mutex
+	finished bool
+}
+
+// abort discards what has been written, the caller should hold mutex
+func (transfer *Transfer) abort() {
+	transfer.finished = true
+	if aborter, ok := transfer.Writer.(Aborter); ok {
+		aborter.Abort()
+	} else {
+		transfer.Writer.Close()
+	}
+}
+
+// discard aborts the transfer unless it's finished, it's for transfers removed by hub rather than by their chunks
+func (transfer *Transfer) discard() {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+	if !transfer.finished {
+		transfer.abort()
+	}
+}
+
+// validateChunk examines whether cReq could be written, the transfer ID becomes a file name on receiver,
+// so only the IDs generated by SendFileStream are accepted
+func validateChunk(cReq *FileChunkRequest) error {
+	if !transferIDPattern.MatchString(cReq.TransferID) || cReq.File == nil {
+		return ErrorMalformedChunk
+	}
+	return nil
+}
+
+// SendFileStream sends the content read from reader as a sequence of FileChunkRequest,
+// each chunk waits for the response of peer before the next is sent,
+// so at most FileChunkSize of the content is buffered on both sides.
+// It returns the response of the final chunk, or the CodedError told by peer, wrapping ErrorTransferRejected, if a chunk is rejected.
+func (hub *Hub) SendFileStream(username string, password string, device string, unrootPath string, file *File, reader io.Reader) (*Response, error) {
+	return hub.SendFileStreamContext(context.Background(), username, password, device, unrootPath, file, reader)
+}
+
+// SendFileStreamContext is SendFileStream with ctx to cancel the transfer,
+// peer is told to discard the transfer if ctx is done before it completes.
+// Each chunk waits at most OperationTimeoutPeriod for its response, no matter how long the whole transfer takes.
+func (hub *Hub) SendFileStreamContext(ctx context.Context, username string, password string, device string, unrootPath string, file *File, reader io.Reader) (*Response, error) {
+	transferID := UUID()
+	digest := md5.New()
+	buffer := make([]byte, FileChunkSize)
+	var offset int64
+	hub.LogDebug("SendFileStream called,\n transfer id: %v,\n unrootPath: %v,\n file checksum: %v\n", transferID, unrootPath, file.ContentChecksum)
+	for {
+		n, readErr := io.ReadFull(reader, buffer)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			hub.LogDebug("error on reading content in SendFileStream: %v\n", readErr)
+			hub.abortFileStream(username, password, device, transferID, file, unrootPath, offset)
+			return nil, readErr
+		}
+		digest.Write(buffer[:n])
+		cReq := &FileChunkRequest{
+			TransferID: transferID,
+			File:       file,
+			UnrootPath: unrootPath,
+			Offset:     offset,
+			Content:    buffer[:n],
+			Final:      readErr != nil,
+		}
+		if cReq.Final {
+			copy(cReq.Checksum[:], digest.Sum(nil))
+		}
+		res, err := hub.sendFileChunk(ctx, username, password, device, cReq)
+		if err != nil {
+			hub.LogDebug("error on sendFileChunk in SendFileStream: %v\n", err)
+			if hub.Err() == nil {
+				hub.abortFileStream(username, password, device, transferID, file, unrootPath, offset)
+			}
+			return nil, err
+		}
+		if res.Status != StatusOK {
+			hub.LogDebug("chunk rejected in SendFileStream, response: %v\n", res)
+			return res, res.codedError(ErrorTransferRejected)
+		}
+		offset += int64(n)
+		if cReq.Final {
+			hub.LogDebug("SendFileStream finished, transfer id: %v, size: %v\n", transferID, offset)
+			return res, nil
+		}
+	}
+}
+
+// abortFileStream tells peer to discard the transfer, it doesn't wait for the response since the transfer already failed
+func (hub *Hub) abortFileStream(username string, password string, device string, transferID string, file *File, unrootPath string, offset int64) {
+	req, err := hub.newFileChunkRequest(username, password, device, &FileChunkRequest{
+		TransferID: transferID,
+		File:       file,
+		UnrootPath: unrootPath,
+		Offset:     offset,
+		Abort:      true,
+	})
+	if err == nil {
+		err = hub.SendRequest(req)
+	}
+	if err != nil {
+		hub.LogDebug("error on aborting transfer %v: %v\n", transferID, err)
+	}
+}
+
+func (hub *Hub) newFileChunkRequest(username string, password string, device string, cReq *FileChunkRequest) (*Request, error) {
+	cReqData, err := hub.Marshal(cReq)
+	if err != nil {
+		return nil, err
+	}
+	return NewRequest(username, password, device, TypeFileChunk, cReqData), nil
+}
+
+func (hub *Hub) sendFileChunk(ctx context.Context, username string, password string, device string, cReq *FileChunkRequest) (*Response, error) {
+	req, err := hub.newFileChunkRequest(username, password, device, cReq)
+	if err != nil {
+		hub.LogDebug("error on Marshal in sendFileChunk: %v\n", err)
+		return nil, err
+	}
+	hub.LogVerbose("sendFileChunk called,\n request id: %v,\n chunk: %v\n", req.ID, cReq)
+	chunkCtx, cancel := context.WithTimeout(ctx, OperationTimeoutPeriod)
+	defer cancel()
+	res, err := hub.SendRequestForResponseContext(chunkCtx, req)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, ErrorTimeout
+	}
+	return res, err
+}
+
+// ReceiveFileChunk writes the chunk carried by req to the writer of its transfer,
+// open is called to get the writer when the first chunk of a transfer arrives.
+// It returns the chunk and whether the transfer is completed, in which case the writer has been closed.
+// If any error is returned, the transfer is aborted.
+func (hub *Hub) ReceiveFileChunk(req *Request, open ChunkWriterOpener) (*FileChunkRequest, bool, error) {
+	cReq := &FileChunkRequest{}
+	if err := req.Decode(cReq); err != nil {
+		hub.LogDebug("error on Unmarshal in ReceiveFileChunk: %v\n", err)
+		return nil, false, err
+	}
+	hub.LogVerbose("ReceiveFileChunk called,\n request id: %v,\n chunk: %v\n", req.ID, cReq)
+	done, err := hub.WriteFileChunk(cReq, open)
+	return cReq, done, err
+}
+
+// WriteFileChunk is ReceiveFileChunk with the chunk decoded already,
+// it returns whether the transfer is completed.
+// Chunks without file or with a transfer ID not generated by SendFileStream are rejected with ErrorMalformedChunk,
+// new transfers beyond MaxTransfers are rejected with ErrorTooManyTransfers before their writers are opened,
+// and a first chunk of a transfer that is open already is rejected with ErrorTransferExists.
+func (hub *Hub) WriteFileChunk(cReq *FileChunkRequest, open ChunkWriterOpener) (bool, error) {
+	if err := validateChunk(cReq); err != nil {
+		hub.LogDebug("malformed chunk of transfer %q\n", cReq.TransferID)
+		return false, err
+	}
+	hub.transferMutex.Lock()
+	transfer, exists := hub.Transfers[cReq.TransferID]
+	hub.transferMutex.Unlock()
+	if cReq.Abort {
+		if exists {
+			hub.LogDebug("transfer %v aborted by peer\n", cReq.TransferID)
+			hub.removeTransfer(transfer)
+			transfer.discard()
+		}
+		return false, ErrorTransferAborted
+	}
+	if !exists {
+		if cReq.Offset != 0 {
+			return false, ErrorTransferNotFound
+		}
+		var err error
+		if transfer, err = hub.openTransfer(cReq, open); err != nil {
+			return false, err
+		}
+	} else {
+		transfer.mutex.Lock()
+	}
+	defer transfer.mutex.Unlock()
+	if transfer.finished {
+		// evicted or aborted meanwhile
+		return false, ErrorTransferNotFound
+	}
+	transfer.Updated = time.Now()
+	if cReq.Offset != transfer.Offset {
+		hub.LogDebug("chunk offset %v does not match transfer offset %v\n", cReq.Offset, transfer.Offset)
+		hub.removeTransfer(transfer)
+		transfer.abort()
+		return false, ErrorChunkOffset
+	}
+	if _, err := transfer.Writer.Write(cReq.Content); err != nil {
+		hub.LogDebug("error on writing chunk in WriteFileChunk: %v\n", err)
+		hub.removeTransfer(transfer)
+		transfer.abort()
+		return false, err
+	}
+	transfer.hash.Write(cReq.Content)
+	transfer.Offset += int64(len(cReq.Content))
+	if !cReq.Final {
+		return false, nil
+	}
+
+	hub.removeTransfer(transfer)
+	var checksum Checksum
+	copy(checksum[:], transfer.hash.Sum(nil))
+	if checksum != cReq.Checksum {
+		hub.LogDebug("checksum of transfer %v mismatch, expected: %v, actual: %v\n", transfer.ID, cReq.Checksum, checksum)
+		transfer.abort()
+		return false, ErrorChecksumMismatch
+	}
+	transfer.finished = true
+	if err := transfer.Writer.Close(); err != nil {
+		hub.LogDebug("error on closing writer in WriteFileChunk: %v\n", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// openTransfer reserves the ID of a new transfer if there are less than MaxTransfers and no transfer of the ID,
+// then opens its writer by open. The transfer is returned with its mutex held,
+// so that chunks of the same transfer wait for the writer.
+func (hub *Hub) openTransfer(cReq *FileChunkRequest, open ChunkWriterOpener) (*Transfer, error) {
+	transfer := &Transfer{
+		ID:      cReq.TransferID,
+		Updated: time.Now(),
+		hash:    md5.New(),
+	}
+	transfer.mutex.Lock()
+	hub.transferMutex.Lock()
+	if _, exists := hub.Transfers[transfer.ID]; exists {
+		hub.transferMutex.Unlock()
+		hub.LogDebug("transfer %v already exists\n", transfer.ID)
+		return nil, ErrorTransferExists
+	}
+	if hub.MaxTransfers > 0 && len(hub.Transfers) >= hub.MaxTransfers {
+		hub.transferMutex.Unlock()
+		hub.LogDebug("transfer %v exceeds limit of %v transfers\n", transfer.ID, hub.MaxTransfers)
+		return nil, ErrorTooManyTransfers
+	}
+	hub.Transfers[transfer.ID] = transfer
+	hub.transferMutex.Unlock()
+
+	writer, err := open(cReq)
+	if err != nil {
+		hub.LogDebug("error on opening writer in WriteFileChunk: %v\n", err)
+		transfer.finished = true
+		transfer.mutex.Unlock()
+		hub.removeTransfer(transfer)
+		return nil, err
+	}
+	transfer.Writer = writer
+	return transfer, nil
+}
+
+func (hub *Hub) removeTransfer(transfer *Transfer) {
+	hub.transferMutex.Lock()
+	defer hub.transferMutex.Unlock()
+	if hub.Transfers[transfer.ID] == transfer {
+		delete(hub.Transfers, transfer.ID)
+	}
+}
+
+// EvictTransfers aborts inbound transfers that receive no chunk for TransferIdleTimeout, until the hub is closed,
+// so that transfers abandoned by peer don't hold writers forever.
+// This should be run as goroutine.
+func (hub *Hub) EvictTransfers() error {
+	if hub.TransferIdleTimeout <= 0 {
+		return nil
+	}
+	for sleepUntilDone(hub.done, hub.TransferIdleTimeout/2) {
+		deadline := time.Now().Add(-hub.TransferIdleTimeout)
+		hub.transferMutex.Lock()
+		transfers := make([]*Transfer, 0, len(hub.Transfers))
+		for _, transfer := range hub.Transfers {
+			transfers = append(transfers, transfer)
+		}
+		hub.transferMutex.Unlock()
+		// transfer.mutex is held while chunks take transferMutex, so they are never locked the other way around
+		for _, transfer := range transfers {
+			transfer.mutex.Lock()
+			idle := !transfer.finished && transfer.Updated.Before(deadline)
+			if idle {
+				hub.LogInfo("evict idle transfer %v from %v, received %v bytes\n", transfer.ID, hub.Conn.RemoteAddr(), transfer.Offset)
+				transfer.abort()
+			}
+			transfer.mutex.Unlock()
+			if idle {
+				hub.removeTransfer(transfer)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package syncbox
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryWriter is the writer of transfers in tests, it records whether it's closed or aborted
+type memoryWriter struct {
+	bytes.Buffer
+	mutex   sync.Mutex
+	closed  bool
+	aborted bool
+}
+
+func (writer *memoryWriter) Close() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.closed = true
+	return nil
+}
+
+func (writer *memoryWriter) Abort() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.aborted = true
+	return nil
+}
+
+func (writer *memoryWriter) isAborted() bool {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.aborted
+}
+
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	local, remote := net.Pipe()
+	hub := NewHub(local, func(error) {})
+	t.Cleanup(func() {
+		hub.Close()
+		remote.Close()
+	})
+	return hub
+}
+
+func TestSendFileStream(t *testing.T) {
+	a, b := hubPair(t)
+	content := make([]byte, 3*FileChunkSize+100)
+	rand.Read(content)
+	writer := &memoryWriter{}
+	go func() {
+		for {
+			req, err := b.ReceiveRequest()
+			if err != nil {
+				return
+			}
+			_, _, err = b.ReceiveFileChunk(req, func(*FileChunkRequest) (io.WriteCloser, error) {
+				return writer, nil
+			})
+			if err != nil {
+				b.SendErrorResponse(req, err)
+				continue
+			}
+			b.SendResponse(req, &Response{Status: StatusOK})
+		}
+	}()
+	file := &File{Object: &Object{ContentChecksum: md5.Sum(content)}}
+	if _, err := a.SendFileStream("u", "p", "d", "/file", file, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if !writer.closed || !bytes.Equal(writer.Bytes(), content) {
+		t.Fatalf("received %v bytes of %v, closed: %v", writer.Len(), len(content), writer.closed)
+	}
+}
+
+func TestWriteFileChunkMalformed(t *testing.T) {
+	hub := newTestHub(t)
+	open := func(*FileChunkRequest) (io.WriteCloser, error) {
+		t.Fatal("writer opened for malformed chunk")
+		return nil, nil
+	}
+	chunks := []*FileChunkRequest{
+		{TransferID: "../../x", File: &File{}},
+		{TransferID: "", File: &File{}},
+		{TransferID: UUID() + "/..", File: &File{}},
+		{TransferID: UUID()},
+	}
+	for _, cReq := range chunks {
+		if _, err := hub.WriteFileChunk(cReq, open); err != ErrorMalformedChunk {
+			t.Errorf("chunk of transfer %q, file %v: got %v", cReq.TransferID, cReq.File, err)
+		}
+	}
+	if ErrorCode(ErrorMalformedChunk) != CodeBadRequest {
+		t.Fatal("malformed chunks should be bad requests")
+	}
+}
+
+func TestWriteFileChunkMaxTransfers(t *testing.T) {
+	hub := newTestHub(t)
+	hub.MaxTransfers = 2
+	opened := 0
+	open := func(*FileChunkRequest) (io.WriteCloser, error) {
+		opened++
+		return &memoryWriter{}, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := hub.WriteFileChunk(&FileChunkRequest{TransferID: UUID(), File: &File{}, Content: []byte{1}}, open); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hub.WriteFileChunk(&FileChunkRequest{TransferID: UUID(), File: &File{}}, open); err != ErrorTooManyTransfers {
+		t.Fatalf("transfer beyond limit: got %v", err)
+	}
+	if opened != 2 {
+		t.Fatalf("%v writers opened, the refused transfer shouldn't open one", opened)
+	}
+}
+
+func TestWriteFileChunkDuplicateTransfer(t *testing.T) {
+	hub := newTestHub(t)
+	id := UUID()
+	opening := make(chan struct{})
+	release := make(chan struct{})
+	var opened int32
+	open := func(*FileChunkRequest) (io.WriteCloser, error) {
+		if atomic.AddInt32(&opened, 1) == 1 {
+			close(opening)
+			<-release
+		}
+		return &memoryWriter{}, nil
+	}
+	first := make(chan error, 1)
+	go func() {
+		_, err := hub.WriteFileChunk(&FileChunkRequest{TransferID: id, File: &File{}, Content: []byte{1}}, open)
+		first <- err
+	}()
+	<-opening
+	// the ID is reserved while the writer of the first chunk is being opened
+	// as a second chunk that looked the transfer up before the first one reserved it
+	if _, err := hub.openTransfer(&FileChunkRequest{TransferID: id, File: &File{}}, open); err != ErrorTransferExists {
+		t.Fatalf("duplicate first chunk: got %v", err)
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&opened); n != 1 {
+		t.Fatalf("%v writers opened for a transfer", n)
+	}
+	if _, err := hub.WriteFileChunk(&FileChunkRequest{TransferID: id, File: &File{}, Offset: 1, Content: []byte{2}}, open); err != nil {
+		t.Fatalf("next chunk of the transfer: %v", err)
+	}
+	if ErrorCode(ErrorTransferExists) != CodeConflict {
+		t.Fatal("duplicate transfers should be conflicts")
+	}
+}
+
+func TestWriteFileChunkOpenFailure(t *testing.T) {
+	hub := newTestHub(t)
+	openErr := errors.New("storage unavailable")
+	open := func(*FileChunkRequest) (io.WriteCloser, error) {
+		return nil, openErr
+	}
+	id := UUID()
+	if _, err := hub.WriteFileChunk(&FileChunkRequest{TransferID: id, File: &File{}}, open); err != openErr {
+		t.Fatalf("got %v", err)
+	}
+	hub.transferMutex.Lock()
+	_, exists := hub.Transfers[id]
+	hub.transferMutex.Unlock()
+	if exists {
+		t.Fatal("transfer whose writer fails to open should be released")
+	}
+}
+
+func TestEvictTransfers(t *testing.T) {
+	hub := newTestHub(t)
+	hub.TransferIdleTimeout = 50 * time.Millisecond
+	go hub.EvictTransfers()
+	writer := &memoryWriter{}
+	id := UUID()
+	open := func(*FileChunkRequest) (io.WriteCloser, error) {
+		return writer, nil
+	}
+	if _, err := hub.WriteFileChunk(&FileChunkRequest{TransferID: id, File: &File{}, Content: []byte{1}}, open); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !writer.isAborted() {
+		if time.Now().After(deadline) {
+			t.Fatal("idle transfer isn't evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err := hub.WriteFileChunk(&FileChunkRequest{TransferID: id, File: &File{}, Offset: 1, Content: []byte{2}}, open)
+	if err != ErrorTransferNotFound {
+		t.Fatalf("chunk of evicted transfer: got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package syncbox
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// constants for transports
+const (
+	NetworkPipe = "pipe"
+)
+
+// Transport is the interface to specify how connectors listen and dial,
+// so that connectors work with any net.Conn rather than only TCP
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCPTransport is the Transport over TCP, connections are over TLS if TLS is set
+type TCPTransport struct {
+	TLS *TLSConfig
+}
+
+// NewTCPTransport instantiates a TCPTransport, tlsConfig could be nil to use plain TCP
+func NewTCPTransport(tlsConfig *TLSConfig) *TCPTransport {
+	return &TCPTransport{
+		TLS: tlsConfig,
+	}
+}
+
+// Listen listens on addr with the server side TLS config
+func (transport *TCPTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if transport.TLS == nil {
+		return ln, nil
+	}
+	tlsConfig, err := transport.TLS.ServerTLSConfig()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// Dial dials to addr with the client side TLS config, the TLS handshake is done before return
+func (transport *TCPTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if transport.TLS == nil {
+		return conn, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConfig, err := transport.TLS.ClientTLSConfig(host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// pipeAddr is the net.Addr of an end of PipeTransport connections
+type pipeAddr string
+
+func (addr pipeAddr) Network() string {
+	return NetworkPipe
+}
+
+func (addr pipeAddr) String() string {
+	return string(addr)
+}
+
+// pipeConn gives net.Pipe ends distinct addresses, so peers could be told apart by address.
+// Reading or writing after the conn is closed locally fails with net.ErrClosed as TCP does,
+// while net.Pipe returns io.ErrClosedPipe for it.
+type pipeConn struct {
+	net.Conn
+	localAddr  pipeAddr
+	remoteAddr pipeAddr
+	closed     int32
+}
+
+func (conn *pipeConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	return n, conn.wrapError("read", err)
+}
+
+func (conn *pipeConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	return n, conn.wrapError("write", err)
+}
+
+func (conn *pipeConn) Close() error {
+	atomic.StoreInt32(&conn.closed, 1)
+	return conn.Conn.Close()
+}
+
+func (conn *pipeConn) wrapError(op string, err error) error {
+	if err == io.ErrClosedPipe && atomic.LoadInt32(&conn.closed) == 1 {
+		return &net.OpError{Op: op, Net: NetworkPipe, Source: conn.localAddr, Addr: conn.remoteAddr, Err: net.ErrClosed}
+	}
+	return err
+}
+
+func (conn *pipeConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+func (conn *pipeConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// pipeListener accepts connections dialed by PipeTransport
+type pipeListener struct {
+	transport *PipeTransport
+	key       string
+	addr      pipeAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, ErrorListenerClosed
+	}
+}
+
+func (ln *pipeListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		ln.transport.removeListener(ln)
+	})
+	return nil
+}
+
+func (ln *pipeListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// PipeTransport is the in-process Transport based on net.Pipe,
+// it connects a server and several clients in a single program, mostly for testing.
+// Closing one end makes reads on the other end return io.EOF, same as TCP.
+// Hosts are meaningless in process, so addresses of the form host:port are identified by port only,
+// which lets connectors listen on 0.0.0.0:port and dial to localhost:port as they do with TCP.
+type PipeTransport struct {
+	listeners map[string]*pipeListener
+	nextID    int
+	mutex     sync.Mutex
+}
+
+// NewPipeTransport instantiates a PipeTransport without listeners
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{
+		listeners: make(map[string]*pipeListener),
+	}
+}
+
+func pipeKey(addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return ":" + port
+	}
+	return addr
+}
+
+// Listen registers a listener on addr
+func (transport *PipeTransport) Listen(addr string) (net.Listener, error) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	key := pipeKey(addr)
+	if _, exists := transport.listeners[key]; exists {
+		return nil, ErrorAddressInUse
+	}
+	ln := &pipeListener{
+		transport: transport,
+		key:       key,
+		addr:      pipeAddr(addr),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	transport.listeners[key] = ln
+	return ln, nil
+}
+
+// Dial connects to the listener on addr, it blocks until the listener accepts the connection
+func (transport *PipeTransport) Dial(addr string) (net.Conn, error) {
+	transport.mutex.Lock()
+	ln, exists := transport.listeners[pipeKey(addr)]
+	transport.nextID++
+	clientAddr := pipeAddr(NetworkPipe + "-" + strconv.Itoa(transport.nextID))
+	transport.mutex.Unlock()
+	if !exists {
+		return nil, ErrorConnectionRefused
+	}
+	serverEnd, clientEnd := net.Pipe()
+	select {
+	case ln.conns <- &pipeConn{Conn: serverEnd, localAddr: ln.addr, remoteAddr: clientAddr}:
+		return &pipeConn{Conn: clientEnd, localAddr: clientAddr, remoteAddr: ln.addr}, nil
+	case <-ln.closed:
+		serverEnd.Close()
+		clientEnd.Close()
+		return nil, ErrorConnectionRefused
+	}
+}
+
+func (transport *PipeTransport) removeListener(ln *pipeListener) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if transport.listeners[ln.key] == ln {
+		delete(transport.listeners, ln.key)
+	}
+}
+
+// IsClosedConnError examines whether err means the connection is closed, by peer or locally
+func IsClosedConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrorPeerSocketClosed || err == io.EOF || err == io.ErrClosedPipe || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	return strings.HasSuffix(err.Error(), "use of closed network connection")
+}
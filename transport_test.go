@@ -0,0 +1,130 @@
+package syncbox
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// pipePair returns the client and server ends of a PipeTransport connection
+func pipePair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	transport := NewPipeTransport()
+	ln, err := transport.Listen("0.0.0.0:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	return pipeConnect(t, transport, ln)
+}
+
+// pipeConnect dials the address of ln on transport, and returns the client and server ends of the connection
+func pipeConnect(t *testing.T, transport *PipeTransport, ln net.Listener) (net.Conn, net.Conn) {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := transport.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestPipeTransportListenDial(t *testing.T) {
+	transport := NewPipeTransport()
+	if _, err := transport.Dial("localhost:9000"); err != ErrorConnectionRefused {
+		t.Fatalf("dial without listener: got %v", err)
+	}
+	ln, err := transport.Listen("0.0.0.0:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Listen("localhost:9000"); err != ErrorAddressInUse {
+		t.Fatalf("listen twice on a port: got %v", err)
+	}
+	ln.Close()
+	if _, err := ln.Accept(); err != ErrorListenerClosed {
+		t.Fatalf("accept on closed listener: got %v", err)
+	}
+	if _, err := transport.Dial("localhost:9000"); err != ErrorConnectionRefused {
+		t.Fatalf("dial to closed listener: got %v", err)
+	}
+	if _, err := transport.Listen("0.0.0.0:9000"); err != nil {
+		t.Fatalf("listen after the listener closed: %v", err)
+	}
+}
+
+func TestPipeTransportAddresses(t *testing.T) {
+	transport := NewPipeTransport()
+	ln, err := transport.Listen("0.0.0.0:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, server := pipeConnect(t, transport, ln)
+	other, _ := pipeConnect(t, transport, ln)
+	if client.LocalAddr().String() != server.RemoteAddr().String() || server.LocalAddr().String() != client.RemoteAddr().String() {
+		t.Fatalf("ends disagree on addresses: %v-%v, %v-%v", client.LocalAddr(), client.RemoteAddr(), server.LocalAddr(), server.RemoteAddr())
+	}
+	if client.LocalAddr().Network() != NetworkPipe {
+		t.Fatalf("network %v", client.LocalAddr().Network())
+	}
+	if client.LocalAddr().String() == other.LocalAddr().String() {
+		t.Fatal("clients should have distinct addresses")
+	}
+}
+
+func TestPipeTransportCloseSemantics(t *testing.T) {
+	client, server := pipePair(t)
+	go client.Write([]byte("data"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	client.Close()
+	// peer sees EOF, as it does over TCP
+	if _, err := server.Read(buf); err != io.EOF {
+		t.Fatalf("read after peer closed: got %v", err)
+	}
+	// the closed end gets net.ErrClosed, as it does over TCP
+	_, err := client.Read(buf)
+	if !errors.Is(err, net.ErrClosed) || !IsClosedConnError(err) {
+		t.Fatalf("read after closed locally: got %v", err)
+	}
+	if _, err := client.Write(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after closed locally: got %v", err)
+	}
+}
+
+func TestHubOverPipeTransportPeerClosed(t *testing.T) {
+	client, server := pipePair(t)
+	hub := NewHub(server, func(error) {})
+	defer hub.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- hub.Setup()
+	}()
+	client.Close()
+	if err := <-errs; err != ErrorPeerSocketClosed {
+		t.Fatalf("hub of closed peer: got %v", err)
+	}
+	if hub.Err() != ErrorPeerSocketClosed {
+		t.Fatalf("hub closed by %v", hub.Err())
+	}
+}